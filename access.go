@@ -0,0 +1,163 @@
+package l402
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+// AccessRequest is a transport-agnostic view of a request for a paid resource
+// It lets minters and authorities serve gRPC calls, WebSocket messages or queued jobs the same way as HTTP requests
+type AccessRequest interface {
+	Context() context.Context
+	// Service is the name of the service being accessed, the Host of an HTTP request
+	Service() string
+	// Method is the HTTP method, or the operation name of other transports
+	Method() string
+	Path() string
+	RemoteAddr() string
+	// Header holds the HTTP headers, or the metadata of other transports
+	Header() http.Header
+}
+
+type AccessRequestMinter interface {
+	MintWithChallengeFor(AccessRequest) (string, Challenge, error)
+}
+
+type AccessRequestAuthority interface {
+	ApproveAccessFor(AccessRequest, map[Identifier]*macaroon.Macaroon) Rejection
+}
+
+type httpAccessRequest struct {
+	r *http.Request
+}
+
+func HTTPAccessRequest(r *http.Request) AccessRequest {
+	return httpAccessRequest{r: r}
+}
+
+func (h httpAccessRequest) Context() context.Context { return h.r.Context() }
+func (h httpAccessRequest) Service() string          { return h.r.Host }
+func (h httpAccessRequest) Method() string           { return h.r.Method }
+func (h httpAccessRequest) Path() string             { return h.r.URL.Path }
+func (h httpAccessRequest) RemoteAddr() string       { return h.r.RemoteAddr }
+func (h httpAccessRequest) Header() http.Header      { return h.r.Header }
+
+type accessRequest struct {
+	ctx        context.Context //nolint:containedctx
+	service    string
+	method     string
+	path       string
+	remoteAddr string
+	header     http.Header
+}
+
+// NewAccessRequest describes a request made through a transport other than HTTP
+func NewAccessRequest(ctx context.Context, service, method, path, remoteAddr string, header http.Header) AccessRequest {
+	if header == nil {
+		header = make(http.Header)
+	}
+	return accessRequest{
+		ctx:        ctx,
+		service:    service,
+		method:     method,
+		path:       path,
+		remoteAddr: remoteAddr,
+		header:     header,
+	}
+}
+
+func (a accessRequest) Context() context.Context { return a.ctx }
+func (a accessRequest) Service() string          { return a.service }
+func (a accessRequest) Method() string           { return a.method }
+func (a accessRequest) Path() string             { return a.path }
+func (a accessRequest) RemoteAddr() string       { return a.remoteAddr }
+func (a accessRequest) Header() http.Header      { return a.header }
+
+// HTTPRequest returns the *http.Request behind an AccessRequest
+// Requests of other transports are converted into an equivalent *http.Request, without a body
+func HTTPRequest(ar AccessRequest) *http.Request {
+	if h, ok := ar.(httpAccessRequest); ok {
+		return h.r
+	}
+
+	r := &http.Request{
+		Method:     ar.Method(),
+		URL:        &url.URL{Path: ar.Path()},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     ar.Header(),
+		Host:       ar.Service(),
+		RemoteAddr: ar.RemoteAddr(),
+		RequestURI: ar.Path(),
+		Body:       http.NoBody,
+	}
+	return r.WithContext(ar.Context())
+}
+
+type httpMinter struct {
+	minter AccessRequestMinter
+}
+
+// HTTPMacaroonMinter adapts an AccessRequestMinter to the MacaroonMinter used by Proxy and Authenticator
+func HTTPMacaroonMinter(minter AccessRequestMinter) MacaroonMinter {
+	if m, ok := minter.(MacaroonMinter); ok {
+		return m
+	}
+	return httpMinter{minter: minter}
+}
+
+func (h httpMinter) MintWithChallenge(r *http.Request) (string, Challenge, error) {
+	return h.minter.MintWithChallengeFor(HTTPAccessRequest(r))
+}
+
+type httpAuthority struct {
+	authority AccessRequestAuthority
+}
+
+// HTTPAccessAuthority adapts an AccessRequestAuthority to the AccessAuthority used by Proxy
+func HTTPAccessAuthority(authority AccessRequestAuthority) AccessAuthority {
+	if a, ok := authority.(AccessAuthority); ok {
+		return a
+	}
+	return httpAuthority{authority: authority}
+}
+
+func (h httpAuthority) ApproveAccess(r *http.Request, macaroons map[Identifier]*macaroon.Macaroon) Rejection {
+	return h.authority.ApproveAccessFor(HTTPAccessRequest(r), macaroons)
+}
+
+type accessRequestMinter struct {
+	minter MacaroonMinter
+}
+
+// AccessRequestMinterOf lets a MacaroonMinter serve requests of any transport
+func AccessRequestMinterOf(minter MacaroonMinter) AccessRequestMinter {
+	if m, ok := minter.(AccessRequestMinter); ok {
+		return m
+	}
+	return accessRequestMinter{minter: minter}
+}
+
+func (a accessRequestMinter) MintWithChallengeFor(ar AccessRequest) (string, Challenge, error) {
+	return a.minter.MintWithChallenge(HTTPRequest(ar))
+}
+
+type accessRequestAuthority struct {
+	authority AccessAuthority
+}
+
+// AccessRequestAuthorityOf lets an AccessAuthority approve requests of any transport
+func AccessRequestAuthorityOf(authority AccessAuthority) AccessRequestAuthority {
+	if a, ok := authority.(AccessRequestAuthority); ok {
+		return a
+	}
+	return accessRequestAuthority{authority: authority}
+}
+
+func (a accessRequestAuthority) ApproveAccessFor(ar AccessRequest, macaroons map[Identifier]*macaroon.Macaroon) Rejection {
+	return a.authority.ApproveAccess(HTTPRequest(ar), macaroons)
+}
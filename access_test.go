@@ -0,0 +1,116 @@
+package l402
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+func TestHTTPAccessRequest(t *testing.T) {
+	r := httptest.NewRequest("POST", "http://videos.example.com/videos/1?quality=hd", nil)
+	r.Header.Set("Authorization", "L402 token")
+
+	ar := HTTPAccessRequest(r)
+
+	if ar.Service() != "videos.example.com" || ar.Method() != "POST" || ar.Path() != "/videos/1" || ar.RemoteAddr() != r.RemoteAddr {
+		t.Errorf("unexpected access request: %s %s %s %s", ar.Service(), ar.Method(), ar.Path(), ar.RemoteAddr())
+	}
+
+	if ar.Header().Get("Authorization") != "L402 token" || ar.Context() != r.Context() {
+		t.Error("expected the headers and context of the HTTP request")
+	}
+
+	if HTTPRequest(ar) != r {
+		t.Error("expected the original HTTP request")
+	}
+}
+
+func TestHTTPRequest(t *testing.T) {
+	ctx := context.WithValue(context.Background(), KeyMacaroon, "value")
+	header := http.Header{"Authorization": {"L402 token"}}
+
+	r := HTTPRequest(NewAccessRequest(ctx, "videos.v1.Videos", "Stream", "/videos.v1.Videos/Stream", "10.0.0.1:1234", header))
+
+	if r.Host != "videos.v1.Videos" || r.Method != "Stream" || r.URL.Path != "/videos.v1.Videos/Stream" || r.RemoteAddr != "10.0.0.1:1234" {
+		t.Errorf("unexpected request: %s %s %s %s", r.Host, r.Method, r.URL.Path, r.RemoteAddr)
+	}
+
+	if r.Header.Get("Authorization") != "L402 token" || r.Context().Value(KeyMacaroon) != "value" {
+		t.Error("expected the headers and context of the access request")
+	}
+
+	if empty := NewAccessRequest(ctx, "", "", "", "", nil); empty.Header() == nil {
+		t.Error("expected non nil headers")
+	}
+}
+
+func TestAccessRequestShims(t *testing.T) {
+	var approved, minted AccessRequest
+
+	authority := mockAccessAuthority{func(r *http.Request, _ map[Identifier]*macaroon.Macaroon) Rejection {
+		approved = HTTPAccessRequest(r)
+		return ErrPaymentRequired
+	}}
+	minter := mockMinter{func(r *http.Request) (string, Challenge, error) {
+		minted = HTTPAccessRequest(r)
+		return "macaroonBase64", Invoice("invoice"), nil
+	}}
+
+	ar := NewAccessRequest(context.Background(), "service", "Method", "/service/Method", "", nil)
+
+	// The old interfaces serve requests of any transport
+	if rejection := AccessRequestAuthorityOf(authority).ApproveAccessFor(ar, nil); !errors.Is(rejection, ErrPaymentRequired) {
+		t.Errorf("expected: %v but got: %v", ErrPaymentRequired, rejection)
+	}
+	if macaroonBase64, _, _ := AccessRequestMinterOf(minter).MintWithChallengeFor(ar); macaroonBase64 != "macaroonBase64" {
+		t.Errorf("expected: %s but got: %s", "macaroonBase64", macaroonBase64)
+	}
+	if approved.Path() != "/service/Method" || minted.Method() != "Method" {
+		t.Errorf("unexpected requests: %v %v", approved, minted)
+	}
+
+	// And the new interfaces can be given back to Proxy
+	r := httptest.NewRequest("GET", "/videos/1", nil)
+	if rejection := HTTPAccessAuthority(accessRequestAuthority{authority}).ApproveAccess(r, nil); !errors.Is(rejection, ErrPaymentRequired) {
+		t.Errorf("expected: %v but got: %v", ErrPaymentRequired, rejection)
+	}
+	if _, challenge, _ := HTTPMacaroonMinter(accessRequestMinter{minter}).MintWithChallenge(r); challenge != Invoice("invoice") {
+		t.Errorf("expected: %v but got: %v", Invoice("invoice"), challenge)
+	}
+	if HTTPRequest(approved) != r || HTTPRequest(minted) != r {
+		t.Error("expected the original HTTP request")
+	}
+
+	// Types implementing both interfaces are not wrapped
+	standardAuthority := Authority(MemoryRootKeyStore())
+	if _, wrapped := AccessRequestAuthorityOf(standardAuthority).(accessRequestAuthority); wrapped {
+		t.Error("expected the standard authority to implement AccessRequestAuthority")
+	}
+	if _, wrapped := HTTPAccessAuthority(standardAuthority).(httpAuthority); wrapped {
+		t.Error("expected the standard authority to implement AccessAuthority")
+	}
+}
+
+func TestAuthority_ApproveAccessFor(t *testing.T) {
+	ctx := context.Background()
+	rootKeys := MemoryRootKeyStore()
+	id, rootKey, _ := rootKeys.NewRootKey(ctx)
+	macaroonID, _ := MarchalIdentifier(Identifier{ID: id})
+	mac, _ := macaroon.New(rootKey, macaroonID, "", macaroon.V2)
+	AddFirstPartyCaveats(mac, NewCaveat(MethodsCondition, "Stream"), NewCaveat(PathCondition, "/videos.v1.Videos")) //nolint:errcheck
+	macaroons := map[Identifier]*macaroon.Macaroon{{ID: id}: mac}
+
+	authority := Authority(rootKeys)
+
+	if rejection := authority.ApproveAccessFor(NewAccessRequest(ctx, "videos", "Stream", "/videos.v1.Videos/Stream", "", nil), macaroons); rejection != nil {
+		t.Errorf("expected: %v but got: %v", nil, rejection)
+	}
+
+	if rejection := authority.ApproveAccessFor(NewAccessRequest(ctx, "videos", "Upload", "/videos.v1.Videos/Upload", "", nil), macaroons); !errors.Is(rejection, ErrUnsatisfiedCaveat) {
+		t.Errorf("expected: %v but got: %v", ErrUnsatisfiedCaveat, rejection)
+	}
+}
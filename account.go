@@ -0,0 +1,183 @@
+package l402
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+// DepositCondition sets how many millisatoshis the invoice of a macaroon credits to the account of its ID
+const DepositCondition = "deposit"
+
+// BalanceHeader reports the remaining balance of a prepaid account, in millisatoshis
+const BalanceHeader = "L402-Balance"
+
+type accountMinter struct {
+	invoices    InvoiceProvider
+	rootKeys    RootKeyStore
+	depositMsat uint64
+	caveats     []Caveat
+}
+
+// AccountMinter is a MacaroonMinter for prepaid accounts, see WithAccounts
+// Its invoices deposit depositMsat into the account, which is keyed by the macaroon's Identifier.ID
+// Requests presenting a token of an existing account are offered a top-up of that same account,
+// the top-up macaroon keeps the caveats of the presented token, but replaces its expiry with the given caveats
+func AccountMinter(invoices InvoiceProvider, rootKeys RootKeyStore, depositMsat uint64, caveats ...Caveat) accountMinter {
+	return accountMinter{
+		invoices:    invoices,
+		rootKeys:    rootKeys,
+		depositMsat: depositMsat,
+		caveats:     caveats,
+	}
+}
+
+func (m accountMinter) MintWithChallenge(r *http.Request) (string, Challenge, error) {
+	return m.MintWithChallengeFor(HTTPAccessRequest(r))
+}
+
+func (m accountMinter) MintWithChallengeFor(r AccessRequest) (string, Challenge, error) {
+	id, rootKey, previousCaveats, found := m.account(r.Context())
+
+	// The invoice comes first, so a node that fails to create it doesn't leave the root key of a new account behind
+	memo := "L402 deposit"
+	if found {
+		memo = fmt.Sprintf("L402 deposit %x", id[:4])
+	}
+	invoice, paymentHash, err := m.invoices.CreateInvoice(r.Context(), m.depositMsat, memo)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %w", ErrFailedInvoiceRequest, err)
+	}
+
+	if !found {
+		if id, rootKey, err = m.rootKeys.NewRootKey(r.Context()); err != nil {
+			return "", nil, err
+		}
+	}
+
+	caveats := slices.Concat([]Caveat{NewCaveat(DepositCondition, strconv.FormatUint(m.depositMsat, 10))}, m.caveats, previousCaveats)
+
+	macaroonBase64, err := mintMacaroon(rootKey, Identifier{PaymentHash: paymentHash, ID: id}, caveats)
+	if err != nil {
+		if !found {
+			deleteRootKey(r.Context(), m.rootKeys, id)
+		}
+		return "", nil, err
+	}
+
+	return macaroonBase64, invoice, nil
+}
+
+// account finds the account of the token presented with the request, only if the token is authentic
+func (m accountMinter) account(ctx context.Context) (ID, []byte, []Caveat, bool) {
+	macaroons, _ := ctx.Value(KeyMacaroon).(map[Identifier]*macaroon.Macaroon)
+	if len(macaroons) == 0 {
+		return ID{}, nil, nil, false
+	}
+
+	identifier := SortedIdentifiers(macaroons)[0]
+	rootKey, err := m.rootKeys.RootKey(ctx, identifier.ID)
+	if err != nil {
+		return ID{}, nil, nil, false
+	}
+
+	conditions, err := macaroons[identifier].VerifySignature(rootKey, nil)
+	if err != nil {
+		return ID{}, nil, nil, false
+	}
+
+	// A top-up must not lift the restrictions of an attenuated token
+	var caveats []Caveat
+	for _, condition := range conditions {
+		caveat, err := DecodeCaveat(condition)
+		if err != nil {
+			return ID{}, nil, nil, false
+		} else if caveat.Condition != DepositCondition && caveat.Condition != ExpiresCondition {
+			caveats = append(caveats, caveat)
+		}
+	}
+
+	return identifier.ID, rootKey, caveats, true
+}
+
+type accounts struct {
+	ledger   AccountLedger
+	invoices InvoiceStore
+	pricer   Pricer
+}
+
+// charge credits the deposits of the token and debits the price of the request from its account
+// Deposits are credited with the amount that was invoiced for them, never the one of their caveat, which the holder can forge
+// on a macaroon minted without caveats, and only the deposits of the debited account are credited
+func (a accounts) charge(r *http.Request, macaroons map[Identifier]*macaroon.Macaroon) (int64, error) {
+	identifiers := SortedIdentifiers(macaroons)
+	account := identifiers[0].ID
+
+	for _, identifier := range identifiers {
+		if identifier.ID != account {
+			continue
+		}
+
+		_, found, err := deposit(macaroons[identifier])
+		if err != nil {
+			return 0, err
+		} else if !found {
+			continue
+		}
+
+		record, err := a.invoices.Invoice(r.Context(), identifier.PaymentHash)
+		if errors.Is(err, ErrUnknownInvoice) {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+
+		if _, err := a.ledger.Deposit(r.Context(), account, identifier.PaymentHash, int64(record.AmountMsat)); err != nil { //nolint:gosec
+			return 0, err
+		}
+	}
+
+	price, _, err := a.pricer.Price(r)
+	if err != nil {
+		return 0, err
+	}
+
+	return a.ledger.Debit(r.Context(), account, int64(price)) //nolint:gosec
+}
+
+// deposit returns the amount of the deposit caveat set by AccountMinter
+// Only the first caveat of a macaroon counts, so a deposit added by the holder of a token minted with caveats is never credited
+func deposit(mac *macaroon.Macaroon) (int64, bool, error) {
+	caveats := mac.Caveats()
+	if len(caveats) == 0 || caveats[0].VerificationId != nil {
+		return 0, false, nil
+	}
+
+	caveat, err := DecodeCaveat(string(caveats[0].Id))
+	if err != nil || caveat.Condition != DepositCondition {
+		return 0, false, nil
+	}
+
+	amount, err := strconv.ParseInt(caveat.Value, 10, 64)
+	if err != nil || amount < 0 {
+		return 0, false, fmt.Errorf("%w: %s", ErrInvalidCaveat, caveat)
+	}
+	return amount, true, nil
+}
+
+var errDepositAlreadySet = errors.New("deposit already set")
+
+// DepositSatisfier only allows a single deposit caveat, set by the minter, deposits are credited by WithAccounts
+func DepositSatisfier() Satisfier {
+	return Satisfier{
+		Condition: DepositCondition,
+		SatisfyPrevious: func(Caveat, Caveat) error {
+			return errDepositAlreadySet
+		},
+	}
+}
@@ -0,0 +1,291 @@
+package l402
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+func TestAccounts(t *testing.T) {
+	rootKeys := MemoryRootKeyStore()
+	ledger := MemoryLedger()
+	invoices := &preimageInvoiceProvider{}
+	invoiceStore := MemoryInvoiceStore()
+
+	minter := AccountMinter(RecordInvoices(invoices, invoiceStore), rootKeys, 2000, NewCaveat(MethodsCondition, "GET"))
+	handler := Proxy(minter, Authority(rootKeys), WithAccounts(ledger, invoiceStore, FixedPrice(1000)))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "premium content")
+	}))
+
+	serve := func(authorization string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/videos/1", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve("")
+	account := challengedToken(t, w, invoices)
+
+	tests := []struct {
+		expectedResponseStatus int
+		expectedBalance        string
+	}{
+		{expectedResponseStatus: http.StatusOK, expectedBalance: "1000"},
+		{expectedResponseStatus: http.StatusOK, expectedBalance: "0"},
+		{expectedResponseStatus: http.StatusPaymentRequired, expectedBalance: "0"},
+	}
+
+	for _, test := range tests {
+		w = serve(account)
+
+		if w.Code != test.expectedResponseStatus {
+			t.Errorf("expected: %d but got: %d", test.expectedResponseStatus, w.Code)
+		}
+
+		if balance := w.Header().Get(BalanceHeader); balance != test.expectedBalance {
+			t.Errorf("expected: %s but got: %s", test.expectedBalance, balance)
+		}
+	}
+
+	topUp := challengedToken(t, w, invoices)
+
+	if w = serve(topUp); w.Code != http.StatusOK || w.Header().Get(BalanceHeader) != "1000" {
+		t.Errorf("expected a top-up to 1000 but got: %d %s", w.Code, w.Header().Get(BalanceHeader))
+	}
+
+	// The first deposit isn't credited twice, both tokens share the same account
+	if w = serve(account); w.Code != http.StatusOK || w.Header().Get(BalanceHeader) != "0" {
+		t.Errorf("expected a balance of 0 but got: %d %s", w.Code, w.Header().Get(BalanceHeader))
+	}
+}
+
+func TestAccounts_ForgedDeposit(t *testing.T) {
+	tests := map[string]struct {
+		recordInvoices         bool
+		expectedResponseStatus int
+		expectedBalance        string
+	}{
+		"recorded invoice": {
+			recordInvoices:         true,
+			expectedResponseStatus: http.StatusOK,
+			expectedBalance:        "900",
+		},
+		"unknown invoice": {
+			expectedResponseStatus: http.StatusPaymentRequired,
+			expectedBalance:        "0",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			rootKeys := MemoryRootKeyStore()
+			invoices := &preimageInvoiceProvider{}
+			invoiceStore := MemoryInvoiceStore()
+
+			// A plain minter issues macaroons without caveats, so the deposit added by the holder comes first
+			var provider InvoiceProvider = invoices
+			if test.recordInvoices {
+				provider = RecordInvoices(invoices, invoiceStore)
+			}
+			minter := Minter(provider, rootKeys, FixedPrice(1000))
+			handler := Proxy(minter, Authority(rootKeys), WithAccounts(MemoryLedger(), invoiceStore, FixedPrice(100)))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			token := challengedToken(t, w, invoices)
+
+			macaroonBase64, preimage, _ := strings.Cut(strings.TrimPrefix(token, "L402 "), ":")
+			macaroons, _ := UnmarshalMacaroons(macaroonBase64)
+			for _, mac := range macaroons {
+				AddFirstPartyCaveats(mac, NewCaveat(DepositCondition, "1000000")) //nolint:errcheck
+				macaroonBase64, _ = MarshalMacaroons(mac)
+			}
+
+			w = httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Authorization", "L402 "+macaroonBase64+":"+preimage)
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.expectedResponseStatus {
+				t.Errorf("expected: %d but got: %d", test.expectedResponseStatus, w.Code)
+			}
+
+			if balance := w.Header().Get(BalanceHeader); balance != test.expectedBalance {
+				t.Errorf("expected: %s but got: %s", test.expectedBalance, balance)
+			}
+		})
+	}
+}
+
+func TestAccountMinter_TopUp(t *testing.T) {
+	ctx := context.Background()
+	rootKeys := MemoryRootKeyStore()
+	id, rootKey, _ := rootKeys.NewRootKey(ctx)
+	minter := AccountMinter(&preimageInvoiceProvider{}, rootKeys, 2000)
+
+	tests := map[string]struct {
+		rootKey         []byte
+		expectedSameID  bool
+		expectedCaveats []string
+	}{
+		"attenuated token": {
+			rootKey:         rootKey,
+			expectedSameID:  true,
+			expectedCaveats: []string{"deposit=2000", "path=/videos"},
+		},
+		"forged token": {
+			rootKey:         []byte("forged"),
+			expectedCaveats: []string{"deposit=2000"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			macaroonID, _ := MarchalIdentifier(Identifier{ID: id})
+			mac, _ := macaroon.New(test.rootKey, macaroonID, "", macaroon.V2)
+			AddFirstPartyCaveats(mac, NewCaveat(DepositCondition, "1"), NewCaveat(ExpiresCondition, "2024-01-01T00:00:00Z"), NewCaveat(PathCondition, "/videos")) //nolint:errcheck
+
+			r := httptest.NewRequest("GET", "/videos/1", nil)
+			r = r.WithContext(context.WithValue(ctx, KeyMacaroon, map[Identifier]*macaroon.Macaroon{{ID: id}: mac}))
+
+			macaroonBase64, _, err := minter.MintWithChallenge(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			macaroons, _ := UnmarshalMacaroons(macaroonBase64)
+			for identifier, topUp := range macaroons {
+				if sameID := identifier.ID == id; sameID != test.expectedSameID {
+					t.Errorf("expected: %v but got: %v", test.expectedSameID, sameID)
+				}
+
+				caveats, _ := FirstPartyCaveats(topUp)
+				var conditions []string
+				for _, caveat := range caveats {
+					conditions = append(conditions, caveat.String())
+				}
+				if fmt.Sprint(conditions) != fmt.Sprint(test.expectedCaveats) {
+					t.Errorf("expected: %v but got: %v", test.expectedCaveats, conditions)
+				}
+			}
+		})
+	}
+}
+
+func TestDepositSatisfier(t *testing.T) {
+	ctx := context.Background()
+	rootKeys := MemoryRootKeyStore()
+	id, rootKey, _ := rootKeys.NewRootKey(ctx)
+
+	macaroonID, _ := MarchalIdentifier(Identifier{ID: id})
+	mac, _ := macaroon.New(rootKey, macaroonID, "", macaroon.V2)
+	AddFirstPartyCaveats(mac, NewCaveat(DepositCondition, "1000"), NewCaveat(DepositCondition, "1000000")) //nolint:errcheck
+
+	rejection := Authority(rootKeys).ApproveAccess(httptest.NewRequest("GET", "/", nil), map[Identifier]*macaroon.Macaroon{{ID: id}: mac})
+
+	if !errors.Is(rejection, errDepositAlreadySet) {
+		t.Errorf("expected: %v but got: %v", errDepositAlreadySet, rejection)
+	}
+}
+
+var challengeMatcher = regexp.MustCompile(`L402 macaroon="(\S+)", invoice="(\S+)"`)
+
+// challengedToken pays the invoice of a 402 response and returns the Authorization value of the token
+func challengedToken(t testing.TB, w *httptest.ResponseRecorder, invoices *preimageInvoiceProvider) string {
+	t.Helper()
+
+	if w.Code != http.StatusPaymentRequired {
+		t.Fatalf("expected: %d but got: %d", http.StatusPaymentRequired, w.Code)
+	}
+
+	challenge := challengeMatcher.FindStringSubmatch(w.Header().Get("WWW-Authenticate"))
+	if len(challenge) != 3 {
+		t.Fatalf("unexpected challenge: %s", w.Header().Get("WWW-Authenticate"))
+	}
+
+	preimage := invoices.preimage(Invoice(challenge[2]))
+	return "L402 " + challenge[1] + ":" + hex.EncodeToString(preimage[:])
+}
+
+// preimageInvoiceProvider creates invoices with a distinct preimage each, it's safe for concurrent use
+type preimageInvoiceProvider struct {
+	mu        sync.Mutex
+	preimages map[Invoice]Hash
+}
+
+func (p *preimageInvoiceProvider) CreateInvoice(context.Context, uint64, string) (Invoice, Hash, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.preimages == nil {
+		p.preimages = make(map[Invoice]Hash)
+	}
+
+	preimage := Hash{byte(len(p.preimages) + 1)}
+	invoice := Invoice(fmt.Sprintf("lnbc%d", len(p.preimages)+1))
+	p.preimages[invoice] = preimage
+
+	return invoice, sha256.Sum256(preimage[:]), nil
+}
+
+func (p *preimageInvoiceProvider) preimage(invoice Invoice) Hash {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.preimages[invoice]
+}
+
+func TestDeposit(t *testing.T) {
+	tests := map[string]struct {
+		caveats         []Caveat
+		expectedAmount  int64
+		expectedDeposit bool
+		expectedError   error
+	}{
+		"minted deposit": {
+			caveats:         []Caveat{NewCaveat(DepositCondition, "2000"), NewCaveat(PathCondition, "/videos")},
+			expectedAmount:  2000,
+			expectedDeposit: true,
+		},
+		"no deposit": {
+			caveats: []Caveat{NewCaveat(PathCondition, "/videos")},
+		},
+		"deposit added by the holder": {
+			caveats: []Caveat{NewCaveat(PathCondition, "/videos"), NewCaveat(DepositCondition, "1000000")},
+		},
+		"invalid deposit": {
+			caveats:       []Caveat{NewCaveat(DepositCondition, "-1")},
+			expectedError: ErrInvalidCaveat,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			mac, _ := macaroon.New([]byte{1}, []byte{2}, "", macaroon.V2)
+			AddFirstPartyCaveats(mac, test.caveats...) //nolint:errcheck
+
+			amount, found, err := deposit(mac)
+
+			if !errors.Is(err, test.expectedError) {
+				t.Errorf("expected: %v but got: %v", test.expectedError, err)
+			}
+
+			if amount != test.expectedAmount || found != test.expectedDeposit {
+				t.Errorf("expected: %d %v but got: %d %v", test.expectedAmount, test.expectedDeposit, amount, found)
+			}
+		})
+	}
+}
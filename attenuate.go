@@ -0,0 +1,68 @@
+package l402
+
+import (
+	"errors"
+	"fmt"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+var errBoundDischarges = errors.New("discharge macaroons are bound to the original token")
+
+// Attenuate returns a copy of a token restricted by the given caveats, like a read-only token valid for one hour
+// The token's preimage stays the same, so the copy can be handed to a sub-team or a browser without a new payment
+// Caveats that widen the access granted by a previous caveat of the same condition are refused, according to DefaultSatisfiers
+// Tokens with discharge macaroons can't be attenuated, as their discharges are bound to the signatures of the original macaroons
+func Attenuate(macaroonBase64 string, caveats ...Caveat) (string, error) {
+	macaroons, discharges, err := UnmarshalToken(macaroonBase64)
+	if err != nil {
+		return "", err
+	} else if len(discharges) > 0 {
+		return "", fmt.Errorf("%w: %w", ErrInvalidMacaroon, errBoundDischarges)
+	}
+
+	satisfiers := make(map[string]Satisfier)
+	for _, satisfier := range DefaultSatisfiers() {
+		satisfiers[satisfier.Condition] = satisfier
+	}
+
+	attenuated := make([]*macaroon.Macaroon, 0, len(macaroons))
+	for _, identifier := range SortedIdentifiers(macaroons) {
+		mac := macaroons[identifier].Clone()
+
+		if err := checkNarrowing(satisfiers, mac, caveats); err != nil {
+			return "", err
+		} else if err := AddFirstPartyCaveats(mac, caveats...); err != nil {
+			return "", err
+		}
+
+		attenuated = append(attenuated, mac)
+	}
+
+	return MarshalMacaroons(attenuated...)
+}
+
+// checkNarrowing applies the same narrowing rules as the Authority to the caveats about to be added to a macaroon
+func checkNarrowing(satisfiers map[string]Satisfier, mac *macaroon.Macaroon, caveats []Caveat) error {
+	existing, err := FirstPartyCaveats(mac)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidCaveat, err)
+	}
+
+	previous := make(map[string]Caveat)
+	for _, caveat := range existing {
+		previous[caveat.Condition] = caveat
+	}
+
+	for _, caveat := range caveats {
+		satisfier, found := satisfiers[caveat.Condition]
+		if previousCaveat, hasPrevious := previous[caveat.Condition]; found && hasPrevious && satisfier.SatisfyPrevious != nil {
+			if err := satisfier.SatisfyPrevious(previousCaveat, caveat); err != nil {
+				return fmt.Errorf("%w: %s: %w", ErrWideningCaveat, caveat, err)
+			}
+		}
+		previous[caveat.Condition] = caveat
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package l402
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+func TestAttenuate(t *testing.T) {
+	macaroonID, _ := MarchalIdentifier(Identifier{ID: ID{1}})
+	mac, _ := macaroon.New([]byte{1}, macaroonID, "", macaroon.V2)
+	AddFirstPartyCaveats(mac, NewCaveat(MethodsCondition, "GET,HEAD,POST"), NewCaveat(ExpiresCondition, "2024-01-02T00:00:00Z")) //nolint:errcheck
+	token, _ := MarshalMacaroons(mac)
+
+	discharged := mac.Clone()
+	AddThirdPartyCaveats(discharged, ThirdPartyCaveat{RootKey: []byte{2}, ID: []byte("logged-in")}) //nolint:errcheck
+	discharge, _ := macaroon.New([]byte{2}, []byte("logged-in"), "", macaroon.V2)
+	discharge.Bind(discharged.Signature())
+	dischargedToken, _ := MarshalMacaroons(discharged, discharge)
+
+	tests := map[string]struct {
+		token           string
+		caveats         []Caveat
+		expectedCaveats []Caveat
+		expectedError   error
+	}{
+		"read-only for one hour": {
+			token:   token,
+			caveats: []Caveat{NewCaveat(MethodsCondition, "GET,HEAD"), NewCaveat(ExpiresCondition, "2024-01-01T01:00:00Z")},
+			expectedCaveats: []Caveat{
+				NewCaveat(MethodsCondition, "GET,HEAD,POST"),
+				NewCaveat(ExpiresCondition, "2024-01-02T00:00:00Z"),
+				NewCaveat(MethodsCondition, "GET,HEAD"),
+				NewCaveat(ExpiresCondition, "2024-01-01T01:00:00Z"),
+			},
+		},
+		"new condition": {
+			token:   token,
+			caveats: []Caveat{NewCaveat(PathCondition, "/videos")},
+			expectedCaveats: []Caveat{
+				NewCaveat(MethodsCondition, "GET,HEAD,POST"),
+				NewCaveat(ExpiresCondition, "2024-01-02T00:00:00Z"),
+				NewCaveat(PathCondition, "/videos"),
+			},
+		},
+		"widened methods": {
+			token:         token,
+			caveats:       []Caveat{NewCaveat(MethodsCondition, "GET,DELETE")},
+			expectedError: ErrWideningCaveat,
+		},
+		"widened by a later caveat": {
+			token:         token,
+			caveats:       []Caveat{NewCaveat(PathCondition, "/videos/1"), NewCaveat(PathCondition, "/videos")},
+			expectedError: ErrWideningCaveat,
+		},
+		"extended expiry": {
+			token:         token,
+			caveats:       []Caveat{NewCaveat(ExpiresCondition, "2025-01-01T00:00:00Z")},
+			expectedError: ErrWideningCaveat,
+		},
+		"discharged token": {
+			token:         dischargedToken,
+			caveats:       []Caveat{NewCaveat(PathCondition, "/videos")},
+			expectedError: errBoundDischarges,
+		},
+		"invalid token": {
+			token:         "not a token",
+			expectedError: ErrInvalidMacaroon,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			attenuated, err := Attenuate(test.token, test.caveats...)
+			if !errors.Is(err, test.expectedError) {
+				t.Fatalf("expected: %v but got: %v", test.expectedError, err)
+			} else if err != nil {
+				return
+			}
+
+			macaroons, err := UnmarshalMacaroons(attenuated)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			attenuatedMac := macaroons[Identifier{ID: ID{1}}]
+			if _, err := attenuatedMac.VerifySignature([]byte{1}, nil); err != nil {
+				t.Errorf("expected: %v but got: %v", nil, err)
+			}
+
+			if caveats, _ := FirstPartyCaveats(attenuatedMac); !reflect.DeepEqual(caveats, test.expectedCaveats) {
+				t.Errorf("expected: %v but got: %v", test.expectedCaveats, caveats)
+			}
+		})
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
 type Rejection error
@@ -24,6 +26,45 @@ func (i Invoice) String() string {
 	return fmt.Sprintf(`invoice="%s"`, string(i))
 }
 
+// AmountMsat parses the amount of a BOLT 11 invoice from its human-readable part
+// Invoices without an amount, or that can't be parsed, return false
+func (i Invoice) AmountMsat() (uint64, bool) {
+	invoice := strings.ToLower(string(i))
+	separator := strings.LastIndexByte(invoice, '1')
+	if !strings.HasPrefix(invoice, "ln") || separator < 0 {
+		return 0, false
+	}
+
+	// The currency prefix (bc, tb, bcrt...) is followed by the amount and its multiplier
+	hrp := strings.TrimLeft(invoice[2:separator], "abcdefghijklmnopqrstuvwxyz")
+	if hrp == "" {
+		return 0, false
+	}
+
+	// Millisatoshis per unit of each multiplier, pico-bitcoin is a tenth of a millisatoshi
+	multipliers := map[byte]uint64{'m': 100_000_000, 'u': 100_000, 'n': 100}
+	const millisatoshisPerBitcoin = 100_000_000_000
+
+	digits, multiplier := hrp, uint64(millisatoshisPerBitcoin)
+	switch last := hrp[len(hrp)-1]; {
+	case last == 'p':
+		digits = hrp[:len(hrp)-1]
+		amount, err := strconv.ParseUint(digits, 10, 64)
+		if err != nil || amount%10 != 0 {
+			return 0, false
+		}
+		return amount / 10, true
+	case multipliers[last] != 0:
+		digits, multiplier = hrp[:len(hrp)-1], multipliers[last]
+	}
+
+	amount, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil || amount > ^uint64(0)/multiplier {
+		return 0, false
+	}
+	return amount * multiplier, true
+}
+
 type authenticator struct {
 	macaroonMinter MacaroonMinter
 	errorHandler   http.Handler
@@ -37,16 +78,18 @@ func Authenticator(minter MacaroonMinter, errorHandler http.Handler) authenticat
 }
 
 func (a authenticator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rejection := context.Cause(r.Context())
+
+	// The request context was cancelled to carry the rejection, so the minter gets a live one
+	mintingRequest := r.WithContext(context.WithoutCancel(r.Context()))
+
 	// Ask the minter to give us a macaroon and a challenge (a lightning invoice)
-	macaroonBase64, challenge, err := a.macaroonMinter.MintWithChallenge(r)
+	macaroonBase64, challenge, err := a.macaroonMinter.MintWithChallenge(mintingRequest)
 	if err != nil {
-		ctx, cancelCause := context.WithCancelCause(r.Context())
-		cancelCause(fmt.Errorf("%w: %w", ErrFailedMacaroonMinting, err))
-		a.errorHandler.ServeHTTP(w, r.WithContext(ctx))
+		a.errorHandler.ServeHTTP(w, withCancelCause(r, fmt.Errorf("%w: %w", ErrFailedMacaroonMinting, err)))
 		return
 	}
 
-	rejection := context.Cause(r.Context())
 	var recoverableRejection RecoverableRejection
 	if errors.As(rejection, &recoverableRejection) {
 		// Rejecting access to an API resource triggers a re-authentication opportunity
@@ -59,5 +102,32 @@ func (a authenticator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Add("WWW-Authenticate", fmt.Sprintf(`L402 macaroon="%s", %s`, macaroonBase64, challenge))
+
+	if AcceptsProblem(r) {
+		WriteProblem(w, paymentRequiredProblem(rejection, macaroonBase64, challenge))
+		return
+	}
+
 	http.Error(w, rejection.Error(), http.StatusPaymentRequired)
 }
+
+// paymentRequiredProblem describes the rejection along with the challenge to overcome it
+func paymentRequiredProblem(rejection Rejection, macaroonBase64 string, challenge Challenge) Problem {
+	problem := NewProblem(rejection, http.StatusPaymentRequired)
+	problem.Macaroon = macaroonBase64
+
+	if invoice, ok := challenge.(Invoice); ok {
+		problem.Invoice = string(invoice)
+		problem.PriceMsat, _ = invoice.AmountMsat()
+	} else {
+		problem.Challenge = challenge.String()
+	}
+
+	var recoverableRejection RecoverableRejection
+	if errors.As(rejection, &recoverableRejection) {
+		problem.Recovery = make(http.Header)
+		recoverableRejection.AdviseRecovery(problem.Recovery)
+	}
+
+	return problem
+}
@@ -0,0 +1,265 @@
+package l402
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+// Satisfier enforces the caveats of one condition
+type Satisfier struct {
+	Condition string
+	// SatisfyPrevious checks that a caveat only narrows the access granted by a previous caveat of the same condition
+	SatisfyPrevious func(previous, current Caveat) error
+	// SatisfyFinal checks that a caveat is satisfied by the request
+	SatisfyFinal func(r AccessRequest, caveat Caveat) error
+}
+
+type authority struct {
+	rootKeys   RootKeyStore
+	satisfiers map[string]Satisfier
+}
+
+// Authority is the standard AccessAuthority
+// It verifies the signature of every macaroon with its root key and then checks their caveats
+// The default satisfiers are always included, and the given satisfiers replace them by condition
+// Caveats without a satisfier are rejected
+// Rejections of a macaroon are reported as a *MacaroonError
+// Third-party caveats are verified with the discharge macaroons found in the request context, see KeyDischarges
+// Signatures aren't verified again for tokens found in the token cache, see KeySignatureVerified
+func Authority(rootKeys RootKeyStore, satisfiers ...Satisfier) authority {
+	a := authority{
+		rootKeys:   rootKeys,
+		satisfiers: make(map[string]Satisfier),
+	}
+
+	for _, satisfier := range slices.Concat(DefaultSatisfiers(), satisfiers) {
+		a.satisfiers[satisfier.Condition] = satisfier
+	}
+
+	return a
+}
+
+func (a authority) ApproveAccess(r *http.Request, macaroons map[Identifier]*macaroon.Macaroon) Rejection {
+	return a.ApproveAccessFor(HTTPAccessRequest(r), macaroons)
+}
+
+func (a authority) ApproveAccessFor(r AccessRequest, macaroons map[Identifier]*macaroon.Macaroon) Rejection {
+	if len(macaroons) == 0 {
+		return ErrPaymentRequired
+	}
+
+	allDischarges, _ := r.Context().Value(KeyDischarges).([]*macaroon.Macaroon)
+	signatureVerified, _ := r.Context().Value(KeySignatureVerified).(bool)
+
+	for i, identifier := range tokenOrder(r.Context(), macaroons) {
+		mac := macaroons[identifier]
+
+		discharges := DischargesFor(mac, allDischarges)
+		if !signatureVerified {
+			rootKey, err := a.rootKeys.RootKey(r.Context(), identifier.ID)
+			if err != nil {
+				return &MacaroonError{Index: i, Stage: StageSignature, Err: err}
+			}
+
+			if _, err := mac.VerifySignature(rootKey, discharges); err != nil {
+				return &MacaroonError{Index: i, Stage: StageSignature, Err: fmt.Errorf("%w: %w", ErrInvalidSignature, err)}
+			}
+		}
+
+		// Every macaroon narrows its own caveats, a discharge can't be narrowed by the macaroon it discharges
+		for _, m := range slices.Concat([]*macaroon.Macaroon{mac}, discharges) {
+			if err := a.checkCaveats(r, firstPartyConditions(m)); err != nil {
+				return &MacaroonError{Index: i, Stage: StageCaveat, Err: err}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (a authority) checkCaveats(r AccessRequest, conditions []string) error {
+	previous := make(map[string]Caveat)
+
+	for _, condition := range conditions {
+		caveat, err := DecodeCaveat(condition)
+		if err != nil {
+			return err
+		}
+
+		satisfier, found := a.satisfiers[caveat.Condition]
+		if !found {
+			return fmt.Errorf("%w: %s", ErrUnknownCaveat, caveat.Condition)
+		}
+
+		if previousCaveat, found := previous[caveat.Condition]; found && satisfier.SatisfyPrevious != nil {
+			if err := satisfier.SatisfyPrevious(previousCaveat, caveat); err != nil {
+				return fmt.Errorf("%w: %s: %w", ErrUnsatisfiedCaveat, caveat, err)
+			}
+		}
+		previous[caveat.Condition] = caveat
+
+		if satisfier.SatisfyFinal != nil {
+			if err := satisfier.SatisfyFinal(r, caveat); err != nil {
+				return fmt.Errorf("%w: %s: %w", ErrUnsatisfiedCaveat, caveat, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func firstPartyConditions(mac *macaroon.Macaroon) []string {
+	conditions := make([]string, 0, len(mac.Caveats()))
+	for _, caveat := range mac.Caveats() {
+		if caveat.VerificationId == nil {
+			conditions = append(conditions, string(caveat.Id))
+		}
+	}
+	return conditions
+}
+
+var errExpired = errors.New("expired")
+
+const (
+	ExpiresCondition = "expires"
+	MethodsCondition = "methods"
+	PathCondition    = "path"
+)
+
+func DefaultSatisfiers() []Satisfier {
+	return []Satisfier{
+		ExpiresSatisfier(time.Now),
+		MethodsSatisfier(),
+		PathSatisfier(),
+		MaxBytesSatisfier(),
+		RateSatisfier(),
+		DepositSatisfier(),
+		CreditSatisfier(),
+	}
+}
+
+// ExpiresSatisfier enforces "expires=<RFC 3339 timestamp>" caveats
+func ExpiresSatisfier(now func() time.Time) Satisfier {
+	return Satisfier{
+		Condition: ExpiresCondition,
+		SatisfyPrevious: func(previous, current Caveat) error {
+			previousExpiry, err := time.Parse(time.RFC3339, previous.Value)
+			if err != nil {
+				return err
+			}
+			currentExpiry, err := time.Parse(time.RFC3339, current.Value)
+			if err != nil {
+				return err
+			} else if currentExpiry.After(previousExpiry) {
+				return fmt.Errorf("expiry extended from %s", previous.Value)
+			}
+			return nil
+		},
+		SatisfyFinal: func(_ AccessRequest, caveat Caveat) error {
+			expiry, err := time.Parse(time.RFC3339, caveat.Value)
+			if err != nil {
+				return err
+			} else if !now().Before(expiry) {
+				return errExpired
+			}
+			return nil
+		},
+	}
+}
+
+// MethodsSatisfier enforces "methods=GET,HEAD" caveats
+func MethodsSatisfier() Satisfier {
+	methods := func(caveat Caveat) []string {
+		return strings.Split(strings.ReplaceAll(strings.ToUpper(caveat.Value), " ", ""), ",")
+	}
+
+	return Satisfier{
+		Condition: MethodsCondition,
+		SatisfyPrevious: func(previous, current Caveat) error {
+			previousMethods := methods(previous)
+			for _, method := range methods(current) {
+				if !slices.Contains(previousMethods, method) {
+					return fmt.Errorf("method %s not allowed by %s", method, previous)
+				}
+			}
+			return nil
+		},
+		SatisfyFinal: func(r AccessRequest, caveat Caveat) error {
+			if !slices.Contains(methods(caveat), strings.ToUpper(r.Method())) {
+				return fmt.Errorf("method %s not allowed", r.Method())
+			}
+			return nil
+		},
+	}
+}
+
+// PathSatisfier enforces "path=/prefix" caveats, the prefix is matched by whole path segments
+func PathSatisfier() Satisfier {
+	return Satisfier{
+		Condition: PathCondition,
+		SatisfyPrevious: func(previous, current Caveat) error {
+			if !hasPathPrefix(current.Value, previous.Value) {
+				return fmt.Errorf("path %s is outside of %s", current.Value, previous.Value)
+			}
+			return nil
+		},
+		SatisfyFinal: func(r AccessRequest, caveat Caveat) error {
+			if !hasPathPrefix(r.Path(), caveat.Value) {
+				return fmt.Errorf("path %s not allowed", r.Path())
+			}
+			return nil
+		},
+	}
+}
+
+func hasPathPrefix(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// MaxBytesSatisfier only checks that max_bytes caveats are narrowed, they are enforced by WithByteMetering
+func MaxBytesSatisfier() Satisfier {
+	return Satisfier{
+		Condition: MaxBytesCondition,
+		SatisfyPrevious: func(previous, current Caveat) error {
+			previousLimit, err := strconv.ParseInt(previous.Value, 10, 64)
+			if err != nil {
+				return err
+			}
+			currentLimit, err := strconv.ParseInt(current.Value, 10, 64)
+			if err != nil {
+				return err
+			} else if currentLimit > previousLimit {
+				return fmt.Errorf("limit increased from %s", previous.Value)
+			}
+			return nil
+		},
+	}
+}
+
+// RateSatisfier only checks that rate caveats are narrowed, they are enforced by WithRateLimiter
+func RateSatisfier() Satisfier {
+	return Satisfier{
+		Condition: RateCondition,
+		SatisfyPrevious: func(previous, current Caveat) error {
+			previousRate, err := ParseRate(previous.Value)
+			if err != nil {
+				return err
+			}
+			currentRate, err := ParseRate(current.Value)
+			if err != nil {
+				return err
+			} else if currentRate.perSecond() > previousRate.perSecond() || currentRate.Requests > previousRate.Requests {
+				return fmt.Errorf("rate increased from %s", previous.Value)
+			}
+			return nil
+		},
+	}
+}
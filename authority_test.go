@@ -0,0 +1,241 @@
+package l402
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+func TestAuthority_ApproveAccess(t *testing.T) {
+	ctx := context.Background()
+	rootKeys := MemoryRootKeyStore()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := map[string]struct {
+		caveats           []Caveat
+		method            string
+		path              string
+		wrongRootKey      bool
+		expectedRejection error
+	}{
+		"no caveats": {},
+		"all satisfied": {
+			caveats: []Caveat{
+				NewCaveat(ExpiresCondition, "2024-01-01T01:00:00Z"),
+				NewCaveat(MethodsCondition, "GET,POST"),
+				NewCaveat(MethodsCondition, "GET"),
+				NewCaveat(PathCondition, "/videos"),
+				NewCaveat(PathCondition, "/videos/1"),
+				NewCaveat(MaxBytesCondition, "100"),
+				NewCaveat(RateCondition, "10/s"),
+			},
+			path: "/videos/1/stream",
+		},
+		"wrong root key": {
+			wrongRootKey:      true,
+			expectedRejection: ErrInvalidSignature,
+		},
+		"unknown caveat": {
+			caveats:           []Caveat{NewCaveat("tier", "gold")},
+			expectedRejection: ErrUnknownCaveat,
+		},
+		"expired": {
+			caveats:           []Caveat{NewCaveat(ExpiresCondition, "2023-12-31T23:59:59Z")},
+			expectedRejection: errExpired,
+		},
+		"extended expiry": {
+			caveats: []Caveat{
+				NewCaveat(ExpiresCondition, "2024-01-01T01:00:00Z"),
+				NewCaveat(ExpiresCondition, "2024-01-02T01:00:00Z"),
+			},
+			expectedRejection: ErrUnsatisfiedCaveat,
+		},
+		"method not allowed": {
+			caveats:           []Caveat{NewCaveat(MethodsCondition, "GET,HEAD")},
+			method:            "POST",
+			expectedRejection: ErrUnsatisfiedCaveat,
+		},
+		"widened methods": {
+			caveats:           []Caveat{NewCaveat(MethodsCondition, "GET"), NewCaveat(MethodsCondition, "GET,POST")},
+			expectedRejection: ErrUnsatisfiedCaveat,
+		},
+		"path not allowed": {
+			caveats:           []Caveat{NewCaveat(PathCondition, "/videos")},
+			path:              "/videos-private",
+			expectedRejection: ErrUnsatisfiedCaveat,
+		},
+		"widened path": {
+			caveats:           []Caveat{NewCaveat(PathCondition, "/videos/1"), NewCaveat(PathCondition, "/videos")},
+			path:              "/videos/1",
+			expectedRejection: ErrUnsatisfiedCaveat,
+		},
+		"widened max bytes": {
+			caveats:           []Caveat{NewCaveat(MaxBytesCondition, "100"), NewCaveat(MaxBytesCondition, "200")},
+			expectedRejection: ErrUnsatisfiedCaveat,
+		},
+		"widened rate": {
+			caveats:           []Caveat{NewCaveat(RateCondition, "10/s"), NewCaveat(RateCondition, "10/ms")},
+			expectedRejection: ErrUnsatisfiedCaveat,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			id, rootKey, _ := rootKeys.NewRootKey(ctx)
+			if test.wrongRootKey {
+				rootKey = []byte("wrong")
+			}
+
+			macaroonID, _ := MarchalIdentifier(Identifier{ID: id})
+			mac, _ := macaroon.New(rootKey, macaroonID, "", macaroon.V2)
+			AddFirstPartyCaveats(mac, test.caveats...) //nolint:errcheck
+
+			method, path := "GET", "/videos/1"
+			if test.method != "" {
+				method = test.method
+			}
+			if test.path != "" {
+				path = test.path
+			}
+
+			authority := Authority(rootKeys, ExpiresSatisfier(func() time.Time { return now }))
+			rejection := authority.ApproveAccess(httptest.NewRequest(method, path, nil), map[Identifier]*macaroon.Macaroon{{ID: id}: mac})
+
+			if !errors.Is(rejection, test.expectedRejection) {
+				t.Errorf("expected: %v but got: %v", test.expectedRejection, rejection)
+			}
+		})
+	}
+}
+
+func TestAuthority_UnknownRootKey(t *testing.T) {
+	mac, _ := macaroon.New([]byte{1}, []byte{2}, "", macaroon.V2)
+
+	rejection := Authority(MemoryRootKeyStore()).ApproveAccess(&http.Request{}, map[Identifier]*macaroon.Macaroon{{ID: ID{1}}: mac})
+
+	if !errors.Is(rejection, ErrUnknownRootKey) {
+		t.Errorf("expected: %v but got: %v", ErrUnknownRootKey, rejection)
+	}
+}
+
+func TestAuthority_TokenOrder(t *testing.T) {
+	rootKeys := MemoryRootKeyStore()
+	id, rootKey, _ := rootKeys.NewRootKey(context.Background())
+
+	known, _ := macaroon.New(rootKey, []byte{1}, "", macaroon.V2)
+	unknown, _ := macaroon.New([]byte{2}, []byte{2}, "", macaroon.V2)
+	unknownID := ID{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	macaroons := map[Identifier]*macaroon.Macaroon{{ID: id}: known, {ID: unknownID}: unknown}
+
+	tests := map[string]struct {
+		identifiers   []Identifier
+		expectedIndex int
+	}{
+		"order of the token": {
+			identifiers:   []Identifier{{ID: unknownID}, {ID: id}},
+			expectedIndex: 0,
+		},
+		"no order": {
+			expectedIndex: 1,
+		},
+		"order of another token": {
+			identifiers:   []Identifier{{ID: unknownID}, {ID: ID{1}}},
+			expectedIndex: 1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r = r.WithContext(context.WithValue(r.Context(), KeyIdentifiers, test.identifiers))
+
+			rejection := Authority(rootKeys).ApproveAccess(r, macaroons)
+
+			var macaroonError *MacaroonError
+			if !errors.As(rejection, &macaroonError) || macaroonError.Index != test.expectedIndex {
+				t.Errorf("expected: macaroon %d but got: %v", test.expectedIndex, rejection)
+			}
+		})
+	}
+}
+
+func TestAuthority_ThirdPartyCaveats(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	rootKeys := MemoryRootKeyStore()
+	authService := ThirdPartyCaveat{RootKey: []byte("shared with the auth service"), ID: []byte("logged-in"), Location: "https://auth.example.com"}
+
+	minter := Minter(&fakeInvoiceProvider{}, rootKeys, FixedPrice(1000), WithThirdPartyCaveats(func(AccessRequest) ([]ThirdPartyCaveat, error) {
+		return []ThirdPartyCaveat{authService}, nil
+	}))
+
+	tests := map[string]struct {
+		dischargeRootKey  []byte
+		dischargeCaveats  []Caveat
+		unbound           bool
+		noDischarge       bool
+		expectedRejection error
+	}{
+		"discharged": {
+			dischargeRootKey: authService.RootKey,
+			dischargeCaveats: []Caveat{NewCaveat(ExpiresCondition, "2024-01-01T01:00:00Z")},
+		},
+		"missing discharge": {
+			noDischarge:       true,
+			expectedRejection: ErrInvalidSignature,
+		},
+		"unbound discharge": {
+			dischargeRootKey:  authService.RootKey,
+			unbound:           true,
+			expectedRejection: ErrInvalidSignature,
+		},
+		"forged discharge": {
+			dischargeRootKey:  []byte("forged"),
+			expectedRejection: ErrInvalidSignature,
+		},
+		"expired discharge": {
+			dischargeRootKey:  authService.RootKey,
+			dischargeCaveats:  []Caveat{NewCaveat(ExpiresCondition, "2023-12-31T23:59:59Z")},
+			expectedRejection: errExpired,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			macaroonBase64, _, err := minter.MintWithChallenge(httptest.NewRequest("GET", "/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			macaroons, _ := UnmarshalMacaroons(macaroonBase64)
+			mac := macaroons[SortedIdentifiers(macaroons)[0]]
+
+			token := []*macaroon.Macaroon{mac}
+			if !test.noDischarge {
+				discharge, _ := macaroon.New(test.dischargeRootKey, authService.ID, authService.Location, macaroon.V2)
+				AddFirstPartyCaveats(discharge, test.dischargeCaveats...) //nolint:errcheck
+				if !test.unbound {
+					discharge.Bind(mac.Signature())
+				}
+				token = append(token, discharge)
+			}
+			tokenBase64, _ := MarshalMacaroons(token...)
+
+			macaroons, discharges, err := UnmarshalToken(tokenBase64)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r = r.WithContext(context.WithValue(r.Context(), KeyDischarges, discharges))
+
+			authority := Authority(rootKeys, ExpiresSatisfier(func() time.Time { return now }))
+			if rejection := authority.ApproveAccess(r, macaroons); !errors.Is(rejection, test.expectedRejection) {
+				t.Errorf("expected: %v but got: %v", test.expectedRejection, rejection)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package l402
+
+import (
+	"fmt"
+	"strings"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+// Caveat is a first-party macaroon caveat encoded as "condition=value"
+type Caveat struct {
+	Condition string
+	Value     string
+}
+
+func NewCaveat(condition, value string) Caveat {
+	return Caveat{Condition: condition, Value: value}
+}
+
+func (c Caveat) String() string {
+	return c.Condition + "=" + c.Value
+}
+
+func DecodeCaveat(s string) (Caveat, error) {
+	condition, value, found := strings.Cut(s, "=")
+	condition = strings.TrimSpace(condition)
+	if !found || condition == "" {
+		return Caveat{}, fmt.Errorf("%w: %q", ErrInvalidCaveat, s)
+	}
+	return Caveat{Condition: condition, Value: strings.TrimSpace(value)}, nil
+}
+
+func (c Caveat) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c *Caveat) UnmarshalText(text []byte) error {
+	caveat, err := DecodeCaveat(string(text))
+	*c = caveat
+	return err
+}
+
+func AddFirstPartyCaveats(mac *macaroon.Macaroon, caveats ...Caveat) error {
+	for _, caveat := range caveats {
+		if err := mac.AddFirstPartyCaveat([]byte(caveat.String())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ThirdPartyCaveat requires a discharge macaroon from a third party, like "must also be logged in via our auth service"
+type ThirdPartyCaveat struct {
+	// RootKey is shared with the third party, which signs the discharge macaroon with it
+	RootKey []byte
+	// ID lets the third party find or decrypt the RootKey and the condition to check
+	ID       []byte
+	Location string
+}
+
+func AddThirdPartyCaveats(mac *macaroon.Macaroon, caveats ...ThirdPartyCaveat) error {
+	for _, caveat := range caveats {
+		if err := mac.AddThirdPartyCaveat(caveat.RootKey, caveat.ID, caveat.Location); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FirstPartyCaveats returns the first-party caveats of a macaroon in the order they were added
+// The caveats are not verified, so the macaroon's signature must be checked before trusting them
+func FirstPartyCaveats(mac *macaroon.Macaroon) ([]Caveat, error) {
+	caveats := make([]Caveat, 0, len(mac.Caveats()))
+	for _, c := range mac.Caveats() {
+		if c.VerificationId != nil {
+			continue // Third-party caveats are checked by their discharge macaroons
+		}
+		caveat, err := DecodeCaveat(string(c.Id))
+		if err != nil {
+			return nil, err
+		}
+		caveats = append(caveats, caveat)
+	}
+	return caveats, nil
+}
+
+// caveatValues returns the values of every first-party caveat of a macaroon matching the condition
+// Caveats that cannot be decoded are skipped
+func caveatValues(mac *macaroon.Macaroon, condition string) []string {
+	var values []string
+	for _, c := range mac.Caveats() {
+		if c.VerificationId != nil {
+			continue
+		}
+		if caveat, err := DecodeCaveat(string(c.Id)); err == nil && caveat.Condition == condition {
+			values = append(values, caveat.Value)
+		}
+	}
+	return values
+}
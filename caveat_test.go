@@ -0,0 +1,82 @@
+package l402
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+func TestDecodeCaveat(t *testing.T) {
+	tests := map[string]struct {
+		caveat         string
+		expectedCaveat Caveat
+		expectedError  error
+	}{
+		"empty": {
+			caveat:        "",
+			expectedError: ErrInvalidCaveat,
+		},
+		"no value": {
+			caveat:        "max_bytes",
+			expectedError: ErrInvalidCaveat,
+		},
+		"no condition": {
+			caveat:        "=100",
+			expectedError: ErrInvalidCaveat,
+		},
+		"empty value": {
+			caveat:         "services=",
+			expectedCaveat: Caveat{Condition: "services"},
+		},
+		"padded": {
+			caveat:         " max_bytes = 100 ",
+			expectedCaveat: Caveat{Condition: "max_bytes", Value: "100"},
+		},
+		"value with equal sign": {
+			caveat:         "path=/a=b",
+			expectedCaveat: Caveat{Condition: "path", Value: "/a=b"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			caveat, err := DecodeCaveat(test.caveat)
+
+			if !errors.Is(err, test.expectedError) {
+				t.Fatalf("expected: %v but got: %v", test.expectedError, err)
+			}
+
+			if caveat != test.expectedCaveat {
+				t.Errorf("expected: %v but got: %v", test.expectedCaveat, caveat)
+			}
+		})
+	}
+}
+
+func TestFirstPartyCaveats(t *testing.T) {
+	mac, _ := macaroon.New([]byte{1}, []byte{2}, "", macaroon.V2)
+
+	caveats := []Caveat{NewCaveat("max_bytes", "100"), NewCaveat("max_bytes", "50")}
+	if err := AddFirstPartyCaveats(mac, caveats...); err != nil {
+		t.Fatalf("expected: %v but got: %v", nil, err)
+	}
+
+	if err := mac.AddThirdPartyCaveat([]byte{3}, []byte("third-party"), "https://auth.example.com"); err != nil {
+		t.Fatalf("expected: %v but got: %v", nil, err)
+	}
+
+	decodedCaveats, err := FirstPartyCaveats(mac)
+	if err != nil {
+		t.Fatalf("expected: %v but got: %v", nil, err)
+	}
+
+	if !reflect.DeepEqual(decodedCaveats, caveats) {
+		t.Errorf("expected: %v but got: %v", caveats, decodedCaveats)
+	}
+
+	if values := caveatValues(mac, "max_bytes"); !reflect.DeepEqual(values, []string{"100", "50"}) {
+		t.Errorf("expected: %v but got: %v", []string{"100", "50"}, values)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/gofeuer/l402"
+	"gopkg.in/yaml.v3"
+)
+
+var errInvalidConfig = errors.New("invalid config")
+
+type config struct {
+	Listen              string             `json:"listen"                yaml:"listen"`
+	Upstreams           []upstreamConfig   `json:"upstreams"             yaml:"upstreams"`
+	Pricing             l402.RoutePricing  `json:"pricing"               yaml:"pricing"`
+	OpenAPI             string             `json:"openapi"               yaml:"openapi"` // prices and authorizes by the operations of an OpenAPI document instead
+	Caveats             []l402.Caveat      `json:"caveats"               yaml:"caveats"`
+	TokenLifetime       duration           `json:"token_lifetime"        yaml:"token_lifetime"`
+	RootKeys            rootKeysConfig     `json:"root_keys"             yaml:"root_keys"`
+	Invoices            invoicesConfig     `json:"invoices"              yaml:"invoices"`
+	RateLimiterCapacity int                `json:"rate_limiter_capacity" yaml:"rate_limiter_capacity"`
+	ByteMetering        bool               `json:"byte_metering"         yaml:"byte_metering"`
+	MintingCache        mintingCacheConfig `json:"minting_cache"         yaml:"minting_cache"`
+}
+
+// upstreamConfig forwards the requests matching a http.ServeMux pattern to a target URL
+type upstreamConfig struct {
+	Path   string `json:"path"   yaml:"path"`
+	Target string `json:"target" yaml:"target"`
+}
+
+// mintingCacheConfig answers repeated unauthenticated requests of a client with the same invoice
+type mintingCacheConfig struct {
+	Capacity int      `json:"capacity" yaml:"capacity"` // 0 disables the cache
+	TTL      duration `json:"ttl"      yaml:"ttl"`      // defaults to the invoice expiry
+}
+
+type rootKeysConfig struct {
+	Type string `json:"type" yaml:"type"` // memory or file
+	Path string `json:"path" yaml:"path"`
+}
+
+type invoicesConfig struct {
+	Type         string `json:"type"          yaml:"type"` // lnd
+	URL          string `json:"url"           yaml:"url"`
+	MacaroonPath string `json:"macaroon_path" yaml:"macaroon_path"`
+	TLSCertPath  string `json:"tls_cert_path" yaml:"tls_cert_path"`
+	Expiry       int64  `json:"expiry"        yaml:"expiry"` // seconds
+}
+
+type duration time.Duration
+
+func (d *duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	*d = duration(parsed)
+	return err
+}
+
+// loadConfig reads a JSON file, or a YAML file otherwise
+func loadConfig(filename string) (config, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return config{}, err
+	}
+
+	c := config{Listen: ":8080"}
+	if filepath.Ext(filename) == ".json" {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&c)
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(&c)
+	}
+	if err != nil {
+		return config{}, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	return c, nil
+}
+
+func (c config) handler() (http.Handler, error) {
+	if len(c.Upstreams) == 0 {
+		return nil, fmt.Errorf("%w: upstreams: at least one upstream is required", errInvalidConfig)
+	}
+
+	rootKeys, err := c.RootKeys.store()
+	if err != nil {
+		return nil, err
+	}
+
+	invoices, err := c.Invoices.provider()
+	if err != nil {
+		return nil, err
+	}
+
+	routePricer, satisfiers, err := c.routePricer()
+	if err != nil {
+		return nil, err
+	}
+
+	pricer := l402.PricerFunc(func(r *http.Request) (uint64, []l402.Caveat, error) {
+		price, caveats, err := routePricer.Price(r)
+		caveats = slices.Concat(c.Caveats, caveats)
+		if c.TokenLifetime > 0 {
+			expiry := time.Now().Add(time.Duration(c.TokenLifetime)).UTC().Format(time.RFC3339)
+			caveats = append(caveats, l402.NewCaveat(l402.ExpiresCondition, expiry))
+		}
+		return price, caveats, err
+	})
+
+	var options []l402.Option
+	if c.RateLimiterCapacity > 0 {
+		options = append(options, l402.WithRateLimiter(l402.TokenBucketLimiter(c.RateLimiterCapacity)))
+	}
+	if c.ByteMetering {
+		options = append(options, l402.WithByteMetering(l402.MemoryUsageCounter()))
+	}
+
+	var minter l402.MacaroonMinter = l402.Minter(invoices, rootKeys, pricer)
+	if c.MintingCache.Capacity > 0 {
+		minter = l402.CachingMinter(minter, l402.ClientRouteFingerprint, c.mintingCacheTTL(), c.MintingCache.Capacity)
+	}
+
+	middleware := l402.Proxy(minter, l402.Authority(rootKeys, satisfiers...), options...)
+
+	mux := http.NewServeMux()
+	for i, upstream := range c.Upstreams {
+		target, err := url.Parse(upstream.Target)
+		if err != nil || target.Scheme == "" || target.Host == "" {
+			return nil, fmt.Errorf("%w: upstreams[%d].target: invalid URL %q", errInvalidConfig, i, upstream.Target)
+		}
+		mux.Handle(upstream.Path, middleware(httputil.NewSingleHostReverseProxy(target)))
+	}
+
+	return mux, nil
+}
+
+// routePricer prices requests by the configured routes, or by the operations of the OpenAPI document
+// Pricing by an OpenAPI document also requires the capabilities of its operations, and binds tokens to the tier they were bought at
+func (c config) routePricer() (l402.Pricer, []l402.Satisfier, error) {
+	if c.OpenAPI == "" {
+		routePricer, err := l402.RoutePricer(c.Pricing)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: pricing: %w", errInvalidConfig, err)
+		}
+		return routePricer, nil, nil
+	}
+
+	if len(c.Pricing.Tiers) > 0 || len(c.Pricing.Routes) > 0 || c.Pricing.DefaultTier != "" {
+		return nil, nil, fmt.Errorf("%w: pricing: can't be set along with openapi", errInvalidConfig)
+	}
+
+	pricing, err := l402.LoadOpenAPI(c.OpenAPI)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: openapi: %w", errInvalidConfig, err)
+	}
+
+	routePricer, err := pricing.Pricer()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: openapi: %w", errInvalidConfig, err)
+	}
+	return routePricer, pricing.Satisfiers(), nil
+}
+
+// lndDefaultExpiry is the expiry of LND invoices created without one
+const lndDefaultExpiry = time.Hour
+
+func (c config) mintingCacheTTL() time.Duration {
+	ttl := lndDefaultExpiry
+	if c.Invoices.Expiry > 0 {
+		ttl = time.Duration(c.Invoices.Expiry) * time.Second
+	}
+	if c.MintingCache.TTL > 0 {
+		ttl = min(ttl, time.Duration(c.MintingCache.TTL))
+	}
+	return ttl
+}
+
+func (c rootKeysConfig) store() (l402.RootKeyStore, error) {
+	switch c.Type {
+	case "", "memory":
+		return l402.MemoryRootKeyStore(), nil
+	case "file":
+		if c.Path == "" {
+			return nil, fmt.Errorf("%w: root_keys.path: required by the file store", errInvalidConfig)
+		}
+		return l402.FileRootKeyStore(c.Path)
+	default:
+		return nil, fmt.Errorf("%w: root_keys.type: unknown store %q", errInvalidConfig, c.Type)
+	}
+}
+
+func (c invoicesConfig) provider() (l402.InvoiceProvider, error) {
+	switch c.Type {
+	case "lnd":
+		if c.URL == "" {
+			return nil, fmt.Errorf("%w: invoices.url: required by the lnd backend", errInvalidConfig)
+		}
+		return newLNDInvoiceProvider(c)
+	default:
+		return nil, fmt.Errorf("%w: invoices.type: unknown backend %q", errInvalidConfig, c.Type)
+	}
+}
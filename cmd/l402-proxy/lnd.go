@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gofeuer/l402"
+)
+
+var errInvalidPaymentHash = errors.New("invalid payment hash")
+
+// lndInvoiceProvider creates invoices through the REST API of an LND node
+type lndInvoiceProvider struct {
+	client      *http.Client
+	url         string
+	macaroonHex string
+	expiry      int64
+}
+
+func newLNDInvoiceProvider(c invoicesConfig) (lndInvoiceProvider, error) {
+	provider := lndInvoiceProvider{
+		client: &http.Client{},
+		url:    strings.TrimSuffix(c.URL, "/"),
+		expiry: c.Expiry,
+	}
+
+	if c.MacaroonPath != "" {
+		macaroonBytes, err := os.ReadFile(c.MacaroonPath)
+		if err != nil {
+			return lndInvoiceProvider{}, err
+		}
+		provider.macaroonHex = hex.EncodeToString(macaroonBytes)
+	}
+
+	if c.TLSCertPath != "" {
+		certificate, err := os.ReadFile(c.TLSCertPath)
+		if err != nil {
+			return lndInvoiceProvider{}, err
+		}
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM(certificate) {
+			return lndInvoiceProvider{}, fmt.Errorf("%s: no certificates found", c.TLSCertPath)
+		}
+		provider.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: certPool, MinVersion: tls.VersionTLS12}}
+	}
+
+	return provider, nil
+}
+
+type lndInvoiceRequest struct {
+	ValueMsat string `json:"value_msat"`
+	Memo      string `json:"memo"`
+	Expiry    string `json:"expiry,omitempty"`
+}
+
+type lndInvoiceResponse struct {
+	RHash          string `json:"r_hash"`
+	PaymentRequest string `json:"payment_request"`
+}
+
+func (p lndInvoiceProvider) CreateInvoice(ctx context.Context, amountMsat uint64, memo string) (l402.Invoice, l402.Hash, error) {
+	invoiceRequest := lndInvoiceRequest{
+		ValueMsat: strconv.FormatUint(amountMsat, 10),
+		Memo:      memo,
+	}
+	if p.expiry > 0 {
+		invoiceRequest.Expiry = strconv.FormatInt(p.expiry, 10)
+	}
+
+	body, err := json.Marshal(invoiceRequest)
+	if err != nil {
+		return "", l402.Hash{}, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url+"/v1/invoices", bytes.NewReader(body))
+	if err != nil {
+		return "", l402.Hash{}, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if p.macaroonHex != "" {
+		request.Header.Set("Grpc-Metadata-macaroon", p.macaroonHex)
+	}
+
+	response, err := p.client.Do(request)
+	if err != nil {
+		return "", l402.Hash{}, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return "", l402.Hash{}, fmt.Errorf("lnd: %s: %s", response.Status, bytes.TrimSpace(message))
+	}
+
+	var invoiceResponse lndInvoiceResponse
+	if err := json.NewDecoder(response.Body).Decode(&invoiceResponse); err != nil {
+		return "", l402.Hash{}, err
+	}
+
+	var paymentHash l402.Hash
+	rHash, err := base64.StdEncoding.DecodeString(invoiceResponse.RHash)
+	if err != nil || len(rHash) != len(paymentHash) {
+		return "", l402.Hash{}, fmt.Errorf("%w: %q", errInvalidPaymentHash, invoiceResponse.RHash)
+	}
+	copy(paymentHash[:], rHash)
+
+	return l402.Invoice(invoiceResponse.PaymentRequest), paymentHash, nil
+}
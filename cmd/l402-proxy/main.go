@@ -0,0 +1,66 @@
+// Command l402-proxy is a reverse proxy that requires L402 payments before forwarding requests to its upstreams
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const shutdownTimeout = 10 * time.Second
+
+func main() {
+	configFile := flag.String("config", "l402-proxy.yaml", "path to the YAML or JSON configuration file")
+	flag.Parse()
+
+	if err := run(*configFile); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(configFile string) error {
+	c, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+
+	handler, err := c.handler()
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Addr:              c.Listen,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Printf("l402-proxy listening on %s", c.Listen)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "upstream %s", r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	lnd := newFakeLND()
+	defer lnd.Close()
+
+	configFile := writeConfig(t, "l402-proxy.yaml", fmt.Sprintf(`
+upstreams:
+  - path: /api/
+    target: %s
+pricing:
+  tiers:
+    basic: {price_msat: 1000}
+  routes:
+    - path: /api/**
+      tier: basic
+caveats: ["methods=GET"]
+token_lifetime: 1h
+root_keys:
+  type: file
+  path: %s
+invoices:
+  type: lnd
+  url: %s
+`, upstream.URL, filepath.Join(t.TempDir(), "root_keys.json"), lnd.URL))
+
+	c, err := loadConfig(configFile)
+	if err != nil {
+		t.Fatalf("expected: %v but got: %v", nil, err)
+	}
+
+	handler, err := c.handler()
+	if err != nil {
+		t.Fatalf("expected: %v but got: %v", nil, err)
+	}
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	// Without a token the proxy asks for a payment
+	response := get(t, server.URL+"/api/hello", "")
+	if response.StatusCode != http.StatusPaymentRequired {
+		body, _ := io.ReadAll(response.Body)
+		t.Fatalf("expected: %d but got: %d %s", http.StatusPaymentRequired, response.StatusCode, body)
+	}
+
+	challenge := regexp.MustCompile(`L402 macaroon="(\S+)", invoice="(\S+)"`).FindStringSubmatch(response.Header.Get("WWW-Authenticate"))
+	if len(challenge) != 3 {
+		t.Fatalf("unexpected challenge: %s", response.Header.Get("WWW-Authenticate"))
+	}
+	macaroonBase64, invoice := challenge[1], challenge[2]
+
+	if amount := lnd.amounts[invoice]; amount != "1000" {
+		t.Errorf("expected: %s but got: %s", "1000", amount)
+	}
+
+	// Paying the invoice reveals the preimage that unlocks the upstream
+	preimage := lnd.pay(invoice)
+	response = get(t, server.URL+"/api/hello", "L402 "+macaroonBase64+":"+preimage)
+	if body, _ := io.ReadAll(response.Body); response.StatusCode != http.StatusOK || string(body) != "upstream /api/hello" {
+		t.Errorf("expected: %d %s but got: %d %s", http.StatusOK, "upstream /api/hello", response.StatusCode, body)
+	}
+
+	// The token was minted for GET requests only
+	request, _ := http.NewRequest(http.MethodPost, server.URL+"/api/hello", nil) //nolint:noctx
+	request.Header.Set("Authorization", "L402 "+macaroonBase64+":"+preimage)
+	if response, err := http.DefaultClient.Do(request); err != nil || response.StatusCode != http.StatusPaymentRequired {
+		t.Errorf("expected: %d but got: %v %v", http.StatusPaymentRequired, response.StatusCode, err)
+	}
+
+	response = get(t, server.URL+"/api/hello", "L402 "+macaroonBase64+":"+strings.Repeat("0", 64))
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected: %d but got: %d", http.StatusBadRequest, response.StatusCode)
+	}
+
+	response = get(t, server.URL+"/other", "")
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("expected: %d but got: %d", http.StatusNotFound, response.StatusCode)
+	}
+}
+
+func TestConfig_Handler(t *testing.T) {
+	tests := map[string]struct {
+		config        string
+		expectedError string
+	}{
+		"no upstreams": {
+			config:        `{"invoices": {"type": "lnd", "url": "http://localhost"}}`,
+			expectedError: "upstreams: at least one upstream is required",
+		},
+		"unknown root key store": {
+			config:        `{"upstreams": [{"path": "/", "target": "http://localhost"}], "root_keys": {"type": "vault"}}`,
+			expectedError: `root_keys.type: unknown store "vault"`,
+		},
+		"file root key store without path": {
+			config:        `{"upstreams": [{"path": "/", "target": "http://localhost"}], "root_keys": {"type": "file"}}`,
+			expectedError: `root_keys.path: required by the file store`,
+		},
+		"unknown invoice backend": {
+			config:        `{"upstreams": [{"path": "/", "target": "http://localhost"}]}`,
+			expectedError: `invoices.type: unknown backend ""`,
+		},
+		"invalid target": {
+			config:        `{"upstreams": [{"path": "/", "target": "localhost"}], "invoices": {"type": "lnd", "url": "http://localhost"}}`,
+			expectedError: `upstreams[0].target: invalid URL "localhost"`,
+		},
+		"invalid pricing": {
+			config:        `{"upstreams": [{"path": "/", "target": "http://localhost"}], "invoices": {"type": "lnd", "url": "http://localhost"}, "pricing": {"default_tier": "gold"}}`,
+			expectedError: `pricing: default_tier: unknown tier "gold"`,
+		},
+		"pricing along with openapi": {
+			config:        `{"upstreams": [{"path": "/", "target": "http://localhost"}], "invoices": {"type": "lnd", "url": "http://localhost"}, "pricing": {"default_tier": "gold"}, "openapi": "openapi.yaml"}`,
+			expectedError: `pricing: can't be set along with openapi`,
+		},
+		"missing openapi document": {
+			config:        `{"upstreams": [{"path": "/", "target": "http://localhost"}], "invoices": {"type": "lnd", "url": "http://localhost"}, "openapi": "/nonexistent/openapi.yaml"}`,
+			expectedError: `openapi: open /nonexistent/openapi.yaml`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			c, err := loadConfig(writeConfig(t, "l402-proxy.json", test.config))
+			if err != nil {
+				t.Fatalf("expected: %v but got: %v", nil, err)
+			}
+
+			_, err = c.handler()
+
+			if !errors.Is(err, errInvalidConfig) || !strings.Contains(err.Error(), test.expectedError) {
+				t.Errorf("expected: %s but got: %v", test.expectedError, err)
+			}
+		})
+	}
+}
+
+func writeConfig(t *testing.T, filename, content string) string {
+	t.Helper()
+	filename = filepath.Join(t.TempDir(), filename)
+	if err := os.WriteFile(filename, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func get(t *testing.T, url, authorization string) *http.Response {
+	t.Helper()
+	request, _ := http.NewRequest(http.MethodGet, url, nil) //nolint:noctx
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+	return response
+}
+
+// fakeLND implements the invoice endpoint of the LND REST API
+type fakeLND struct {
+	*httptest.Server
+	mu        sync.Mutex
+	preimages map[string]string
+	amounts   map[string]string
+}
+
+func newFakeLND() *fakeLND {
+	lnd := &fakeLND{preimages: make(map[string]string), amounts: make(map[string]string)}
+	lnd.Server = httptest.NewServer(http.HandlerFunc(lnd.addInvoice))
+	return lnd
+}
+
+func (f *fakeLND) addInvoice(w http.ResponseWriter, r *http.Request) {
+	var invoiceRequest lndInvoiceRequest
+	if r.Method != http.MethodPost || r.URL.Path != "/v1/invoices" {
+		http.NotFound(w, r)
+		return
+	} else if err := json.NewDecoder(r.Body).Decode(&invoiceRequest); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var preimage [32]byte
+	rand.Read(preimage[:]) //nolint:errcheck
+	paymentHash := sha256.Sum256(preimage[:])
+
+	f.mu.Lock()
+	invoice := fmt.Sprintf("lnbcrt%d", len(f.preimages))
+	f.preimages[invoice] = hex.EncodeToString(preimage[:])
+	f.amounts[invoice] = invoiceRequest.ValueMsat
+	f.mu.Unlock()
+
+	json.NewEncoder(w).Encode(lndInvoiceResponse{ //nolint:errcheck
+		RHash:          base64.StdEncoding.EncodeToString(paymentHash[:]),
+		PaymentRequest: invoice,
+	})
+}
+
+func (f *fakeLND) pay(invoice string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.preimages[invoice]
+}
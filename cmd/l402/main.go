@@ -0,0 +1,304 @@
+// Command l402 inspects, decodes and attenuates L402 tokens
+//
+// Usage:
+//
+//	l402 decode [token]
+//	l402 attenuate -caveat condition=value [-caveat ...] [macaroon]
+//	l402 verify -root-key hex -preimage hex [macaroon]
+//	l402 header -preimage hex [macaroon]
+//
+// The token can be given as an argument or through the standard input, either as a
+// base64 macaroon, as "macaroon:preimage" or as a whole "L402 macaroon:preimage" header value
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/gofeuer/l402"
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+var (
+	errUsage           = errors.New("usage: l402 <decode|attenuate|verify|header> [flags] [token]")
+	errMissingToken    = errors.New("missing token")
+	errMissingPreimage = errors.New("missing preimage")
+	errMissingRootKey  = errors.New("missing root key")
+	errMissingCaveat   = errors.New("missing caveat")
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	command, args := args[0], args[1:]
+	switch command {
+	case "decode":
+		return decode(args, stdin, stdout)
+	case "attenuate":
+		return attenuate(args, stdin, stdout)
+	case "verify":
+		return verify(args, stdin, stdout)
+	case "header":
+		return header(args, stdin, stdout)
+	default:
+		return fmt.Errorf("%w: unknown command %q", errUsage, command)
+	}
+}
+
+type decodedMacaroon struct {
+	MacaroonVersion uint16              `json:"macaroon_version"`
+	Version         uint16              `json:"version"`
+	PaymentHash     string              `json:"payment_hash"`
+	ID              string              `json:"id"`
+	Location        string              `json:"location,omitempty"`
+	Caveats         []string            `json:"caveats"`
+	ThirdParty      []thirdPartyCaveat  `json:"third_party_caveats,omitempty"`
+	Signature       string              `json:"signature"`
+	Verified        *verificationResult `json:"verified,omitempty"`
+}
+
+type thirdPartyCaveat struct {
+	ID       string `json:"id"`
+	Location string `json:"location"`
+}
+
+type verificationResult struct {
+	Preimage  bool   `json:"preimage"`
+	Signature bool   `json:"signature"`
+	Error     string `json:"error,omitempty"`
+}
+
+func decode(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("decode", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	token, _, err := readToken(flags.Args(), stdin)
+	if err != nil {
+		return err
+	}
+
+	return printJSON(stdout, describe(token))
+}
+
+func attenuate(args []string, stdin io.Reader, stdout io.Writer) error {
+	var caveats caveatsFlag
+	flags := flag.NewFlagSet("attenuate", flag.ContinueOnError)
+	flags.Var(&caveats, "caveat", "first-party caveat to add, as condition=value (repeatable)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	} else if len(caveats) == 0 {
+		return errMissingCaveat
+	}
+
+	macaroonBase64, _, err := readRawToken(flags.Args(), stdin)
+	if err != nil {
+		return err
+	}
+
+	// Caveats that widen the access of the token are refused
+	macaroonBase64, err = l402.Attenuate(macaroonBase64, caveats...)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(stdout, macaroonBase64)
+	return err
+}
+
+func verify(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	rootKeyHex := flags.String("root-key", "", "hex encoded root key of the macaroons")
+	preimageHex := flags.String("preimage", "", "hex encoded preimage, if not included in the token")
+	if err := flags.Parse(args); err != nil {
+		return err
+	} else if *rootKeyHex == "" {
+		return errMissingRootKey
+	}
+
+	rootKey, err := hex.DecodeString(*rootKeyHex)
+	if err != nil {
+		return fmt.Errorf("invalid root key: %w", err)
+	}
+
+	token, tokenPreimage, err := readToken(flags.Args(), stdin)
+	if err != nil {
+		return err
+	}
+
+	preimage, err := decodePreimage(*preimageHex, tokenPreimage)
+	if err != nil {
+		return err
+	}
+	paymentHash := l402.Hash(sha256.Sum256(preimage[:]))
+
+	decoded := describe(token)
+	var failed bool
+	for i, identifier := range token.Identifiers {
+		mac := token.Macaroons[identifier]
+		result := &verificationResult{Preimage: identifier.PaymentHash == paymentHash}
+		if _, err := mac.VerifySignature(rootKey, l402.DischargesFor(mac, token.Discharges)); err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Signature = true
+		}
+		failed = failed || !result.Preimage || !result.Signature
+		decoded[i].Verified = result
+	}
+
+	if err := printJSON(stdout, decoded); err != nil {
+		return err
+	} else if failed {
+		return l402.ErrInvalidMacaroon
+	}
+	return nil
+}
+
+func header(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("header", flag.ContinueOnError)
+	preimageHex := flags.String("preimage", "", "hex encoded preimage revealed by paying the invoice")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	token, tokenPreimage, err := readToken(flags.Args(), stdin)
+	if err != nil {
+		return err
+	}
+
+	preimage, err := decodePreimage(*preimageHex, tokenPreimage)
+	if err != nil {
+		return err
+	}
+
+	// The macaroons keep their order, followed by the discharges of their third-party caveats
+	ordered := make([]*macaroon.Macaroon, 0, len(token.Identifiers)+len(token.Discharges))
+	for _, identifier := range token.Identifiers {
+		ordered = append(ordered, token.Macaroons[identifier])
+	}
+	ordered = append(ordered, token.Discharges...)
+
+	macaroonBase64, err := l402.MarshalMacaroons(ordered...)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(stdout, "L402 %s:%s\n", macaroonBase64, hex.EncodeToString(preimage[:]))
+	return err
+}
+
+// readToken reads the macaroons along with their discharges, and the preimage if there is one, from the arguments or the standard input
+func readToken(args []string, stdin io.Reader) (l402.VerifiedToken, string, error) {
+	macaroonBase64, preimageHex, err := readRawToken(args, stdin)
+	if err != nil {
+		return l402.VerifiedToken{}, "", err
+	}
+
+	token, err := l402.UnmarshalOrderedToken(macaroonBase64)
+	if err != nil {
+		return l402.VerifiedToken{}, "", err
+	}
+	return token, preimageHex, nil
+}
+
+// readRawToken splits a token into its base64 macaroons and preimage, without decoding them
+func readRawToken(args []string, stdin io.Reader) (string, string, error) {
+	var token string
+	if len(args) > 0 {
+		token = args[0]
+	} else {
+		line, err := bufio.NewReader(stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", "", err
+		}
+		token = line
+	}
+
+	token = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(token), "L402 "))
+	if token == "" {
+		return "", "", errMissingToken
+	}
+
+	macaroonBase64, preimageHex, _ := strings.Cut(token, ":")
+	return macaroonBase64, preimageHex, nil
+}
+
+func decodePreimage(preimageHex, tokenPreimageHex string) (l402.ByteBlock, error) {
+	if preimageHex == "" {
+		preimageHex = tokenPreimageHex
+	}
+	if preimageHex == "" {
+		return l402.ByteBlock{}, errMissingPreimage
+	}
+
+	var preimage l402.ByteBlock
+	if n, err := hex.Decode(preimage[:], []byte(preimageHex)); err != nil || n != len(preimage) || len(preimageHex) != 2*len(preimage) {
+		return l402.ByteBlock{}, fmt.Errorf("%w: %q", l402.ErrInvalidPreimage, preimageHex)
+	}
+	return preimage, nil
+}
+
+// describe lists the macaroons of a token in its order, the discharges are left out
+func describe(token l402.VerifiedToken) []decodedMacaroon {
+	decoded := make([]decodedMacaroon, 0, len(token.Identifiers))
+	for _, identifier := range token.Identifiers {
+		mac := token.Macaroons[identifier]
+		d := decodedMacaroon{
+			MacaroonVersion: uint16(mac.Version()),
+			Version:         identifier.Version,
+			PaymentHash:     hex.EncodeToString(identifier.PaymentHash[:]),
+			ID:              hex.EncodeToString(identifier.ID[:]),
+			Location:        mac.Location(),
+			Caveats:         []string{},
+			Signature:       hex.EncodeToString(mac.Signature()),
+		}
+		for _, caveat := range mac.Caveats() {
+			if caveat.VerificationId == nil {
+				d.Caveats = append(d.Caveats, string(caveat.Id))
+			} else {
+				d.ThirdParty = append(d.ThirdParty, thirdPartyCaveat{ID: string(caveat.Id), Location: caveat.Location})
+			}
+		}
+		decoded = append(decoded, d)
+	}
+	return decoded
+}
+
+func printJSON(w io.Writer, v any) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+type caveatsFlag []l402.Caveat
+
+func (f *caveatsFlag) String() string {
+	return fmt.Sprint([]l402.Caveat(*f))
+}
+
+func (f *caveatsFlag) Set(value string) error {
+	caveat, err := l402.DecodeCaveat(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, caveat)
+	return nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/gofeuer/l402"
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+var (
+	rootKey  = []byte("root key")
+	preimage = l402.ByteBlock{7}
+)
+
+func newToken(t *testing.T) string {
+	t.Helper()
+	macaroonID, _ := l402.MarchalIdentifier(l402.Identifier{PaymentHash: sha256.Sum256(preimage[:]), ID: l402.ID{1}})
+	mac, _ := macaroon.New(rootKey, macaroonID, "https://example.com", macaroon.V2)
+	l402.AddFirstPartyCaveats(mac, l402.NewCaveat("methods", "GET")) //nolint:errcheck
+	macaroonBase64, err := l402.MarshalMacaroons(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return macaroonBase64
+}
+
+func TestRun_Decode(t *testing.T) {
+	token := newToken(t)
+
+	for name, input := range map[string]struct {
+		args  []string
+		stdin string
+	}{
+		"argument": {args: []string{"decode", token}},
+		"stdin":    {args: []string{"decode"}, stdin: token + "\n"},
+		"header":   {args: []string{"decode", "L402 " + token + ":" + hex.EncodeToString(preimage[:])}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var stdout bytes.Buffer
+			if err := run(input.args, strings.NewReader(input.stdin), &stdout); err != nil {
+				t.Fatalf("expected: %v but got: %v", nil, err)
+			}
+
+			var decoded []decodedMacaroon
+			if err := json.Unmarshal(stdout.Bytes(), &decoded); err != nil || len(decoded) != 1 {
+				t.Fatalf("unexpected output: %s %v", stdout.String(), err)
+			}
+
+			paymentHash := sha256.Sum256(preimage[:])
+			if decoded[0].PaymentHash != hex.EncodeToString(paymentHash[:]) {
+				t.Errorf("expected: %x but got: %s", paymentHash, decoded[0].PaymentHash)
+			}
+
+			if decoded[0].ID != "01"+strings.Repeat("0", 62) {
+				t.Errorf("expected: %s but got: %s", "01"+strings.Repeat("0", 62), decoded[0].ID)
+			}
+
+			if len(decoded[0].Caveats) != 1 || decoded[0].Caveats[0] != "methods=GET" {
+				t.Errorf("expected: %v but got: %v", []string{"methods=GET"}, decoded[0].Caveats)
+			}
+
+			if decoded[0].Location != "https://example.com" || decoded[0].MacaroonVersion != uint16(macaroon.V2) || len(decoded[0].Signature) != 64 {
+				t.Errorf("unexpected macaroon: %+v", decoded[0])
+			}
+		})
+	}
+}
+
+func TestRun_AttenuateAndVerify(t *testing.T) {
+	var attenuated bytes.Buffer
+	if err := run([]string{"attenuate", "-caveat", "path=/videos", "-caveat", "max_bytes=100", newToken(t)}, nil, &attenuated); err != nil {
+		t.Fatalf("expected: %v but got: %v", nil, err)
+	}
+
+	var verified bytes.Buffer
+	args := []string{"verify", "-root-key", hex.EncodeToString(rootKey), "-preimage", hex.EncodeToString(preimage[:])}
+	if err := run(args, strings.NewReader(attenuated.String()), &verified); err != nil {
+		t.Fatalf("expected: %v but got: %v", nil, err)
+	}
+
+	var decoded []decodedMacaroon
+	json.Unmarshal(verified.Bytes(), &decoded) //nolint:errcheck
+	if expected := []string{"methods=GET", "path=/videos", "max_bytes=100"}; len(decoded) != 1 || strings.Join(decoded[0].Caveats, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected: %v but got: %s", expected, verified.String())
+	}
+
+	if result := decoded[0].Verified; result == nil || !result.Preimage || !result.Signature {
+		t.Errorf("expected a verified macaroon but got: %s", verified.String())
+	}
+}
+
+func TestRun_AttenuateWidening(t *testing.T) {
+	err := run([]string{"attenuate", "-caveat", "methods=GET,POST", newToken(t)}, nil, &bytes.Buffer{})
+	if !errors.Is(err, l402.ErrWideningCaveat) {
+		t.Errorf("expected: %v but got: %v", l402.ErrWideningCaveat, err)
+	}
+}
+
+func TestRun_Verify(t *testing.T) {
+	tests := map[string]struct {
+		args          []string
+		expectedError error
+	}{
+		"valid": {
+			args: []string{"-root-key", hex.EncodeToString(rootKey), "-preimage", hex.EncodeToString(preimage[:])},
+		},
+		"wrong root key": {
+			args:          []string{"-root-key", "00", "-preimage", hex.EncodeToString(preimage[:])},
+			expectedError: l402.ErrInvalidMacaroon,
+		},
+		"wrong preimage": {
+			args:          []string{"-root-key", hex.EncodeToString(rootKey), "-preimage", strings.Repeat("0", 64)},
+			expectedError: l402.ErrInvalidMacaroon,
+		},
+		"short preimage": {
+			args:          []string{"-root-key", hex.EncodeToString(rootKey), "-preimage", "00"},
+			expectedError: l402.ErrInvalidPreimage,
+		},
+		"no preimage": {
+			args:          []string{"-root-key", hex.EncodeToString(rootKey)},
+			expectedError: errMissingPreimage,
+		},
+		"no root key": {
+			expectedError: errMissingRootKey,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			args := append(append([]string{"verify"}, test.args...), newToken(t))
+
+			err := run(args, nil, &bytes.Buffer{})
+
+			if !errors.Is(err, test.expectedError) {
+				t.Errorf("expected: %v but got: %v", test.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestRun_Header(t *testing.T) {
+	token := newToken(t)
+	var stdout bytes.Buffer
+
+	if err := run([]string{"header", "-preimage", hex.EncodeToString(preimage[:]), token}, nil, &stdout); err != nil {
+		t.Fatalf("expected: %v but got: %v", nil, err)
+	}
+
+	if expected := "L402 " + token + ":" + hex.EncodeToString(preimage[:]) + "\n"; stdout.String() != expected {
+		t.Errorf("expected: %s but got: %s", expected, stdout.String())
+	}
+}
+
+func TestRun_Discharges(t *testing.T) {
+	// Two macaroons out of ID order, the first one with a third-party caveat and its discharge
+	var macaroons []*macaroon.Macaroon
+	for _, id := range []l402.ID{{2}, {1}} {
+		macaroonID, _ := l402.MarchalIdentifier(l402.Identifier{PaymentHash: sha256.Sum256(preimage[:]), ID: id})
+		mac, _ := macaroon.New(rootKey, macaroonID, "", macaroon.V2)
+		macaroons = append(macaroons, mac)
+	}
+	dischargeKey := []byte("discharge key")
+	macaroons[0].AddThirdPartyCaveat(dischargeKey, []byte("user=alice"), "https://auth.example.com") //nolint:errcheck
+	discharge, _ := macaroon.New(dischargeKey, []byte("user=alice"), "https://auth.example.com", macaroon.V2)
+	discharge.Bind(macaroons[0].Signature())
+
+	token, err := l402.MarshalMacaroons(append(macaroons, discharge)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var header bytes.Buffer
+	if err := run([]string{"header", "-preimage", hex.EncodeToString(preimage[:]), token}, nil, &header); err != nil {
+		t.Fatalf("expected: %v but got: %v", nil, err)
+	}
+	if expected := "L402 " + token + ":" + hex.EncodeToString(preimage[:]) + "\n"; header.String() != expected {
+		t.Errorf("expected: %s but got: %s", expected, header.String())
+	}
+
+	var verified bytes.Buffer
+	if err := run([]string{"verify", "-root-key", hex.EncodeToString(rootKey)}, strings.NewReader(header.String()), &verified); err != nil {
+		t.Fatalf("expected: %v but got: %v %s", nil, err, verified.String())
+	}
+
+	var decoded []decodedMacaroon
+	json.Unmarshal(verified.Bytes(), &decoded) //nolint:errcheck
+	if len(decoded) != 2 || decoded[0].ID != "02"+strings.Repeat("0", 62) || len(decoded[0].ThirdParty) != 1 {
+		t.Errorf("expected the macaroons in the order of the token but got: %s", verified.String())
+	}
+}
+
+func TestRun_Usage(t *testing.T) {
+	for _, args := range [][]string{nil, {"encode"}} {
+		if err := run(args, nil, &bytes.Buffer{}); !errors.Is(err, errUsage) {
+			t.Errorf("expected: %v but got: %v", errUsage, err)
+		}
+	}
+
+	if err := run([]string{"decode"}, strings.NewReader(""), &bytes.Buffer{}); !errors.Is(err, errMissingToken) {
+		t.Errorf("expected: %v but got: %v", errMissingToken, err)
+	}
+
+	if err := run([]string{"attenuate", newToken(t)}, nil, &bytes.Buffer{}); !errors.Is(err, errMissingCaveat) {
+		t.Errorf("expected: %v but got: %v", errMissingCaveat, err)
+	}
+}
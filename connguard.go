@@ -0,0 +1,358 @@
+package l402
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+// ConnectionGuard keeps enforcing access on connections that are hijacked by the API handler, like WebSockets
+// Charges are debited from the ledger account of the token's first identifier, see SortedIdentifiers
+type ConnectionGuard struct {
+	Ledger Ledger
+	// Interval is how often the token is revalidated by the AccessAuthority and charged PricePerInterval
+	Interval         time.Duration
+	PricePerInterval int64
+	// PricePerMessage is charged for every WebSocket message received from the client
+	PricePerMessage int64
+	// CloseTimeout is how long to wait for an outgoing WebSocket frame to complete before closing abruptly
+	CloseTimeout time.Duration
+}
+
+const (
+	defaultGuardCloseTimeout = 5 * time.Second
+	// websocketPolicyViolation is the status code sent in the close frame when access ends
+	websocketPolicyViolation = 1008
+	maxCloseReasonSize       = 123
+)
+
+type guardedResponseWriter struct {
+	http.ResponseWriter
+	guard      ConnectionGuard
+	id         ID
+	websocket  bool
+	revalidate func() error
+}
+
+func (p proxy) guardConnection(w http.ResponseWriter, r *http.Request, macaroons map[Identifier]*macaroon.Macaroon) http.ResponseWriter {
+	// The request context is cancelled once the handler returns, but hijacked connections outlive it
+	// Signatures are verified again, so revoking a root key ends the connections of its tokens
+	revalidationRequest := r.WithContext(context.WithValue(context.WithoutCancel(r.Context()), KeySignatureVerified, false))
+
+	return &guardedResponseWriter{
+		ResponseWriter: w,
+		guard:          *p.connectionGuard,
+		id:             SortedIdentifiers(macaroons)[0].ID,
+		websocket:      strings.EqualFold(r.Header.Get("Upgrade"), "websocket"),
+		revalidate: func() error {
+			return p.accessAuthority.ApproveAccess(revalidationRequest, macaroons)
+		},
+	}
+}
+
+func (g *guardedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(g.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Bytes already buffered by the server must be metered as well
+	var reader io.Reader = conn
+	if buffered := rw.Reader.Buffered(); buffered > 0 {
+		peeked, _ := rw.Reader.Peek(buffered)
+		reader = io.MultiReader(bytes.NewReader(bytes.Clone(peeked)), conn)
+	}
+
+	guarded := &guardedConn{
+		Conn:       conn,
+		reader:     reader,
+		guard:      g.guard,
+		id:         g.id,
+		websocket:  g.websocket,
+		revalidate: g.revalidate,
+		done:       make(chan struct{}),
+	}
+	if guarded.guard.CloseTimeout <= 0 {
+		guarded.guard.CloseTimeout = defaultGuardCloseTimeout
+	}
+
+	if guarded.guard.Interval > 0 {
+		go guarded.watch()
+	}
+
+	return guarded, bufio.NewReadWriter(bufio.NewReader(guarded), bufio.NewWriter(guarded)), nil
+}
+
+func (g *guardedResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+type guardedConn struct {
+	net.Conn
+	reader     io.Reader
+	guard      ConnectionGuard
+	id         ID
+	websocket  bool
+	revalidate func() error
+
+	incoming frameParser
+
+	writeMu sync.Mutex
+	// handshake counts the matched bytes of the blank line that ends the 101 Switching Protocols response
+	handshake    int
+	outgoing     frameParser
+	pendingClose error
+	closed       bool
+
+	endOnce sync.Once
+	done    chan struct{}
+}
+
+func (c *guardedConn) watch() {
+	ticker := time.NewTicker(c.guard.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.revalidate(); err != nil {
+				c.end(err)
+				return
+			}
+			if err := c.charge(c.guard.PricePerInterval); err != nil {
+				c.end(err)
+				return
+			}
+		}
+	}
+}
+
+func (c *guardedConn) charge(amount int64) error {
+	if amount <= 0 || c.guard.Ledger == nil {
+		return nil
+	}
+	_, err := c.guard.Ledger.Debit(context.Background(), c.id, amount)
+	return err
+}
+
+func (c *guardedConn) Read(b []byte) (int, error) {
+	n, err := c.reader.Read(b)
+
+	if c.websocket && c.guard.PricePerMessage > 0 {
+		var chargeErr error
+		c.incoming.feed(b[:n], false, func(fin bool, opcode byte) {
+			// A message is complete when its final data frame arrives, control frames are free
+			if fin && opcode < websocketOpcodeClose && chargeErr == nil {
+				chargeErr = c.charge(c.guard.PricePerMessage)
+			}
+		})
+		if chargeErr != nil {
+			c.end(chargeErr)
+		}
+	}
+
+	return n, err
+}
+
+func (c *guardedConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closed {
+		return 0, net.ErrClosed
+	} else if !c.websocket {
+		return c.Conn.Write(b)
+	}
+
+	// The handler writes the handshake response on the hijacked connection before the first frame
+	written := 0
+	if c.handshake < len(endOfHeader) {
+		written = c.skipHandshake(b)
+		if n, err := c.Conn.Write(b[:written]); err != nil {
+			return n, err
+		}
+	}
+
+	// While a close is pending, only the rest of the current frame is written
+	stopAtBoundary := c.pendingClose != nil
+	consumed := written + c.outgoing.feed(b[written:], stopAtBoundary, nil)
+
+	n, err := c.Conn.Write(b[written:consumed])
+	n += written
+	if err != nil {
+		return n, err
+	}
+
+	if c.pendingClose != nil && c.outgoing.atBoundary() {
+		c.closeLocked(c.pendingClose)
+	}
+
+	if n < len(b) {
+		return n, net.ErrClosed
+	}
+	return n, nil
+}
+
+const endOfHeader = "\r\n\r\n"
+
+// skipHandshake returns how many bytes of b belong to the handshake response
+func (c *guardedConn) skipHandshake(b []byte) int {
+	for i, char := range b {
+		if char == endOfHeader[c.handshake] {
+			c.handshake++
+		} else if char == '\r' {
+			c.handshake = 1
+		} else {
+			c.handshake = 0
+		}
+
+		if c.handshake == len(endOfHeader) {
+			return i + 1
+		}
+	}
+	return len(b)
+}
+
+func (c *guardedConn) Close() error {
+	c.endOnce.Do(func() { close(c.done) })
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.Conn.Close()
+}
+
+// end closes the connection once access is no longer granted
+// WebSocket clients get a close frame with the reason, sent between two outgoing frames
+func (c *guardedConn) end(reason error) {
+	c.endOnce.Do(func() {
+		close(c.done)
+
+		c.writeMu.Lock()
+		defer c.writeMu.Unlock()
+
+		if c.closed {
+			return
+		} else if !c.websocket || c.handshake < len(endOfHeader) || c.outgoing.atBoundary() {
+			c.closeLocked(reason)
+			return
+		}
+
+		c.pendingClose = reason
+		time.AfterFunc(c.guard.CloseTimeout, func() {
+			c.writeMu.Lock()
+			defer c.writeMu.Unlock()
+			if !c.closed {
+				c.closed = true
+				c.Conn.Close()
+			}
+		})
+	})
+}
+
+func (c *guardedConn) closeLocked(reason error) {
+	if c.websocket && c.handshake == len(endOfHeader) {
+		c.Conn.Write(websocketCloseFrame(websocketPolicyViolation, reason.Error())) //nolint:errcheck
+	}
+	c.closed = true
+	c.Conn.Close()
+}
+
+const websocketOpcodeClose = 0x8
+
+func websocketCloseFrame(status uint16, reason string) []byte {
+	if len(reason) > maxCloseReasonSize {
+		reason = reason[:maxCloseReasonSize]
+	}
+	frame := make([]byte, 4, 4+len(reason))
+	frame[0] = 0x80 | websocketOpcodeClose // FIN bit and close opcode
+	frame[1] = byte(2 + len(reason))
+	binary.BigEndian.PutUint16(frame[2:], status)
+	return append(frame, reason...)
+}
+
+// frameParser follows the frame boundaries of a WebSocket stream without buffering the payloads
+type frameParser struct {
+	header     [14]byte
+	headerSize int // bytes of the current header received so far
+	remaining  uint64
+}
+
+func (p *frameParser) atBoundary() bool {
+	return p.headerSize == 0 && p.remaining == 0
+}
+
+// feed consumes a chunk of the stream and calls onFrame for every frame header that is completed
+// If stopAtBoundary is set, it stops at the end of the current frame and returns how many bytes were consumed
+func (p *frameParser) feed(b []byte, stopAtBoundary bool, onFrame func(fin bool, opcode byte)) int {
+	consumed := 0
+	for consumed < len(b) {
+		if p.remaining > 0 {
+			skip := min(p.remaining, uint64(len(b)-consumed))
+			p.remaining -= skip
+			consumed += int(skip)
+		} else {
+			if stopAtBoundary && p.headerSize == 0 {
+				return consumed
+			}
+			p.header[p.headerSize] = b[consumed]
+			p.headerSize++
+			consumed++
+			p.completeHeader(onFrame)
+		}
+
+		if stopAtBoundary && p.atBoundary() {
+			return consumed
+		}
+	}
+	return consumed
+}
+
+func (p *frameParser) completeHeader(onFrame func(fin bool, opcode byte)) {
+	if p.headerSize < 2 {
+		return
+	}
+
+	size := 2
+	payloadSize := uint64(p.header[1] & 0x7f)
+	switch payloadSize {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if p.header[1]&0x80 != 0 {
+		size += 4 // masking key
+	}
+	if p.headerSize < size {
+		return
+	}
+
+	switch payloadSize {
+	case 126:
+		payloadSize = uint64(binary.BigEndian.Uint16(p.header[2:]))
+	case 127:
+		payloadSize = binary.BigEndian.Uint64(p.header[2:])
+	}
+
+	if onFrame != nil {
+		onFrame(p.header[0]&0x80 != 0, p.header[0]&0x0f)
+	}
+	p.headerSize = 0
+	p.remaining = payloadSize
+}
@@ -0,0 +1,290 @@
+package l402
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1" //nolint:gosec
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+func TestConnectionGuard_PerMessage(t *testing.T) {
+	id := ID{1}
+	ledger := MemoryLedger()
+	ledger.Credit(context.Background(), id, 20) //nolint:errcheck
+
+	accessAuthority := mockAccessAuthority{func(*http.Request, map[Identifier]*macaroon.Macaroon) Rejection {
+		return nil // access approved
+	}}
+	handler := Proxy(nil, accessAuthority, WithConnectionGuard(ConnectionGuard{
+		Ledger:          ledger,
+		PricePerMessage: 10,
+	}))(http.HandlerFunc(websocketEcho))
+
+	conn, reader := dialWebsocket(t, handler, id)
+
+	for _, message := range []string{"first", "second"} {
+		writeFrame(conn, 0x1, []byte(message), true) //nolint:errcheck
+		opcode, payload, err := readFrame(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opcode != 0x1 || string(payload) != message {
+			t.Errorf("expected: %s but got: %s", message, payload)
+		}
+	}
+
+	// The balance is used up, so the third message closes the connection
+	writeFrame(conn, 0x1, []byte("third"), true) //nolint:errcheck
+	assertPolicyViolation(t, reader, ErrInsufficientBalance.Error())
+
+	if balance, _ := ledger.Balance(context.Background(), id); balance != 0 {
+		t.Errorf("expected: %d but got: %d", 0, balance)
+	}
+}
+
+func TestConnectionGuard_Revalidation(t *testing.T) {
+	var approvals atomic.Int32
+	accessAuthority := mockAccessAuthority{func(*http.Request, map[Identifier]*macaroon.Macaroon) Rejection {
+		// The upgrade request and the first revalidation are approved, then the token expires
+		if approvals.Add(1) > 2 {
+			return errExpired
+		}
+		return nil
+	}}
+	handler := Proxy(nil, accessAuthority, WithConnectionGuard(ConnectionGuard{
+		Interval: 10 * time.Millisecond,
+	}))(http.HandlerFunc(websocketEcho))
+
+	_, reader := dialWebsocket(t, handler, ID{1})
+
+	assertPolicyViolation(t, reader, errExpired.Error())
+}
+
+func TestFrameParser(t *testing.T) {
+	var stream []byte
+	for _, size := range []int{5, 200, 70000} {
+		var frame strings.Builder
+		writeFrame(&frame, 0x2, make([]byte, size), true) //nolint:errcheck
+		stream = append(stream, frame.String()...)
+	}
+
+	var parser frameParser
+	var frames int
+
+	// Feed the stream in small chunks that split the headers
+	for chunk := range slices.Chunk(stream, 3) {
+		parser.feed(chunk, false, func(fin bool, opcode byte) {
+			frames++
+			if !fin || opcode != 0x2 {
+				t.Errorf("unexpected frame: fin %v opcode %d", fin, opcode)
+			}
+		})
+	}
+
+	if frames != 3 || !parser.atBoundary() {
+		t.Errorf("expected: %d frames but got: %d", 3, frames)
+	}
+
+	// A pending close only lets the rest of the current frame through
+	var outgoing frameParser
+	if consumed := outgoing.feed(stream[:10], false, nil); consumed != 10 {
+		t.Errorf("expected: %d but got: %d", 10, consumed)
+	}
+	if consumed := outgoing.feed(stream[10:], true, nil); consumed != 1 {
+		t.Errorf("expected: %d but got: %d", 1, consumed)
+	}
+}
+
+func assertPolicyViolation(t *testing.T, reader *bufio.Reader, expectedReason string) {
+	t.Helper()
+
+	opcode, payload, err := readFrame(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opcode != websocketOpcodeClose || len(payload) < 2 {
+		t.Fatalf("expected a close frame but got opcode: %d", opcode)
+	}
+
+	if status := binary.BigEndian.Uint16(payload); status != websocketPolicyViolation {
+		t.Errorf("expected: %d but got: %d", websocketPolicyViolation, status)
+	}
+
+	if reason := string(payload[2:]); reason != expectedReason {
+		t.Errorf("expected: %s but got: %s", expectedReason, reason)
+	}
+
+	if _, err := reader.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Errorf("expected: %v but got: %v", io.EOF, err)
+	}
+}
+
+func dialWebsocket(t *testing.T, handler http.Handler, id ID) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	preimage := Hash{}
+	macaroonID, _ := MarchalIdentifier(Identifier{PaymentHash: sha256.Sum256(preimage[:]), ID: id})
+	mac, _ := macaroon.New([]byte{1}, macaroonID, "", macaroon.V2)
+	macaroonBase64, _ := MarshalMacaroons(mac)
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+
+	r, _ := http.NewRequest("GET", server.URL+"/feed", nil)
+	r.Header.Set("Authorization", "L402 "+macaroonBase64+":"+hex.EncodeToString(preimage[:]))
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	if err := r.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected: %d but got: %d", http.StatusSwitchingProtocols, resp.StatusCode)
+	}
+
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected Sec-WebSocket-Accept: %s", accept)
+	}
+
+	return conn, reader
+}
+
+// websocketEcho is a minimal WebSocket server that echoes every frame back
+func websocketEcho(w http.ResponseWriter, r *http.Request) {
+	accept := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11")) //nolint:gosec
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")  //nolint:errcheck
+	rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n\r\n") //nolint:errcheck
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	for {
+		opcode, payload, err := readFrame(rw.Reader)
+		if err != nil || opcode == websocketOpcodeClose {
+			return
+		}
+		if err := writeFrame(rw, opcode, payload, false); err != nil {
+			return
+		}
+		if err := rw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	size := uint64(header[1] & 0x7f)
+	switch size {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(r, extended[:]); err != nil {
+			return 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(r, extended[:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(extended[:])
+	}
+
+	var mask [4]byte
+	masked := header[1]&0x80 != 0
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	return header[0] & 0x0f, payload, nil
+}
+
+// writeFrame writes a single final frame, clients must mask their frames
+func writeFrame(w io.Writer, opcode byte, payload []byte, masked bool) error {
+	frame := []byte{0x80 | opcode}
+
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+
+	switch size := len(payload); {
+	case size < 126:
+		frame = append(frame, maskBit|byte(size))
+	case size <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(size))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(size))
+	}
+
+	if masked {
+		mask := [4]byte{1, 2, 3, 4}
+		frame = append(frame, mask[:]...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	_, err := w.Write(frame)
+	return err
+}
@@ -0,0 +1,125 @@
+package l402
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+type ConsumeStore interface {
+	// Consume marks the payment hashes of a token as spent, all of them or none
+	// It fails with ErrTokenSpent if any of them was spent already
+	Consume(ctx context.Context, paymentHashes ...Hash) error
+	// Release puts back payment hashes consumed for a request that was turned down before it was served
+	Release(ctx context.Context, paymentHashes ...Hash) error
+}
+
+type memoryConsumeStore struct {
+	mu       sync.Mutex
+	consumed map[Hash]time.Time
+	ttl      time.Duration
+	sweepAt  time.Time
+	now      func() time.Time
+}
+
+// MemoryConsumeStore remembers spent payment hashes for ttl
+// The ttl must outlast the tokens, a payment hash forgotten while its token is still valid can be spent again
+func MemoryConsumeStore(ttl time.Duration) *memoryConsumeStore {
+	return &memoryConsumeStore{
+		consumed: make(map[Hash]time.Time),
+		ttl:      ttl,
+		now:      time.Now,
+	}
+}
+
+func (s *memoryConsumeStore) Consume(_ context.Context, paymentHashes ...Hash) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	for _, paymentHash := range paymentHashes {
+		if expires, found := s.consumed[paymentHash]; found && now.Before(expires) {
+			return fmt.Errorf("%w: %x", ErrTokenSpent, paymentHash)
+		}
+	}
+
+	for _, paymentHash := range paymentHashes {
+		s.consumed[paymentHash] = now.Add(s.ttl)
+	}
+	return nil
+}
+
+func (s *memoryConsumeStore) Release(_ context.Context, paymentHashes ...Hash) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, paymentHash := range paymentHashes {
+		delete(s.consumed, paymentHash)
+	}
+	return nil
+}
+
+// sweep forgets the expired payment hashes, at most once per ttl
+func (s *memoryConsumeStore) sweep(now time.Time) {
+	if now.Before(s.sweepAt) {
+		return
+	}
+	for paymentHash, expires := range s.consumed {
+		if !now.Before(expires) {
+			delete(s.consumed, paymentHash)
+		}
+	}
+	s.sweepAt = now.Add(s.ttl)
+}
+
+// spentToken is what spend consumed for a request
+type spentToken struct {
+	credits, payments []Hash
+}
+
+// spend consumes the token of an approved request
+// Credits are redeemed once when refunds are enabled, and payments are consumed once in single-use mode
+func (p proxy) spend(ctx context.Context, macaroons map[Identifier]*macaroon.Macaroon) (spentToken, error) {
+	var credits, payments []Hash
+	for _, identifier := range SortedIdentifiers(macaroons) {
+		// A credit is keyed by the ID of the payment it stands for, so each payment is credited or refunded once
+		if creditFor, isCredit := credit(macaroons[identifier]); isCredit && p.refunds != nil {
+			credits = append(credits, Hash(creditFor))
+		} else if p.consumeStore != nil {
+			payments = append(payments, identifier.PaymentHash)
+		}
+	}
+
+	var spent spentToken
+	if len(credits) > 0 {
+		if err := p.refunds.Credits.Consume(ctx, credits...); err != nil {
+			return spentToken{}, err
+		}
+		spent.credits = credits
+	}
+	if len(payments) > 0 {
+		if err := p.consumeStore.Consume(ctx, payments...); err != nil {
+			return spentToken{}, errors.Join(err, p.release(ctx, spent))
+		}
+		spent.payments = payments
+	}
+	return spent, nil
+}
+
+// release puts back what spend consumed, for a request turned down before reaching the API handler
+func (p proxy) release(ctx context.Context, spent spentToken) error {
+	var err error
+	if len(spent.credits) > 0 {
+		err = p.refunds.Credits.Release(ctx, spent.credits...)
+	}
+	if len(spent.payments) > 0 {
+		err = errors.Join(err, p.consumeStore.Release(ctx, spent.payments...))
+	}
+	return err
+}
@@ -0,0 +1,183 @@
+package l402
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMemoryConsumeStore(t *testing.T) {
+	now := time.Now()
+	store := MemoryConsumeStore(time.Hour)
+	store.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	if err := store.Consume(ctx, Hash{1}); err != nil {
+		t.Errorf("expected: %v but got: %v", nil, err)
+	}
+
+	if err := store.Consume(ctx, Hash{2}, Hash{1}); !errors.Is(err, ErrTokenSpent) {
+		t.Errorf("expected: %v but got: %v", ErrTokenSpent, err)
+	}
+
+	// Nothing is consumed when any payment hash was spent already
+	if err := store.Consume(ctx, Hash{2}); err != nil {
+		t.Errorf("expected: %v but got: %v", nil, err)
+	}
+
+	now = now.Add(time.Hour)
+	if err := store.Consume(ctx, Hash{1}); err != nil {
+		t.Errorf("expected: %v but got: %v", nil, err)
+	}
+
+	if len(store.consumed) != 1 {
+		t.Errorf("expected: %d but got: %d", 1, len(store.consumed))
+	}
+}
+
+func TestMemoryConsumeStore_Concurrent(t *testing.T) {
+	store := MemoryConsumeStore(time.Hour)
+
+	var wg sync.WaitGroup
+	var consumed atomic.Int32
+	for range 100 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if store.Consume(context.Background(), Hash{1}) == nil {
+				consumed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if consumed.Load() != 1 {
+		t.Errorf("expected: %d but got: %d", 1, consumed.Load())
+	}
+}
+
+func TestWithSingleUse(t *testing.T) {
+	rootKeys := MemoryRootKeyStore()
+	invoices := &preimageInvoiceProvider{}
+	minter := Minter(invoices, rootKeys, FixedPrice(1000))
+
+	var served atomic.Int32
+	handler := Proxy(minter, Authority(rootKeys), WithSingleUse(MemoryConsumeStore(time.Hour)))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			served.Add(1)
+		}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	token := challengedToken(t, w, invoices)
+
+	// Concurrent replays of the token are served only once
+	responses := make([]*httptest.ResponseRecorder, 20)
+	var wg sync.WaitGroup
+	for i := range responses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i] = httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Authorization", token)
+			handler.ServeHTTP(responses[i], r)
+		}()
+	}
+	wg.Wait()
+
+	if served.Load() != 1 {
+		t.Errorf("expected: %d but got: %d", 1, served.Load())
+	}
+
+	for _, w := range responses {
+		if w.Code == http.StatusOK {
+			continue
+		} else if w.Code != http.StatusPaymentRequired {
+			t.Errorf("expected: %d but got: %d", http.StatusPaymentRequired, w.Code)
+		} else if !strings.Contains(w.Body.String(), ErrTokenSpent.Error()) {
+			t.Errorf("expected: %q but got: %q", ErrTokenSpent, w.Body.String())
+		} else if w.Header().Get("WWW-Authenticate") == "" {
+			t.Error("expected a fresh challenge")
+		}
+	}
+}
+
+// throttleOnce throttles the first request only
+type throttleOnce struct {
+	throttled atomic.Bool
+}
+
+func (l *throttleOnce) Allow(map[ID]Rate) (time.Duration, bool) {
+	return time.Second, l.throttled.Swap(true)
+}
+
+func TestWithSingleUse_Throttled(t *testing.T) {
+	rootKeys := MemoryRootKeyStore()
+	invoices := &preimageInvoiceProvider{}
+	minter := Minter(invoices, rootKeys, FixedPrice(1000))
+
+	handler := Proxy(minter, Authority(rootKeys), WithSingleUse(MemoryConsumeStore(time.Hour)), WithRateLimiter(&throttleOnce{}))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	token := challengedToken(t, w, invoices)
+
+	// A throttled request doesn't spend the token
+	for _, expectedStatus := range []int{http.StatusTooManyRequests, http.StatusOK, http.StatusPaymentRequired} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", token)
+		handler.ServeHTTP(w, r)
+
+		if w.Code != expectedStatus {
+			t.Errorf("expected: %d but got: %d", expectedStatus, w.Code)
+		}
+	}
+}
+
+func TestWithSingleUse_InsufficientBalance(t *testing.T) {
+	rootKeys := MemoryRootKeyStore()
+	invoices := &preimageInvoiceProvider{}
+	invoiceStore := MemoryInvoiceStore()
+	ledger := MemoryLedger()
+	minter := AccountMinter(RecordInvoices(invoices, invoiceStore), rootKeys, 1000)
+
+	handler := Proxy(minter, Authority(rootKeys), WithSingleUse(MemoryConsumeStore(time.Hour)), WithAccounts(ledger, invoiceStore, FixedPrice(2000)))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	token := challengedToken(t, w, invoices)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", token)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusPaymentRequired {
+		t.Errorf("expected: %d but got: %d", http.StatusPaymentRequired, w.Code)
+	}
+
+	// The account is topped up out of band, and the token that was turned down is still good
+	macaroonBase64, _, _ := strings.Cut(strings.TrimPrefix(token, "L402 "), ":")
+	macaroons, _, err := UnmarshalToken(macaroonBase64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ledger.Deposit(context.Background(), SortedIdentifiers(macaroons)[0].ID, Hash{0xff}, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected: %d but got: %d", http.StatusOK, w.Code)
+	}
+}
@@ -0,0 +1,75 @@
+package l402
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+const masterFingerprintSize = 4
+
+var errNoMaster = errors.New("no master secret")
+
+type derivedRootKeys struct {
+	masters map[[masterFingerprintSize]byte][]byte
+	current [masterFingerprintSize]byte
+}
+
+// DerivedRootKeys is a RootKeyStore that needs no storage, the root key of a macaroon is HMAC-SHA256(master, Identifier.ID)
+// New macaroons are derived from the first master, the others keep verifying the macaroons minted before a rotation
+// Every ID starts with the first 4 bytes of the SHA-256 of its master, so it's verified without trying every master
+// Masters must be at least BlockSize bytes long
+func DerivedRootKeys(masters ...[]byte) (derivedRootKeys, error) {
+	if len(masters) == 0 {
+		return derivedRootKeys{}, errNoMaster
+	}
+
+	d := derivedRootKeys{masters: make(map[[masterFingerprintSize]byte][]byte)}
+	for i, master := range masters {
+		if len(master) < BlockSize {
+			return derivedRootKeys{}, fmt.Errorf("master %d: %w", i, errShortSecret)
+		}
+
+		fingerprint := masterFingerprint(master)
+		if _, found := d.masters[fingerprint]; found {
+			return derivedRootKeys{}, fmt.Errorf("master %d: duplicate fingerprint %x", i, fingerprint)
+		}
+		d.masters[fingerprint] = bytes.Clone(master)
+	}
+	d.current = masterFingerprint(masters[0])
+
+	return d, nil
+}
+
+func (d derivedRootKeys) NewRootKey(context.Context) (ID, []byte, error) {
+	var id ID
+	copy(id[:], d.current[:])
+	if _, err := rand.Read(id[masterFingerprintSize:]); err != nil {
+		return ID{}, nil, err
+	}
+
+	return id, hmacRootKey(d.masters[d.current], id), nil
+}
+
+func (d derivedRootKeys) RootKey(_ context.Context, id ID) ([]byte, error) {
+	master, found := d.masters[[masterFingerprintSize]byte(id[:masterFingerprintSize])]
+	if !found {
+		return nil, ErrUnknownRootKey
+	}
+	return hmacRootKey(master, id), nil
+}
+
+func masterFingerprint(master []byte) [masterFingerprintSize]byte {
+	digest := sha256.Sum256(master)
+	return [masterFingerprintSize]byte(digest[:masterFingerprintSize])
+}
+
+func hmacRootKey(master []byte, id ID) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write(id[:])
+	return mac.Sum(nil)
+}
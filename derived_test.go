@@ -0,0 +1,98 @@
+package l402
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestDerivedRootKeys_Vectors(t *testing.T) {
+	tests := map[string]struct {
+		master          []byte
+		id              string
+		expectedRootKey string
+	}{
+		"repeated byte master": {
+			master:          bytes.Repeat([]byte{1}, BlockSize),
+			id:              "72cd6e84000102030405060708090a0b0c0d0e0f101112131415161718191a1b",
+			expectedRootKey: "58c4aa6e60d3d3b4529faf11380d4f86ae1bb5190c8fd8131227d4e3d592d013",
+		},
+		"passphrase master": {
+			master:          []byte("correct horse battery staple, 32b"),
+			id:              "5db7dd36000102030405060708090a0b0c0d0e0f101112131415161718191a1b",
+			expectedRootKey: "412e3b6ea8785501427b21b363d646311e096a9d210001f2020357800d9efaa2",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			rootKeys, err := DerivedRootKeys(test.master)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var id ID
+			hex.Decode(id[:], []byte(test.id)) //nolint:errcheck
+
+			rootKey, err := rootKeys.RootKey(context.Background(), id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if hex.EncodeToString(rootKey) != test.expectedRootKey {
+				t.Errorf("expected: %s but got: %x", test.expectedRootKey, rootKey)
+			}
+		})
+	}
+}
+
+func TestDerivedRootKeys_Rotation(t *testing.T) {
+	ctx := context.Background()
+	oldMaster := bytes.Repeat([]byte{1}, BlockSize)
+	newMaster := bytes.Repeat([]byte{2}, BlockSize)
+
+	before, _ := DerivedRootKeys(oldMaster)
+	oldID, oldRootKey, _ := before.NewRootKey(ctx)
+
+	after, err := DerivedRootKeys(newMaster, oldMaster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newID, newRootKey, _ := after.NewRootKey(ctx)
+
+	if masterFingerprint(newMaster) != [masterFingerprintSize]byte(newID[:masterFingerprintSize]) {
+		t.Errorf("expected: %x but got: %x", masterFingerprint(newMaster), newID[:masterFingerprintSize])
+	}
+
+	for id, expectedRootKey := range map[ID][]byte{oldID: oldRootKey, newID: newRootKey} {
+		if rootKey, _ := after.RootKey(ctx, id); !bytes.Equal(rootKey, expectedRootKey) {
+			t.Errorf("expected: %x but got: %x", expectedRootKey, rootKey)
+		}
+	}
+
+	if _, err := before.RootKey(ctx, newID); !errors.Is(err, ErrUnknownRootKey) {
+		t.Errorf("expected: %v but got: %v", ErrUnknownRootKey, err)
+	}
+}
+
+func TestDerivedRootKeys_InvalidMasters(t *testing.T) {
+	master := bytes.Repeat([]byte{1}, BlockSize)
+
+	tests := map[string]struct {
+		masters       [][]byte
+		expectedError error
+	}{
+		"no master":    {expectedError: errNoMaster},
+		"short master": {masters: [][]byte{master, []byte("short")}, expectedError: errShortSecret},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := DerivedRootKeys(test.masters...); !errors.Is(err, test.expectedError) {
+				t.Errorf("expected: %v but got: %v", test.expectedError, err)
+			}
+		})
+	}
+}
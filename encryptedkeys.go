@@ -0,0 +1,311 @@
+package l402
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// KeyEncryptionKey is an AES-256 key that encrypts root keys at rest, its ID tells which key sealed each root key
+type KeyEncryptionKey struct {
+	ID  string
+	Key []byte
+}
+
+// SealedRootKeyStore keeps the sealed root keys of EncryptedRootKeys as opaque values, so any backend can encrypt them at rest
+type SealedRootKeyStore interface {
+	// SaveSealedRootKey stores the sealed root key of an ID, replacing the previous one
+	SaveSealedRootKey(ctx context.Context, id ID, sealed []byte) error
+	// SealedRootKey returns the sealed root key of an ID, or ErrUnknownRootKey
+	SealedRootKey(ctx context.Context, id ID) ([]byte, error)
+	// SealedRootKeyIDs lists the IDs of every sealed root key, so they can be rewrapped
+	SealedRootKeyIDs(ctx context.Context) ([]ID, error)
+}
+
+var (
+	errInvalidKEK = errors.New("invalid key encryption key")
+	errUnknownKEK = errors.New("unknown key encryption key")
+	errTruncated  = errors.New("truncated root key")
+)
+
+type sealedRootKey struct {
+	KEK    string `json:"kek"`
+	Sealed []byte `json:"sealed"` // the nonce followed by the AES-256-GCM ciphertext, authenticating the ID
+}
+
+type encryptedRootKeys struct {
+	store SealedRootKeyStore
+	kek   string
+	aeads map[string]cipher.AEAD
+}
+
+// EncryptedRootKeys is a RootKeyStore whose root keys are sealed with AES-256-GCM under a key encryption key before they're stored
+// New root keys are sealed with kek, the previous keys only open the root keys that weren't rewrapped yet, see Rewrap
+// Each root key is sealed along with its ID, so records swapped in the store fail to open
+func EncryptedRootKeys(store SealedRootKeyStore, kek KeyEncryptionKey, previous ...KeyEncryptionKey) (encryptedRootKeys, error) {
+	e := encryptedRootKeys{
+		store: store,
+		kek:   kek.ID,
+		aeads: make(map[string]cipher.AEAD),
+	}
+
+	for _, k := range append([]KeyEncryptionKey{kek}, previous...) {
+		if _, found := e.aeads[k.ID]; found || k.ID == "" || len(k.Key) != BlockSize {
+			return encryptedRootKeys{}, fmt.Errorf("%w: %q", errInvalidKEK, k.ID)
+		}
+		block, err := aes.NewCipher(k.Key)
+		if err != nil {
+			return encryptedRootKeys{}, err
+		}
+		if e.aeads[k.ID], err = cipher.NewGCM(block); err != nil {
+			return encryptedRootKeys{}, err
+		}
+	}
+
+	return e, nil
+}
+
+// EncryptedFileRootKeyStore keeps the root keys of EncryptedRootKeys in a JSON lines file, every sealed key is appended to it and synced
+// Opening the file fails if a root key was sealed with a key encryption key that isn't given
+func EncryptedFileRootKeyStore(filename string, kek KeyEncryptionKey, previous ...KeyEncryptionKey) (encryptedRootKeys, error) {
+	store, err := openFileSealedRootKeyStore(filename)
+	if err != nil {
+		return encryptedRootKeys{}, err
+	}
+
+	e, err := EncryptedRootKeys(store, kek, previous...)
+	if err != nil {
+		return encryptedRootKeys{}, err
+	}
+
+	for id, value := range store.sealed {
+		if _, err := e.decode(id, value); err != nil {
+			return encryptedRootKeys{}, fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+
+	return e, nil
+}
+
+func (e encryptedRootKeys) NewRootKey(ctx context.Context) (ID, []byte, error) {
+	id, rootKey, err := newRandomRootKey()
+	if err != nil {
+		return ID{}, nil, err
+	}
+
+	sealed, err := e.seal(id, rootKey)
+	if err != nil {
+		return ID{}, nil, err
+	}
+
+	if err := e.store.SaveSealedRootKey(ctx, id, sealed); err != nil {
+		return ID{}, nil, err
+	}
+	return id, rootKey, nil
+}
+
+func (e encryptedRootKeys) RootKey(ctx context.Context, id ID) ([]byte, error) {
+	value, err := e.store.SealedRootKey(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := e.decode(id, value)
+	if err != nil {
+		return nil, err
+	}
+	return e.open(id, sealed)
+}
+
+// DeleteRootKey forgets a root key, if the sealed root key store can delete it
+// Stores without a DeleteSealedRootKey method give errors.ErrUnsupported, which callers treat as a key that stays stored
+func (e encryptedRootKeys) DeleteRootKey(ctx context.Context, id ID) error {
+	if deleter, ok := e.store.(interface {
+		DeleteSealedRootKey(context.Context, ID) error
+	}); ok {
+		return deleter.DeleteSealedRootKey(ctx, id)
+	}
+	return errors.ErrUnsupported
+}
+
+// Rewrap seals every root key with the current key encryption key, so the previous ones can be discarded
+// Each root key is replaced on its own, a failed Rewrap can be run again
+func (e encryptedRootKeys) Rewrap(ctx context.Context) error {
+	ids, err := e.store.SealedRootKeyIDs(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		value, err := e.store.SealedRootKey(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		sealed, err := e.decode(id, value)
+		if err != nil {
+			return err
+		} else if sealed.KEK == e.kek {
+			continue
+		}
+
+		rootKey, err := e.open(id, sealed)
+		if err != nil {
+			return err
+		}
+		if value, err = e.seal(id, rootKey); err != nil {
+			return err
+		}
+		if err := e.store.SaveSealedRootKey(ctx, id, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e encryptedRootKeys) seal(id ID, rootKey []byte) ([]byte, error) {
+	aead := e.aeads[e.kek]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(rootKey)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealedRootKey{KEK: e.kek, Sealed: aead.Seal(nonce, nonce, rootKey, id[:])})
+}
+
+// decode parses a stored root key and checks that its key encryption key is known
+func (e encryptedRootKeys) decode(id ID, value []byte) (sealedRootKey, error) {
+	var sealed sealedRootKey
+	if err := json.Unmarshal(value, &sealed); err != nil {
+		return sealedRootKey{}, fmt.Errorf("%x: %w", id, err)
+	} else if _, found := e.aeads[sealed.KEK]; !found {
+		return sealedRootKey{}, fmt.Errorf("%x: %w: %q", id, errUnknownKEK, sealed.KEK)
+	}
+	return sealed, nil
+}
+
+func (e encryptedRootKeys) open(id ID, sealed sealedRootKey) ([]byte, error) {
+	aead := e.aeads[sealed.KEK]
+	if len(sealed.Sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("%x: %w", id, errTruncated)
+	}
+
+	nonce, ciphertext := sealed.Sealed[:aead.NonceSize()], sealed.Sealed[aead.NonceSize():]
+	rootKey, err := aead.Open(nil, nonce, ciphertext, id[:])
+	if err != nil {
+		return nil, fmt.Errorf("%x: %w", id, err)
+	}
+	return rootKey, nil
+}
+
+type memorySealedRootKeyStore struct {
+	mu     sync.RWMutex
+	sealed map[ID][]byte
+}
+
+func MemorySealedRootKeyStore() *memorySealedRootKeyStore {
+	return &memorySealedRootKeyStore{sealed: make(map[ID][]byte)}
+}
+
+func (s *memorySealedRootKeyStore) SaveSealedRootKey(_ context.Context, id ID, sealed []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sealed[id] = bytes.Clone(sealed)
+	return nil
+}
+
+func (s *memorySealedRootKeyStore) SealedRootKey(_ context.Context, id ID) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sealed, found := s.sealed[id]
+	if !found {
+		return nil, ErrUnknownRootKey
+	}
+	return bytes.Clone(sealed), nil
+}
+
+func (s *memorySealedRootKeyStore) DeleteSealedRootKey(_ context.Context, id ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sealed, id)
+	return nil
+}
+
+func (s *memorySealedRootKeyStore) SealedRootKeyIDs(context.Context) ([]ID, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Collect(maps.Keys(s.sealed)), nil
+}
+
+// fileSealedRootKeyStore keeps the JSON values of EncryptedRootKeys in a JSON lines file, each line maps hex IDs to their values
+// A rewrapped key is appended again, and a deleted key is appended with a null value
+type fileSealedRootKeyStore struct {
+	memorySealedRootKeyStore
+	filename string
+}
+
+func openFileSealedRootKeyStore(filename string) (*fileSealedRootKeyStore, error) {
+	s := &fileSealedRootKeyStore{
+		memorySealedRootKeyStore: memorySealedRootKeyStore{sealed: make(map[ID][]byte)},
+		filename:                 filename,
+	}
+
+	// Files written before the JSON lines format are a single line
+	_, err := readJSONLines(filename, func(line []byte) error {
+		var encodedRootKeys map[string]json.RawMessage
+		if err := json.Unmarshal(line, &encodedRootKeys); err != nil {
+			return err
+		}
+
+		for encodedID, sealed := range encodedRootKeys {
+			id, err := decodeID(encodedID)
+			if err != nil {
+				return err
+			} else if bytes.Equal(sealed, []byte("null")) {
+				delete(s.sealed, id)
+				continue
+			}
+			s.sealed[id] = sealed
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *fileSealedRootKeyStore) SaveSealedRootKey(_ context.Context, id ID, sealed []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := appendJSONLine(s.filename, map[string]json.RawMessage{hex.EncodeToString(id[:]): sealed}); err != nil {
+		return err
+	}
+	s.sealed[id] = bytes.Clone(sealed)
+	return nil
+}
+
+func (s *fileSealedRootKeyStore) DeleteSealedRootKey(_ context.Context, id ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.sealed[id]; !found {
+		return nil
+	} else if err := appendJSONLine(s.filename, map[string]json.RawMessage{hex.EncodeToString(id[:]): nil}); err != nil {
+		return err
+	}
+	delete(s.sealed, id)
+	return nil
+}
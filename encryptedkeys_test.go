@@ -0,0 +1,193 @@
+package l402
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptedFileRootKeyStore(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "root_keys.json")
+	oldKEK := KeyEncryptionKey{ID: "2024", Key: bytes.Repeat([]byte{1}, BlockSize)}
+	newKEK := KeyEncryptionKey{ID: "2025", Key: bytes.Repeat([]byte{2}, BlockSize)}
+
+	rootKeys, err := EncryptedFileRootKeyStore(filename, oldKEK)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, rootKey, err := rootKeys.NewRootKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data, _ := os.ReadFile(filename); bytes.Contains(data, rootKey) || bytes.Contains(data, []byte(hex.EncodeToString(rootKey))) {
+		t.Error("expected the root key to be encrypted")
+	}
+
+	// A new key encryption key still opens the root keys sealed with the previous one
+	rotated, err := EncryptedFileRootKeyStore(filename, newKEK, oldKEK)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if storedRootKey, err := rotated.RootKey(ctx, id); err != nil || !bytes.Equal(storedRootKey, rootKey) {
+		t.Errorf("expected: %x but got: %x %v", rootKey, storedRootKey, err)
+	}
+
+	if _, err := EncryptedFileRootKeyStore(filename, newKEK); !errors.Is(err, errUnknownKEK) {
+		t.Errorf("expected: %v but got: %v", errUnknownKEK, err)
+	}
+
+	if err := rotated.Rewrap(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	rewrapped, err := EncryptedFileRootKeyStore(filename, newKEK)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if storedRootKey, err := rewrapped.RootKey(ctx, id); err != nil || !bytes.Equal(storedRootKey, rootKey) {
+		t.Errorf("expected: %x but got: %x %v", rootKey, storedRootKey, err)
+	}
+
+	// Keys are appended, and deleted keys stay deleted after reopening the file
+	if err := rewrapped.DeleteRootKey(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filename); bytes.Count(data, []byte("\n")) != 3 {
+		t.Errorf("expected: %d but got: %d lines", 3, bytes.Count(data, []byte("\n")))
+	}
+
+	reopened, err := EncryptedFileRootKeyStore(filename, newKEK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.RootKey(ctx, id); !errors.Is(err, ErrUnknownRootKey) {
+		t.Errorf("expected: %v but got: %v", ErrUnknownRootKey, err)
+	}
+}
+
+func TestEncryptedFileRootKeyStore_SwappedRecords(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "root_keys.json")
+	kek := KeyEncryptionKey{ID: "2025", Key: bytes.Repeat([]byte{1}, BlockSize)}
+
+	rootKeys, _ := EncryptedFileRootKeyStore(filename, kek)
+	id, _, _ := rootKeys.NewRootKey(ctx)
+	rootKeys.NewRootKey(ctx) //nolint:errcheck
+
+	// Each key is appended on a line of its own, they're swapped into a single object like the files of the earlier format
+	records := make(map[string]sealedRootKey)
+	data, _ := os.ReadFile(filename)
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		json.Unmarshal(line, &records) //nolint:errcheck
+	}
+
+	var encodedIDs []string
+	for encodedID := range records {
+		encodedIDs = append(encodedIDs, encodedID)
+	}
+	records[encodedIDs[0]], records[encodedIDs[1]] = records[encodedIDs[1]], records[encodedIDs[0]]
+	data, _ = json.Marshal(records)
+	os.WriteFile(filename, data, 0o600) //nolint:errcheck
+
+	reopened, err := EncryptedFileRootKeyStore(filename, kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := reopened.RootKey(ctx, id); err == nil {
+		t.Error("expected a swapped record to fail authentication")
+	}
+}
+
+func TestEncryptedFileRootKeyStore_InvalidKEK(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "root_keys.json")
+	kek := KeyEncryptionKey{ID: "2025", Key: bytes.Repeat([]byte{1}, BlockSize)}
+
+	tests := map[string]struct {
+		kek      KeyEncryptionKey
+		previous []KeyEncryptionKey
+	}{
+		"short key":    {kek: KeyEncryptionKey{ID: "2025", Key: []byte("short")}},
+		"missing ID":   {kek: KeyEncryptionKey{Key: kek.Key}},
+		"duplicate ID": {kek: kek, previous: []KeyEncryptionKey{kek}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := EncryptedFileRootKeyStore(filename, test.kek, test.previous...); !errors.Is(err, errInvalidKEK) {
+				t.Errorf("expected: %v but got: %v", errInvalidKEK, err)
+			}
+		})
+	}
+}
+
+func TestEncryptedRootKeys(t *testing.T) {
+	ctx := context.Background()
+	store := MemorySealedRootKeyStore()
+	oldKEK := KeyEncryptionKey{ID: "2024", Key: bytes.Repeat([]byte{1}, BlockSize)}
+	newKEK := KeyEncryptionKey{ID: "2025", Key: bytes.Repeat([]byte{2}, BlockSize)}
+
+	rootKeys, _ := EncryptedRootKeys(store, oldKEK)
+	id, rootKey, err := rootKeys.NewRootKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sealed, _ := store.SealedRootKey(ctx, id); bytes.Contains(sealed, rootKey) {
+		t.Error("expected the root key to be encrypted")
+	}
+
+	rotated, _ := EncryptedRootKeys(store, newKEK, oldKEK)
+	if err := rotated.Rewrap(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		kek             KeyEncryptionKey
+		id              ID
+		expectedRootKey []byte
+		expectedError   error
+	}{
+		"rewrapped root key": {
+			kek:             newKEK,
+			id:              id,
+			expectedRootKey: rootKey,
+		},
+		"discarded key encryption key": {
+			kek:           oldKEK,
+			id:            id,
+			expectedError: errUnknownKEK,
+		},
+		"unknown ID": {
+			kek:           newKEK,
+			id:            ID{1},
+			expectedError: ErrUnknownRootKey,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			rootKeys, _ := EncryptedRootKeys(store, test.kek)
+
+			storedRootKey, err := rootKeys.RootKey(ctx, test.id)
+
+			if !errors.Is(err, test.expectedError) {
+				t.Errorf("expected: %v but got: %v", test.expectedError, err)
+			}
+
+			if !bytes.Equal(storedRootKey, test.expectedRootKey) {
+				t.Errorf("expected: %x but got: %x", test.expectedRootKey, storedRootKey)
+			}
+		})
+	}
+}
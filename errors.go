@@ -3,6 +3,7 @@ package l402
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
 )
 
@@ -12,14 +13,110 @@ var (
 	ErrFailedInvoiceRequest  = errors.New("failed invoice request")
 	ErrFailedMacaroonMinting = errors.New("failed macaroon minting")
 	ErrPaymentRequired       = errors.New("payment required")
+	ErrInvalidCaveat         = errors.New("invalid caveat")
+	ErrAllowanceExhausted    = errors.New("allowance exhausted")
+	ErrUnknownRootKey        = errors.New("unknown root key")
+	ErrNoPrice               = errors.New("no price")
+	ErrInvalidSignature      = errors.New("invalid signature")
+	ErrUnknownCaveat         = errors.New("unknown caveat")
+	ErrUnsatisfiedCaveat     = errors.New("unsatisfied caveat")
+	ErrInsufficientBalance   = errors.New("insufficient balance")
+	ErrWideningCaveat        = errors.New("widening caveat")
+	ErrRevoked               = errors.New("revoked")
+	ErrTokenSpent            = errors.New("token already spent")
 )
 
+// Stage is the step of checking a token that failed
+type Stage string
+
+const (
+	StageHeader     Stage = "header"
+	StageDecode     Stage = "decode"
+	StageIdentifier Stage = "identifier"
+	StagePreimage   Stage = "preimage"
+	StageSignature  Stage = "signature"
+	StageCaveat     Stage = "caveat"
+)
+
+// MacaroonError tells which macaroon of a token failed, and at which stage
+// It matches the sentinel error of its stage with errors.Is, as well as its cause
+type MacaroonError struct {
+	// Index is the position of the failing macaroon in the token, discharge macaroons aside, see VerifiedToken.Identifiers
+	// It's -1 when the failure isn't tied to a single macaroon
+	Index int
+	Stage Stage
+	Err   error
+}
+
+func (e *MacaroonError) Error() string {
+	message := fmt.Sprintf("%s: %v", e.Stage, e.Err)
+	if e.Index >= 0 {
+		message = fmt.Sprintf("macaroon %d: %s", e.Index, message)
+	}
+	if sentinel := e.sentinel(); sentinel != nil && !errors.Is(e.Err, sentinel) {
+		message = fmt.Sprintf("%v: %s", sentinel, message)
+	}
+	return message
+}
+
+func (e *MacaroonError) Unwrap() []error {
+	if sentinel := e.sentinel(); sentinel != nil {
+		return []error{sentinel, e.Err}
+	}
+	return []error{e.Err}
+}
+
+// sentinel is the error matched by every failure of the stage, signature and caveat failures are told apart by their cause
+func (e *MacaroonError) sentinel() error {
+	switch e.Stage {
+	case StageHeader:
+		return ErrPaymentRequired
+	case StageDecode, StageIdentifier:
+		return ErrInvalidMacaroon
+	case StagePreimage:
+		return ErrInvalidPreimage
+	default:
+		return nil
+	}
+}
+
+// StatusCode is the HTTP status of the failure
+// Malformed tokens are bad requests, while tokens that don't grant access are challenged for a new payment
+func (e *MacaroonError) StatusCode() int {
+	switch {
+	case e.Stage == StageDecode, e.Stage == StageIdentifier, e.Stage == StagePreimage, errors.Is(e.Err, ErrInvalidCaveat):
+		return http.StatusBadRequest
+	default:
+		return http.StatusPaymentRequired
+	}
+}
+
+// DefaultErrorHandler replies with the error as plain text, or as application/problem+json if the client accepts it
 func DefaultErrorHandler(w http.ResponseWriter, r *http.Request) {
 	err := context.Cause(r.Context())
+	status := errorStatus(w, err)
+
+	if AcceptsProblem(r) {
+		WriteProblem(w, NewProblem(err, status))
+		return
+	}
+
+	http.Error(w, err.Error(), status)
+}
+
+// errorStatus picks the status code of an error and sets the headers that go along with it
+func errorStatus(w http.ResponseWriter, err error) int {
+	var rateLimited ErrRateLimited
+	var statusCoder interface{ StatusCode() int }
 	switch {
-	case errors.Is(err, ErrInvalidMacaroon), errors.Is(err, ErrInvalidPreimage):
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.As(err, &rateLimited):
+		w.Header().Set("Retry-After", rateLimited.RetryAfter())
+		return http.StatusTooManyRequests
+	case errors.As(err, &statusCoder):
+		return statusCoder.StatusCode()
+	case errors.Is(err, ErrInvalidMacaroon), errors.Is(err, ErrInvalidPreimage), errors.Is(err, ErrInvalidCaveat), errors.Is(err, ErrRefundRejected):
+		return http.StatusBadRequest
 	default:
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return http.StatusInternalServerError
 	}
 }
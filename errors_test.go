@@ -0,0 +1,115 @@
+package l402
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMacaroonError(t *testing.T) {
+	tests := map[string]struct {
+		err                error
+		expectedMessage    string
+		expectedErrors     []error
+		expectedStatusCode int
+	}{
+		"corrupt token": {
+			err:                &MacaroonError{Index: -1, Stage: StageDecode, Err: base64.CorruptInputError(3)},
+			expectedMessage:    "invalid macaroon: decode: illegal base64 data at input byte 3",
+			expectedErrors:     []error{ErrInvalidMacaroon, base64.CorruptInputError(3)},
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		"unknown identifier version": {
+			err:                &MacaroonError{Index: 1, Stage: StageIdentifier, Err: ErrUnknownVersion(7)},
+			expectedMessage:    "invalid macaroon: macaroon 1: identifier: " + ErrUnknownVersion(7).Error(),
+			expectedErrors:     []error{ErrInvalidMacaroon, ErrUnknownVersion(7)},
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		"wrong preimage": {
+			err:                &MacaroonError{Index: 0, Stage: StagePreimage, Err: errPreimageMismatch},
+			expectedMessage:    "invalid preimage: macaroon 0: preimage: preimage doesn't match the payment hash",
+			expectedErrors:     []error{ErrInvalidPreimage, errPreimageMismatch},
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		"forged signature": {
+			err:                &MacaroonError{Index: 0, Stage: StageSignature, Err: fmt.Errorf("%w: signature mismatch", ErrInvalidSignature)},
+			expectedMessage:    "macaroon 0: signature: invalid signature: signature mismatch",
+			expectedErrors:     []error{ErrInvalidSignature},
+			expectedStatusCode: http.StatusPaymentRequired,
+		},
+		"malformed caveat": {
+			err:                &MacaroonError{Index: 0, Stage: StageCaveat, Err: ErrInvalidCaveat},
+			expectedMessage:    "macaroon 0: caveat: invalid caveat",
+			expectedErrors:     []error{ErrInvalidCaveat},
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		"unsatisfied caveat": {
+			err:                &MacaroonError{Index: 2, Stage: StageCaveat, Err: fmt.Errorf("%w: expires", ErrUnsatisfiedCaveat)},
+			expectedMessage:    "macaroon 2: caveat: unsatisfied caveat: expires",
+			expectedErrors:     []error{ErrUnsatisfiedCaveat},
+			expectedStatusCode: http.StatusPaymentRequired,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if message := test.err.Error(); message != test.expectedMessage {
+				t.Errorf("expected: %s but got: %s", test.expectedMessage, message)
+			}
+
+			for _, expectedError := range test.expectedErrors {
+				if !errors.Is(test.err, expectedError) {
+					t.Errorf("expected %v to match: %v", test.err, expectedError)
+				}
+			}
+
+			w := httptest.NewRecorder()
+			DefaultErrorHandler(w, withCancelCause(httptest.NewRequest("GET", "/", nil), test.err))
+
+			if w.Code != test.expectedStatusCode {
+				t.Errorf("expected: %d but got: %d", test.expectedStatusCode, w.Code)
+			}
+		})
+	}
+}
+
+func TestDefaultErrorHandler(t *testing.T) {
+	tests := map[string]struct {
+		err                error
+		expectedStatusCode int
+		expectedRetryAfter string
+	}{
+		"invalid macaroon": {
+			err:                fmt.Errorf("%w: unsupported", ErrInvalidMacaroon),
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		"rate limited": {
+			err:                ErrRateLimited(1500 * time.Millisecond),
+			expectedStatusCode: http.StatusTooManyRequests,
+			expectedRetryAfter: "2",
+		},
+		"unknown error": {
+			err:                errors.New("disk full"),
+			expectedStatusCode: http.StatusInternalServerError,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			DefaultErrorHandler(w, withCancelCause(httptest.NewRequest("GET", "/", nil), test.err))
+
+			if w.Code != test.expectedStatusCode {
+				t.Errorf("expected: %d but got: %d", test.expectedStatusCode, w.Code)
+			}
+
+			if retryAfter := w.Header().Get("Retry-After"); retryAfter != test.expectedRetryAfter {
+				t.Errorf("expected: %s but got: %s", test.expectedRetryAfter, retryAfter)
+			}
+		})
+	}
+}
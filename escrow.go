@@ -0,0 +1,277 @@
+package l402
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// HoldInvoiceProvider creates invoices whose payments are held by the node until they're settled or cancelled
+type HoldInvoiceProvider interface {
+	// CreateHoldInvoice asks for an invoice paying to the hash of a preimage that the node doesn't know yet
+	CreateHoldInvoice(ctx context.Context, paymentHash Hash, amountMsat uint64, memo string) (Invoice, error)
+	// Accepted reports whether the payment of the invoice is held by the node, waiting to be settled
+	Accepted(ctx context.Context, paymentHash Hash) (bool, error)
+	// SettleInvoice claims the held payment, revealing the preimage to the payer
+	SettleInvoice(ctx context.Context, preimage Hash) error
+	// CancelInvoice refunds the held payment
+	CancelInvoice(ctx context.Context, paymentHash Hash) error
+}
+
+// Escrow holds the payment of a request until the API responds, see EscrowMinter and WithEscrow
+// Preimages are derived from the Secret and the macaroon ID, so no state is kept between minting and settling
+type Escrow struct {
+	Invoices HoldInvoiceProvider
+	Secret   []byte
+	// Succeeded tells which response statuses settle the payment, the others cancel it
+	// It defaults to the 1xx, 2xx and 3xx statuses
+	Succeeded func(status int) bool
+	// Claims remembers the held payments claimed by a request, so each one pays for a single request
+	// It defaults to a MemoryConsumeStore, a shared store is needed when many proxies serve the same tokens
+	Claims ConsumeStore
+}
+
+// escrowClaimTTL is how long the default claims of WithEscrow are remembered, it outlasts the hold invoices
+const escrowClaimTTL = 24 * time.Hour
+
+var (
+	errNotEscrowed    = errors.New("macaroon not minted for escrow")
+	errPaymentNotHeld = errors.New("payment not held")
+)
+
+// preimage is the preimage of the hold invoice of a macaroon ID
+func (e Escrow) preimage(id ID) Hash {
+	mac := hmac.New(sha256.New, e.Secret)
+	mac.Write([]byte("l402 escrow preimage "))
+	mac.Write(id[:])
+	return Hash(mac.Sum(nil))
+}
+
+func (e Escrow) succeeded(status int) bool {
+	if e.Succeeded != nil {
+		return e.Succeeded(status)
+	}
+	return status < http.StatusBadRequest
+}
+
+type escrowMinter struct {
+	escrow   Escrow
+	rootKeys RootKeyStore
+	pricer   Pricer
+}
+
+// EscrowMinter mints macaroons challenged by hold invoices, to be served by a proxy with WithEscrow
+func EscrowMinter(escrow Escrow, rootKeys RootKeyStore, pricer Pricer) escrowMinter {
+	return escrowMinter{
+		escrow:   escrow,
+		rootKeys: rootKeys,
+		pricer:   pricer,
+	}
+}
+
+func (m escrowMinter) MintWithChallenge(r *http.Request) (string, Challenge, error) {
+	return m.MintWithChallengeFor(HTTPAccessRequest(r))
+}
+
+func (m escrowMinter) MintWithChallengeFor(r AccessRequest) (string, Challenge, error) {
+	amountMsat, caveats, err := m.pricer.Price(HTTPRequest(r))
+	if err != nil {
+		return "", nil, err
+	}
+
+	id, rootKey, err := m.rootKeys.NewRootKey(r.Context())
+	if err != nil {
+		return "", nil, err
+	}
+
+	// The preimage derives from the ID, so the root key can't wait for the hold invoice and is deleted if it fails
+	preimage := m.escrow.preimage(id)
+	paymentHash := Hash(sha256.Sum256(preimage[:]))
+
+	invoice, err := m.escrow.Invoices.CreateHoldInvoice(r.Context(), paymentHash, amountMsat, fmt.Sprintf("L402 %s %s", r.Method(), r.Path()))
+	if err != nil {
+		deleteRootKey(r.Context(), m.rootKeys, id)
+		return "", nil, fmt.Errorf("%w: %w", ErrFailedInvoiceRequest, err)
+	}
+
+	macaroonBase64, err := mintMacaroon(rootKey, Identifier{PaymentHash: paymentHash, ID: id}, caveats)
+	if err != nil {
+		deleteRootKey(r.Context(), m.rootKeys, id)
+		return "", nil, err
+	}
+
+	return macaroonBase64, invoice, nil
+}
+
+// escrowAuthorizationMatcher matches a token presented without its preimage, which the client only learns once the payment is settled
+var escrowAuthorizationMatcher = regexp.MustCompile(`^L402 ([^\s:]+):?$`)
+
+func getEscrowAuthorizationHeader(r *http.Request) (string, bool) {
+	for _, v := range r.Header.Values("Authorization") {
+		if matches := escrowAuthorizationMatcher.FindStringSubmatch(v); len(matches) == 2 {
+			return matches[1], true
+		}
+	}
+	return "", false
+}
+
+// serveEscrow serves a request paid by held payments, which are settled if the API succeeds and cancelled otherwise
+func (p proxy) serveEscrow(w http.ResponseWriter, r *http.Request, macaroonBase64 string) {
+	token, err := UnmarshalOrderedToken(macaroonBase64)
+	if err != nil {
+		p.errorHandler.ServeHTTP(w, withCancelCause(r, err))
+		return
+	}
+	macaroons, identifiers := token.Macaroons, token.Identifiers
+
+	ctx := context.WithValue(r.Context(), KeyMacaroon, macaroons)
+	ctx = context.WithValue(ctx, KeyIdentifiers, identifiers)
+	if len(token.Discharges) > 0 {
+		ctx = context.WithValue(ctx, KeyDischarges, token.Discharges)
+	}
+	r = r.WithContext(ctx)
+
+	paymentHashes := make([]Hash, 0, len(identifiers))
+	for i, identifier := range identifiers {
+		preimage := p.escrow.preimage(identifier.ID)
+		if sha256.Sum256(preimage[:]) != identifier.PaymentHash {
+			p.errorHandler.ServeHTTP(w, withCancelCause(r, &MacaroonError{Index: i, Stage: StagePreimage, Err: errNotEscrowed}))
+			return
+		}
+
+		accepted, err := p.escrow.Invoices.Accepted(r.Context(), identifier.PaymentHash)
+		if err != nil {
+			p.errorHandler.ServeHTTP(w, withCancelCause(r, err))
+			return
+		} else if !accepted {
+			p.authenticator.ServeHTTP(w, withCancelCause(r, &MacaroonError{Index: i, Stage: StagePreimage, Err: errPaymentNotHeld}))
+			return
+		}
+		paymentHashes = append(paymentHashes, identifier.PaymentHash)
+	}
+
+	// Held payments pay for a single request, the other requests presenting them meanwhile aren't served
+	// Only the request that claimed them settles or cancels them
+	if err := p.escrow.Claims.Consume(r.Context(), paymentHashes...); errors.Is(err, ErrTokenSpent) {
+		p.authenticator.ServeHTTP(w, withCancelCause(r, err))
+		return
+	} else if err != nil {
+		p.errorHandler.ServeHTTP(w, withCancelCause(r, err))
+		return
+	}
+
+	// Payments held for a request that isn't served are refunded
+	if rejection := p.accessAuthority.ApproveAccess(r, macaroons); rejection != nil {
+		p.cancelEscrow(r, identifiers)
+		p.authenticator.ServeHTTP(w, withCancelCause(r, rejection))
+		return
+	}
+
+	writer := &escrowWriter{
+		ResponseWriter: w,
+		release: func(status int) error {
+			if !p.escrow.succeeded(status) {
+				p.cancelEscrow(r, identifiers)
+				return nil
+			}
+			return p.settleEscrow(r, identifiers)
+		},
+		fail: func(err error) {
+			// The API response is replaced, its headers included
+			clear(w.Header())
+			p.errorHandler.ServeHTTP(w, withCancelCause(r, err))
+		},
+	}
+
+	// A handler that panics doesn't get paid either
+	completed := false
+	defer func() {
+		if completed {
+			// A handler that wrote nothing responds with 200
+			writer.releaseWith(http.StatusOK)
+		} else if !writer.released {
+			writer.released = true
+			p.cancelEscrow(r, identifiers)
+		}
+	}()
+
+	p.serveAPI(writer, r, macaroons, false)
+	completed = true
+}
+
+var errSettleFailed = errors.New("failed to settle the held payment")
+
+// settleEscrow claims the held payments of a token, revealing their preimages to the payer
+func (p proxy) settleEscrow(r *http.Request, identifiers []Identifier) error {
+	ctx := context.WithoutCancel(r.Context())
+	for _, identifier := range identifiers {
+		if err := p.escrow.Invoices.SettleInvoice(ctx, p.escrow.preimage(identifier.ID)); err != nil {
+			return fmt.Errorf("%w: %w", errSettleFailed, err)
+		}
+	}
+	return nil
+}
+
+// cancelEscrow refunds the held payments of a token
+// Failures are ignored, the node cancels the payments that are never settled once they time out
+func (p proxy) cancelEscrow(r *http.Request, identifiers []Identifier) {
+	ctx := context.WithoutCancel(r.Context())
+	for _, identifier := range identifiers {
+		p.escrow.Invoices.CancelInvoice(ctx, identifier.PaymentHash) //nolint:errcheck
+	}
+}
+
+// escrowWriter settles or cancels the held payments as soon as the API handler writes its status, before the response reaches the client
+// If the payments can't be settled, the response is replaced by an error, so the client isn't served for free
+type escrowWriter struct {
+	http.ResponseWriter
+	release  func(status int) error
+	fail     func(error)
+	released bool
+	failed   bool
+}
+
+// releaseWith releases the payments once, according to the status of the response
+func (e *escrowWriter) releaseWith(status int) {
+	if e.released {
+		return
+	}
+	e.released = true
+	if err := e.release(status); err != nil {
+		e.failed = true
+		e.fail(err)
+	}
+}
+
+func (e *escrowWriter) WriteHeader(status int) {
+	if status >= http.StatusOK {
+		e.releaseWith(status)
+	}
+	if !e.failed {
+		e.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (e *escrowWriter) Write(b []byte) (int, error) {
+	e.releaseWith(http.StatusOK)
+	if e.failed {
+		return 0, errSettleFailed
+	}
+	return e.ResponseWriter.Write(b)
+}
+
+func (e *escrowWriter) Flush() {
+	e.releaseWith(http.StatusOK)
+	if flusher, ok := e.ResponseWriter.(http.Flusher); ok && !e.failed {
+		flusher.Flush()
+	}
+}
+
+func (e *escrowWriter) Unwrap() http.ResponseWriter {
+	return e.ResponseWriter
+}
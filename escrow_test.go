@@ -0,0 +1,320 @@
+package l402
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEscrow(t *testing.T) {
+	tests := map[string]struct {
+		pay                    bool
+		apiStatus              int
+		expectedResponseStatus int
+		expectedInvoiceState   string
+	}{
+		"successful response": {
+			pay:                    true,
+			apiStatus:              http.StatusOK,
+			expectedResponseStatus: http.StatusOK,
+			expectedInvoiceState:   "settled",
+		},
+		"failed response": {
+			pay:                    true,
+			apiStatus:              http.StatusBadGateway,
+			expectedResponseStatus: http.StatusBadGateway,
+			expectedInvoiceState:   "canceled",
+		},
+		"payment not held": {
+			expectedResponseStatus: http.StatusPaymentRequired,
+			expectedInvoiceState:   "open",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			rootKeys := MemoryRootKeyStore()
+			invoices := &fakeHoldInvoiceProvider{}
+			escrow := Escrow{Invoices: invoices, Secret: []byte("secret")}
+
+			handler := Proxy(EscrowMinter(escrow, rootKeys, FixedPrice(1000)), Authority(rootKeys), WithEscrow(escrow))(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(test.apiStatus)
+				}))
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			challenge := challengeMatcher.FindStringSubmatch(w.Header().Get("WWW-Authenticate"))
+			if len(challenge) != 3 {
+				t.Fatalf("unexpected challenge: %s", w.Header().Get("WWW-Authenticate"))
+			}
+
+			paymentHash := invoices.paymentHashes[Invoice(challenge[2])]
+			if test.pay {
+				invoices.pay(paymentHash)
+			}
+
+			w = httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Authorization", "L402 "+challenge[1])
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.expectedResponseStatus {
+				t.Errorf("expected: %d but got: %d", test.expectedResponseStatus, w.Code)
+			}
+
+			if state := invoices.states[paymentHash]; state != test.expectedInvoiceState {
+				t.Errorf("expected: %s but got: %s", test.expectedInvoiceState, state)
+			}
+		})
+	}
+}
+
+func TestEscrow_SettledToken(t *testing.T) {
+	rootKeys := MemoryRootKeyStore()
+	invoices := &fakeHoldInvoiceProvider{}
+	escrow := Escrow{Invoices: invoices, Secret: []byte("secret")}
+	handler := Proxy(EscrowMinter(escrow, rootKeys, FixedPrice(1000)), Authority(rootKeys), WithEscrow(escrow))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	challenge := challengeMatcher.FindStringSubmatch(w.Header().Get("WWW-Authenticate"))
+	paymentHash := invoices.paymentHashes[Invoice(challenge[2])]
+	invoices.pay(paymentHash)
+
+	serve := func(authorization string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", authorization)
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if status := serve("L402 " + challenge[1]); status != http.StatusOK {
+		t.Errorf("expected: %d but got: %d", http.StatusOK, status)
+	}
+
+	// The payment was settled, so it isn't held anymore
+	if status := serve("L402 " + challenge[1]); status != http.StatusPaymentRequired {
+		t.Errorf("expected: %d but got: %d", http.StatusPaymentRequired, status)
+	}
+
+	// The preimage revealed by the settlement makes it a regular token
+	preimage := invoices.preimages[paymentHash]
+	if status := serve("L402 " + challenge[1] + ":" + hex.EncodeToString(preimage[:])); status != http.StatusOK {
+		t.Errorf("expected: %d but got: %d", http.StatusOK, status)
+	}
+}
+
+func TestEscrow_NotEscrowed(t *testing.T) {
+	rootKeys := MemoryRootKeyStore()
+	escrow := Escrow{Invoices: &fakeHoldInvoiceProvider{}, Secret: []byte("secret")}
+	handler := Proxy(Minter(&fakeInvoiceProvider{}, rootKeys, FixedPrice(1000)), Authority(rootKeys), WithEscrow(escrow))(http.NotFoundHandler())
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	macaroonBase64, _, _ := strings.Cut(strings.TrimPrefix(w.Header().Get("WWW-Authenticate"), `L402 macaroon="`), `"`)
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "L402 "+macaroonBase64)
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected: %d but got: %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestEscrow_Concurrent(t *testing.T) {
+	rootKeys := MemoryRootKeyStore()
+	invoices := &fakeHoldInvoiceProvider{}
+	escrow := Escrow{Invoices: invoices, Secret: []byte("secret")}
+
+	const requests = 20
+	finished := make(chan int, requests)
+	unblock := make(chan struct{})
+	var served atomic.Int32
+
+	handler := Proxy(EscrowMinter(escrow, rootKeys, FixedPrice(1000)), Authority(rootKeys), WithEscrow(escrow))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			served.Add(1)
+			// The request that claimed the payment is still running while the others are turned down
+			select {
+			case <-unblock:
+			case <-time.After(time.Second):
+			}
+		}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	challenge := challengeMatcher.FindStringSubmatch(w.Header().Get("WWW-Authenticate"))
+	paymentHash := invoices.paymentHashes[Invoice(challenge[2])]
+	invoices.pay(paymentHash)
+
+	var wg sync.WaitGroup
+	for range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Authorization", "L402 "+challenge[1])
+			handler.ServeHTTP(w, r)
+			finished <- w.Code
+		}()
+	}
+
+	statuses := make(map[int]int)
+	for range requests - 1 {
+		statuses[<-finished]++
+	}
+	close(unblock)
+	wg.Wait()
+	statuses[<-finished]++
+
+	if served.Load() != 1 {
+		t.Errorf("expected: %d but got: %d", 1, served.Load())
+	}
+	if statuses[http.StatusOK] != 1 || statuses[http.StatusPaymentRequired] != requests-1 {
+		t.Errorf("expected: %d served and %d challenged but got: %v", 1, requests-1, statuses)
+	}
+
+	// The requests turned down didn't cancel the payment of the one being served
+	if state := invoices.states[paymentHash]; state != "settled" {
+		t.Errorf("expected: %s but got: %s", "settled", state)
+	}
+}
+
+func TestEscrow_SettleFailure(t *testing.T) {
+	rootKeys := MemoryRootKeyStore()
+	invoices := &fakeHoldInvoiceProvider{}
+	escrow := Escrow{Invoices: unsettledInvoiceProvider{invoices}, Secret: []byte("secret")}
+
+	handler := Proxy(EscrowMinter(escrow, rootKeys, FixedPrice(1000)), Authority(rootKeys), WithEscrow(escrow))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Premium", "true")
+			fmt.Fprint(w, "premium content")
+		}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	challenge := challengeMatcher.FindStringSubmatch(w.Header().Get("WWW-Authenticate"))
+	invoices.pay(invoices.paymentHashes[Invoice(challenge[2])])
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "L402 "+challenge[1])
+	handler.ServeHTTP(w, r)
+
+	// The content isn't served when the payment can't be settled
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected: %d but got: %d", http.StatusInternalServerError, w.Code)
+	}
+	if strings.Contains(w.Body.String(), "premium content") || w.Header().Get("X-Premium") != "" {
+		t.Errorf("unexpected response: %v %q", w.Header(), w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), errSettleFailed.Error()) {
+		t.Errorf("expected: %q but got: %q", errSettleFailed, w.Body.String())
+	}
+}
+
+func TestEscrowMinter_FailedInvoice(t *testing.T) {
+	rootKeys := MemoryRootKeyStore()
+	escrow := Escrow{Invoices: failingHoldInvoiceProvider{&fakeHoldInvoiceProvider{}}, Secret: []byte("secret")}
+
+	_, _, err := EscrowMinter(escrow, rootKeys, FixedPrice(1000)).MintWithChallenge(httptest.NewRequest("GET", "/", nil))
+	if !errors.Is(err, ErrFailedInvoiceRequest) {
+		t.Fatalf("expected: %v but got: %v", ErrFailedInvoiceRequest, err)
+	}
+
+	// The root key is created before the hold invoice, since the preimage derives from its ID, so it must be deleted
+	if len(rootKeys.rootKeys) != 0 {
+		t.Errorf("expected: %d but got: %d", 0, len(rootKeys.rootKeys))
+	}
+}
+
+// failingHoldInvoiceProvider fails to create hold invoices, like a node that went offline
+type failingHoldInvoiceProvider struct {
+	*fakeHoldInvoiceProvider
+}
+
+func (failingHoldInvoiceProvider) CreateHoldInvoice(context.Context, Hash, uint64, string) (Invoice, error) {
+	return "", errNodeOffline
+}
+
+// unsettledInvoiceProvider fails to settle invoices, like a node that went offline
+type unsettledInvoiceProvider struct {
+	*fakeHoldInvoiceProvider
+}
+
+var errNodeOffline = errors.New("node offline")
+
+func (unsettledInvoiceProvider) SettleInvoice(context.Context, Hash) error {
+	return errNodeOffline
+}
+
+// fakeHoldInvoiceProvider tracks the state of hold invoices like a lightning node would
+type fakeHoldInvoiceProvider struct {
+	mu            sync.Mutex
+	paymentHashes map[Invoice]Hash
+	states        map[Hash]string
+	preimages     map[Hash]Hash
+}
+
+var errInvoiceNotAccepted = errors.New("invoice not accepted")
+
+func (f *fakeHoldInvoiceProvider) CreateHoldInvoice(_ context.Context, paymentHash Hash, _ uint64, _ string) (Invoice, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.states == nil {
+		f.paymentHashes, f.states, f.preimages = make(map[Invoice]Hash), make(map[Hash]string), make(map[Hash]Hash)
+	}
+
+	invoice := Invoice("lnbc" + hex.EncodeToString(paymentHash[:4]))
+	f.paymentHashes[invoice] = paymentHash
+	f.states[paymentHash] = "open"
+	return invoice, nil
+}
+
+func (f *fakeHoldInvoiceProvider) pay(paymentHash Hash) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.states[paymentHash] = "accepted"
+}
+
+func (f *fakeHoldInvoiceProvider) Accepted(_ context.Context, paymentHash Hash) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.states[paymentHash] == "accepted", nil
+}
+
+func (f *fakeHoldInvoiceProvider) SettleInvoice(_ context.Context, preimage Hash) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	paymentHash := Hash(sha256.Sum256(preimage[:]))
+	if f.states[paymentHash] != "accepted" {
+		return errInvoiceNotAccepted
+	}
+	f.states[paymentHash] = "settled"
+	f.preimages[paymentHash] = preimage
+	return nil
+}
+
+func (f *fakeHoldInvoiceProvider) CancelInvoice(_ context.Context, paymentHash Hash) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.states[paymentHash] = "canceled"
+	return nil
+}
@@ -2,9 +2,10 @@ module github.com/gofeuer/l402
 
 go 1.23
 
-require gopkg.in/macaroon.v2 v2.1.0
-
 require (
-	golang.org/x/crypto v0.26.0 // indirect
-	golang.org/x/sys v0.24.0 // indirect
+	golang.org/x/crypto v0.26.0
+	gopkg.in/macaroon.v2 v2.1.0
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require golang.org/x/sys v0.24.0 // indirect
@@ -0,0 +1,19 @@
+module github.com/gofeuer/l402/grpcl402
+
+go 1.23
+
+require (
+	github.com/gofeuer/l402 v0.0.0-20261018235936-b48ade11dcd0
+	google.golang.org/grpc v1.68.1
+	gopkg.in/macaroon.v2 v2.1.0
+)
+
+require (
+	golang.org/x/crypto v0.27.0 // indirect
+	golang.org/x/net v0.29.0 // indirect
+	golang.org/x/sys v0.25.0 // indirect
+	golang.org/x/text v0.18.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240903143218-8af14fe29dc1 // indirect
+	google.golang.org/protobuf v1.34.2 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
@@ -0,0 +1,141 @@
+// Package grpcl402 enforces L402 on gRPC servers, reading the token from the authorization metadata of each call
+package grpcl402
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gofeuer/l402"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcMethod is the HTTP method of every gRPC call, caveats and pricers see the full method name as the path
+const grpcMethod = http.MethodPost
+
+type interceptor struct {
+	minter    l402.AccessRequestMinter
+	authority l402.AccessRequestAuthority
+}
+
+// UnaryServerInterceptor serves the calls presenting an L402 token that the authority approves, in the same form as the Authorization header
+// The other calls fail with codes.Unauthenticated, and the challenge minted for them is sent in the www-authenticate trailer
+func UnaryServerInterceptor(minter l402.AccessRequestMinter, authority l402.AccessRequestAuthority) grpc.UnaryServerInterceptor {
+	i := interceptor{minter: minter, authority: authority}
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		authorized, err := i.authorize(ctx, info.FullMethod, func(trailer metadata.MD) { grpc.SetTrailer(ctx, trailer) }) //nolint:errcheck
+		if err != nil {
+			return nil, err
+		}
+		return handler(authorized, req)
+	}
+}
+
+// StreamServerInterceptor is the UnaryServerInterceptor of streams, the token is checked once when the stream opens
+func StreamServerInterceptor(minter l402.AccessRequestMinter, authority l402.AccessRequestAuthority) grpc.StreamServerInterceptor {
+	i := interceptor{minter: minter, authority: authority}
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := i.authorize(ss.Context(), info.FullMethod, ss.SetTrailer)
+		if err != nil {
+			return err
+		}
+		return handler(srv, authorizedStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// authorize checks the token of a call, the returned context holds its macaroons under l402.KeyMacaroon like the requests served by l402.Proxy
+func (i interceptor) authorize(ctx context.Context, fullMethod string, setTrailer func(metadata.MD)) (context.Context, error) {
+	r := accessRequest(ctx, fullMethod)
+	token, err := l402.DecodeAuthorization(r.Header())
+	if errors.Is(err, l402.ErrPaymentRequired) {
+		// Missing or malformed tokens
+		return nil, i.challenge(r, err, setTrailer)
+	} else if err != nil {
+		return nil, statusError(err)
+	}
+
+	ctx = context.WithValue(ctx, l402.KeyMacaroon, token.Macaroons)
+	ctx = context.WithValue(ctx, l402.KeyIdentifiers, token.Identifiers)
+	if len(token.Discharges) > 0 {
+		ctx = context.WithValue(ctx, l402.KeyDischarges, token.Discharges)
+	}
+
+	r = accessRequest(ctx, fullMethod)
+	if rejection := i.authority.ApproveAccessFor(r, token.Macaroons); rejection != nil {
+		return nil, i.challenge(r, rejection, setTrailer)
+	}
+
+	return ctx, nil
+}
+
+// challenge mints a token for the call and sends it in the trailer, along with the recovery advised by the rejection
+func (i interceptor) challenge(r l402.AccessRequest, rejection l402.Rejection, setTrailer func(metadata.MD)) error {
+	macaroonBase64, challenge, err := i.minter.MintWithChallengeFor(r)
+	if err != nil {
+		return statusError(fmt.Errorf("%w: %w", l402.ErrFailedMacaroonMinting, err))
+	}
+
+	header := make(http.Header)
+	var recoverableRejection l402.RecoverableRejection
+	if errors.As(rejection, &recoverableRejection) {
+		recoverableRejection.AdviseRecovery(header)
+	}
+	header.Add("WWW-Authenticate", fmt.Sprintf(`L402 macaroon="%s", %s`, macaroonBase64, challenge))
+
+	trailer := make(metadata.MD, len(header))
+	for key, values := range header {
+		trailer.Append(key, values...)
+	}
+	setTrailer(trailer)
+
+	return status.Error(codes.Unauthenticated, rejection.Error())
+}
+
+// accessRequest describes a call to the minter and the authority
+// The metadata stands for the headers, the :authority pseudo-header for the service and the full method name for the path
+func accessRequest(ctx context.Context, fullMethod string) l402.AccessRequest {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	var service string
+	header := make(http.Header, len(md))
+	for key, values := range md {
+		if key == ":authority" && len(values) > 0 {
+			service = values[0]
+		} else if !strings.HasPrefix(key, ":") {
+			header[http.CanonicalHeaderKey(key)] = values
+		}
+	}
+
+	var remoteAddr string
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		remoteAddr = p.Addr.String()
+	}
+
+	return l402.NewAccessRequest(ctx, service, grpcMethod, fullMethod, remoteAddr, header)
+}
+
+// statusError is the gRPC status of a failure that isn't challenged, malformed tokens are invalid arguments
+func statusError(err error) error {
+	switch {
+	case errors.Is(err, l402.ErrInvalidMacaroon), errors.Is(err, l402.ErrInvalidPreimage), errors.Is(err, l402.ErrInvalidCaveat):
+		return status.Error(codes.InvalidArgument, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+// authorizedStream hands the context holding the macaroons of the token to the stream handler
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx context.Context //nolint:containedctx
+}
+
+func (s authorizedStream) Context() context.Context {
+	return s.ctx
+}
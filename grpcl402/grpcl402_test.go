@@ -0,0 +1,178 @@
+package grpcl402
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gofeuer/l402"
+	"github.com/gofeuer/l402/l402test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+func newHealthClient(t *testing.T, caveats ...l402.Caveat) (healthpb.HealthClient, *l402test.Wallet, l402.RootKeyStore) {
+	t.Helper()
+
+	node := l402test.NewNode()
+	rootKeys := l402.MemoryRootKeyStore()
+	minter := l402.Minter(node, rootKeys, l402.FixedPrice(1000, caveats...))
+	authority := l402.Authority(rootKeys)
+
+	// The handlers see the macaroons of the token, like the ones behind l402.Proxy
+	requireMacaroons := func(ctx context.Context) error {
+		if _, found := ctx.Value(l402.KeyMacaroon).(map[l402.Identifier]*macaroon.Macaroon); !found {
+			return status.Error(codes.Internal, "no macaroons in the context")
+		}
+		return nil
+	}
+
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(UnaryServerInterceptor(minter, authority),
+			func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+				if err := requireMacaroons(ctx); err != nil {
+					return nil, err
+				}
+				return handler(ctx, req)
+			}),
+		grpc.ChainStreamInterceptor(StreamServerInterceptor(minter, authority),
+			func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				if err := requireMacaroons(ss.Context()); err != nil {
+					return err
+				}
+				return handler(srv, ss)
+			}),
+	)
+	healthpb.RegisterHealthServer(server, health.NewServer())
+
+	listener := bufconn.Listen(1 << 20)
+	go server.Serve(listener) //nolint:errcheck
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///l402",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return healthpb.NewHealthClient(conn), l402test.NewWallet(node), rootKeys
+}
+
+// payTrailer pays the challenge sent in the trailer of a rejected call
+func payTrailer(t *testing.T, wallet *l402test.Wallet, err error, trailer metadata.MD) string {
+	t.Helper()
+
+	if code := status.Code(err); code != codes.Unauthenticated {
+		t.Fatalf("expected: %v but got: %v", codes.Unauthenticated, err)
+	}
+
+	header := make(http.Header)
+	for key, values := range trailer {
+		header[http.CanonicalHeaderKey(key)] = values
+	}
+
+	authorization, err := wallet.PayChallenge(context.Background(), header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authorization
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	client, wallet, rootKeys := newHealthClient(t, l402.NewCaveat(l402.PathCondition, "/grpc.health.v1.Health/Check"))
+
+	var trailer metadata.MD
+	_, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{}, grpc.Trailer(&trailer))
+	authorization := payTrailer(t, wallet, err, trailer)
+
+	tests := map[string]struct {
+		authorization string
+		expectedCode  codes.Code
+	}{
+		"no token": {
+			expectedCode: codes.Unauthenticated,
+		},
+		"malformed token": {
+			authorization: "L402 abc",
+			expectedCode:  codes.Unauthenticated,
+		},
+		"wrong preimage": {
+			authorization: authorization[:len(authorization)-64] + strings.Repeat("0", 64),
+			expectedCode:  codes.InvalidArgument,
+		},
+		"unknown root key": {
+			authorization: l402test.NewToken(t, l402.MemoryRootKeyStore()).Authorization(),
+			expectedCode:  codes.Unauthenticated,
+		},
+		"paid token": {
+			authorization: authorization,
+			expectedCode:  codes.OK,
+		},
+		"token minted by the store": {
+			authorization: l402test.NewToken(t, rootKeys).Authorization(),
+			expectedCode:  codes.OK,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			if test.authorization != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, "authorization", test.authorization)
+			}
+
+			var trailer metadata.MD
+			_, err := client.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Trailer(&trailer))
+
+			if code := status.Code(err); code != test.expectedCode {
+				t.Errorf("expected: %v but got: %v", test.expectedCode, err)
+			}
+
+			if challenged := len(trailer.Get("www-authenticate")) > 0; challenged != (test.expectedCode == codes.Unauthenticated) {
+				t.Errorf("expected a challenge with %v but got: %v", test.expectedCode, trailer)
+			}
+		})
+	}
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	client, wallet, _ := newHealthClient(t, l402.NewCaveat(l402.PathCondition, "/grpc.health.v1.Health/Watch"))
+
+	watch := func(authorization string) (healthpb.Health_WatchClient, error) {
+		ctx := context.Background()
+		if authorization != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", authorization)
+		}
+		stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+		if err != nil {
+			return nil, err
+		}
+		_, err = stream.Recv()
+		return stream, err
+	}
+
+	stream, err := watch("")
+	authorization := payTrailer(t, wallet, err, stream.Trailer())
+
+	if _, err := watch(authorization); err != nil {
+		t.Errorf("expected the stream to be served but got: %v", err)
+	}
+
+	// The token only pays for Watch
+	var trailer metadata.MD
+	_, err = client.Check(metadata.AppendToOutgoingContext(context.Background(), "authorization", authorization), &healthpb.HealthCheckRequest{}, grpc.Trailer(&trailer))
+	if code := status.Code(err); code != codes.Unauthenticated || len(trailer.Get("www-authenticate")) == 0 {
+		t.Errorf("expected a challenge but got: %v %v", err, trailer)
+	}
+}
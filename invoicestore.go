@@ -0,0 +1,84 @@
+package l402
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrUnknownInvoice = errors.New("unknown invoice")
+
+// InvoiceRecord is an invoice issued with a macaroon
+type InvoiceRecord struct {
+	PaymentHash Hash
+	Invoice     Invoice
+	AmountMsat  uint64
+	Memo        string
+	CreatedAt   time.Time
+}
+
+type InvoiceStore interface {
+	SaveInvoice(context.Context, InvoiceRecord) error
+	// Invoice returns the invoice issued with a payment hash, or ErrUnknownInvoice
+	Invoice(context.Context, Hash) (InvoiceRecord, error)
+}
+
+type memoryInvoiceStore struct {
+	mu       sync.RWMutex
+	invoices map[Hash]InvoiceRecord
+}
+
+func MemoryInvoiceStore() *memoryInvoiceStore {
+	return &memoryInvoiceStore{invoices: make(map[Hash]InvoiceRecord)}
+}
+
+func (s *memoryInvoiceStore) SaveInvoice(_ context.Context, record InvoiceRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.invoices[record.PaymentHash] = record
+	return nil
+}
+
+func (s *memoryInvoiceStore) Invoice(_ context.Context, paymentHash Hash) (InvoiceRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	record, found := s.invoices[paymentHash]
+	if !found {
+		return InvoiceRecord{}, ErrUnknownInvoice
+	}
+	return record, nil
+}
+
+type recordingInvoiceProvider struct {
+	invoices InvoiceProvider
+	store    InvoiceStore
+	now      func() time.Time
+}
+
+// RecordInvoices saves every invoice created by the provider in the store
+// An invoice that can't be saved isn't handed out, so every issued macaroon has its invoice on record
+func RecordInvoices(invoices InvoiceProvider, store InvoiceStore) InvoiceProvider {
+	return recordingInvoiceProvider{invoices: invoices, store: store, now: time.Now}
+}
+
+func (p recordingInvoiceProvider) CreateInvoice(ctx context.Context, amountMsat uint64, memo string) (Invoice, Hash, error) {
+	invoice, paymentHash, err := p.invoices.CreateInvoice(ctx, amountMsat, memo)
+	if err != nil {
+		return "", Hash{}, err
+	}
+
+	record := InvoiceRecord{
+		PaymentHash: paymentHash,
+		Invoice:     invoice,
+		AmountMsat:  amountMsat,
+		Memo:        memo,
+		CreatedAt:   p.now().UTC(),
+	}
+	if err := p.store.SaveInvoice(ctx, record); err != nil {
+		return "", Hash{}, err
+	}
+
+	return invoice, paymentHash, nil
+}
@@ -0,0 +1,35 @@
+package l402
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRecordInvoices(t *testing.T) {
+	ctx := context.Background()
+	store := MemoryInvoiceStore()
+
+	invoice, paymentHash, err := RecordInvoices(&fakeInvoiceProvider{}, store).CreateInvoice(ctx, 1000, "L402")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := store.Invoice(ctx, paymentHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if record.Invoice != invoice || record.AmountMsat != 1000 || record.Memo != "L402" || record.CreatedAt.IsZero() {
+		t.Errorf("unexpected record: %+v", record)
+	}
+
+	if _, err := store.Invoice(ctx, Hash{}); !errors.Is(err, ErrUnknownInvoice) {
+		t.Errorf("expected: %v but got: %v", ErrUnknownInvoice, err)
+	}
+
+	failing := &fakeInvoiceProvider{err: ErrFailedInvoiceRequest}
+	if _, _, err := RecordInvoices(failing, store).CreateInvoice(ctx, 1000, "L402"); !errors.Is(err, ErrFailedInvoiceRequest) {
+		t.Errorf("expected: %v but got: %v", ErrFailedInvoiceRequest, err)
+	}
+}
@@ -0,0 +1,87 @@
+package l402
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// appendJSONLine appends a record to a JSON lines file and syncs it, so a change costs a small write instead of a rewrite
+func appendJSONLine(filename string, record any) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	} else if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// readJSONLines passes every line of a JSON lines file to decode, and returns how many lines it read
+// A last line cut short by a crash, which isn't even valid JSON, is dropped from the file
+// Any other line that can't be decoded is an error
+// A whole last line without its newline, as written by the earlier single-object formats, is kept
+func readJSONLines(filename string, decode func(line []byte) error) (int, error) {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	lines := 0
+	for offset := 0; offset < len(data); {
+		line, terminated := data[offset:], false
+		if end := bytes.IndexByte(line, '\n'); end >= 0 {
+			line, terminated = line[:end], true
+		}
+		lines++
+
+		if len(bytes.TrimSpace(line)) == 0 {
+			offset += len(line) + 1
+			continue
+		}
+
+		if !terminated && !json.Valid(line) {
+			return lines - 1, os.Truncate(filename, int64(offset))
+		} else if err := decode(bytes.TrimSpace(line)); err != nil {
+			return 0, fmt.Errorf("%s: line %d: %w", filename, lines, err)
+		} else if !terminated {
+			return lines, appendNewline(filename)
+		}
+
+		offset += len(line) + 1
+	}
+	return lines, nil
+}
+
+func appendNewline(filename string) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write([]byte("\n")); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// shouldCompact tells whether a journal holds so many stale lines that it's worth rewriting it with only the live ones
+func shouldCompact(lines, live int) bool {
+	return lines > 2*live+1024
+}
@@ -0,0 +1,165 @@
+package l402
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Epoch numbers the secrets of a key manager, it's stored in the first 4 bytes of every Identifier.ID
+type Epoch uint32
+
+// EpochOf recovers the epoch of the secret that the root key of a macaroon ID was derived from
+func EpochOf(id ID) Epoch {
+	return Epoch(binary.BigEndian.Uint32(id[:4]))
+}
+
+// EpochSecret is the secret of an epoch, retired epochs can verify macaroons until their cutoff
+type EpochSecret struct {
+	Epoch  Epoch
+	Secret []byte
+	Cutoff time.Time // zero for the current epoch
+}
+
+var (
+	errRetiredEpoch   = errors.New("retired epoch")
+	errDuplicateEpoch = errors.New("duplicate epoch")
+	errShortSecret    = fmt.Errorf("secret shorter than %d bytes", BlockSize)
+)
+
+type keyManager struct {
+	mu      sync.RWMutex
+	current Epoch
+	epochs  map[Epoch]EpochSecret
+	caches  []TokenCache
+	now     func() time.Time
+}
+
+// KeyManager is a RootKeyStore that derives the root key of each macaroon from its ID and the secret of an epoch
+// New macaroons are signed with the current epoch, and the retired ones are kept for verification until their cutoff
+// Only the epoch secrets need to be stored, they must be at least BlockSize bytes long
+func KeyManager(current EpochSecret, retired ...EpochSecret) (*keyManager, error) {
+	m := &keyManager{
+		current: current.Epoch,
+		epochs:  make(map[Epoch]EpochSecret),
+		now:     time.Now,
+	}
+
+	current.Cutoff = time.Time{}
+	for _, epochSecret := range append([]EpochSecret{current}, retired...) {
+		if err := m.add(epochSecret); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// Rotate makes a new epoch current, macaroons of the previous epoch can be verified until the cutoff
+func (m *keyManager) Rotate(next EpochSecret, cutoff time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	next.Cutoff = time.Time{}
+	if err := m.add(next); err != nil {
+		return err
+	}
+
+	previous := m.epochs[m.current]
+	previous.Cutoff = cutoff
+	m.epochs[m.current] = previous
+	m.current = next.Epoch
+
+	m.invalidateOnCutoff(previous, m.caches)
+	return nil
+}
+
+// InvalidateOnCutoff makes the token caches forget the tokens of retired epochs once their cutoff passes
+// Cached tokens aren't verified again, so they'd be served until the cache ttl runs out otherwise
+func (m *keyManager) InvalidateOnCutoff(caches ...TokenCache) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.caches = append(m.caches, caches...)
+	for _, epochSecret := range m.epochs {
+		if !epochSecret.Cutoff.IsZero() {
+			m.invalidateOnCutoff(epochSecret, caches)
+		}
+	}
+}
+
+// invalidateOnCutoff revokes the tokens of an epoch in the caches at its cutoff, or right away if it has passed
+// Tokens verified later are rejected along with the root keys of the epoch, so they aren't cached again
+func (m *keyManager) invalidateOnCutoff(epochSecret EpochSecret, caches []TokenCache) {
+	if len(caches) == 0 {
+		return
+	}
+
+	invalidate := func() {
+		for _, cache := range caches {
+			cache.RevokeFunc(func(id ID) bool { return EpochOf(id) == epochSecret.Epoch })
+		}
+	}
+
+	if wait := epochSecret.Cutoff.Sub(m.now()); wait > 0 {
+		time.AfterFunc(wait, invalidate)
+	} else {
+		invalidate()
+	}
+}
+
+func (m *keyManager) add(epochSecret EpochSecret) error {
+	if _, found := m.epochs[epochSecret.Epoch]; found {
+		return fmt.Errorf("%w: %d", errDuplicateEpoch, epochSecret.Epoch)
+	} else if len(epochSecret.Secret) < BlockSize {
+		return fmt.Errorf("epoch %d: %w", epochSecret.Epoch, errShortSecret)
+	}
+
+	m.epochs[epochSecret.Epoch] = epochSecret
+	return nil
+}
+
+func (m *keyManager) NewRootKey(context.Context) (ID, []byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var id ID
+	binary.BigEndian.PutUint32(id[:4], uint32(m.current))
+	if _, err := rand.Read(id[4:]); err != nil {
+		return ID{}, nil, err
+	}
+
+	rootKey, err := deriveRootKey(m.epochs[m.current].Secret, id)
+	return id, rootKey, err
+}
+
+func (m *keyManager) RootKey(_ context.Context, id ID) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	epochSecret, found := m.epochs[EpochOf(id)]
+	if !found {
+		return nil, ErrUnknownRootKey
+	} else if !epochSecret.Cutoff.IsZero() && !m.now().Before(epochSecret.Cutoff) {
+		return nil, fmt.Errorf("%w: %w %d", ErrUnknownRootKey, errRetiredEpoch, epochSecret.Epoch)
+	}
+
+	return deriveRootKey(epochSecret.Secret, id)
+}
+
+// deriveRootKey expands the secret into the root key of a macaroon ID with HKDF-SHA256
+func deriveRootKey(secret []byte, id ID) ([]byte, error) {
+	rootKey := make([]byte, BlockSize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, append([]byte("l402 root key "), id[:]...)), rootKey); err != nil {
+		return nil, err
+	}
+	return rootKey, nil
+}
@@ -0,0 +1,144 @@
+package l402
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+func TestKeyManager(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	manager, err := KeyManager(EpochSecret{Epoch: 1, Secret: bytes.Repeat([]byte{1}, BlockSize)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.now = func() time.Time { return now }
+
+	oldID, oldRootKey, _ := manager.NewRootKey(ctx)
+
+	if err := manager.Rotate(EpochSecret{Epoch: 2, Secret: bytes.Repeat([]byte{2}, BlockSize)}, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	newID, newRootKey, _ := manager.NewRootKey(ctx)
+
+	if epoch := EpochOf(newID); epoch != 2 {
+		t.Errorf("expected: %d but got: %d", 2, epoch)
+	}
+
+	tests := map[string]struct {
+		id              ID
+		elapsed         time.Duration
+		expectedRootKey []byte
+		expectedError   error
+	}{
+		"current epoch": {
+			id:              newID,
+			elapsed:         time.Hour,
+			expectedRootKey: newRootKey,
+		},
+		"retired epoch before its cutoff": {
+			id:              oldID,
+			expectedRootKey: oldRootKey,
+		},
+		"retired epoch after its cutoff": {
+			id:            oldID,
+			elapsed:       time.Hour,
+			expectedError: errRetiredEpoch,
+		},
+		"unknown epoch": {
+			id:            ID{0, 0, 0, 3},
+			expectedError: ErrUnknownRootKey,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			manager.now = func() time.Time { return now.Add(test.elapsed) }
+
+			rootKey, err := manager.RootKey(ctx, test.id)
+
+			if !errors.Is(err, test.expectedError) {
+				t.Errorf("expected: %v but got: %v", test.expectedError, err)
+			}
+
+			if !bytes.Equal(rootKey, test.expectedRootKey) {
+				t.Errorf("expected: %x but got: %x", test.expectedRootKey, rootKey)
+			}
+		})
+	}
+}
+
+func TestKeyManager_InvalidateOnCutoff(t *testing.T) {
+	now := time.Now()
+
+	manager, err := KeyManager(EpochSecret{Epoch: 2, Secret: bytes.Repeat([]byte{2}, BlockSize)},
+		EpochSecret{Epoch: 1, Secret: bytes.Repeat([]byte{1}, BlockSize), Cutoff: now.Add(-time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.now = func() time.Time { return now }
+
+	cache := MemoryTokenCache(10, time.Hour)
+	for epoch := range Epoch(4) {
+		cache.Add(Hash{byte(epoch)}, VerifiedToken{Macaroons: map[Identifier]*macaroon.Macaroon{{ID: ID{0, 0, 0, byte(epoch)}}: nil}}, cache.Generation())
+	}
+
+	manager.InvalidateOnCutoff(cache)
+
+	if err := manager.Rotate(EpochSecret{Epoch: 3, Secret: bytes.Repeat([]byte{3}, BlockSize)}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		key           Hash
+		expectedFound bool
+	}{
+		"retired epoch past its cutoff": {key: Hash{1}},
+		"epoch rotated at once":         {key: Hash{2}},
+		"current epoch":                 {key: Hash{3}, expectedFound: true},
+		"unknown epoch":                 {key: Hash{0}, expectedFound: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, found := cache.Get(test.key); found != test.expectedFound {
+				t.Errorf("expected: %v but got: %v", test.expectedFound, found)
+			}
+		})
+	}
+}
+
+func TestKeyManager_InvalidSecrets(t *testing.T) {
+	secret := bytes.Repeat([]byte{1}, BlockSize)
+
+	tests := map[string]struct {
+		current       EpochSecret
+		retired       []EpochSecret
+		expectedError error
+	}{
+		"short secret": {
+			current:       EpochSecret{Epoch: 1, Secret: []byte("short")},
+			expectedError: errShortSecret,
+		},
+		"duplicate epoch": {
+			current:       EpochSecret{Epoch: 1, Secret: secret},
+			retired:       []EpochSecret{{Epoch: 1, Secret: secret}},
+			expectedError: errDuplicateEpoch,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := KeyManager(test.current, test.retired...); !errors.Is(err, test.expectedError) {
+				t.Errorf("expected: %v but got: %v", test.expectedError, err)
+			}
+		})
+	}
+}
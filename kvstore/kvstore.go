@@ -0,0 +1,292 @@
+// Package kvstore keeps the state of the L402 flow in an append-only log file, for single node deployments without a database
+package kvstore
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gofeuer/l402"
+)
+
+// compactionThreshold is how many overwritten records the log holds before it's compacted
+const compactionThreshold = 10_000
+
+// Store implements l402.RootKeyStore, l402.RootKeyDeleter, l402.SealedRootKeyStore, l402.InvoiceStore, l402.RevocationStore and l402.UsageCounter
+// Every change is appended to the log and synced before it's acknowledged
+type Store struct {
+	mu       sync.RWMutex
+	filename string
+	file     *os.File
+	values   map[bucket]map[string][]byte
+	size     int64
+	stale    int // overwritten records still in the log
+	now      func() time.Time
+}
+
+// Open replays the log, truncating the torn record left by a crash if any
+// A corrupt record in the middle of the log fails to open it, instead of dropping the records after it
+func Open(filename string) (*Store, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		filename: filename,
+		file:     file,
+		values:   make(map[bucket]map[string][]byte),
+		now:      time.Now,
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	valid, err := readRecords(file, info.Size(), s.apply)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	if err := file.Truncate(valid); err != nil {
+		file.Close()
+		return nil, err
+	}
+	s.size = valid
+
+	return s, nil
+}
+
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// apply sets the value of a record, an empty value is a tombstone deleting the key
+func (s *Store) apply(b bucket, key, value []byte) {
+	values, found := s.values[b]
+	if !found {
+		values = make(map[string][]byte)
+		s.values[b] = values
+	}
+	if _, found := values[string(key)]; found {
+		s.stale++
+	}
+	if len(value) == 0 {
+		s.stale++ // The tombstone itself is left out of the next compaction
+		delete(values, string(key))
+		return
+	}
+	values[string(key)] = value
+}
+
+func (s *Store) get(b bucket, key []byte) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, found := s.values[b][string(key)]
+	return value, found
+}
+
+// putLocked appends a record and syncs it, the value is only visible once it's durable
+// A failed append is truncated, so it can't hide the records appended after it
+func (s *Store) putLocked(b bucket, key, value []byte) error {
+	record := encodeRecord(b, key, value)
+	if _, err := s.file.Write(record); err != nil {
+		s.file.Truncate(s.size) //nolint:errcheck
+		return err
+	} else if err := s.file.Sync(); err != nil {
+		s.file.Truncate(s.size) //nolint:errcheck
+		return err
+	}
+
+	s.size += int64(len(record))
+	s.apply(b, key, value)
+	if s.stale >= compactionThreshold {
+		return s.compactLocked()
+	}
+	return nil
+}
+
+// Compact rewrites the log with only the current values
+func (s *Store) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compactLocked()
+}
+
+func (s *Store) compactLocked() error {
+	if err := writeFileAtomic(s.filename, s.writeSnapshotLocked); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.filename, os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file.Close()
+	s.file = file
+	s.size = info.Size()
+	s.stale = 0
+	return nil
+}
+
+// Backup writes a compacted copy of the log, which can be opened as is to restore the store
+func (s *Store) Backup(w io.Writer) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.writeSnapshotLocked(w)
+}
+
+func (s *Store) writeSnapshotLocked(w io.Writer) error {
+	buffered := bufio.NewWriter(w)
+	for b, values := range s.values {
+		for key, value := range values {
+			if _, err := buffered.Write(encodeRecord(b, []byte(key), value)); err != nil {
+				return err
+			}
+		}
+	}
+	return buffered.Flush()
+}
+
+func (s *Store) NewRootKey(context.Context) (l402.ID, []byte, error) {
+	var id l402.ID
+	rootKey := make([]byte, l402.BlockSize)
+	if _, err := rand.Read(id[:]); err != nil {
+		return l402.ID{}, nil, err
+	} else if _, err := rand.Read(rootKey); err != nil {
+		return l402.ID{}, nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.putLocked(bucketRootKeys, id[:], rootKey); err != nil {
+		return l402.ID{}, nil, err
+	}
+	return id, rootKey, nil
+}
+
+func (s *Store) RootKey(_ context.Context, id l402.ID) ([]byte, error) {
+	rootKey, found := s.get(bucketRootKeys, id[:])
+	if !found {
+		return nil, l402.ErrUnknownRootKey
+	}
+	return append([]byte(nil), rootKey...), nil
+}
+
+// DeleteRootKey implements l402.RootKeyDeleter
+func (s *Store) DeleteRootKey(_ context.Context, id l402.ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.values[bucketRootKeys][string(id[:])]; !found {
+		return nil
+	}
+	return s.putLocked(bucketRootKeys, id[:], nil)
+}
+
+func (s *Store) SaveSealedRootKey(_ context.Context, id l402.ID, sealed []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.putLocked(bucketSealedRootKeys, id[:], append([]byte(nil), sealed...))
+}
+
+func (s *Store) SealedRootKey(_ context.Context, id l402.ID) ([]byte, error) {
+	sealed, found := s.get(bucketSealedRootKeys, id[:])
+	if !found {
+		return nil, l402.ErrUnknownRootKey
+	}
+	return append([]byte(nil), sealed...), nil
+}
+
+func (s *Store) DeleteSealedRootKey(_ context.Context, id l402.ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.values[bucketSealedRootKeys][string(id[:])]; !found {
+		return nil
+	}
+	return s.putLocked(bucketSealedRootKeys, id[:], nil)
+}
+
+func (s *Store) SealedRootKeyIDs(context.Context) ([]l402.ID, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := make([]l402.ID, 0, len(s.values[bucketSealedRootKeys]))
+	for key := range s.values[bucketSealedRootKeys] {
+		ids = append(ids, l402.ID([]byte(key)))
+	}
+	return ids, nil
+}
+
+func (s *Store) SaveInvoice(_ context.Context, record l402.InvoiceRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.putLocked(bucketInvoices, record.PaymentHash[:], value)
+}
+
+func (s *Store) Invoice(_ context.Context, paymentHash l402.Hash) (l402.InvoiceRecord, error) {
+	value, found := s.get(bucketInvoices, paymentHash[:])
+	if !found {
+		return l402.InvoiceRecord{}, l402.ErrUnknownInvoice
+	}
+
+	var record l402.InvoiceRecord
+	err := json.Unmarshal(value, &record)
+	return record, err
+}
+
+func (s *Store) Revoke(_ context.Context, id l402.ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.values[bucketRevocations][string(id[:])]; found {
+		return nil
+	}
+	return s.putLocked(bucketRevocations, id[:], binary.BigEndian.AppendUint64(nil, uint64(s.now().Unix()))) //nolint:gosec
+}
+
+func (s *Store) Revoked(_ context.Context, id l402.ID) (bool, error) {
+	_, revoked := s.get(bucketRevocations, id[:])
+	return revoked, nil
+}
+
+func (s *Store) Add(_ context.Context, id l402.ID, n int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var total int64
+	if value, found := s.values[bucketUsage][string(id[:])]; found {
+		total = int64(binary.BigEndian.Uint64(value)) //nolint:gosec
+	}
+	if n == 0 {
+		return total, nil
+	}
+
+	total += n
+	if err := s.putLocked(bucketUsage, id[:], binary.BigEndian.AppendUint64(nil, uint64(total))); err != nil { //nolint:gosec
+		return 0, err
+	}
+	return total, nil
+}
@@ -0,0 +1,272 @@
+package kvstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofeuer/l402"
+)
+
+var (
+	_ l402.RootKeyStore       = (*Store)(nil)
+	_ l402.SealedRootKeyStore = (*Store)(nil)
+	_ l402.InvoiceStore       = (*Store)(nil)
+	_ l402.RevocationStore    = (*Store)(nil)
+	_ l402.UsageCounter       = (*Store)(nil)
+)
+
+func openStore(t *testing.T, filename string) *Store {
+	t.Helper()
+
+	store, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "l402.log")
+	store := openStore(t, filename)
+
+	id, rootKey, err := store.NewRootKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := l402.InvoiceRecord{PaymentHash: l402.Hash{1}, Invoice: "lnbc1", AmountMsat: 1000, CreatedAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	store.SaveInvoice(ctx, record) //nolint:errcheck
+	store.Revoke(ctx, l402.ID{2})  //nolint:errcheck
+	store.Add(ctx, id, 100)        //nolint:errcheck
+	store.Add(ctx, id, 50)         //nolint:errcheck
+	store.Close()
+
+	reopened := openStore(t, filename)
+
+	if storedRootKey, err := reopened.RootKey(ctx, id); err != nil || !bytes.Equal(storedRootKey, rootKey) {
+		t.Errorf("expected: %x but got: %x %v", rootKey, storedRootKey, err)
+	}
+
+	if _, err := reopened.RootKey(ctx, l402.ID{}); !errors.Is(err, l402.ErrUnknownRootKey) {
+		t.Errorf("expected: %v but got: %v", l402.ErrUnknownRootKey, err)
+	}
+
+	if stored, err := reopened.Invoice(ctx, record.PaymentHash); err != nil || stored != record {
+		t.Errorf("expected: %+v but got: %+v %v", record, stored, err)
+	}
+
+	if _, err := reopened.Invoice(ctx, l402.Hash{2}); !errors.Is(err, l402.ErrUnknownInvoice) {
+		t.Errorf("expected: %v but got: %v", l402.ErrUnknownInvoice, err)
+	}
+
+	if revoked, _ := reopened.Revoked(ctx, l402.ID{2}); !revoked {
+		t.Error("expected the ID to be revoked")
+	}
+
+	if total, _ := reopened.Add(ctx, id, 0); total != 150 {
+		t.Errorf("expected: %d but got: %d", 150, total)
+	}
+
+	// Deleted root keys stay deleted after reopening and compacting the log
+	if err := reopened.DeleteRootKey(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	reopened.Close()
+
+	compacted := openStore(t, filename)
+	if err := compacted.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := compacted.RootKey(ctx, id); !errors.Is(err, l402.ErrUnknownRootKey) {
+		t.Errorf("expected: %v but got: %v", l402.ErrUnknownRootKey, err)
+	}
+}
+
+func TestStore_SealedRootKeys(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "l402.log")
+	oldKEK := l402.KeyEncryptionKey{ID: "2024", Key: bytes.Repeat([]byte{1}, l402.BlockSize)}
+	newKEK := l402.KeyEncryptionKey{ID: "2025", Key: bytes.Repeat([]byte{2}, l402.BlockSize)}
+
+	store := openStore(t, filename)
+	rootKeys, _ := l402.EncryptedRootKeys(store, oldKEK)
+	id, rootKey, err := rootKeys.NewRootKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	if data, _ := os.ReadFile(filename); bytes.Contains(data, rootKey) {
+		t.Error("expected the root key to be encrypted")
+	}
+
+	reopened := openStore(t, filename)
+	rotated, _ := l402.EncryptedRootKeys(reopened, newKEK, oldKEK)
+	if err := rotated.Rewrap(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	rewrapped, _ := l402.EncryptedRootKeys(reopened, newKEK)
+	if storedRootKey, err := rewrapped.RootKey(ctx, id); err != nil || !bytes.Equal(storedRootKey, rootKey) {
+		t.Errorf("expected: %x but got: %x %v", rootKey, storedRootKey, err)
+	}
+}
+
+func TestStore_CrashRecovery(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "l402.log")
+	store := openStore(t, filename)
+
+	store.Add(ctx, l402.ID{1}, 100) //nolint:errcheck
+	store.Add(ctx, l402.ID{1}, 50)  //nolint:errcheck
+	store.Close()
+
+	tests := map[string]struct {
+		truncate      int64
+		expectedTotal int64
+	}{
+		"torn payload": {truncate: 3, expectedTotal: 100},
+		"torn header":  {truncate: recordHeaderSize + 3 + l402.BlockSize + 8 - 4, expectedTotal: 100},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			info, _ := os.Stat(filename)
+			os.Truncate(filename, info.Size()-test.truncate) //nolint:errcheck
+
+			recovered := openStore(t, filename)
+			if total, _ := recovered.Add(ctx, l402.ID{1}, 0); total != test.expectedTotal {
+				t.Errorf("expected: %d but got: %d", test.expectedTotal, total)
+			}
+
+			// Appends after the recovery aren't hidden by the torn record
+			recovered.Add(ctx, l402.ID{1}, 1) //nolint:errcheck
+			recovered.Close()
+
+			reopened := openStore(t, filename)
+			if total, _ := reopened.Add(ctx, l402.ID{1}, 0); total != test.expectedTotal+1 {
+				t.Errorf("expected: %d but got: %d", test.expectedTotal+1, total)
+			}
+			reopened.Close()
+
+			// Every case tears the second record
+			os.Truncate(filename, info.Size()) //nolint:errcheck
+		})
+	}
+}
+
+func TestStore_Corruption(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "l402.log")
+	store := openStore(t, filename)
+
+	store.Add(ctx, l402.ID{1}, 100) //nolint:errcheck
+	store.Add(ctx, l402.ID{1}, 50)  //nolint:errcheck
+	store.Close()
+
+	data, _ := os.ReadFile(filename)
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(filename, data, 0o600) //nolint:errcheck
+
+	if total, _ := openStore(t, filename).Add(ctx, l402.ID{1}, 0); total != 100 {
+		t.Errorf("expected: %d but got: %d", 100, total)
+	}
+}
+
+func TestStore_CorruptionInTheMiddle(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "l402.log")
+	store := openStore(t, filename)
+
+	store.Add(ctx, l402.ID{1}, 100) //nolint:errcheck
+	store.Add(ctx, l402.ID{1}, 50)  //nolint:errcheck
+	store.Add(ctx, l402.ID{1}, 25)  //nolint:errcheck
+	store.Close()
+
+	data, _ := os.ReadFile(filename)
+	recordSize := len(data) / 3
+	data[recordSize+recordHeaderSize+1] ^= 0xff
+	os.WriteFile(filename, data, 0o600) //nolint:errcheck
+
+	if _, err := Open(filename); !errors.Is(err, errCorruptRecord) {
+		t.Errorf("expected: %v but got: %v", errCorruptRecord, err)
+	}
+
+	// The log is left as it was, for an operator to repair
+	if info, _ := os.Stat(filename); info.Size() != int64(len(data)) {
+		t.Errorf("expected: %d but got: %d", len(data), info.Size())
+	}
+}
+
+func TestStore_TornLength(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "l402.log")
+	store := openStore(t, filename)
+
+	store.Add(ctx, l402.ID{1}, 100) //nolint:errcheck
+	store.Close()
+
+	// A torn header claiming a huge payload isn't allocated, it's dropped
+	file, _ := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0o600)
+	file.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 1}) //nolint:errcheck
+	file.Close()
+
+	if total, _ := openStore(t, filename).Add(ctx, l402.ID{1}, 0); total != 100 {
+		t.Errorf("expected: %d but got: %d", 100, total)
+	}
+}
+
+func TestStore_Compact(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "l402.log")
+	store := openStore(t, filename)
+
+	for range 100 {
+		store.Add(ctx, l402.ID{1}, 1) //nolint:errcheck
+	}
+	before, _ := os.Stat(filename)
+
+	if err := store.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	store.Add(ctx, l402.ID{2}, 1) //nolint:errcheck
+
+	after, _ := os.Stat(filename)
+	if after.Size() >= before.Size() {
+		t.Errorf("expected the log to shrink from %d bytes but got: %d", before.Size(), after.Size())
+	}
+
+	store.Close()
+	reopened := openStore(t, filename)
+	for id, expectedTotal := range map[l402.ID]int64{{1}: 100, {2}: 1} {
+		if total, _ := reopened.Add(ctx, id, 0); total != expectedTotal {
+			t.Errorf("expected: %d but got: %d", expectedTotal, total)
+		}
+	}
+}
+
+func TestStore_Backup(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store := openStore(t, filepath.Join(dir, "l402.log"))
+	id, rootKey, _ := store.NewRootKey(ctx)
+
+	var backup bytes.Buffer
+	if err := store.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(dir, "restored.log")
+	os.WriteFile(filename, backup.Bytes(), 0o600) //nolint:errcheck
+
+	if restoredRootKey, err := openStore(t, filename).RootKey(ctx, id); err != nil || !bytes.Equal(restoredRootKey, rootKey) {
+		t.Errorf("expected: %x but got: %x %v", rootKey, restoredRootKey, err)
+	}
+}
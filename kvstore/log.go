@@ -0,0 +1,116 @@
+package kvstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// A record is the length and the CRC-32 of its payload, followed by the payload:
+// the bucket, the length of the key, the key and the value
+const recordHeaderSize = 8
+
+type bucket byte
+
+const (
+	bucketRootKeys bucket = iota + 1
+	bucketInvoices
+	bucketRevocations
+	bucketUsage
+	bucketSealedRootKeys
+)
+
+var errCorruptRecord = errors.New("corrupt record")
+
+func encodeRecord(b bucket, key, value []byte) []byte {
+	payload := make([]byte, 0, 3+len(key)+len(value))
+	payload = append(payload, byte(b))
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(key))) //nolint:gosec
+	payload = append(payload, key...)
+	payload = append(payload, value...)
+
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload))) //nolint:gosec
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	return append(record, payload...)
+}
+
+// readRecords calls apply for every record of a log of size bytes and returns the size of its valid part
+// A torn or corrupt last record, which is what a crash in the middle of an append leaves behind, ends the valid part
+// A corrupt record followed by others is an error, dropping them would lose acknowledged writes
+func readRecords(r io.Reader, size int64, apply func(b bucket, key, value []byte)) (int64, error) {
+	reader := bufio.NewReader(r)
+	var valid int64
+	header := make([]byte, recordHeaderSize)
+
+	for {
+		if _, err := io.ReadFull(reader, header); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return valid, nil
+		} else if err != nil {
+			return valid, err
+		}
+
+		// The length isn't trusted, a record running past the end of the log was torn
+		length := int64(binary.BigEndian.Uint32(header[0:4]))
+		end := valid + recordHeaderSize + length
+		if end > size {
+			return valid, nil
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return valid, nil
+		} else if err != nil {
+			return valid, err
+		}
+
+		b, key, value, err := decodePayload(payload, binary.BigEndian.Uint32(header[4:8]))
+		if err != nil && end == size {
+			return valid, nil
+		} else if err != nil {
+			return valid, fmt.Errorf("%w at offset %d", err, valid)
+		}
+
+		apply(b, key, value)
+		valid = end
+	}
+}
+
+func decodePayload(payload []byte, checksum uint32) (bucket, []byte, []byte, error) {
+	if crc32.ChecksumIEEE(payload) != checksum || len(payload) < 3 {
+		return 0, nil, nil, errCorruptRecord
+	}
+
+	keySize := int(binary.BigEndian.Uint16(payload[1:3]))
+	if len(payload) < 3+keySize {
+		return 0, nil, nil, errCorruptRecord
+	}
+	return bucket(payload[0]), payload[3 : 3+keySize], payload[3+keySize:], nil
+}
+
+// writeFileAtomic writes to a temporary file and renames it over the destination,
+// so the log is either the previous one or the compacted one if the process crashes
+func writeFileAtomic(filename string, write func(io.Writer) error) error {
+	file, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name()) //nolint:errcheck
+
+	if err := write(file); err != nil {
+		file.Close()
+		return fmt.Errorf("%s: %w", filename, err)
+	} else if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	} else if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), filename)
+}
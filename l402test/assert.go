@@ -0,0 +1,76 @@
+package l402test
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gofeuer/l402"
+)
+
+// Challenge is the L402 challenge of a 402 response
+type Challenge struct {
+	Macaroon   string // base64
+	Invoice    l402.Invoice
+	Identifier l402.Identifier
+}
+
+// AssertPaymentRequired checks that a response is a 402 with an L402 challenge, and returns the challenge
+// The challenged macaroon must decode to a single macaroon
+func AssertPaymentRequired(t testing.TB, response *http.Response) Challenge {
+	t.Helper()
+
+	if response.StatusCode != http.StatusPaymentRequired {
+		t.Fatalf("expected: %d but got: %d", http.StatusPaymentRequired, response.StatusCode)
+	}
+
+	for _, value := range response.Header.Values("WWW-Authenticate") {
+		challenge := challengeMatcher.FindStringSubmatch(value)
+		if len(challenge) != 3 {
+			continue
+		}
+
+		macaroons, err := l402.UnmarshalMacaroons(challenge[1])
+		if err != nil {
+			t.Fatalf("expected a valid macaroon but got: %v", err)
+		} else if len(macaroons) != 1 {
+			t.Fatalf("expected: %d but got: %d macaroons", 1, len(macaroons))
+		}
+
+		return Challenge{Macaroon: challenge[1], Invoice: l402.Invoice(challenge[2]), Identifier: l402.SortedIdentifiers(macaroons)[0]}
+	}
+
+	t.Fatalf("expected an L402 challenge but got: %q", response.Header.Values("WWW-Authenticate"))
+	return Challenge{}
+}
+
+// AssertRejected checks that a response is a 402 with an L402 challenge, whose body describes the rejection
+// Both plain text and Problem Details bodies are understood
+func AssertRejected(t testing.TB, response *http.Response, rejection l402.Rejection) Challenge {
+	t.Helper()
+
+	challenge := AssertPaymentRequired(t, response)
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	detail := string(body)
+	if mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type")); mediaType == l402.ProblemContentType {
+		var problem l402.Problem
+		if err := json.Unmarshal(body, &problem); err != nil {
+			t.Fatalf("expected Problem Details but got: %v", err)
+		}
+		detail = problem.Detail
+	}
+
+	if !strings.Contains(detail, rejection.Error()) {
+		t.Errorf("expected: %q but got: %q", rejection.Error(), detail)
+	}
+
+	return challenge
+}
@@ -0,0 +1,147 @@
+package l402test
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofeuer/l402"
+)
+
+func TestWallet_Pay(t *testing.T) {
+	ctx := context.Background()
+	node := NewNode()
+	wallet := NewWallet(node)
+
+	invoice, paymentHash, err := node.CreateInvoice(ctx, 1500, "L402 GET /")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if amountMsat, ok := invoice.AmountMsat(); !ok || amountMsat != 1500 {
+		t.Errorf("expected: %d but got: %d", 1500, amountMsat)
+	}
+
+	preimage, err := wallet.Pay(ctx, invoice)
+	if err != nil {
+		t.Fatal(err)
+	} else if sha256.Sum256(preimage[:]) != paymentHash {
+		t.Errorf("expected: %x but got: %x", paymentHash, sha256.Sum256(preimage[:]))
+	}
+
+	if state, _ := node.State(paymentHash); state != StateSettled {
+		t.Errorf("expected: %s but got: %s", StateSettled, state)
+	}
+
+	if _, err := wallet.Pay(ctx, invoice); !errors.Is(err, ErrInvoiceNotOpen) {
+		t.Errorf("expected: %v but got: %v", ErrInvoiceNotOpen, err)
+	}
+
+	if _, err := wallet.Pay(ctx, "lnbcrt10p1unknown"); !errors.Is(err, ErrUnknownInvoice) {
+		t.Errorf("expected: %v but got: %v", ErrUnknownInvoice, err)
+	}
+
+	if wallet.SpentMsat() != 1500 {
+		t.Errorf("expected: %d but got: %d", 1500, wallet.SpentMsat())
+	}
+}
+
+func TestProxy(t *testing.T) {
+	rootKeys := l402.MemoryRootKeyStore()
+	node := NewNode()
+	minter := l402.Minter(node, rootKeys, l402.FixedPrice(1000, l402.NewCaveat(l402.PathCondition, "/videos")))
+	handler := l402.Proxy(minter, l402.Authority(rootKeys))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(authorization string) *http.Response {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/videos/1", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	t.Run("paid challenge", func(t *testing.T) {
+		response := serve("")
+		AssertRejected(t, response, l402.ErrPaymentRequired)
+
+		authorization, err := NewWallet(node).PayChallenge(context.Background(), response.Header)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if response := serve(authorization); response.StatusCode != http.StatusOK {
+			t.Errorf("expected: %d but got: %d", http.StatusOK, response.StatusCode)
+		}
+	})
+
+	t.Run("token", func(t *testing.T) {
+		if response := serve(NewToken(t, rootKeys).Authorization()); response.StatusCode != http.StatusOK {
+			t.Errorf("expected: %d but got: %d", http.StatusOK, response.StatusCode)
+		}
+	})
+
+	t.Run("expired token", func(t *testing.T) {
+		AssertRejected(t, serve(ExpiredToken(t, rootKeys).Authorization()), l402.ErrUnsatisfiedCaveat)
+	})
+
+	t.Run("attenuated token", func(t *testing.T) {
+		token := AttenuatedToken(t, NewToken(t, rootKeys), l402.NewCaveat(l402.PathCondition, "/photos"))
+		AssertRejected(t, serve(token.Authorization()), l402.ErrUnsatisfiedCaveat)
+	})
+
+	t.Run("forged token", func(t *testing.T) {
+		AssertRejected(t, serve(NewToken(t, l402.MemoryRootKeyStore()).Authorization()), l402.ErrUnknownRootKey)
+	})
+}
+
+func TestNode_HoldInvoice(t *testing.T) {
+	ctx := context.Background()
+	rootKeys := l402.MemoryRootKeyStore()
+	node := NewNode()
+	wallet := NewWallet(node)
+
+	escrow := l402.Escrow{Invoices: node, Secret: []byte("secret")}
+	handler := l402.Proxy(l402.EscrowMinter(escrow, rootKeys, l402.FixedPrice(1000)), l402.Authority(rootKeys), l402.WithEscrow(escrow))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	challenge := AssertPaymentRequired(t, w.Result())
+
+	if _, err := wallet.Pay(ctx, challenge.Invoice); !errors.Is(err, ErrPaymentHeld) {
+		t.Fatalf("expected: %v but got: %v", ErrPaymentHeld, err)
+	}
+
+	if _, err := wallet.Preimage(challenge.Identifier.PaymentHash); !errors.Is(err, ErrNotSettled) {
+		t.Errorf("expected: %v but got: %v", ErrNotSettled, err)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "L402 "+challenge.Macaroon)
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected: %d but got: %d", http.StatusOK, w.Code)
+	}
+
+	preimage, err := wallet.Preimage(challenge.Identifier.PaymentHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := Token{Macaroon: challenge.Macaroon, Preimage: preimage, Identifier: challenge.Identifier}
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", token.Authorization())
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected: %d but got: %d", http.StatusOK, w.Code)
+	}
+}
@@ -0,0 +1,200 @@
+// Package l402test provides a fake lightning node, a fake wallet, token builders and assertions for testing code that uses l402
+package l402test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/gofeuer/l402"
+)
+
+// InvoiceState is the state of an invoice of the fake node
+type InvoiceState string
+
+const (
+	StateOpen     InvoiceState = "open"
+	StateAccepted InvoiceState = "accepted" // a hold invoice paid but not settled yet
+	StateSettled  InvoiceState = "settled"
+	StateCanceled InvoiceState = "canceled"
+)
+
+var (
+	ErrUnknownInvoice = errors.New("unknown invoice")
+	ErrInvoiceNotOpen = errors.New("invoice not open")
+	ErrNotAccepted    = errors.New("invoice not accepted")
+)
+
+type invoice struct {
+	invoice    l402.Invoice
+	amountMsat uint64
+	memo       string
+	preimage   l402.Hash
+	known      bool // false for hold invoices until they're settled
+	hold       bool
+	state      InvoiceState
+}
+
+// Node is a fake lightning node, it implements l402.InvoiceProvider and l402.HoldInvoiceProvider
+// Invoices have real random preimages, and are paid by a Wallet
+type Node struct {
+	mu       sync.Mutex
+	invoices map[l402.Hash]*invoice
+	hashes   map[l402.Invoice]l402.Hash
+}
+
+func NewNode() *Node {
+	return &Node{
+		invoices: make(map[l402.Hash]*invoice),
+		hashes:   make(map[l402.Invoice]l402.Hash),
+	}
+}
+
+func (n *Node) CreateInvoice(_ context.Context, amountMsat uint64, memo string) (l402.Invoice, l402.Hash, error) {
+	var preimage l402.Hash
+	if _, err := rand.Read(preimage[:]); err != nil {
+		return "", l402.Hash{}, err
+	}
+
+	paymentHash := l402.Hash(sha256.Sum256(preimage[:]))
+	return n.add(&invoice{amountMsat: amountMsat, memo: memo, preimage: preimage, known: true}, paymentHash), paymentHash, nil
+}
+
+func (n *Node) CreateHoldInvoice(_ context.Context, paymentHash l402.Hash, amountMsat uint64, memo string) (l402.Invoice, error) {
+	return n.add(&invoice{amountMsat: amountMsat, memo: memo, hold: true}, paymentHash), nil
+}
+
+func (n *Node) add(i *invoice, paymentHash l402.Hash) l402.Invoice {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	i.invoice = encodeInvoice(i.amountMsat, paymentHash)
+	i.state = StateOpen
+	n.invoices[paymentHash] = i
+	n.hashes[i.invoice] = paymentHash
+	return i.invoice
+}
+
+func (n *Node) Accepted(_ context.Context, paymentHash l402.Hash) (bool, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	i, found := n.invoices[paymentHash]
+	if !found {
+		return false, ErrUnknownInvoice
+	}
+	return i.state == StateAccepted, nil
+}
+
+func (n *Node) SettleInvoice(_ context.Context, preimage l402.Hash) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	i, found := n.invoices[sha256.Sum256(preimage[:])]
+	if !found {
+		return ErrUnknownInvoice
+	} else if i.state != StateAccepted {
+		return fmt.Errorf("%w: %s", ErrNotAccepted, i.state)
+	}
+
+	i.preimage, i.known, i.state = preimage, true, StateSettled
+	return nil
+}
+
+func (n *Node) CancelInvoice(_ context.Context, paymentHash l402.Hash) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	i, found := n.invoices[paymentHash]
+	if !found {
+		return ErrUnknownInvoice
+	} else if i.state == StateSettled {
+		return fmt.Errorf("%w: %s", ErrInvoiceNotOpen, i.state)
+	}
+
+	i.state = StateCanceled
+	return nil
+}
+
+// State tells the state of the invoice with the payment hash
+func (n *Node) State(paymentHash l402.Hash) (InvoiceState, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	i, found := n.invoices[paymentHash]
+	if !found {
+		return "", false
+	}
+	return i.state, true
+}
+
+// PaymentHash finds the payment hash of an invoice issued by the node
+func (n *Node) PaymentHash(inv l402.Invoice) (l402.Hash, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	paymentHash, found := n.hashes[inv]
+	return paymentHash, found
+}
+
+// pay settles a regular invoice and returns its preimage, hold invoices are only accepted
+func (n *Node) pay(inv l402.Invoice) (uint64, l402.Hash, bool, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	i, found := n.invoices[n.hashes[inv]]
+	if !found {
+		return 0, l402.Hash{}, false, ErrUnknownInvoice
+	} else if i.state != StateOpen {
+		return 0, l402.Hash{}, false, fmt.Errorf("%w: %s", ErrInvoiceNotOpen, i.state)
+	}
+
+	if i.hold {
+		i.state = StateAccepted
+		return i.amountMsat, l402.Hash{}, false, nil
+	}
+
+	i.state = StateSettled
+	return i.amountMsat, i.preimage, true, nil
+}
+
+// preimage returns the preimage of a settled invoice
+func (n *Node) preimage(paymentHash l402.Hash) (l402.Hash, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	i, found := n.invoices[paymentHash]
+	if !found || i.state != StateSettled || !i.known {
+		return l402.Hash{}, false
+	}
+	return i.preimage, true
+}
+
+// bech32Charset is the alphabet of the data part of BOLT 11 invoices
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// encodeInvoice makes a regtest invoice string whose amount l402.Invoice.AmountMsat can parse
+// It isn't a valid BOLT 11 invoice, the data part only encodes the payment hash
+func encodeInvoice(amountMsat uint64, paymentHash l402.Hash) l402.Invoice {
+	data := make([]byte, 0, (len(paymentHash)*8+4)/5)
+	var buffer, bits uint
+	for _, b := range paymentHash {
+		buffer, bits = buffer<<8|uint(b), bits+8
+		for bits >= 5 {
+			bits -= 5
+			data = append(data, bech32Charset[buffer>>bits&31])
+		}
+	}
+	if bits > 0 {
+		data = append(data, bech32Charset[buffer<<(5-bits)&31])
+	}
+
+	if amountMsat == 0 {
+		return l402.Invoice("lnbcrt1" + string(data))
+	}
+	// Pico-bitcoins are tenths of millisatoshis
+	return l402.Invoice(fmt.Sprintf("lnbcrt%dp1%s", amountMsat*10, data))
+}
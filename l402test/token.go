@@ -0,0 +1,82 @@
+package l402test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gofeuer/l402"
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+// Token is a paid token, as its client holds it
+type Token struct {
+	Macaroon   string // base64
+	Preimage   l402.Hash
+	Identifier l402.Identifier
+}
+
+// Authorization is the value of the Authorization header presenting the token
+func (t Token) Authorization() string {
+	return fmt.Sprintf("L402 %s:%s", t.Macaroon, hex.EncodeToString(t.Preimage[:]))
+}
+
+// NewToken mints a paid token, signed by a new root key of the store, as if its invoice was paid
+func NewToken(t testing.TB, rootKeys l402.RootKeyStore, caveats ...l402.Caveat) Token {
+	t.Helper()
+
+	var preimage l402.Hash
+	if _, err := rand.Read(preimage[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	id, rootKey, err := rootKeys.NewRootKey(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identifier := l402.Identifier{PaymentHash: sha256.Sum256(preimage[:]), ID: id}
+	macaroonID, err := l402.MarchalIdentifier(identifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mac, err := macaroon.New(rootKey, macaroonID, "", macaroon.LatestVersion)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := l402.AddFirstPartyCaveats(mac, caveats...); err != nil {
+		t.Fatal(err)
+	}
+
+	macaroonBase64, err := l402.MarshalMacaroons(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return Token{Macaroon: macaroonBase64, Preimage: preimage, Identifier: identifier}
+}
+
+// ExpiredToken mints a paid token that expired an hour ago
+func ExpiredToken(t testing.TB, rootKeys l402.RootKeyStore, caveats ...l402.Caveat) Token {
+	t.Helper()
+	expiry := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	return NewToken(t, rootKeys, slices.Concat(caveats, []l402.Caveat{l402.NewCaveat(l402.ExpiresCondition, expiry)})...)
+}
+
+// AttenuatedToken narrows a token with more caveats, like its holder would with l402.Attenuate
+func AttenuatedToken(t testing.TB, token Token, caveats ...l402.Caveat) Token {
+	t.Helper()
+
+	macaroonBase64, err := l402.Attenuate(token.Macaroon, caveats...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token.Macaroon = macaroonBase64
+	return token
+}
@@ -0,0 +1,85 @@
+package l402test
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+
+	"github.com/gofeuer/l402"
+)
+
+var (
+	ErrPaymentHeld = errors.New("payment held")
+	ErrNoChallenge = errors.New("no L402 challenge")
+	ErrNotSettled  = errors.New("payment not settled")
+)
+
+// Wallet pays the invoices of a Node
+type Wallet struct {
+	node *Node
+
+	mu        sync.Mutex
+	spentMsat uint64
+}
+
+func NewWallet(node *Node) *Wallet {
+	return &Wallet{node: node}
+}
+
+// Pay pays an invoice and returns its preimage
+// Hold invoices are only accepted, Pay fails with ErrPaymentHeld and the preimage is known once the node settles them
+func (w *Wallet) Pay(_ context.Context, invoice l402.Invoice) (l402.Hash, error) {
+	amountMsat, preimage, settled, err := w.node.pay(invoice)
+	if err != nil {
+		return l402.Hash{}, err
+	}
+
+	w.mu.Lock()
+	w.spentMsat += amountMsat
+	w.mu.Unlock()
+
+	if !settled {
+		return l402.Hash{}, ErrPaymentHeld
+	}
+	return preimage, nil
+}
+
+// Preimage returns the preimage of a settled payment, like a paid hold invoice once settled
+func (w *Wallet) Preimage(paymentHash l402.Hash) (l402.Hash, error) {
+	if preimage, settled := w.node.preimage(paymentHash); settled {
+		return preimage, nil
+	}
+	return l402.Hash{}, ErrNotSettled
+}
+
+// SpentMsat is the amount paid by the wallet so far
+func (w *Wallet) SpentMsat() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.spentMsat
+}
+
+var challengeMatcher = regexp.MustCompile(`L402 macaroon="(\S+)", invoice="(\S+)"`)
+
+// PayChallenge pays the invoice challenged by the WWW-Authenticate header of a response
+// It returns the Authorization value of the paid token
+func (w *Wallet) PayChallenge(ctx context.Context, header http.Header) (string, error) {
+	for _, value := range header.Values("WWW-Authenticate") {
+		challenge := challengeMatcher.FindStringSubmatch(value)
+		if len(challenge) != 3 {
+			continue
+		}
+
+		preimage, err := w.Pay(ctx, l402.Invoice(challenge[2]))
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("L402 %s:%s", challenge[1], hex.EncodeToString(preimage[:])), nil
+	}
+
+	return "", ErrNoChallenge
+}
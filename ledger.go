@@ -0,0 +1,282 @@
+package l402
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Ledger keeps the balance of each token, in millisatoshis
+type Ledger interface {
+	Balance(ctx context.Context, id ID) (int64, error)
+	// Credit adds the amount to the balance and returns the new balance
+	Credit(ctx context.Context, id ID, amount int64) (int64, error)
+	// Debit subtracts the amount from the balance and returns the new balance
+	// If the balance can't cover the amount, it's left untouched and ErrInsufficientBalance is returned
+	Debit(ctx context.Context, id ID, amount int64) (int64, error)
+}
+
+// AccountLedger is a Ledger funded by paying L402 invoices
+type AccountLedger interface {
+	Ledger
+	// Deposit credits the amount paid with an invoice and returns the new balance
+	// Each payment hash is only credited once, so presenting the same token again doesn't add funds
+	Deposit(ctx context.Context, id ID, paymentHash Hash, amount int64) (int64, error)
+}
+
+type memoryLedger struct {
+	mu       sync.Mutex
+	balances map[ID]int64
+	deposits map[Hash]time.Time // when each payment hash was credited
+	now      func() time.Time
+}
+
+func MemoryLedger() *memoryLedger {
+	return &memoryLedger{
+		balances: make(map[ID]int64),
+		deposits: make(map[Hash]time.Time),
+		now:      time.Now,
+	}
+}
+
+func (l *memoryLedger) Balance(_ context.Context, id ID) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.balances[id], nil
+}
+
+func (l *memoryLedger) Credit(_ context.Context, id ID, amount int64) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.balances[id] += amount
+	return l.balances[id], nil
+}
+
+func (l *memoryLedger) Debit(_ context.Context, id ID, amount int64) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.balances[id] < amount {
+		return l.balances[id], ErrInsufficientBalance
+	}
+	l.balances[id] -= amount
+	return l.balances[id], nil
+}
+
+func (l *memoryLedger) Deposit(_ context.Context, id ID, paymentHash Hash, amount int64) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, found := l.deposits[paymentHash]; !found {
+		l.deposits[paymentHash] = l.now()
+		l.balances[id] += amount
+	}
+	return l.balances[id], nil
+}
+
+// PruneDeposits forgets the payment hashes credited before the cutoff, so the ledger doesn't grow forever
+// It's only safe once the deposit tokens of those payments have expired, or they could be credited again
+func (l *memoryLedger) PruneDeposits(cutoff time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune(cutoff)
+	return nil
+}
+
+func (l *memoryLedger) prune(cutoff time.Time) {
+	for paymentHash, credited := range l.deposits {
+		if credited.Before(cutoff) {
+			delete(l.deposits, paymentHash)
+		}
+	}
+}
+
+type fileLedger struct {
+	memoryLedger
+	filename string
+	lines    int
+}
+
+// ledgerRecord is a line of the ledger file, either a change or a snapshot of the whole ledger written by compaction
+type ledgerRecord struct {
+	ID       string           `json:"id,omitempty"`
+	Amount   int64            `json:"amount,omitempty"`   // added to the balance of ID
+	Deposit  string           `json:"deposit,omitempty"`  // the payment hash credited by the change
+	Time     int64            `json:"time,omitempty"`     // when the deposit was credited, in unix seconds
+	Balances map[string]int64 `json:"balances,omitempty"` // snapshot
+	Deposits map[string]int64 `json:"deposits,omitempty"` // snapshot, payment hashes and the time they were credited
+}
+
+// FileLedger keeps the balances in a JSON lines file, every change is appended to it and synced
+// The file is compacted once most of its lines are stale
+func FileLedger(filename string) (*fileLedger, error) {
+	l := &fileLedger{
+		memoryLedger: *MemoryLedger(),
+		filename:     filename,
+	}
+
+	lines, err := readJSONLines(filename, func(line []byte) error {
+		var record ledgerRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return err
+		}
+		return l.apply(record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	l.lines = lines
+
+	return l, nil
+}
+
+func (l *fileLedger) apply(record ledgerRecord) error {
+	for encodedID, balance := range record.Balances {
+		id, err := decodeID(encodedID)
+		if err != nil {
+			return err
+		}
+		l.balances[id] = balance
+	}
+
+	for encodedHash, credited := range record.Deposits {
+		paymentHash, err := decodeHash(encodedHash)
+		if err != nil {
+			return err
+		}
+		l.deposits[paymentHash] = time.Unix(credited, 0)
+	}
+
+	if record.ID == "" {
+		return nil
+	}
+
+	id, err := decodeID(record.ID)
+	if err != nil {
+		return err
+	}
+	l.balances[id] += record.Amount
+
+	if record.Deposit != "" {
+		paymentHash, err := decodeHash(record.Deposit)
+		if err != nil {
+			return err
+		}
+		l.deposits[paymentHash] = time.Unix(record.Time, 0)
+	}
+	return nil
+}
+
+func decodeID(encodedID string) (ID, error) {
+	var id ID
+	if n, err := hex.Decode(id[:], []byte(encodedID)); err != nil || n != len(id) {
+		return ID{}, fmt.Errorf("invalid ID %q", encodedID)
+	}
+	return id, nil
+}
+
+func decodeHash(encodedHash string) (Hash, error) {
+	var paymentHash Hash
+	if n, err := hex.Decode(paymentHash[:], []byte(encodedHash)); err != nil || n != len(paymentHash) {
+		return Hash{}, fmt.Errorf("invalid payment hash %q", encodedHash)
+	}
+	return paymentHash, nil
+}
+
+func (l *fileLedger) Credit(_ context.Context, id ID, amount int64) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.append(ledgerRecord{ID: hex.EncodeToString(id[:]), Amount: amount}); err != nil {
+		return l.balances[id], err
+	}
+	l.balances[id] += amount
+	return l.balances[id], nil
+}
+
+func (l *fileLedger) Debit(_ context.Context, id ID, amount int64) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.balances[id] < amount {
+		return l.balances[id], ErrInsufficientBalance
+	}
+
+	if err := l.append(ledgerRecord{ID: hex.EncodeToString(id[:]), Amount: -amount}); err != nil {
+		return l.balances[id], err
+	}
+	l.balances[id] -= amount
+	return l.balances[id], nil
+}
+
+func (l *fileLedger) Deposit(_ context.Context, id ID, paymentHash Hash, amount int64) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, found := l.deposits[paymentHash]; found {
+		return l.balances[id], nil
+	}
+
+	now := l.now()
+	record := ledgerRecord{ID: hex.EncodeToString(id[:]), Amount: amount, Deposit: hex.EncodeToString(paymentHash[:]), Time: now.Unix()}
+	if err := l.append(record); err != nil {
+		return l.balances[id], err
+	}
+	l.deposits[paymentHash] = now
+	l.balances[id] += amount
+	return l.balances[id], nil
+}
+
+// PruneDeposits forgets the payment hashes credited before the cutoff and compacts the file
+// It's only safe once the deposit tokens of those payments have expired, or they could be credited again
+func (l *fileLedger) PruneDeposits(cutoff time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(cutoff)
+	return l.compact()
+}
+
+// append writes a change to the file before it's applied, compacting the file when most of its lines are stale
+func (l *fileLedger) append(record ledgerRecord) error {
+	if err := appendJSONLine(l.filename, record); err != nil {
+		return err
+	}
+
+	l.lines++
+	if shouldCompact(l.lines, len(l.balances)+len(l.deposits)) {
+		// The change is already safe in the file, a failed compaction is retried by the next change
+		l.compact() //nolint:errcheck
+	}
+	return nil
+}
+
+// compact rewrites the file as a single snapshot, the applied changes are left out
+func (l *fileLedger) compact() error {
+	snapshot := ledgerRecord{
+		Balances: make(map[string]int64, len(l.balances)),
+		Deposits: make(map[string]int64, len(l.deposits)),
+	}
+	for id, balance := range l.balances {
+		if balance != 0 {
+			snapshot.Balances[hex.EncodeToString(id[:])] = balance
+		}
+	}
+	for paymentHash, credited := range l.deposits {
+		snapshot.Deposits[hex.EncodeToString(paymentHash[:])] = credited.Unix()
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(l.filename, append(data, '\n')); err != nil {
+		return err
+	}
+
+	l.lines = 1
+	return nil
+}
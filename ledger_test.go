@@ -0,0 +1,131 @@
+package l402
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryLedger(t *testing.T) {
+	ctx := context.Background()
+	ledger := MemoryLedger()
+
+	if balance, _ := ledger.Credit(ctx, ID{1}, 100); balance != 100 {
+		t.Errorf("expected: %d but got: %d", 100, balance)
+	}
+
+	if balance, _ := ledger.Debit(ctx, ID{1}, 60); balance != 40 {
+		t.Errorf("expected: %d but got: %d", 40, balance)
+	}
+
+	balance, err := ledger.Debit(ctx, ID{1}, 60)
+	if !errors.Is(err, ErrInsufficientBalance) {
+		t.Errorf("expected: %v but got: %v", ErrInsufficientBalance, err)
+	}
+
+	if balance != 40 {
+		t.Errorf("expected: %d but got: %d", 40, balance)
+	}
+
+	if balance, _ := ledger.Balance(ctx, ID{2}); balance != 0 {
+		t.Errorf("expected: %d but got: %d", 0, balance)
+	}
+}
+
+func TestFileLedger(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "ledger.json")
+
+	ledger, err := FileLedger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ledger.Deposit(ctx, ID{1}, Hash{1}, 100) //nolint:errcheck
+	ledger.Debit(ctx, ID{1}, 30)             //nolint:errcheck
+
+	reopened, err := FileLedger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if balance, _ := reopened.Balance(ctx, ID{1}); balance != 70 {
+		t.Errorf("expected: %d but got: %d", 70, balance)
+	}
+
+	// The deposit was already credited before reopening the ledger
+	if balance, _ := reopened.Deposit(ctx, ID{1}, Hash{1}, 100); balance != 70 {
+		t.Errorf("expected: %d but got: %d", 70, balance)
+	}
+
+	if balance, _ := reopened.Deposit(ctx, ID{1}, Hash{2}, 100); balance != 170 {
+		t.Errorf("expected: %d but got: %d", 170, balance)
+	}
+}
+
+func TestFileLedger_Journal(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "ledger.jsonl")
+
+	ledger, _ := FileLedger(filename)
+	ledger.Deposit(ctx, ID{1}, Hash{1}, 100) //nolint:errcheck
+	for range 10 {
+		ledger.Debit(ctx, ID{1}, 1) //nolint:errcheck
+	}
+
+	// Every change appends a line instead of rewriting the file
+	data, _ := os.ReadFile(filename)
+	if lines := bytes.Count(data, []byte("\n")); lines != 11 {
+		t.Errorf("expected: %d but got: %d", 11, lines)
+	}
+
+	// A change cut short by a crash is dropped
+	os.WriteFile(filename, append(data, `{"id":"01`...), 0o600) //nolint:errcheck
+	reopened, err := FileLedger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance, _ := reopened.Balance(ctx, ID{1}); balance != 90 {
+		t.Errorf("expected: %d but got: %d", 90, balance)
+	}
+
+	// A corrupt change before the end isn't silently skipped
+	os.WriteFile(filename, append([]byte("{\n"), data...), 0o600) //nolint:errcheck
+	if _, err := FileLedger(filename); err == nil {
+		t.Error("expected an error for a corrupt line")
+	}
+}
+
+func TestFileLedger_PruneDeposits(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "ledger.jsonl")
+
+	now := time.Unix(1700000000, 0)
+	ledger, _ := FileLedger(filename)
+	ledger.now = func() time.Time { return now }
+
+	ledger.Deposit(ctx, ID{1}, Hash{1}, 100) //nolint:errcheck
+	now = now.Add(time.Hour)
+	ledger.Deposit(ctx, ID{1}, Hash{2}, 100) //nolint:errcheck
+
+	if err := ledger.PruneDeposits(now); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, _ := FileLedger(filename)
+	if balance, _ := reopened.Balance(ctx, ID{1}); balance != 200 {
+		t.Errorf("expected: %d but got: %d", 200, balance)
+	}
+
+	// Only the pruned deposit can be credited again
+	if balance, _ := reopened.Deposit(ctx, ID{1}, Hash{2}, 100); balance != 200 {
+		t.Errorf("expected: %d but got: %d", 200, balance)
+	}
+	if balance, _ := reopened.Deposit(ctx, ID{1}, Hash{1}, 100); balance != 300 {
+		t.Errorf("expected: %d but got: %d", 300, balance)
+	}
+}
@@ -0,0 +1,84 @@
+package l402
+
+import "container/list"
+
+// lru is a bounded map that evicts its least recently used entries
+// It's not safe for concurrent use, callers must hold their own lock
+type lru[K comparable, V any] struct {
+	capacity int
+	entries  map[K]*list.Element
+	order    *list.List
+	onEvict  func(K, V)
+}
+
+type lruEntry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+func newLRU[K comparable, V any](capacity int) *lru[K, V] {
+	return &lru[K, V]{
+		capacity: max(capacity, 1),
+		entries:  make(map[K]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (c *lru[K, V]) Get(key K) (V, bool) {
+	element, found := c.entries[key]
+	if !found {
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*lruEntry[K, V]).value, true //nolint:forcetypeassert
+}
+
+// Add inserts or replaces an entry and reports whether another entry was evicted to make room for it
+func (c *lru[K, V]) Add(key K, value V) bool {
+	if element, found := c.entries[key]; found {
+		element.Value.(*lruEntry[K, V]).value = value //nolint:forcetypeassert
+		c.order.MoveToFront(element)
+		return false
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry[K, V]{key: key, value: value})
+
+	if c.order.Len() <= c.capacity {
+		return false
+	}
+
+	oldest := c.order.Back()
+	c.removeElement(oldest)
+	if c.onEvict != nil {
+		entry := oldest.Value.(*lruEntry[K, V]) //nolint:forcetypeassert
+		c.onEvict(entry.key, entry.value)
+	}
+	return true
+}
+
+func (c *lru[K, V]) Remove(key K) {
+	if element, found := c.entries[key]; found {
+		c.removeElement(element)
+	}
+}
+
+// RemoveFunc removes every entry for which remove returns true, without calling onEvict
+func (c *lru[K, V]) RemoveFunc(remove func(K, V) bool) {
+	for element := c.order.Front(); element != nil; {
+		next := element.Next()
+		if entry := element.Value.(*lruEntry[K, V]); remove(entry.key, entry.value) { //nolint:forcetypeassert
+			c.removeElement(element)
+		}
+		element = next
+	}
+}
+
+func (c *lru[K, V]) Len() int {
+	return c.order.Len()
+}
+
+func (c *lru[K, V]) removeElement(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*lruEntry[K, V]).key) //nolint:forcetypeassert
+}
@@ -0,0 +1,39 @@
+package l402
+
+import "testing"
+
+func TestLRU(t *testing.T) {
+	var evicted []string
+	cache := newLRU[string, int](2)
+	cache.onEvict = func(key string, _ int) { evicted = append(evicted, key) }
+
+	cache.Add("a", 1)
+	cache.Add("b", 2)
+	cache.Get("a") // "b" becomes the least recently used
+
+	if wasEvicted := cache.Add("c", 3); !wasEvicted {
+		t.Error("expected an entry to be evicted")
+	}
+
+	if _, found := cache.Get("b"); found {
+		t.Error("expected b to be evicted")
+	}
+
+	if value, found := cache.Get("a"); !found || value != 1 {
+		t.Errorf("expected: %d but got: %d", 1, value)
+	}
+
+	cache.Add("a", 4)
+	if value, _ := cache.Get("a"); value != 4 {
+		t.Errorf("expected: %d but got: %d", 4, value)
+	}
+
+	cache.Remove("c")
+	if cache.Len() != 1 {
+		t.Errorf("expected: %d but got: %d", 1, cache.Len())
+	}
+
+	if len(evicted) != 1 || evicted[0] != "b" {
+		t.Errorf("expected: %v but got: %v", []string{"b"}, evicted)
+	}
+}
@@ -1,11 +1,15 @@
 package l402
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"reflect"
+	"slices"
 	"strings"
 
 	macaroon "gopkg.in/macaroon.v2"
@@ -31,32 +35,135 @@ func MarshalMacaroons(macaroons ...*macaroon.Macaroon) (string, error) {
 	return macaroonBase64, err
 }
 
+// UnmarshalMacaroons decodes the macaroons of a token without discharge macaroons
+// Tokens with discharges are rejected, since the macaroons alone can't be verified nor marshaled back into the same token,
+// use UnmarshalToken to get the discharges as well
 func UnmarshalMacaroons(macaroonBase64 string) (map[Identifier]*macaroon.Macaroon, error) {
+	macaroons, discharges, err := UnmarshalToken(macaroonBase64)
+	if err != nil {
+		return nil, err
+	} else if len(discharges) > 0 {
+		return nil, &MacaroonError{Index: -1, Stage: StageDecode, Err: errUnexpectedDischarges}
+	}
+	return macaroons, nil
+}
+
+var (
+	errNoMacaroon           = errors.New("token has no L402 macaroon")
+	errUnexpectedDischarges = errors.New("token has discharge macaroons, decode it with UnmarshalToken")
+)
+
+// UnmarshalToken decodes the macaroons of a token along with the discharge macaroons of their third-party caveats
+// Failures are reported as a *MacaroonError
+// A macaroon without an L402 Identifier is only accepted as a discharge if a third-party caveat of the token refers to it
+// Discharges must be bound to the macaroon they discharge, which is checked when verifying the signatures
+func UnmarshalToken(macaroonBase64 string) (map[Identifier]*macaroon.Macaroon, []*macaroon.Macaroon, error) {
+	token, err := UnmarshalOrderedToken(macaroonBase64)
+	return token.Macaroons, token.Discharges, err
+}
+
+// UnmarshalOrderedToken is UnmarshalToken keeping the order of the macaroons in the token, which MacaroonError.Index counts in
+// The macaroons are listed in VerifiedToken.Identifiers, their signatures and preimage aren't verified yet
+func UnmarshalOrderedToken(macaroonBase64 string) (VerifiedToken, error) {
 	macaroonBytes, err := base64.StdEncoding.DecodeString(macaroonBase64)
 	if err != nil {
 		// The macaroons might be separated by commas, so we strip them and try again
 		macaroonBase64 = strings.ReplaceAll(macaroonBase64, ",", "")
 		if macaroonBytes, err = base64.StdEncoding.DecodeString(macaroonBase64); err != nil {
-			return nil, err
+			return VerifiedToken{}, &MacaroonError{Index: -1, Stage: StageDecode, Err: err}
 		}
 	}
 
 	macaroons := make(macaroon.Slice, 0, 1)
 	if err := macaroons.UnmarshalBinary(macaroonBytes); err != nil {
-		return nil, err
+		return VerifiedToken{}, &MacaroonError{Index: -1, Stage: StageDecode, Err: err}
 	}
 
-	macaroonsMap := make(map[Identifier]*macaroon.Macaroon, len(macaroons))
+	thirdPartyCaveatIDs := make(map[string]struct{})
+	for _, mac := range macaroons {
+		for _, caveat := range mac.Caveats() {
+			if caveat.VerificationId != nil {
+				thirdPartyCaveatIDs[string(caveat.Id)] = struct{}{}
+			}
+		}
+	}
+
+	token := VerifiedToken{Macaroons: make(map[Identifier]*macaroon.Macaroon, len(macaroons))}
 
-	for i, macaroon := range macaroons {
-		identifier, err := UnmarshalIdentifier(macaroon.Id())
+	for _, mac := range macaroons {
+		identifier, err := UnmarshalIdentifier(mac.Id())
 		if err != nil {
-			return nil, fmt.Errorf("index %d: %w", i, err)
+			if _, found := thirdPartyCaveatIDs[string(mac.Id())]; found {
+				token.Discharges = append(token.Discharges, mac)
+				continue
+			}
+			return VerifiedToken{}, &MacaroonError{Index: len(token.Identifiers), Stage: StageIdentifier, Err: err}
+		}
+		if _, found := token.Macaroons[identifier]; !found {
+			token.Identifiers = append(token.Identifiers, identifier)
 		}
-		macaroonsMap[identifier] = macaroon
+		token.Macaroons[identifier] = mac
 	}
 
-	return macaroonsMap, err
+	// A token without macaroons, like the one of a lone comma, would be approved without paying for anything
+	if len(token.Macaroons) == 0 {
+		return VerifiedToken{}, &MacaroonError{Index: -1, Stage: StageDecode, Err: errNoMacaroon}
+	}
+
+	return token, nil
+}
+
+// DischargesFor selects the discharges needed by a macaroon, including the ones needed by those discharges
+// VerifySignature rejects the discharges a macaroon doesn't use, so a token's discharges are handed over this way
+func DischargesFor(mac *macaroon.Macaroon, discharges []*macaroon.Macaroon) []*macaroon.Macaroon {
+	var needed []*macaroon.Macaroon
+	pending := []*macaroon.Macaroon{mac}
+
+	for len(pending) > 0 {
+		current := pending[0]
+		pending = pending[1:]
+
+		for _, caveat := range current.Caveats() {
+			if caveat.VerificationId == nil {
+				continue
+			}
+			for _, discharge := range discharges {
+				if bytes.Equal(discharge.Id(), caveat.Id) && !slices.Contains(needed, discharge) {
+					needed = append(needed, discharge)
+					pending = append(pending, discharge)
+				}
+			}
+		}
+	}
+
+	return needed
+}
+
+// tokenOrder lists the macaroons in the order of the token, found in the context under KeyIdentifiers
+// Macaroons handed over without their order, like the ones of a custom caller, are sorted with SortedIdentifiers
+func tokenOrder(ctx context.Context, macaroons map[Identifier]*macaroon.Macaroon) []Identifier {
+	identifiers, _ := ctx.Value(KeyIdentifiers).([]Identifier)
+	if len(identifiers) != len(macaroons) {
+		return SortedIdentifiers(macaroons)
+	}
+	for _, identifier := range identifiers {
+		if _, found := macaroons[identifier]; !found {
+			return SortedIdentifiers(macaroons)
+		}
+	}
+	return identifiers
+}
+
+// SortedIdentifiers gives the macaroons of a token a stable order, sorted by ID
+func SortedIdentifiers(macaroons map[Identifier]*macaroon.Macaroon) []Identifier {
+	identifiers := make([]Identifier, 0, len(macaroons))
+	for identifier := range macaroons {
+		identifiers = append(identifiers, identifier)
+	}
+	slices.SortFunc(identifiers, func(a, b Identifier) int {
+		return bytes.Compare(a.ID[:], b.ID[:])
+	})
+	return identifiers
 }
 
 var (
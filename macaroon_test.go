@@ -79,10 +79,9 @@ func TestUnmarshalMacaroons(t *testing.T) {
 		expectedMacaroons map[Identifier]*macaroon.Macaroon
 		expectedError     error
 	}{
-		"no macaroons": { // macaroonsBase64 is guaranteed by authorizationMatcher to be a non empty string
-			macaroonsBase64:   "",
-			expectedMacaroons: map[Identifier]*macaroon.Macaroon{},
-			expectedError:     nil,
+		"no macaroons": { // a token without macaroons pays for nothing
+			macaroonsBase64: "",
+			expectedError:   ErrInvalidMacaroon,
 		},
 		"defective macaroon": {
 			macaroonsBase64: "AGIAJEemVQUTEyNCR0exk7ek90Cg==",
@@ -104,7 +103,7 @@ func TestUnmarshalMacaroons(t *testing.T) {
 		},
 		"many defective macaroons": {
 			macaroonsBase64: "AgJCAAABAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAgMAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAEAAAGIHqWvcIDGguzG0xeNz7kxTr4IrPg64b0EjRonYD3zkVeAgJCAAABAAAAAAAAAAAAAAAAAAAAAAAAAA",
-			expectedError:   errors.New("illegal base64 data at input byte 172"),
+			expectedError:   base64.CorruptInputError(172),
 		},
 		"many macaroons with comma": {
 			macaroonsBase64: "AgJCAAABAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAgMAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAEAAAGIHqWvcIDGguzG0xeNz7kxTr4IrPg64b0EjRonYD3zkVe,AgJCAAABAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAgMAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAFAAAGIJL//w3j0KDNo5jUh+g47BAyhvsP7eiNYFHlPDw4Od/Z",
@@ -282,3 +281,65 @@ func TestUnmarshalIdentifier(t *testing.T) {
 		})
 	}
 }
+
+func TestUnmarshalToken(t *testing.T) {
+	macaroonID, _ := MarchalIdentifier(Identifier{ID: ID{1}})
+	mac, _ := macaroon.New([]byte{1}, macaroonID, "", macaroon.V2)
+	AddThirdPartyCaveats(mac, ThirdPartyCaveat{RootKey: []byte{2}, ID: []byte("logged-in")}) //nolint:errcheck
+
+	discharge, _ := macaroon.New([]byte{2}, []byte("logged-in"), "", macaroon.V2)
+	discharge.Bind(mac.Signature())
+	stranger, _ := macaroon.New([]byte{3}, []byte("stranger"), "", macaroon.V2)
+
+	tests := map[string]struct {
+		macaroons          macaroon.Slice
+		macaroonBase64     string
+		expectedDischarges int
+		expectedError      error
+	}{
+		"discharged": {
+			macaroons:          macaroon.Slice{mac, discharge},
+			expectedDischarges: 1,
+		},
+		"unrelated macaroon": {
+			macaroons:     macaroon.Slice{mac, stranger},
+			expectedError: ErrUnknownVersion(-1),
+		},
+		"no macaroon": {
+			macaroonBase64: ",",
+			expectedError:  errNoMacaroon,
+		},
+		"empty token": {
+			expectedError: errNoMacaroon,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			macaroonBase64 := test.macaroonBase64
+			if len(test.macaroons) > 0 {
+				macaroonBase64, _ = MarshalMacaroons(test.macaroons...)
+			}
+
+			macaroons, discharges, err := UnmarshalToken(macaroonBase64)
+			if !errors.Is(err, test.expectedError) {
+				t.Fatalf("expected: %v but got: %v", test.expectedError, err)
+			} else if err != nil {
+				return
+			}
+
+			if len(macaroons) != 1 || macaroons[Identifier{ID: ID{1}}] == nil {
+				t.Errorf("expected the L402 macaroon but got: %v", macaroons)
+			}
+
+			if len(discharges) != test.expectedDischarges {
+				t.Errorf("expected: %d but got: %d", test.expectedDischarges, len(discharges))
+			}
+
+			// UnmarshalMacaroons can't drop the discharges without breaking the token
+			if _, err := UnmarshalMacaroons(macaroonBase64); (err != nil) != (test.expectedDischarges > 0) || (err != nil && !errors.Is(err, ErrInvalidMacaroon)) {
+				t.Errorf("expected an error only for discharges but got: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package l402
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+// MaxBytesCondition limits the total amount of response bytes a token can be used to download
+const MaxBytesCondition = "max_bytes"
+
+type UsageCounter interface {
+	// Add increments the usage recorded for a token by n and returns the new total
+	// Calling Add with n equal to zero returns the current usage
+	Add(ctx context.Context, id ID, n int64) (int64, error)
+}
+
+type memoryUsageCounter struct {
+	mu    sync.Mutex
+	usage map[ID]int64
+}
+
+func MemoryUsageCounter() *memoryUsageCounter {
+	return &memoryUsageCounter{usage: make(map[ID]int64)}
+}
+
+func (c *memoryUsageCounter) Add(_ context.Context, id ID, n int64) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.usage[id] += n
+	return c.usage[id], nil
+}
+
+type byteMeter struct {
+	id    ID
+	limit int64
+}
+
+// byteMeters returns a meter for every macaroon restricted by a max_bytes caveat
+// When a macaroon carries many max_bytes caveats, the most restrictive one is used
+func byteMeters(macaroons map[Identifier]*macaroon.Macaroon) ([]byteMeter, error) {
+	var meters []byteMeter
+	for identifier, mac := range macaroons {
+		values := caveatValues(mac, MaxBytesCondition)
+		if len(values) == 0 {
+			continue
+		}
+
+		meter := byteMeter{id: identifier.ID, limit: -1}
+		for _, value := range values {
+			limit, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || limit < 0 {
+				return nil, fmt.Errorf("%w: %s=%s", ErrInvalidCaveat, MaxBytesCondition, value)
+			}
+			if meter.limit < 0 || limit < meter.limit {
+				meter.limit = limit
+			}
+		}
+		meters = append(meters, meter)
+	}
+	return meters, nil
+}
+
+type meteredResponseWriter struct {
+	http.ResponseWriter
+	ctx       context.Context //nolint:containedctx
+	counter   UsageCounter
+	meters    []byteMeter
+	exhausted bool
+}
+
+// meterResponse wraps w so that the bytes written to it are charged against the allowance of each meter
+// It returns ErrAllowanceExhausted if there is no allowance left to serve the response
+func meterResponse(ctx context.Context, w http.ResponseWriter, counter UsageCounter, meters []byteMeter) (*meteredResponseWriter, error) {
+	for _, meter := range meters {
+		used, err := counter.Add(ctx, meter.id, 0)
+		if err != nil {
+			return nil, err
+		} else if used >= meter.limit {
+			return nil, ErrAllowanceExhausted
+		}
+	}
+
+	return &meteredResponseWriter{
+		ResponseWriter: w,
+		ctx:            ctx,
+		counter:        counter,
+		meters:         meters,
+	}, nil
+}
+
+// reserve charges n bytes to every meter and returns how many of them can actually be written
+// Bytes that don't fit in the allowance are refunded, so the counters never exceed their limits
+func (m *meteredResponseWriter) reserve(n int) (int, error) {
+	if m.exhausted {
+		return 0, ErrAllowanceExhausted
+	} else if n == 0 {
+		return 0, nil
+	}
+
+	allowed := int64(n)
+	charged := make([]byteMeter, 0, len(m.meters))
+	var err error
+
+	for _, meter := range m.meters {
+		var used int64
+		if used, err = m.counter.Add(m.ctx, meter.id, int64(n)); err != nil {
+			break
+		}
+		charged = append(charged, meter)
+		if over := used - meter.limit; over > 0 {
+			allowed = min(allowed, max(int64(n)-over, 0))
+		}
+	}
+
+	if err != nil {
+		allowed = 0
+	}
+
+	if refund := int64(n) - allowed; refund > 0 {
+		for _, meter := range charged {
+			m.counter.Add(m.ctx, meter.id, -refund) //nolint:errcheck
+		}
+	}
+
+	if err != nil {
+		return 0, err
+	} else if allowed < int64(n) {
+		m.exhausted = true
+		return int(allowed), ErrAllowanceExhausted
+	}
+	return n, nil
+}
+
+// release refunds bytes that were reserved but could not be written
+func (m *meteredResponseWriter) release(n int) {
+	for _, meter := range m.meters {
+		m.counter.Add(m.ctx, meter.id, -int64(n)) //nolint:errcheck
+	}
+}
+
+func (m *meteredResponseWriter) Write(b []byte) (int, error) {
+	allowed, reserveErr := m.reserve(len(b))
+
+	n, err := m.ResponseWriter.Write(b[:allowed])
+	if n < allowed {
+		m.release(allowed - n)
+	}
+
+	if err != nil {
+		return n, err
+	}
+	return n, reserveErr
+}
+
+func (m *meteredResponseWriter) Flush() {
+	if flusher, ok := m.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// ReadFrom hands src to the ReadFrom of the underlying writer, if it has one, wrapped to charge every read
+// The wrapping hides the concrete type of src, so zero-copy paths like sendfile aren't taken
+func (m *meteredResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if readerFrom, ok := m.ResponseWriter.(io.ReaderFrom); ok {
+		return readerFrom.ReadFrom(&meteredReader{Reader: src, writer: m})
+	}
+	return io.Copy(struct{ io.Writer }{m}, src)
+}
+
+func (m *meteredResponseWriter) Unwrap() http.ResponseWriter {
+	return m.ResponseWriter
+}
+
+type meteredReader struct {
+	io.Reader
+	writer *meteredResponseWriter
+}
+
+func (r *meteredReader) Read(p []byte) (int, error) {
+	if r.writer.exhausted {
+		return 0, ErrAllowanceExhausted
+	}
+
+	n, err := r.Reader.Read(p)
+
+	allowed, reserveErr := r.writer.reserve(n)
+	if reserveErr != nil {
+		return allowed, reserveErr
+	}
+	return n, err
+}
@@ -0,0 +1,191 @@
+package l402
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+func TestMeteredResponseWriter_Write(t *testing.T) {
+	tests := map[string]struct {
+		limit            int64
+		used             int64
+		writes           []string
+		expectedBody     string
+		expectedUsage    int64
+		expectedError    error
+		expectedRejected bool
+	}{
+		"within allowance": {
+			limit:         10,
+			writes:        []string{"abc", "def"},
+			expectedBody:  "abcdef",
+			expectedUsage: 6,
+		},
+		"exact allowance": {
+			limit:         6,
+			writes:        []string{"abc", "def"},
+			expectedBody:  "abcdef",
+			expectedUsage: 6,
+		},
+		"cut off mid write": {
+			limit:         4,
+			writes:        []string{"abc", "def", "ghi"},
+			expectedBody:  "abcd",
+			expectedUsage: 4,
+			expectedError: ErrAllowanceExhausted,
+		},
+		"resumed allowance": {
+			limit:         8,
+			used:          5,
+			writes:        []string{"abc", "def"},
+			expectedBody:  "abc",
+			expectedUsage: 8,
+			expectedError: ErrAllowanceExhausted,
+		},
+		"exhausted allowance": {
+			limit:            8,
+			used:             8,
+			expectedUsage:    8,
+			expectedRejected: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			counter := MemoryUsageCounter()
+			counter.Add(ctx, ID{1}, test.used) //nolint:errcheck
+			w := httptest.NewRecorder()
+
+			meteredWriter, err := meterResponse(ctx, w, counter, []byteMeter{{id: ID{1}, limit: test.limit}})
+			if (err != nil) != test.expectedRejected {
+				t.Fatalf("expected rejection: %v but got: %v", test.expectedRejected, err)
+			}
+
+			var writeErr error
+			for _, write := range test.writes {
+				if _, writeErr = meteredWriter.Write([]byte(write)); writeErr != nil {
+					break
+				}
+			}
+
+			if !errors.Is(writeErr, test.expectedError) {
+				t.Errorf("expected: %v but got: %v", test.expectedError, writeErr)
+			}
+
+			if body := w.Body.String(); body != test.expectedBody {
+				t.Errorf("expected: %s but got: %s", test.expectedBody, body)
+			}
+
+			if usage, _ := counter.Add(ctx, ID{1}, 0); usage != test.expectedUsage {
+				t.Errorf("expected: %d but got: %d", test.expectedUsage, usage)
+			}
+		})
+	}
+}
+
+func TestMeteredResponseWriter_ReadFrom(t *testing.T) {
+	counter := MemoryUsageCounter()
+
+	// The handler runs on another goroutine, so it reports back instead of failing the test itself
+	handlerErrors := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(handlerErrors)
+
+		meteredWriter, err := meterResponse(r.Context(), w, counter, []byteMeter{{id: ID{1}, limit: 1 << 20}})
+		if err != nil {
+			handlerErrors <- err
+			return
+		}
+
+		if _, ok := meteredWriter.ResponseWriter.(io.ReaderFrom); !ok {
+			handlerErrors <- errors.New("expected the response writer to implement io.ReaderFrom")
+			return
+		}
+
+		n, err := meteredWriter.ReadFrom(strings.NewReader(strings.Repeat("x", 1<<21)))
+		if n != 1<<20 || !errors.Is(err, ErrAllowanceExhausted) {
+			handlerErrors <- fmt.Errorf("expected: %d, %v but got: %d, %v", 1<<20, ErrAllowanceExhausted, n, err)
+		}
+	}))
+	defer server.Close()
+
+	response, err := http.Get(server.URL) //nolint:noctx
+	if err != nil {
+		t.Fatalf("expected: %v but got: %v", nil, err)
+	}
+	defer response.Body.Close()
+
+	if body, _ := io.ReadAll(response.Body); len(body) != 1<<20 {
+		t.Errorf("expected: %d but got: %d", 1<<20, len(body))
+	}
+
+	if err := <-handlerErrors; err != nil {
+		t.Error(err)
+	}
+
+	if usage, _ := counter.Add(context.Background(), ID{1}, 0); usage != 1<<20 {
+		t.Errorf("expected: %d but got: %d", 1<<20, usage)
+	}
+}
+
+func TestMeteredResponseWriter_Flush(t *testing.T) {
+	w := httptest.NewRecorder()
+	meteredWriter, _ := meterResponse(context.Background(), w, MemoryUsageCounter(), nil)
+
+	http.NewResponseController(meteredWriter).Flush() //nolint:errcheck
+
+	if !w.Flushed {
+		t.Error("expected the response to be flushed")
+	}
+}
+
+func TestByteMeters(t *testing.T) {
+	tests := map[string]struct {
+		caveats        []Caveat
+		expectedMeters []byteMeter
+		expectedError  error
+	}{
+		"no caveats": {},
+		"unrelated caveat": {
+			caveats: []Caveat{NewCaveat("services", "videos")},
+		},
+		"one limit": {
+			caveats:        []Caveat{NewCaveat(MaxBytesCondition, "100")},
+			expectedMeters: []byteMeter{{id: ID{1}, limit: 100}},
+		},
+		"narrowed limit": {
+			caveats:        []Caveat{NewCaveat(MaxBytesCondition, "100"), NewCaveat(MaxBytesCondition, "50")},
+			expectedMeters: []byteMeter{{id: ID{1}, limit: 50}},
+		},
+		"invalid limit": {
+			caveats:       []Caveat{NewCaveat(MaxBytesCondition, "-1")},
+			expectedError: ErrInvalidCaveat,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			mac, _ := macaroon.New([]byte{1}, []byte{2}, "", macaroon.V2)
+			AddFirstPartyCaveats(mac, test.caveats...) //nolint:errcheck
+
+			meters, err := byteMeters(map[Identifier]*macaroon.Macaroon{{ID: ID{1}}: mac})
+
+			if !errors.Is(err, test.expectedError) {
+				t.Fatalf("expected: %v but got: %v", test.expectedError, err)
+			}
+
+			if len(meters) != len(test.expectedMeters) || (len(meters) > 0 && meters[0] != test.expectedMeters[0]) {
+				t.Errorf("expected: %v but got: %v", test.expectedMeters, meters)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package l402
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+// Fingerprint groups the unauthenticated requests that can be answered with the same challenge
+type Fingerprint func(AccessRequest) string
+
+// ClientRouteFingerprint groups requests by client IP, method and path
+func ClientRouteFingerprint(r AccessRequest) string {
+	return clientIP(r.RemoteAddr()) + " " + r.Method() + " " + r.Path()
+}
+
+// MintingStats are the counters of a CachingMinter
+type MintingStats struct {
+	Hits        uint64 // challenges served from the cache, including requests that waited for a concurrent minting
+	Misses      uint64 // challenges minted by the underlying minter
+	Evictions   uint64 // challenges dropped to stay within capacity
+	Expirations uint64 // challenges dropped because their TTL elapsed
+	Entries     int    // challenges currently cached
+}
+
+type mintedChallenge struct {
+	macaroonBase64 string
+	challenge      Challenge
+	err            error
+	expires        time.Time
+	done           chan struct{} // closed once minted
+}
+
+type cachingMinter struct {
+	minter      MacaroonMinter
+	fingerprint Fingerprint
+	ttl         time.Duration
+	now         func() time.Time
+
+	mu         sync.Mutex
+	challenges *lru[string, *mintedChallenge]
+	stats      MintingStats
+}
+
+// CachingMinter answers repeated unauthenticated requests with the same unpaid macaroon and invoice
+// so crawlers and retry storms don't create an invoice and a root key on every hit
+// Requests sharing a fingerprint get the same challenge for ttl, which must not outlast the invoice expiry
+// At most capacity challenges are kept, the least recently used ones are evicted
+// Requests presenting a token are never cached, as minters like AccountMinter tailor their challenge to it
+func CachingMinter(minter MacaroonMinter, fingerprint Fingerprint, ttl time.Duration, capacity int) *cachingMinter {
+	if fingerprint == nil {
+		fingerprint = ClientRouteFingerprint
+	}
+
+	m := &cachingMinter{
+		minter:      minter,
+		fingerprint: fingerprint,
+		ttl:         ttl,
+		now:         time.Now,
+		challenges:  newLRU[string, *mintedChallenge](capacity),
+	}
+	m.challenges.onEvict = func(string, *mintedChallenge) {
+		m.stats.Evictions++
+	}
+	return m
+}
+
+func (m *cachingMinter) MintWithChallenge(r *http.Request) (string, Challenge, error) {
+	if _, authenticated := r.Context().Value(KeyMacaroon).(map[Identifier]*macaroon.Macaroon); authenticated {
+		return m.minter.MintWithChallenge(r)
+	}
+
+	key := m.fingerprint(HTTPAccessRequest(r))
+
+	m.mu.Lock()
+	minted, found := m.challenges.Get(key)
+	if found && !m.now().Before(minted.expires) {
+		m.challenges.Remove(key)
+		m.stats.Expirations++
+		found = false
+	}
+	if found {
+		m.stats.Hits++
+		m.mu.Unlock()
+
+		select {
+		case <-minted.done:
+			return minted.macaroonBase64, minted.challenge, minted.err
+		case <-r.Context().Done():
+			return "", nil, context.Cause(r.Context())
+		}
+	}
+
+	minted = &mintedChallenge{expires: m.now().Add(m.ttl), done: make(chan struct{})}
+	m.challenges.Add(key, minted)
+	m.stats.Misses++
+	m.mu.Unlock()
+
+	minted.macaroonBase64, minted.challenge, minted.err = m.minter.MintWithChallenge(r)
+	close(minted.done)
+
+	// Failures aren't cached, the next request tries again
+	if minted.err != nil {
+		m.mu.Lock()
+		if current, _ := m.challenges.Get(key); current == minted {
+			m.challenges.Remove(key)
+		}
+		m.mu.Unlock()
+	}
+
+	return minted.macaroonBase64, minted.challenge, minted.err
+}
+
+// Stats returns a snapshot of the cache counters
+func (m *cachingMinter) Stats() MintingStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := m.stats
+	stats.Entries = m.challenges.Len()
+	return stats
+}
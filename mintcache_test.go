@@ -0,0 +1,116 @@
+package l402
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+func TestCachingMinter(t *testing.T) {
+	var minted int
+	failing := false
+	minter := mockMinter{func(*http.Request) (string, Challenge, error) {
+		if failing {
+			return "", nil, ErrFailedInvoiceRequest
+		}
+		minted++
+		return fmt.Sprint("macaroon", minted), Invoice(fmt.Sprint("lnbc", minted)), nil
+	}}
+
+	now := time.Now()
+	cache := CachingMinter(minter, nil, time.Minute, 2)
+	cache.now = func() time.Time { return now }
+
+	mint := func(remoteAddr, path string) string {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = remoteAddr
+		macaroonBase64, _, err := cache.MintWithChallenge(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return macaroonBase64
+	}
+
+	if first, second := mint("10.0.0.1:1234", "/videos"), mint("10.0.0.1:5678", "/videos"); first != second {
+		t.Errorf("expected: %s but got: %s", first, second)
+	}
+
+	if other := mint("10.0.0.2:1234", "/videos"); other != "macaroon2" {
+		t.Errorf("expected: %s but got: %s", "macaroon2", other)
+	}
+
+	mint("10.0.0.1:1234", "/photos") // evicts 10.0.0.1 /videos
+
+	if again := mint("10.0.0.1:1234", "/videos"); again != "macaroon4" {
+		t.Errorf("expected: %s but got: %s", "macaroon4", again)
+	}
+
+	now = now.Add(time.Minute)
+	if expired := mint("10.0.0.1:1234", "/videos"); expired != "macaroon5" {
+		t.Errorf("expected: %s but got: %s", "macaroon5", expired)
+	}
+
+	failing = true
+	r := httptest.NewRequest("GET", "/music", nil)
+	if _, _, err := cache.MintWithChallenge(r); !errors.Is(err, ErrFailedInvoiceRequest) {
+		t.Errorf("expected: %v but got: %v", ErrFailedInvoiceRequest, err)
+	}
+
+	failing = false
+	if retried := mint(r.RemoteAddr, "/music"); retried != "macaroon6" {
+		t.Errorf("expected: %s but got: %s", "macaroon6", retried)
+	}
+
+	expectedStats := MintingStats{Hits: 1, Misses: 7, Evictions: 3, Expirations: 1, Entries: 2}
+	if stats := cache.Stats(); stats != expectedStats {
+		t.Errorf("expected: %+v but got: %+v", expectedStats, stats)
+	}
+}
+
+func TestCachingMinter_Authenticated(t *testing.T) {
+	var minted int
+	minter := mockMinter{func(*http.Request) (string, Challenge, error) {
+		minted++
+		return "macaroon", Invoice("lnbc"), nil
+	}}
+
+	cache := CachingMinter(minter, nil, time.Minute, 10)
+
+	for range 2 {
+		r := httptest.NewRequest("GET", "/videos", nil)
+		r = r.WithContext(context.WithValue(r.Context(), KeyMacaroon, map[Identifier]*macaroon.Macaroon{}))
+		cache.MintWithChallenge(r) //nolint:errcheck
+	}
+
+	if minted != 2 {
+		t.Errorf("expected: %d but got: %d", 2, minted)
+	}
+}
+
+func TestClientRouteFingerprint(t *testing.T) {
+	tests := map[string]struct {
+		remoteAddr          string
+		expectedFingerprint string
+	}{
+		"IPv4":         {remoteAddr: "10.0.0.1:1234", expectedFingerprint: "10.0.0.1 GET /videos"},
+		"IPv6":         {remoteAddr: "[::1]:1234", expectedFingerprint: "::1 GET /videos"},
+		"without port": {remoteAddr: "10.0.0.1", expectedFingerprint: "10.0.0.1 GET /videos"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/videos?page=2", nil)
+			r.RemoteAddr = test.remoteAddr
+
+			if fingerprint := ClientRouteFingerprint(HTTPAccessRequest(r)); fingerprint != test.expectedFingerprint {
+				t.Errorf("expected: %s but got: %s", test.expectedFingerprint, fingerprint)
+			}
+		})
+	}
+}
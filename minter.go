@@ -0,0 +1,103 @@
+package l402
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+type InvoiceProvider interface {
+	// CreateInvoice asks a lightning node for an invoice and returns it along with its payment hash
+	CreateInvoice(ctx context.Context, amountMsat uint64, memo string) (Invoice, Hash, error)
+}
+
+type minter struct {
+	invoices          InvoiceProvider
+	rootKeys          RootKeyStore
+	pricer            Pricer
+	thirdPartyCaveats func(AccessRequest) ([]ThirdPartyCaveat, error)
+}
+
+// MinterOption configures the standard minter
+type MinterOption func(*minter)
+
+// Minter is the standard MacaroonMinter
+// The pricer sizes the invoice of each request and decides the caveats that are added to its macaroon
+func Minter(invoices InvoiceProvider, rootKeys RootKeyStore, pricer Pricer, options ...MinterOption) minter {
+	m := minter{
+		invoices: invoices,
+		rootKeys: rootKeys,
+		pricer:   pricer,
+	}
+
+	for _, option := range options {
+		option(&m)
+	}
+
+	return m
+}
+
+// WithThirdPartyCaveats adds the third-party caveats returned by caveats to every minted macaroon
+// Clients must then present the discharge macaroons of those caveats, bound to the L402 macaroon, along with it
+func WithThirdPartyCaveats(caveats func(AccessRequest) ([]ThirdPartyCaveat, error)) MinterOption {
+	return func(m *minter) {
+		m.thirdPartyCaveats = caveats
+	}
+}
+
+func (m minter) MintWithChallenge(r *http.Request) (string, Challenge, error) {
+	return m.MintWithChallengeFor(HTTPAccessRequest(r))
+}
+
+func (m minter) MintWithChallengeFor(r AccessRequest) (string, Challenge, error) {
+	amountMsat, caveats, err := m.pricer.Price(HTTPRequest(r))
+	if err != nil {
+		return "", nil, err
+	}
+
+	var thirdPartyCaveats []ThirdPartyCaveat
+	if m.thirdPartyCaveats != nil {
+		if thirdPartyCaveats, err = m.thirdPartyCaveats(r); err != nil {
+			return "", nil, err
+		}
+	}
+
+	// The invoice comes first, so a node that fails to create it doesn't leave a root key behind for every request
+	invoice, paymentHash, err := m.invoices.CreateInvoice(r.Context(), amountMsat, fmt.Sprintf("L402 %s %s", r.Method(), r.Path()))
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %w", ErrFailedInvoiceRequest, err)
+	}
+
+	id, rootKey, err := m.rootKeys.NewRootKey(r.Context())
+	if err != nil {
+		return "", nil, err
+	}
+
+	macaroonBase64, err := mintMacaroon(rootKey, Identifier{PaymentHash: paymentHash, ID: id}, caveats, thirdPartyCaveats...)
+	if err != nil {
+		deleteRootKey(r.Context(), m.rootKeys, id)
+		return "", nil, err
+	}
+
+	return macaroonBase64, invoice, nil
+}
+
+func mintMacaroon(rootKey []byte, identifier Identifier, caveats []Caveat, thirdPartyCaveats ...ThirdPartyCaveat) (string, error) {
+	macaroonID, err := MarchalIdentifier(identifier)
+	if err != nil {
+		return "", err
+	}
+
+	mac, err := macaroon.New(rootKey, macaroonID, "", macaroon.LatestVersion)
+	if err != nil {
+		return "", err
+	} else if err := AddFirstPartyCaveats(mac, caveats...); err != nil {
+		return "", err
+	} else if err := AddThirdPartyCaveats(mac, thirdPartyCaveats...); err != nil {
+		return "", err
+	}
+
+	return MarshalMacaroons(mac)
+}
@@ -0,0 +1,99 @@
+package l402
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestMinter_MintWithChallenge(t *testing.T) {
+	tests := map[string]struct {
+		pricer          Pricer
+		invoiceError    error
+		expectedAmount  uint64
+		expectedCaveats []string
+		expectedError   error
+	}{
+		"no price": {
+			pricer:        routePricer{},
+			expectedError: ErrNoPrice,
+		},
+		"failed invoice": {
+			pricer:        FixedPrice(1000),
+			invoiceError:  errors.New("node offline"),
+			expectedError: ErrFailedInvoiceRequest,
+		},
+		"success": {
+			pricer:          FixedPrice(1000, NewCaveat(RateCondition, "10/s"), NewCaveat(MaxBytesCondition, "100")),
+			expectedAmount:  1000,
+			expectedCaveats: []string{"rate=10/s", "max_bytes=100"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			invoices := &fakeInvoiceProvider{err: test.invoiceError}
+			rootKeys := MemoryRootKeyStore()
+
+			macaroonBase64, challenge, err := Minter(invoices, rootKeys, test.pricer).MintWithChallenge(httptest.NewRequest("GET", "/videos/1", nil))
+
+			if !errors.Is(err, test.expectedError) {
+				t.Fatalf("expected: %v but got: %v", test.expectedError, err)
+			} else if err != nil {
+				// A failed challenge leaves no root key behind
+				if len(rootKeys.rootKeys) != 0 {
+					t.Errorf("expected: %d but got: %d", 0, len(rootKeys.rootKeys))
+				}
+				return
+			}
+
+			if challenge != Invoice("lnbc1") {
+				t.Errorf("expected: %v but got: %v", Invoice("lnbc1"), challenge)
+			}
+
+			if invoices.amountMsat != test.expectedAmount {
+				t.Errorf("expected: %d but got: %d", test.expectedAmount, invoices.amountMsat)
+			}
+
+			macaroons, err := UnmarshalMacaroons(macaroonBase64)
+			if err != nil || len(macaroons) != 1 {
+				t.Fatalf("expected one macaroon but got: %v %v", macaroons, err)
+			}
+
+			for identifier, mac := range macaroons {
+				if identifier.PaymentHash != invoices.paymentHash {
+					t.Errorf("expected: %v but got: %v", invoices.paymentHash, identifier.PaymentHash)
+				}
+
+				rootKey, err := rootKeys.RootKey(context.Background(), identifier.ID)
+				if err != nil {
+					t.Fatalf("expected: %v but got: %v", nil, err)
+				}
+
+				caveats, err := mac.VerifySignature(rootKey, nil)
+				if err != nil {
+					t.Fatalf("expected: %v but got: %v", nil, err)
+				}
+
+				if !reflect.DeepEqual(caveats, test.expectedCaveats) {
+					t.Errorf("expected: %v but got: %v", test.expectedCaveats, caveats)
+				}
+			}
+		})
+	}
+}
+
+type fakeInvoiceProvider struct {
+	amountMsat  uint64
+	paymentHash Hash
+	err         error
+}
+
+func (f *fakeInvoiceProvider) CreateInvoice(_ context.Context, amountMsat uint64, _ string) (Invoice, Hash, error) {
+	f.amountMsat = amountMsat
+	f.paymentHash = sha256.Sum256([]byte("preimage"))
+	return "lnbc1", f.paymentHash, f.err
+}
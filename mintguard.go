@@ -0,0 +1,284 @@
+package l402
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MintingGuard protects the minter from clients that would create invoices without ever paying them
+type MintingGuard interface {
+	// AllowMinting returns the error to reply with instead of minting a challenge for the request
+	AllowMinting(*http.Request) error
+}
+
+type MintingGuardFunc func(*http.Request) error
+
+func (f MintingGuardFunc) AllowMinting(r *http.Request) error {
+	return f(r)
+}
+
+var ErrMintingPrecondition = errors.New("minting precondition required")
+
+// MintingPreconditionError asks the client to pass a pre-check, like a proof of work, before being challenged
+// Its advice headers tell the client how to pass it, they're set on the response like the ones of a RecoverableRejection
+type MintingPreconditionError struct {
+	Err    error
+	Advice http.Header
+}
+
+func (e *MintingPreconditionError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrMintingPrecondition, e.Err)
+}
+
+func (e *MintingPreconditionError) Unwrap() []error {
+	return []error{ErrMintingPrecondition, e.Err}
+}
+
+func (e *MintingPreconditionError) StatusCode() int {
+	return http.StatusPreconditionRequired
+}
+
+func (e *MintingPreconditionError) AdviseRecovery(header http.Header) {
+	for key, values := range e.Advice {
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+}
+
+// guardedAuthenticator only lets the authenticator mint a challenge once every guard allows it
+type guardedAuthenticator struct {
+	authenticator http.Handler
+	errorHandler  http.Handler
+	guards        []MintingGuard
+}
+
+func (g guardedAuthenticator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, guard := range g.guards {
+		if err := guard.AllowMinting(r); err != nil {
+			var recoverableRejection RecoverableRejection
+			if errors.As(err, &recoverableRejection) {
+				recoverableRejection.AdviseRecovery(w.Header())
+			}
+			g.errorHandler.ServeHTTP(w, withCancelCause(r, err))
+			return
+		}
+	}
+	g.authenticator.ServeHTTP(w, r)
+}
+
+// clientIP is the remote address of a request without its port
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+type mintingLimiter struct {
+	mu           sync.Mutex
+	perClient    Rate
+	global       Rate
+	clients      *lru[string, *tokenBucket]
+	globalBucket *tokenBucket
+	now          func() time.Time
+}
+
+// MintingLimiter limits how many challenges are minted per client IP, and for all clients together
+// A zero Rate disables either limit, at most capacity client buckets are kept and the least recently used ones are evicted
+// Throttled requests are handled by the error handler with an ErrRateLimited cause
+func MintingLimiter(perClient, global Rate, capacity int) *mintingLimiter {
+	return &mintingLimiter{
+		perClient: perClient,
+		global:    global,
+		clients:   newLRU[string, *tokenBucket](capacity),
+		now:       time.Now,
+	}
+}
+
+func (l *mintingLimiter) AllowMinting(r *http.Request) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	var buckets []*tokenBucket
+	var retryAfter time.Duration
+
+	// Check both buckets before taking from any of them, so a throttled request doesn't consume allowance
+	if l.perClient.Requests > 0 {
+		ip := clientIP(r.RemoteAddr)
+		bucket, found := l.clients.Get(ip)
+		if !found {
+			bucket = &tokenBucket{tokens: float64(l.perClient.Requests), updated: now}
+			l.clients.Add(ip, bucket)
+		}
+		retryAfter = max(retryAfter, bucket.refill(l.perClient, now))
+		buckets = append(buckets, bucket)
+	}
+
+	if l.global.Requests > 0 {
+		if l.globalBucket == nil {
+			l.globalBucket = &tokenBucket{tokens: float64(l.global.Requests), updated: now}
+		}
+		retryAfter = max(retryAfter, l.globalBucket.refill(l.global, now))
+		buckets = append(buckets, l.globalBucket)
+	}
+
+	if retryAfter > 0 {
+		return ErrRateLimited(retryAfter)
+	}
+
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	return nil
+}
+
+const (
+	// ProofOfWorkHeader carries the proof of work of a client asking for a challenge, as "<unix time>:<nonce>"
+	ProofOfWorkHeader = "L402-Proof-Of-Work"
+	// ProofOfWorkDifficultyHeader tells how many leading zero bits the proof of work must have
+	ProofOfWorkDifficultyHeader = "L402-Proof-Of-Work-Difficulty"
+)
+
+var (
+	errMissingProofOfWork      = errors.New("missing proof of work")
+	errStaleProofOfWork        = errors.New("stale proof of work")
+	errInsufficientProofOfWork = errors.New("insufficient proof of work")
+	errReplayedProofOfWork     = errors.New("proof of work already used")
+)
+
+type proofOfWork struct {
+	difficulty int
+	window     time.Duration
+	used       ConsumeStore
+	now        func() time.Time
+}
+
+// ProofOfWork makes clients spend CPU time before being challenged, see SolveProofOfWork
+// The SHA-256 of the request's ClientRouteFingerprint and ProofOfWorkHeader must start with difficulty zero bits,
+// and its time must be within window of the current time
+// Each proof is good for a single challenge, used proofs are remembered until their window closes
+func ProofOfWork(difficulty int, window time.Duration) MintingGuard {
+	return proofOfWork{difficulty: difficulty, window: window, used: MemoryConsumeStore(2 * window), now: time.Now}
+}
+
+func (p proofOfWork) AllowMinting(r *http.Request) error {
+	proof := r.Header.Get(ProofOfWorkHeader)
+	unixTime, _, found := strings.Cut(proof, ":")
+	if !found {
+		return p.precondition(errMissingProofOfWork)
+	}
+
+	seconds, err := strconv.ParseInt(unixTime, 10, 64)
+	if age := p.now().Sub(time.Unix(seconds, 0)); err != nil || age > p.window || age < -p.window {
+		return p.precondition(errStaleProofOfWork)
+	}
+
+	fingerprint := ClientRouteFingerprint(HTTPAccessRequest(r))
+	if proofOfWorkBits(fingerprint, proof) < p.difficulty {
+		return p.precondition(errInsufficientProofOfWork)
+	}
+
+	// A proof is valid for up to twice the window, from window ahead of its time to window after it, which the store outlasts
+	if err := p.used.Consume(r.Context(), sha256.Sum256([]byte(fingerprint+" "+proof))); errors.Is(err, ErrTokenSpent) {
+		return p.precondition(errReplayedProofOfWork)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (p proofOfWork) precondition(err error) error {
+	return &MintingPreconditionError{
+		Err:    err,
+		Advice: http.Header{ProofOfWorkDifficultyHeader: {strconv.Itoa(p.difficulty)}},
+	}
+}
+
+// SolveProofOfWork returns a ProofOfWorkHeader value for a request with the given ClientRouteFingerprint
+func SolveProofOfWork(fingerprint string, difficulty int, now time.Time) string {
+	unixTime := strconv.FormatInt(now.Unix(), 10)
+	for nonce := uint64(0); ; nonce++ {
+		proof := unixTime + ":" + strconv.FormatUint(nonce, 16)
+		if proofOfWorkBits(fingerprint, proof) >= difficulty {
+			return proof
+		}
+	}
+}
+
+// proofOfWorkBits counts the leading zero bits of the proof's hash
+func proofOfWorkBits(fingerprint, proof string) int {
+	digest := sha256.Sum256([]byte(fingerprint + " " + proof))
+
+	zeros := 0
+	for _, b := range digest {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return zeros
+}
+
+// MintingCookieName is the cookie set by CookieCheck
+const MintingCookieName = "l402_minting"
+
+var errMissingMintingCookie = errors.New("missing or expired minting cookie")
+
+type cookieCheck struct {
+	secret []byte
+	maxAge time.Duration
+	now    func() time.Time
+}
+
+// CookieCheck only challenges clients that keep cookies, which most crawlers and scripted retries don't
+// Clients without a valid cookie get one along with a 428 response, so a browser gets its challenge on the next try
+// The cookie is signed with the secret and bound to the client IP
+func CookieCheck(secret []byte, maxAge time.Duration) MintingGuard {
+	return cookieCheck{secret: secret, maxAge: maxAge, now: time.Now}
+}
+
+func (c cookieCheck) AllowMinting(r *http.Request) error {
+	ip := clientIP(r.RemoteAddr)
+
+	if cookie, err := r.Cookie(MintingCookieName); err == nil {
+		unixTime, _, _ := strings.Cut(cookie.Value, ".")
+		seconds, err := strconv.ParseInt(unixTime, 10, 64)
+		issued := time.Unix(seconds, 0)
+		if err == nil && c.now().Sub(issued) < c.maxAge && hmac.Equal([]byte(cookie.Value), []byte(c.cookieValue(ip, issued))) {
+			return nil
+		}
+	}
+
+	cookie := http.Cookie{
+		Name:     MintingCookieName,
+		Value:    c.cookieValue(ip, c.now()),
+		Path:     "/",
+		MaxAge:   int(c.maxAge.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	return &MintingPreconditionError{
+		Err:    errMissingMintingCookie,
+		Advice: http.Header{"Set-Cookie": {cookie.String()}},
+	}
+}
+
+func (c cookieCheck) cookieValue(ip string, issued time.Time) string {
+	unixTime := strconv.FormatInt(issued.Unix(), 10)
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(ip + " " + unixTime))
+	return unixTime + "." + hex.EncodeToString(mac.Sum(nil))
+}
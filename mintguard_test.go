@@ -0,0 +1,184 @@
+package l402
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMintingLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := MintingLimiter(Rate{Requests: 2, Per: time.Minute}, Rate{Requests: 3, Per: time.Minute}, 10)
+	limiter.now = func() time.Time { return now }
+
+	tests := []struct {
+		remoteAddr        string
+		expectedRateLimit bool
+	}{
+		{remoteAddr: "10.0.0.1:1234"},
+		{remoteAddr: "10.0.0.1:5678"},
+		{remoteAddr: "10.0.0.1:1234", expectedRateLimit: true}, // the client is throttled
+		{remoteAddr: "10.0.0.2:1234"},
+		{remoteAddr: "10.0.0.3:1234", expectedRateLimit: true}, // every client is throttled
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+
+		var rateLimited ErrRateLimited
+		if err := limiter.AllowMinting(r); errors.As(err, &rateLimited) != test.expectedRateLimit {
+			t.Errorf("expected: %v but got: %v", test.expectedRateLimit, err)
+		}
+	}
+
+	now = now.Add(30 * time.Second)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.3:1234"
+	if err := limiter.AllowMinting(r); err != nil {
+		t.Errorf("expected: %v but got: %v", nil, err)
+	}
+}
+
+func TestProofOfWork(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	fingerprint := "192.0.2.1 GET /videos"
+
+	tests := map[string]struct {
+		proof         string
+		expectedError error
+	}{
+		"solved": {
+			proof: SolveProofOfWork(fingerprint, 8, now),
+		},
+		"missing": {
+			expectedError: errMissingProofOfWork,
+		},
+		"stale": {
+			proof:         SolveProofOfWork(fingerprint, 8, now.Add(-time.Hour)),
+			expectedError: errStaleProofOfWork,
+		},
+		"unsolved": {
+			proof:         "1700000000:0",
+			expectedError: errInsufficientProofOfWork,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			guard := proofOfWork{difficulty: 8, window: time.Minute, used: MemoryConsumeStore(2 * time.Minute), now: func() time.Time { return now }}
+			r := httptest.NewRequest("GET", "/videos", nil)
+			if test.proof != "" {
+				r.Header.Set(ProofOfWorkHeader, test.proof)
+			}
+
+			err := guard.AllowMinting(r)
+
+			if !errors.Is(err, test.expectedError) {
+				t.Errorf("expected: %v but got: %v", test.expectedError, err)
+			}
+
+			if err != nil {
+				header := make(http.Header)
+				err.(RecoverableRejection).AdviseRecovery(header) //nolint:forcetypeassert,errorlint
+				if difficulty := header.Get(ProofOfWorkDifficultyHeader); difficulty != "8" {
+					t.Errorf("expected: %s but got: %s", "8", difficulty)
+				}
+			}
+		})
+	}
+}
+
+func TestProofOfWork_Replay(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	guard := proofOfWork{difficulty: 8, window: time.Minute, used: MemoryConsumeStore(2 * time.Minute), now: func() time.Time { return now }}
+	proof := SolveProofOfWork("192.0.2.1 GET /videos", 8, now)
+
+	for _, expectedError := range []error{nil, errReplayedProofOfWork} {
+		r := httptest.NewRequest("GET", "/videos", nil)
+		r.Header.Set(ProofOfWorkHeader, proof)
+
+		if err := guard.AllowMinting(r); !errors.Is(err, expectedError) {
+			t.Errorf("expected: %v but got: %v", expectedError, err)
+		}
+	}
+}
+
+func TestCookieCheck(t *testing.T) {
+	now := time.Now()
+	guard := cookieCheck{secret: []byte("secret"), maxAge: time.Hour, now: func() time.Time { return now }}
+
+	err := guard.AllowMinting(httptest.NewRequest("GET", "/", nil))
+	if !errors.Is(err, errMissingMintingCookie) {
+		t.Fatalf("expected: %v but got: %v", errMissingMintingCookie, err)
+	}
+
+	w := httptest.NewRecorder()
+	err.(RecoverableRejection).AdviseRecovery(w.Header()) //nolint:forcetypeassert,errorlint
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected: %d but got: %d", 1, len(cookies))
+	}
+
+	tests := map[string]struct {
+		remoteAddr    string
+		elapsed       time.Duration
+		expectedError error
+	}{
+		"same client":    {remoteAddr: "192.0.2.1:5678"},
+		"another client": {remoteAddr: "10.0.0.1:1234", expectedError: errMissingMintingCookie},
+		"expired cookie": {remoteAddr: "192.0.2.1:1234", elapsed: time.Hour, expectedError: errMissingMintingCookie},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			guard := guard
+			guard.now = func() time.Time { return now.Add(test.elapsed) }
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = test.remoteAddr
+			r.AddCookie(cookies[0])
+
+			if err := guard.AllowMinting(r); !errors.Is(err, test.expectedError) {
+				t.Errorf("expected: %v but got: %v", test.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestWithMintingGuard(t *testing.T) {
+	minted := 0
+	minter := mockMinter{func(*http.Request) (string, Challenge, error) {
+		minted++
+		return "macaroon", Invoice("lnbc"), nil
+	}}
+
+	limiter := MintingLimiter(Rate{Requests: 1, Per: time.Minute}, Rate{}, 10)
+	handler := Proxy(minter, mockAccessAuthority{}, WithMintingGuard(limiter))(http.NotFoundHandler())
+
+	tests := []struct {
+		expectedResponseStatus int
+		expectedRetryAfter     string
+	}{
+		{expectedResponseStatus: http.StatusPaymentRequired},
+		{expectedResponseStatus: http.StatusTooManyRequests, expectedRetryAfter: "60"},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+		if w.Code != test.expectedResponseStatus {
+			t.Errorf("expected: %d but got: %d", test.expectedResponseStatus, w.Code)
+		}
+
+		if retryAfter := w.Header().Get("Retry-After"); retryAfter != test.expectedRetryAfter {
+			t.Errorf("expected: %s but got: %s", test.expectedRetryAfter, retryAfter)
+		}
+	}
+
+	if minted != 1 {
+		t.Errorf("expected: %d but got: %d", 1, minted)
+	}
+}
@@ -0,0 +1,431 @@
+package l402
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CapabilitiesCondition lists the capabilities granted by a token, as in "capabilities=read:videos,write:videos"
+// Operations of an OpenAPI document require capabilities with x-l402-capabilities, see OpenAPIPricing
+const CapabilitiesCondition = "capabilities"
+
+// TierCondition binds a token to the pricing tier it was bought at, as in "tier=premium", see OpenAPIPricing
+// Operations priced with x-l402-price have a tier of their own, named after the operation, as in "tier=DELETE /videos/{id}"
+const TierCondition = "tier"
+
+// Operation is an operation of an OpenAPI document along with its L402 extensions
+type Operation struct {
+	ID           string   // operationId
+	Method       string   // in upper case
+	Path         string   // path template, like /videos/{id}
+	PriceMsat    uint64   // x-l402-price
+	Tier         string   // x-l402-tier
+	Capabilities []string // x-l402-capabilities
+}
+
+// OpenAPIPricing holds the route pricing and the capability table built from an OpenAPI 3 document
+//
+// Operations are priced with x-l402-price, in millisatoshis, or with x-l402-tier, which names one of
+// the tiers declared by x-l402-tiers at the root of the document. The other operations are priced by
+// x-l402-default-tier, if any. Tokens are minted with a capabilities caveat granting the x-l402-capabilities
+// of the operation they were bought for, and CapabilitiesSatisfier rejects them for operations requiring others.
+// They also carry a tier caveat, and TierSatisfier rejects them for operations priced at another tier,
+// so a token bought for a cheap operation can't be used for a pricier one.
+type OpenAPIPricing struct {
+	Pricing    RoutePricing
+	Operations []Operation // the most specific paths first
+}
+
+var openAPIMethods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+// LoadOpenAPI reads an OpenAPI document from a JSON file, or from a YAML file otherwise
+func LoadOpenAPI(filename string) (OpenAPIPricing, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return OpenAPIPricing{}, err
+	}
+
+	pricing, err := DecodeOpenAPI(data, filepath.Ext(filename) == ".json")
+	if err != nil {
+		return OpenAPIPricing{}, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	return pricing, nil
+}
+
+// DecodeOpenAPI builds the pricing of an OpenAPI document, errors name the offending field
+func DecodeOpenAPI(data []byte, isJSON bool) (OpenAPIPricing, error) {
+	var document any
+	var err error
+	if isJSON {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&document)
+	} else {
+		err = yaml.Unmarshal(data, &document)
+	}
+	if err != nil {
+		return OpenAPIPricing{}, err
+	}
+
+	root, ok := document.(map[string]any)
+	if !ok {
+		return OpenAPIPricing{}, fmt.Errorf("must be an object")
+	}
+
+	if version, _ := root["openapi"].(string); !strings.HasPrefix(version, "3.") {
+		return OpenAPIPricing{}, fmt.Errorf("openapi: unsupported version %q", root["openapi"])
+	}
+
+	pricing := OpenAPIPricing{Pricing: RoutePricing{Tiers: make(map[string]Tier)}}
+
+	if err := pricing.decodeTiers(root["x-l402-tiers"]); err != nil {
+		return OpenAPIPricing{}, err
+	}
+
+	defaultTier, err := openAPIString("x-l402-default-tier", root["x-l402-default-tier"])
+	if err != nil {
+		return OpenAPIPricing{}, err
+	} else if _, found := pricing.Pricing.Tiers[defaultTier]; defaultTier != "" && !found {
+		return OpenAPIPricing{}, fmt.Errorf("x-l402-default-tier: unknown tier %q", defaultTier)
+	}
+
+	paths, ok := root["paths"].(map[string]any)
+	if !ok {
+		return OpenAPIPricing{}, fmt.Errorf("paths: must be an object")
+	}
+
+	for _, pathTemplate := range slices.Sorted(maps.Keys(paths)) {
+		item := paths[pathTemplate]
+		field := fmt.Sprintf("paths[%q]", pathTemplate)
+		if !strings.HasPrefix(pathTemplate, "/") {
+			return OpenAPIPricing{}, fmt.Errorf("%s: must start with a slash", field)
+		}
+
+		operations, ok := item.(map[string]any)
+		if !ok {
+			return OpenAPIPricing{}, fmt.Errorf("%s: must be an object", field)
+		}
+
+		for _, method := range openAPIMethods {
+			if operation, found := operations[method]; found {
+				if err := pricing.decodeOperation(field+"."+method, method, pathTemplate, operation); err != nil {
+					return OpenAPIPricing{}, err
+				}
+			}
+		}
+	}
+
+	slices.SortFunc(pricing.Operations, func(a, b Operation) int {
+		if order := comparePathTemplates(a.Path, b.Path); order != 0 {
+			return order
+		}
+		return strings.Compare(a.Method, b.Method)
+	})
+
+	for _, operation := range pricing.Operations {
+		tier := operation.Tier
+		if operation.PriceMsat > 0 {
+			tier = operation.Method + " " + operation.Path
+			pricing.Pricing.Tiers[tier] = Tier{PriceMsat: operation.PriceMsat}
+		} else if tier == "" {
+			tier = defaultTier
+		}
+
+		if tier != "" {
+			pricing.Pricing.Routes = append(pricing.Pricing.Routes, Route{
+				Methods: []string{operation.Method},
+				Path:    pathPattern(operation.Path),
+				Tier:    tier,
+				Caveats: []Caveat{NewCaveat(CapabilitiesCondition, strings.Join(operation.Capabilities, ",")), NewCaveat(TierCondition, tier)},
+			})
+		}
+	}
+
+	// Tokens bought for paths outside of the document don't grant any capability either
+	if defaultTier != "" {
+		pricing.Pricing.Routes = append(pricing.Pricing.Routes, Route{Path: "/**", Tier: defaultTier, Caveats: []Caveat{NewCaveat(CapabilitiesCondition, ""), NewCaveat(TierCondition, defaultTier)}})
+	}
+
+	return pricing, nil
+}
+
+func (p *OpenAPIPricing) decodeTiers(value any) error {
+	if value == nil {
+		return nil
+	}
+
+	tiers, ok := value.(map[string]any)
+	if !ok {
+		return fmt.Errorf("x-l402-tiers: must be an object")
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(tiers)) {
+		value := tiers[name]
+		field := "x-l402-tiers." + name
+
+		tier, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: must be an object", field)
+		}
+
+		for key := range tier {
+			if key != "price_msat" && key != "caveats" {
+				return fmt.Errorf("%s: unknown field %q", field, key)
+			}
+		}
+
+		priceMsat, err := openAPIUint(field+".price_msat", tier["price_msat"])
+		if err != nil {
+			return err
+		}
+
+		conditions, err := openAPIStrings(field+".caveats", tier["caveats"])
+		if err != nil {
+			return err
+		}
+
+		caveats := make([]Caveat, len(conditions))
+		for i, condition := range conditions {
+			if caveats[i], err = DecodeCaveat(condition); err != nil {
+				return fmt.Errorf("%s.caveats[%d]: %w", field, i, err)
+			}
+		}
+
+		p.Pricing.Tiers[name] = Tier{PriceMsat: priceMsat, Caveats: caveats}
+	}
+
+	return nil
+}
+
+var capabilityMatcher = regexp.MustCompile(`^[^\s,]+$`)
+
+func (p *OpenAPIPricing) decodeOperation(field, method, pathTemplate string, value any) error {
+	fields, ok := value.(map[string]any)
+	if !ok {
+		return fmt.Errorf("%s: must be an object", field)
+	}
+
+	operation := Operation{Method: strings.ToUpper(method), Path: pathTemplate}
+
+	var err error
+	if operation.ID, err = openAPIString(field+".operationId", fields["operationId"]); err != nil {
+		return err
+	}
+
+	if operation.PriceMsat, err = openAPIUint(field+".x-l402-price", fields["x-l402-price"]); err != nil {
+		return err
+	} else if fields["x-l402-price"] != nil && operation.PriceMsat == 0 {
+		return fmt.Errorf("%s.x-l402-price: must be a positive integer", field)
+	}
+
+	if operation.Tier, err = openAPIString(field+".x-l402-tier", fields["x-l402-tier"]); err != nil {
+		return err
+	} else if _, found := p.Pricing.Tiers[operation.Tier]; operation.Tier != "" && !found {
+		return fmt.Errorf("%s.x-l402-tier: unknown tier %q", field, operation.Tier)
+	} else if operation.Tier != "" && fields["x-l402-price"] != nil {
+		return fmt.Errorf("%s.x-l402-tier: can't be set along with x-l402-price", field)
+	}
+
+	if operation.Capabilities, err = openAPIStrings(field+".x-l402-capabilities", fields["x-l402-capabilities"]); err != nil {
+		return err
+	}
+	for i, capability := range operation.Capabilities {
+		if !capabilityMatcher.MatchString(capability) {
+			return fmt.Errorf("%s.x-l402-capabilities[%d]: invalid capability %q", field, i, capability)
+		}
+	}
+
+	p.Operations = append(p.Operations, operation)
+	return nil
+}
+
+// Pricer prices requests by the operation they match
+func (p OpenAPIPricing) Pricer() (routePricer, error) {
+	return RoutePricer(p.Pricing)
+}
+
+// Operation finds the operation of a request, the most specific path wins
+func (p OpenAPIPricing) Operation(method, urlPath string) (Operation, bool) {
+	for _, operation := range p.Operations {
+		route := Route{Methods: []string{operation.Method}, Path: pathPattern(operation.Path)}
+		if route.matches(strings.ToUpper(method), urlPath) {
+			return operation, true
+		}
+	}
+	return Operation{}, false
+}
+
+// CapabilitiesSatisfier enforces capabilities caveats, a token must grant every capability required by the operation of the request
+func (p OpenAPIPricing) CapabilitiesSatisfier() Satisfier {
+	return Satisfier{
+		Condition: CapabilitiesCondition,
+		SatisfyPrevious: func(previous, current Caveat) error {
+			previousCapabilities := capabilities(previous)
+			for _, capability := range capabilities(current) {
+				if !slices.Contains(previousCapabilities, capability) {
+					return fmt.Errorf("capability %s not granted by %s", capability, previous)
+				}
+			}
+			return nil
+		},
+		SatisfyFinal: func(r AccessRequest, caveat Caveat) error {
+			operation, found := p.Operation(r.Method(), r.Path())
+			if !found {
+				return nil
+			}
+
+			granted := capabilities(caveat)
+			for _, capability := range operation.Capabilities {
+				if !slices.Contains(granted, capability) {
+					return fmt.Errorf("capability %s required by %s %s", capability, operation.Method, operation.Path)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// TierSatisfier enforces tier caveats, a token is only good for the operations priced at the tier it was bought at
+func (p OpenAPIPricing) TierSatisfier() Satisfier {
+	return Satisfier{
+		Condition: TierCondition,
+		SatisfyPrevious: func(previous, current Caveat) error {
+			if current.Value != previous.Value {
+				return fmt.Errorf("tier %s can't follow %s", current.Value, previous)
+			}
+			return nil
+		},
+		SatisfyFinal: func(r AccessRequest, caveat Caveat) error {
+			tier, found := p.tier(r.Method(), r.Path())
+			if !found {
+				return fmt.Errorf("%w: %s %s", ErrNoPrice, r.Method(), r.Path())
+			} else if tier != caveat.Value {
+				return fmt.Errorf("%s %s is priced at tier %s", r.Method(), r.Path(), tier)
+			}
+			return nil
+		},
+	}
+}
+
+// Satisfiers are the capabilities and tier satisfiers, to be given to Authority
+func (p OpenAPIPricing) Satisfiers() []Satisfier {
+	return []Satisfier{p.CapabilitiesSatisfier(), p.TierSatisfier()}
+}
+
+// tier finds the tier a request is priced at, like the pricer does
+func (p OpenAPIPricing) tier(method, urlPath string) (string, bool) {
+	for _, route := range p.Pricing.Routes {
+		if route.matches(strings.ToUpper(method), urlPath) {
+			return route.Tier, true
+		}
+	}
+	return p.Pricing.DefaultTier, p.Pricing.DefaultTier != ""
+}
+
+func capabilities(caveat Caveat) []string {
+	return strings.FieldsFunc(caveat.Value, func(r rune) bool { return r == ',' })
+}
+
+// pathPattern turns an OpenAPI path template into a path.Match pattern, every template expression matches a part of a segment
+func pathPattern(pathTemplate string) string {
+	var pattern strings.Builder
+	for {
+		literal, rest, found := strings.Cut(pathTemplate, "{")
+		pattern.WriteString(escapePattern(literal))
+		if !found {
+			return pattern.String()
+		}
+
+		_, pathTemplate, found = strings.Cut(rest, "}")
+		if !found {
+			return pattern.String() + escapePattern("{"+rest)
+		}
+		pattern.WriteString("*")
+	}
+}
+
+func escapePattern(literal string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`).Replace(literal)
+}
+
+// comparePathTemplates orders literal segments before templated ones, so that /videos/latest wins over /videos/{id}
+func comparePathTemplates(a, b string) int {
+	aSegments, bSegments := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := range min(len(aSegments), len(bSegments)) {
+		aTemplated, bTemplated := strings.Contains(aSegments[i], "{"), strings.Contains(bSegments[i], "{")
+		if aTemplated != bTemplated {
+			if aTemplated {
+				return 1
+			}
+			return -1
+		} else if order := strings.Compare(aSegments[i], bSegments[i]); order != 0 {
+			return order
+		}
+	}
+	return len(aSegments) - len(bSegments)
+}
+
+func openAPIString(field string, value any) (string, error) {
+	if value == nil {
+		return "", nil
+	} else if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return "", fmt.Errorf("%s: must be a string", field)
+}
+
+func openAPIStrings(field string, value any) ([]string, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	values, ok := value.([]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: must be an array", field)
+	}
+
+	strs := make([]string, len(values))
+	for i, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s[%d]: must be a string", field, i)
+		}
+		strs[i] = s
+	}
+	return strs, nil
+}
+
+// openAPIUint reads a non-negative integer, as decoded from JSON or YAML
+func openAPIUint(field string, value any) (uint64, error) {
+	switch n := value.(type) {
+	case nil:
+		return 0, nil
+	case int:
+		if n >= 0 {
+			return uint64(n), nil
+		}
+	case uint64:
+		return n, nil
+	case float64:
+		if n >= 0 && n <= math.MaxUint64 && n == math.Trunc(n) {
+			return uint64(n), nil
+		}
+	case json.Number:
+		if u, err := strconv.ParseUint(n.String(), 10, 64); err == nil {
+			return u, nil
+		}
+	}
+	return 0, fmt.Errorf("%s: must be a non-negative integer", field)
+}
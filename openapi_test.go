@@ -0,0 +1,314 @@
+package l402
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+const openAPIDocument = `
+openapi: 3.0.3
+info: {title: Videos, version: "1"}
+x-l402-default-tier: basic
+x-l402-tiers:
+  basic: {price_msat: 1000}
+  premium: {price_msat: 5000, caveats: ["rate=10/s"]}
+paths:
+  /videos/{id}:
+    parameters: [{name: id, in: path, required: true}]
+    get:
+      operationId: getVideo
+      x-l402-tier: premium
+      x-l402-capabilities: [read:videos]
+    delete:
+      operationId: deleteVideo
+      x-l402-price: 20000
+      x-l402-capabilities: [read:videos, write:videos]
+  /videos/latest:
+    get:
+      operationId: getLatestVideo
+      responses:
+        200: {description: OK}
+  /files/{name}.json:
+    get:
+      x-l402-price: 3000
+`
+
+func TestDecodeOpenAPI(t *testing.T) {
+	pricing, err := DecodeOpenAPI([]byte(openAPIDocument), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pricer, err := pricing.Pricer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		method            string
+		path              string
+		expectedPrice     uint64
+		expectedCaveats   []string
+		expectedOperation string
+	}{
+		"tier": {
+			method:            "GET",
+			path:              "/videos/1",
+			expectedPrice:     5000,
+			expectedCaveats:   []string{"rate=10/s", "capabilities=read:videos", "tier=premium"},
+			expectedOperation: "getVideo",
+		},
+		"price": {
+			method:            "DELETE",
+			path:              "/videos/1",
+			expectedPrice:     20000,
+			expectedCaveats:   []string{"capabilities=read:videos,write:videos", "tier=DELETE /videos/{id}"},
+			expectedOperation: "deleteVideo",
+		},
+		"literal path wins": {
+			method:            "GET",
+			path:              "/videos/latest",
+			expectedPrice:     1000,
+			expectedCaveats:   []string{"capabilities=", "tier=basic"},
+			expectedOperation: "getLatestVideo",
+		},
+		"partial template": {
+			method:          "GET",
+			path:            "/files/report.json",
+			expectedPrice:   3000,
+			expectedCaveats: []string{"capabilities=", "tier=GET /files/{name}.json"},
+		},
+		"outside of the document": {
+			method:          "GET",
+			path:            "/photos/1",
+			expectedPrice:   1000,
+			expectedCaveats: []string{"capabilities=", "tier=basic"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			price, caveats, err := pricer.Price(httptest.NewRequest(test.method, test.path, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if price != test.expectedPrice {
+				t.Errorf("expected: %d but got: %d", test.expectedPrice, price)
+			}
+
+			if fmt.Sprint(caveats) != fmt.Sprint(test.expectedCaveats) {
+				t.Errorf("expected: %v but got: %v", test.expectedCaveats, caveats)
+			}
+
+			operation, _ := pricing.Operation(test.method, test.path)
+			if operation.ID != test.expectedOperation {
+				t.Errorf("expected: %q but got: %q", test.expectedOperation, operation.ID)
+			}
+		})
+	}
+}
+
+func TestLoadOpenAPI(t *testing.T) {
+	tests := map[string]struct {
+		filename      string
+		content       string
+		expectedError string
+	}{
+		"yaml": {
+			filename: "openapi.yaml",
+			content:  openAPIDocument,
+		},
+		"json": {
+			filename: "openapi.json",
+			content:  `{"openapi": "3.1.0", "paths": {"/videos/{id}": {"get": {"x-l402-price": 1000, "x-l402-capabilities": ["read:videos"]}}}}`,
+		},
+		"swagger": {
+			filename:      "openapi.json",
+			content:       `{"swagger": "2.0", "paths": {}}`,
+			expectedError: `openapi: unsupported version`,
+		},
+		"negative price": {
+			filename:      "openapi.json",
+			content:       `{"openapi": "3.1.0", "paths": {"/videos": {"get": {"x-l402-price": -1}}}}`,
+			expectedError: `paths["/videos"].get.x-l402-price: must be a non-negative integer`,
+		},
+		"fractional price": {
+			filename:      "openapi.yaml",
+			content:       "openapi: 3.0.0\npaths: {/videos: {post: {x-l402-price: 1.5}}}",
+			expectedError: `paths["/videos"].post.x-l402-price: must be a non-negative integer`,
+		},
+		"zero price": {
+			filename:      "openapi.yaml",
+			content:       "openapi: 3.0.0\npaths: {/videos: {post: {x-l402-price: 0}}}",
+			expectedError: `paths["/videos"].post.x-l402-price: must be a positive integer`,
+		},
+		"unknown tier": {
+			filename:      "openapi.yaml",
+			content:       "openapi: 3.0.0\npaths: {/videos: {get: {x-l402-tier: gold}}}",
+			expectedError: `paths["/videos"].get.x-l402-tier: unknown tier "gold"`,
+		},
+		"price and tier": {
+			filename:      "openapi.yaml",
+			content:       "openapi: 3.0.0\nx-l402-tiers: {basic: {}}\npaths: {/videos: {get: {x-l402-tier: basic, x-l402-price: 10}}}",
+			expectedError: `paths["/videos"].get.x-l402-tier: can't be set along with x-l402-price`,
+		},
+		"invalid capability": {
+			filename:      "openapi.yaml",
+			content:       "openapi: 3.0.0\npaths: {/videos: {get: {x-l402-price: 10, x-l402-capabilities: [read, 'write videos']}}}",
+			expectedError: `paths["/videos"].get.x-l402-capabilities[1]: invalid capability "write videos"`,
+		},
+		"invalid tier caveat": {
+			filename:      "openapi.yaml",
+			content:       "openapi: 3.0.0\nx-l402-tiers: {basic: {caveats: [rate]}}\npaths: {}",
+			expectedError: `x-l402-tiers.basic.caveats[0]: invalid caveat`,
+		},
+		"unknown tier field": {
+			filename:      "openapi.yaml",
+			content:       "openapi: 3.0.0\nx-l402-tiers: {basic: {price: 10}}\npaths: {}",
+			expectedError: `x-l402-tiers.basic: unknown field "price"`,
+		},
+		"unknown default tier": {
+			filename:      "openapi.yaml",
+			content:       "openapi: 3.0.0\nx-l402-default-tier: basic\npaths: {}",
+			expectedError: `x-l402-default-tier: unknown tier "basic"`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), test.filename)
+			os.WriteFile(filename, []byte(test.content), 0o600) //nolint:errcheck
+
+			_, err := LoadOpenAPI(filename)
+
+			if (err == nil) != (test.expectedError == "") || (err != nil && !strings.Contains(err.Error(), test.expectedError)) {
+				t.Errorf("expected: %v but got: %v", test.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestOpenAPIPricing_CapabilitiesSatisfier(t *testing.T) {
+	pricing, _ := DecodeOpenAPI([]byte(openAPIDocument), false)
+	rootKeys := MemoryRootKeyStore()
+	authority := Authority(rootKeys, pricing.CapabilitiesSatisfier())
+
+	tests := map[string]struct {
+		method          string
+		path            string
+		capabilities    []string
+		expectedAllowed bool
+	}{
+		"granted":              {method: "GET", path: "/videos/1", capabilities: []string{"read:videos"}, expectedAllowed: true},
+		"missing capability":   {method: "DELETE", path: "/videos/1", capabilities: []string{"read:videos"}},
+		"narrowed":             {method: "GET", path: "/videos/1", capabilities: []string{"read:videos,write:videos", "read:videos"}, expectedAllowed: true},
+		"widened":              {method: "GET", path: "/videos/1", capabilities: []string{"", "read:videos"}},
+		"no requirement":       {method: "GET", path: "/videos/latest", capabilities: []string{""}, expectedAllowed: true},
+		"outside the document": {method: "GET", path: "/photos/1", capabilities: []string{""}, expectedAllowed: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			id, rootKey, _ := rootKeys.NewRootKey(context.Background())
+			macaroonID, _ := MarchalIdentifier(Identifier{ID: id})
+			mac, _ := macaroon.New(rootKey, macaroonID, "", macaroon.V2)
+			for _, capabilities := range test.capabilities {
+				AddFirstPartyCaveats(mac, NewCaveat(CapabilitiesCondition, capabilities)) //nolint:errcheck
+			}
+
+			rejection := authority.ApproveAccess(httptest.NewRequest(test.method, test.path, nil), map[Identifier]*macaroon.Macaroon{{ID: id}: mac})
+
+			if allowed := rejection == nil; allowed != test.expectedAllowed {
+				t.Errorf("expected: %v but got: %v", test.expectedAllowed, rejection)
+			}
+		})
+	}
+}
+
+func TestOpenAPIPricing_Proxy(t *testing.T) {
+	pricing, _ := DecodeOpenAPI([]byte(openAPIDocument), false)
+	pricer, _ := pricing.Pricer()
+	rootKeys := MemoryRootKeyStore()
+	invoices := &preimageInvoiceProvider{}
+
+	handler := Proxy(Minter(invoices, rootKeys, pricer), Authority(rootKeys, pricing.Satisfiers()...))(http.NotFoundHandler())
+
+	serve := func(method, authorization string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, "/videos/1", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// A token bought to read a video can't delete it
+	token := challengedToken(t, serve("GET", ""), invoices)
+
+	if w := serve("GET", token); w.Code != http.StatusNotFound {
+		t.Errorf("expected: %d but got: %d", http.StatusNotFound, w.Code)
+	}
+
+	if w := serve("DELETE", token); w.Code != http.StatusPaymentRequired {
+		t.Errorf("expected: %d but got: %d", http.StatusPaymentRequired, w.Code)
+	}
+}
+
+func TestOpenAPIPricing_TierSatisfier(t *testing.T) {
+	pricing, _ := DecodeOpenAPI([]byte(openAPIDocument), false)
+	pricer, _ := pricing.Pricer()
+	rootKeys := MemoryRootKeyStore()
+	invoices := &preimageInvoiceProvider{}
+
+	handler := Proxy(Minter(invoices, rootKeys, pricer), Authority(rootKeys, pricing.Satisfiers()...))(http.NotFoundHandler())
+
+	serve := func(path, authorization string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// A token bought at the default tier, for 1000 msat
+	token := challengedToken(t, serve("/videos/latest", ""), invoices)
+
+	tests := map[string]struct {
+		path                   string
+		expectedResponseStatus int
+	}{
+		"same operation":                {path: "/videos/latest", expectedResponseStatus: http.StatusNotFound},
+		"same tier outside of the docs": {path: "/photos/1", expectedResponseStatus: http.StatusNotFound},
+		"pricier operation":             {path: "/files/report.json", expectedResponseStatus: http.StatusPaymentRequired},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if w := serve(test.path, token); w.Code != test.expectedResponseStatus {
+				t.Errorf("expected: %d but got: %d", test.expectedResponseStatus, w.Code)
+			}
+		})
+	}
+
+	// The tier a token was bought at can't be swapped by its holder
+	attenuated, err := Attenuate(strings.TrimPrefix(strings.Split(token, ":")[0], "L402 "), NewCaveat(TierCondition, "GET /files/{name}.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, preimageHex, _ := strings.Cut(token, ":")
+	if w := serve("/files/report.json", "L402 "+attenuated+":"+preimageHex); w.Code != http.StatusPaymentRequired {
+		t.Errorf("expected: %d but got: %d", http.StatusPaymentRequired, w.Code)
+	}
+}
@@ -0,0 +1,167 @@
+package l402
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Pricer interface {
+	// Price returns the amount to be invoiced for a request and the caveats that amount buys
+	Price(*http.Request) (uint64, []Caveat, error)
+}
+
+type PricerFunc func(*http.Request) (uint64, []Caveat, error)
+
+func (f PricerFunc) Price(r *http.Request) (uint64, []Caveat, error) {
+	return f(r)
+}
+
+// FixedPrice charges the same amount for every request
+func FixedPrice(amountMsat uint64, caveats ...Caveat) Pricer {
+	return PricerFunc(func(*http.Request) (uint64, []Caveat, error) {
+		return amountMsat, slices.Clone(caveats), nil
+	})
+}
+
+// Tier is a price level and the caveats that it buys
+type Tier struct {
+	PriceMsat uint64   `json:"price_msat" yaml:"price_msat"`
+	Caveats   []Caveat `json:"caveats"    yaml:"caveats"`
+}
+
+// Route assigns a tier to the requests that match its methods and path pattern
+// Patterns follow path.Match, and a trailing "/**" matches every path under a prefix
+// An empty list of methods matches every method
+type Route struct {
+	Methods []string `json:"methods" yaml:"methods"`
+	Path    string   `json:"path"    yaml:"path"`
+	Tier    string   `json:"tier"    yaml:"tier"`
+	Caveats []Caveat `json:"caveats" yaml:"caveats"`
+}
+
+type RoutePricing struct {
+	Tiers       map[string]Tier `json:"tiers"        yaml:"tiers"`
+	Routes      []Route         `json:"routes"       yaml:"routes"`
+	DefaultTier string          `json:"default_tier" yaml:"default_tier"`
+}
+
+type routePricer struct {
+	pricing RoutePricing
+}
+
+// RoutePricer prices requests by the first route that matches them
+// Requests that don't match any route are priced by the default tier, or fail with ErrNoPrice if there is none
+func RoutePricer(pricing RoutePricing) (routePricer, error) {
+	if err := pricing.validate(); err != nil {
+		return routePricer{}, err
+	}
+
+	routes := make([]Route, len(pricing.Routes))
+	for i, route := range pricing.Routes {
+		route.Methods = slices.Clone(route.Methods)
+		for j, method := range route.Methods {
+			route.Methods[j] = strings.ToUpper(method)
+		}
+		routes[i] = route
+	}
+	pricing.Routes = routes
+
+	return routePricer{pricing: pricing}, nil
+}
+
+// LoadRoutePricer reads the route pricing from a JSON file, or from a YAML file otherwise
+func LoadRoutePricer(filename string) (routePricer, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return routePricer{}, err
+	}
+
+	pricing, err := DecodeRoutePricing(data, filepath.Ext(filename) == ".json")
+	if err != nil {
+		return routePricer{}, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	return RoutePricer(pricing)
+}
+
+func DecodeRoutePricing(data []byte, isJSON bool) (RoutePricing, error) {
+	var pricing RoutePricing
+	if isJSON {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		return pricing, decoder.Decode(&pricing)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	return pricing, decoder.Decode(&pricing)
+}
+
+func (p RoutePricing) validate() error {
+	if _, found := p.Tiers[p.DefaultTier]; p.DefaultTier != "" && !found {
+		return fmt.Errorf("default_tier: unknown tier %q", p.DefaultTier)
+	}
+
+	for i, route := range p.Routes {
+		if _, found := p.Tiers[route.Tier]; !found {
+			return fmt.Errorf("routes[%d].tier: unknown tier %q", i, route.Tier)
+		} else if !strings.HasPrefix(route.Path, "/") {
+			return fmt.Errorf("routes[%d].path: must start with a slash: %q", i, route.Path)
+		} else if _, err := path.Match(strings.TrimSuffix(route.Path, "/**"), ""); err != nil {
+			return fmt.Errorf("routes[%d].path: %w: %q", i, err, route.Path)
+		}
+	}
+
+	return nil
+}
+
+func (p routePricer) Price(r *http.Request) (uint64, []Caveat, error) {
+	return p.price(r.Method, r.URL.Path)
+}
+
+func (p routePricer) price(method, urlPath string) (uint64, []Caveat, error) {
+	for _, route := range p.pricing.Routes {
+		if route.matches(method, urlPath) {
+			tier := p.pricing.Tiers[route.Tier]
+			return tier.PriceMsat, slices.Concat(tier.Caveats, route.Caveats), nil
+		}
+	}
+
+	if tier, found := p.pricing.Tiers[p.pricing.DefaultTier]; found {
+		return tier.PriceMsat, slices.Clone(tier.Caveats), nil
+	}
+
+	return 0, nil, fmt.Errorf("%w: %s %s", ErrNoPrice, method, urlPath)
+}
+
+func (r Route) matches(method, urlPath string) bool {
+	if len(r.Methods) > 0 && !slices.Contains(r.Methods, method) {
+		return false
+	}
+
+	if prefix, found := strings.CutSuffix(r.Path, "/**"); found {
+		if matched, _ := path.Match(prefix, urlPath); matched || prefix == "" {
+			return true
+		}
+		// Match the prefix segment by segment, so wildcards are allowed in it as well
+		segments := strings.Count(prefix, "/")
+		if strings.Count(urlPath, "/") < segments+1 {
+			return false
+		}
+		parts := strings.SplitAfterN(urlPath, "/", segments+2)
+		matched, _ := path.Match(prefix+"/", strings.Join(parts[:segments+1], ""))
+		return matched
+	}
+
+	matched, _ := path.Match(r.Path, urlPath)
+	return matched
+}
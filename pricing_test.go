@@ -0,0 +1,166 @@
+package l402
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRoutePricer_Price(t *testing.T) {
+	pricer, err := RoutePricer(RoutePricing{
+		Tiers: map[string]Tier{
+			"basic":   {PriceMsat: 1000, Caveats: []Caveat{NewCaveat(RateCondition, "10/s")}},
+			"premium": {PriceMsat: 5000, Caveats: []Caveat{NewCaveat(RateCondition, "100/s")}},
+		},
+		Routes: []Route{
+			{Methods: []string{"post"}, Path: "/videos/*", Tier: "premium", Caveats: []Caveat{NewCaveat(MaxBytesCondition, "1000")}},
+			{Path: "/videos/*", Tier: "basic"},
+			{Methods: []string{"GET"}, Path: "/api/*/users/**", Tier: "premium"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected: %v but got: %v", nil, err)
+	}
+
+	tests := map[string]struct {
+		method          string
+		path            string
+		expectedPrice   uint64
+		expectedCaveats []Caveat
+		expectedError   error
+	}{
+		"first matching route": {
+			method:          "POST",
+			path:            "/videos/1",
+			expectedPrice:   5000,
+			expectedCaveats: []Caveat{NewCaveat(RateCondition, "100/s"), NewCaveat(MaxBytesCondition, "1000")},
+		},
+		"any method": {
+			method:          "GET",
+			path:            "/videos/1",
+			expectedPrice:   1000,
+			expectedCaveats: []Caveat{NewCaveat(RateCondition, "10/s")},
+		},
+		"subtree root": {
+			method:          "GET",
+			path:            "/api/v1/users",
+			expectedPrice:   5000,
+			expectedCaveats: []Caveat{NewCaveat(RateCondition, "100/s")},
+		},
+		"subtree": {
+			method:          "GET",
+			path:            "/api/v1/users/1/orders",
+			expectedPrice:   5000,
+			expectedCaveats: []Caveat{NewCaveat(RateCondition, "100/s")},
+		},
+		"method mismatch": {
+			method:        "DELETE",
+			path:          "/api/v1/users/1",
+			expectedError: ErrNoPrice,
+		},
+		"path mismatch": {
+			method:        "GET",
+			path:          "/api/v1/usersx",
+			expectedError: ErrNoPrice,
+		},
+		"nested path": {
+			method:        "GET",
+			path:          "/videos/1/thumbnail",
+			expectedError: ErrNoPrice,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			price, caveats, err := pricer.Price(httptest.NewRequest(test.method, test.path, nil))
+
+			if !errors.Is(err, test.expectedError) {
+				t.Fatalf("expected: %v but got: %v", test.expectedError, err)
+			}
+
+			if price != test.expectedPrice {
+				t.Errorf("expected: %d but got: %d", test.expectedPrice, price)
+			}
+
+			if !reflect.DeepEqual(caveats, test.expectedCaveats) {
+				t.Errorf("expected: %v but got: %v", test.expectedCaveats, caveats)
+			}
+		})
+	}
+}
+
+func TestLoadRoutePricer(t *testing.T) {
+	tests := map[string]struct {
+		filename      string
+		content       string
+		expectedError string
+	}{
+		"yaml": {
+			filename: "pricing.yaml",
+			content: `
+default_tier: basic
+tiers:
+  basic:
+    price_msat: 1000
+    caveats: ["rate=10/s"]
+routes:
+  - methods: [GET]
+    path: /videos/**
+    tier: basic
+`,
+		},
+		"json": {
+			filename: "pricing.json",
+			content:  `{"default_tier": "basic", "tiers": {"basic": {"price_msat": 1000, "caveats": ["rate=10/s"]}}}`,
+		},
+		"unknown field": {
+			filename:      "pricing.json",
+			content:       `{"default_tier": "basic", "tiers": {"basic": {"price": 1000}}}`,
+			expectedError: `unknown field "price"`,
+		},
+		"invalid caveat": {
+			filename:      "pricing.yaml",
+			content:       "tiers: {basic: {caveats: [rate]}}",
+			expectedError: "invalid caveat",
+		},
+		"unknown tier": {
+			filename:      "pricing.yaml",
+			content:       "routes: [{path: /videos, tier: gold}]",
+			expectedError: `routes[0].tier: unknown tier "gold"`,
+		},
+		"relative path": {
+			filename:      "pricing.yaml",
+			content:       "tiers: {basic: {}}\nroutes: [{path: videos, tier: basic}]",
+			expectedError: `routes[0].path: must start with a slash`,
+		},
+		"bad pattern": {
+			filename:      "pricing.yaml",
+			content:       "tiers: {basic: {}}\nroutes: [{path: '/videos/[', tier: basic}]",
+			expectedError: `routes[0].path: syntax error in pattern`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), test.filename)
+			os.WriteFile(filename, []byte(test.content), 0o600) //nolint:errcheck
+
+			pricer, err := LoadRoutePricer(filename)
+
+			if (err == nil) != (test.expectedError == "") || (err != nil && !strings.Contains(err.Error(), test.expectedError)) {
+				t.Fatalf("expected: %v but got: %v", test.expectedError, err)
+			} else if err != nil {
+				return
+			}
+
+			price, caveats, err := pricer.Price(httptest.NewRequest("GET", "/videos/1", nil))
+			if price != 1000 || !reflect.DeepEqual(caveats, []Caveat{NewCaveat(RateCondition, "10/s")}) || err != nil {
+				t.Errorf("expected: %d %v but got: %d %v %v", 1000, "rate=10/s", price, caveats, err)
+			}
+		})
+	}
+}
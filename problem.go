@@ -0,0 +1,127 @@
+package l402
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ProblemContentType is the media type of RFC 9457 Problem Details
+const ProblemContentType = "application/problem+json"
+
+// Problem types of the errors reported by the proxy
+const (
+	ProblemInvalidMacaroon       = "urn:l402:problem:invalid-macaroon"
+	ProblemInvalidPreimage       = "urn:l402:problem:invalid-preimage"
+	ProblemInvalidCaveat         = "urn:l402:problem:invalid-caveat"
+	ProblemPaymentRequired       = "urn:l402:problem:payment-required"
+	ProblemFailedMacaroonMinting = "urn:l402:problem:failed-macaroon-minting"
+	ProblemRateLimited           = "urn:l402:problem:rate-limited"
+	ProblemTokenSpent            = "urn:l402:problem:token-spent"
+)
+
+// Problem is an RFC 9457 Problem Details object, extended with the L402 challenge of 402 responses
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+
+	Macaroon  string `json:"macaroon,omitempty"`
+	Invoice   string `json:"invoice,omitempty"`
+	Challenge string `json:"challenge,omitempty"` // set instead of Invoice for other kinds of challenges
+	PriceMsat uint64 `json:"price_msat,omitempty"`
+	// Stage and Index tell which macaroon of the token failed, see MacaroonError
+	Stage Stage `json:"stage,omitempty"`
+	Index *int  `json:"index,omitempty"`
+	// Recovery holds the headers set by a RecoverableRejection, advising how to regain access without a new payment
+	Recovery http.Header `json:"recovery,omitempty"`
+}
+
+var problemTypes = []struct {
+	err         error
+	problemType string
+	title       string
+}{
+	{ErrInvalidMacaroon, ProblemInvalidMacaroon, "Invalid macaroon"},
+	{ErrInvalidPreimage, ProblemInvalidPreimage, "Invalid preimage"},
+	{ErrInvalidCaveat, ProblemInvalidCaveat, "Invalid caveat"},
+	{ErrFailedMacaroonMinting, ProblemFailedMacaroonMinting, "Failed macaroon minting"},
+	{ErrPaymentRequired, ProblemPaymentRequired, "Payment required"},
+	{ErrTokenSpent, ProblemTokenSpent, "Token already spent"},
+}
+
+// NewProblem describes an error with the problem type of the first matching L402 error
+// Errors without a problem type are described as "about:blank", titled after the status code
+func NewProblem(err error, status int) Problem {
+	problem := Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: err.Error(),
+	}
+
+	var macaroonError *MacaroonError
+	if errors.As(err, &macaroonError) {
+		problem.Stage = macaroonError.Stage
+		if macaroonError.Index >= 0 {
+			problem.Index = &macaroonError.Index
+		}
+	}
+
+	var rateLimited ErrRateLimited
+	for _, p := range problemTypes {
+		if errors.Is(err, p.err) {
+			problem.Type, problem.Title = p.problemType, p.title
+			return problem
+		}
+	}
+
+	if errors.As(err, &rateLimited) {
+		problem.Type, problem.Title = ProblemRateLimited, "Rate limited"
+	} else if status == http.StatusPaymentRequired {
+		// Every rejection can be overcome by paying for a new token
+		problem.Type, problem.Title = ProblemPaymentRequired, "Payment required"
+	}
+
+	return problem
+}
+
+// WriteProblem replies with the problem as application/problem+json
+func WriteProblem(w http.ResponseWriter, problem Problem) {
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem) //nolint:errcheck,errchkjson
+}
+
+// ProblemErrorHandler is an error handler that always replies with application/problem+json
+// It uses the same status codes as DefaultErrorHandler
+func ProblemErrorHandler(w http.ResponseWriter, r *http.Request) {
+	err := context.Cause(r.Context())
+	if err == nil {
+		err = errors.New(http.StatusText(http.StatusInternalServerError))
+	}
+	WriteProblem(w, NewProblem(err, errorStatus(w, err)))
+}
+
+// AcceptsProblem tells if the client prefers Problem Details, or JSON in general, over plain text
+func AcceptsProblem(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+			if err != nil || (mediaType != ProblemContentType && mediaType != "application/json") {
+				continue
+			}
+			if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+				continue
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+package l402
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDefaultErrorHandler_Problem(t *testing.T) {
+	tests := map[string]struct {
+		cause           error
+		expectedProblem Problem
+	}{
+		"invalid macaroon": {
+			cause: fmt.Errorf("%w: %w", ErrInvalidMacaroon, errors.New("bad encoding")),
+			expectedProblem: Problem{
+				Type:   ProblemInvalidMacaroon,
+				Title:  "Invalid macaroon",
+				Status: http.StatusBadRequest,
+				Detail: "invalid macaroon: bad encoding",
+			},
+		},
+		"invalid preimage": {
+			cause:           ErrInvalidPreimage,
+			expectedProblem: Problem{Type: ProblemInvalidPreimage, Title: "Invalid preimage", Status: http.StatusBadRequest, Detail: "invalid preimage"},
+		},
+		"failed minting": {
+			cause: fmt.Errorf("%w: %w", ErrFailedMacaroonMinting, errors.New("node offline")),
+			expectedProblem: Problem{
+				Type:   ProblemFailedMacaroonMinting,
+				Title:  "Failed macaroon minting",
+				Status: http.StatusInternalServerError,
+				Detail: "failed macaroon minting: node offline",
+			},
+		},
+		"rate limited": {
+			cause:           ErrRateLimited(time.Second),
+			expectedProblem: Problem{Type: ProblemRateLimited, Title: "Rate limited", Status: http.StatusTooManyRequests, Detail: ErrRateLimited(time.Second).Error()},
+		},
+		"unknown error": {
+			cause:           errors.New("disk full"),
+			expectedProblem: Problem{Type: "about:blank", Title: "Internal Server Error", Status: http.StatusInternalServerError, Detail: "disk full"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Accept", "application/problem+json")
+
+			DefaultErrorHandler(w, withCancelCause(r, test.cause))
+
+			if contentType := w.Header().Get("Content-Type"); contentType != ProblemContentType {
+				t.Errorf("expected: %s but got: %s", ProblemContentType, contentType)
+			}
+
+			var problem Problem
+			if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(problem, test.expectedProblem) {
+				t.Errorf("expected: %+v but got: %+v", test.expectedProblem, problem)
+			}
+
+			if w.Code != test.expectedProblem.Status {
+				t.Errorf("expected: %d but got: %d", test.expectedProblem.Status, w.Code)
+			}
+		})
+	}
+}
+
+func TestAuthenticator_Problem(t *testing.T) {
+	minter := mockMinter{func(*http.Request) (string, Challenge, error) {
+		return "macaroonBase64", Invoice("lnbc2500u1pvjluez"), nil
+	}}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept", "text/html;q=0.9, application/json")
+	ctx, cancelCause := context.WithCancelCause(r.Context())
+	cancelCause(fakeRecoverableRejection(`recovery="tier-upgrade"`))
+
+	Authenticator(minter, http.HandlerFunc(DefaultErrorHandler)).ServeHTTP(w, r.WithContext(ctx))
+
+	var problem Problem
+	if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedProblem := Problem{
+		Type:      ProblemPaymentRequired,
+		Title:     "Payment required",
+		Status:    http.StatusPaymentRequired,
+		Detail:    "payment required",
+		Macaroon:  "macaroonBase64",
+		Invoice:   "lnbc2500u1pvjluez",
+		PriceMsat: 250_000_000,
+		Recovery:  http.Header{"Authentication-Info": {`recovery="tier-upgrade"`}},
+	}
+
+	if !reflect.DeepEqual(problem, expectedProblem) {
+		t.Errorf("expected: %+v but got: %+v", expectedProblem, problem)
+	}
+
+	if w.Header().Get("WWW-Authenticate") == "" {
+		t.Error("expected the WWW-Authenticate header to be kept")
+	}
+}
+
+func TestAcceptsProblem(t *testing.T) {
+	tests := map[string]bool{
+		"":                                  false,
+		"*/*":                               false,
+		"text/plain":                        false,
+		"application/problem+json":          true,
+		"text/html, application/json;q=0.5": true,
+		"application/json;q=0":              false,
+	}
+
+	for accept, expected := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept", accept)
+
+		if accepted := AcceptsProblem(r); accepted != expected {
+			t.Errorf("%q expected: %v but got: %v", accept, expected, accepted)
+		}
+	}
+}
+
+func TestInvoice_AmountMsat(t *testing.T) {
+	tests := map[Invoice]struct {
+		expectedAmount uint64
+		expectedFound  bool
+	}{
+		"lnbc1pvjluezpp5":      {},
+		"lnbc2500u1pvjluezpp5": {expectedAmount: 250_000_000, expectedFound: true},
+		"lnbc20m1pvjluezpp5":   {expectedAmount: 2_000_000_000, expectedFound: true},
+		"lntb10n1pvjluezpp5":   {expectedAmount: 1000, expectedFound: true},
+		"lnbcrt10p1pvjluez":    {expectedAmount: 1, expectedFound: true},
+		"lnbc15p1pvjluez":      {},
+		"lnbc21pvjluez":        {expectedAmount: 200_000_000_000, expectedFound: true},
+		"not an invoice":       {},
+	}
+
+	for invoice, test := range tests {
+		amount, found := invoice.AmountMsat()
+		if amount != test.expectedAmount || found != test.expectedFound {
+			t.Errorf("%s expected: %d %v but got: %d %v", invoice, test.expectedAmount, test.expectedFound, amount, found)
+		}
+	}
+}
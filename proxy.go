@@ -4,9 +4,12 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/http"
 	"regexp"
+	"strconv"
+	"strings"
 
 	macaroon "gopkg.in/macaroon.v2"
 )
@@ -24,9 +27,18 @@ type proxy struct {
 	accessAuthority AccessAuthority
 	apiHandler      http.Handler
 	errorHandler    http.Handler
+	usageCounter    UsageCounter
+	rateLimiter     RateLimiter
+	connectionGuard *ConnectionGuard
+	accounts        *accounts
+	mintingGuards   []MintingGuard
+	tokenCache      TokenCache
+	escrow          *Escrow
+	consumeStore    ConsumeStore
+	refunds         *Refunds
 }
 
-func Proxy(minter MacaroonMinter, authority AccessAuthority, options ...option) func(http.Handler) http.Handler {
+func Proxy(minter MacaroonMinter, authority AccessAuthority, options ...Option) func(http.Handler) http.Handler {
 	p := proxy{
 		accessAuthority: authority,
 		errorHandler:    http.HandlerFunc(DefaultErrorHandler),
@@ -40,42 +52,63 @@ func Proxy(minter MacaroonMinter, authority AccessAuthority, options ...option)
 	if p.authenticator == nil {
 		p.authenticator = Authenticator(minter, p.errorHandler)
 	}
+	if len(p.mintingGuards) > 0 {
+		p.authenticator = guardedAuthenticator{authenticator: p.authenticator, errorHandler: p.errorHandler, guards: p.mintingGuards}
+	}
 
 	// Return as a middleware
 	return func(apiHandler http.Handler) http.Handler {
-		p.apiHandler = apiHandler
-		return &p
+		// Copy the proxy so that the middleware can wrap many handlers
+		handler := p
+		handler.apiHandler = apiHandler
+		return &handler
 	}
 }
 
 type ContextKey string
 
-const KeyMacaroon ContextKey = "proxy_macaroon"
+const (
+	KeyMacaroon ContextKey = "proxy_macaroon"
+	// KeyDischarges holds the discharge macaroons of the token's third-party caveats, if any
+	KeyDischarges ContextKey = "proxy_discharges"
+	// KeySignatureVerified is set when the token was found in the token cache, so its signatures were verified already
+	KeySignatureVerified ContextKey = "proxy_signature_verified"
+	// KeyIdentifiers holds the identifiers of the token's macaroons in the order of the token, see VerifiedToken.Identifiers
+	KeyIdentifiers ContextKey = "proxy_identifiers"
+)
 
 func (p proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	macaroonBase64, preimageHash, found := getL402AuthorizationHeader(r)
 	if !found {
-		ctx, cancelCause := context.WithCancelCause(r.Context())
-		cancelCause(ErrPaymentRequired)
-		p.authenticator.ServeHTTP(w, r.WithContext(ctx))
+		if escrowedMacaroon, escrowed := getEscrowAuthorizationHeader(r); escrowed && p.escrow != nil {
+			p.serveEscrow(w, r, escrowedMacaroon)
+			return
+		}
+		p.authenticator.ServeHTTP(w, withCancelCause(r, missingAuthorization(r.Header)))
 		return
 	}
 
-	macaroons, err := UnmarshalMacaroons(macaroonBase64)
+	token, verified, err := p.decodeToken(macaroonBase64, preimageHash)
 	if err != nil {
-		ctx, cancelCause := context.WithCancelCause(r.Context())
-		cancelCause(fmt.Errorf("%w: %w", ErrInvalidMacaroon, err))
-		p.errorHandler.ServeHTTP(w, r.WithContext(ctx))
+		p.errorHandler.ServeHTTP(w, withCancelCause(r, err))
 		return
 	}
+	macaroons := token.Macaroons
 
 	ctx := context.WithValue(r.Context(), KeyMacaroon, macaroons)
+	ctx = context.WithValue(ctx, KeyIdentifiers, token.Identifiers)
+	if len(token.Discharges) > 0 {
+		ctx = context.WithValue(ctx, KeyDischarges, token.Discharges)
+	}
+	if verified {
+		ctx = context.WithValue(ctx, KeySignatureVerified, true)
+	}
+	r = r.WithContext(ctx)
 
-	if valid := validatePreimage(macaroons, preimageHash); !valid {
-		ctx, cancelCause := context.WithCancelCause(ctx)
-		cancelCause(ErrInvalidPreimage)
-		p.errorHandler.ServeHTTP(w, r.WithContext(ctx))
-		return
+	// The generation is read before the approval, so a token revoked while it's approved isn't cached
+	var generation uint64
+	if p.tokenCache != nil && !verified {
+		generation = p.tokenCache.Generation()
 	}
 
 	// Check if macarron is singed by a valid key and that it grants access to the requested resource
@@ -83,14 +116,157 @@ func (p proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// The presented macaroon might not have been singed properlly or was revoked
 		// Or the presented macaroon is valid but doesn't grant access to this resource
 		// So we give the client the option to re-authenticate with a proper macaroon
-		ctx, cancelCause := context.WithCancelCause(ctx)
-		cancelCause(rejection)
-		p.authenticator.ServeHTTP(w, r.WithContext(ctx))
+		p.authenticator.ServeHTTP(w, withCancelCause(r, rejection))
+		return
+	}
+
+	if p.tokenCache != nil && !verified {
+		p.tokenCache.Add(tokenCacheKey(macaroonBase64, preimageHash), token, generation)
+	}
+
+	if invoice := r.Header.Get(RefundInvoiceHeader); invoice != "" && p.refunds != nil && p.refunds.Refunder != nil && p.refunds.Invoices != nil {
+		p.serveRefund(w, r, macaroons, Invoice(invoice))
 		return
 	}
 
 	// At this point the request is valid, so we proxy the API call
-	p.apiHandler.ServeHTTP(w, r.WithContext(ctx))
+	p.serveAPI(w, r, macaroons, true)
+}
+
+// decodeToken decodes the token and checks its preimage, unless it's found in the token cache
+// Tokens found in the cache had their signatures verified already
+func (p proxy) decodeToken(macaroonBase64 string, preimageHash Hash) (VerifiedToken, bool, error) {
+	if p.tokenCache != nil {
+		if token, found := p.tokenCache.Get(tokenCacheKey(macaroonBase64, preimageHash)); found {
+			return token, true, nil
+		}
+	}
+
+	token, err := verifyPreimage(macaroonBase64, preimageHash)
+	return token, false, err
+}
+
+// DecodeAuthorization decodes the L402 token of the Authorization header and checks its preimage, for transports other than HTTP
+// It fails with ErrPaymentRequired when there's no token, the signatures and caveats are left to the authority
+func DecodeAuthorization(header http.Header) (VerifiedToken, error) {
+	macaroonBase64, preimageHash, found := l402Authorization(header)
+	if !found {
+		return VerifiedToken{}, missingAuthorization(header)
+	}
+	return verifyPreimage(macaroonBase64, preimageHash)
+}
+
+// verifyPreimage decodes a token and checks that every macaroon is paid by the preimage
+func verifyPreimage(macaroonBase64 string, preimageHash Hash) (VerifiedToken, error) {
+	token, err := UnmarshalOrderedToken(macaroonBase64)
+	if err != nil {
+		return VerifiedToken{}, err
+	}
+
+	if err := validatePreimage(token.Identifiers, preimageHash); err != nil {
+		return VerifiedToken{}, err
+	}
+
+	return token, nil
+}
+
+// serveAPI enforces the usage limits of a token and proxies the API call
+// When spend is set, single-use tokens and credits are spent by the first request that gets past the rate limiter,
+// and put back if the request is turned down before reaching the API handler
+func (p proxy) serveAPI(w http.ResponseWriter, r *http.Request, macaroons map[Identifier]*macaroon.Macaroon, spend bool) {
+	// A token is accounted for by its first macaroon, so one without any isn't served even if a custom authority approves it
+	if len(macaroons) == 0 {
+		p.authenticator.ServeHTTP(w, withCancelCause(r, ErrPaymentRequired))
+		return
+	}
+
+	if p.rateLimiter != nil {
+		rates, err := rateLimits(macaroons)
+		if err != nil {
+			p.errorHandler.ServeHTTP(w, withCancelCause(r, err))
+			return
+		}
+		if retryAfter, allowed := p.rateLimiter.Allow(rates); !allowed {
+			p.errorHandler.ServeHTTP(w, withCancelCause(r, ErrRateLimited(retryAfter)))
+			return
+		}
+	}
+
+	var spent spentToken
+	if spend {
+		var err error
+		// Replays of a spent token must pay again
+		if spent, err = p.spend(r.Context(), macaroons); errors.Is(err, ErrTokenSpent) {
+			p.authenticator.ServeHTTP(w, withCancelCause(r, err))
+			return
+		} else if err != nil {
+			p.errorHandler.ServeHTTP(w, withCancelCause(r, err))
+			return
+		}
+	}
+
+	reject := func(handler http.Handler, err error) {
+		if releaseErr := p.release(context.WithoutCancel(r.Context()), spent); releaseErr != nil {
+			err = errors.Join(err, releaseErr)
+		}
+		handler.ServeHTTP(w, withCancelCause(r, err))
+	}
+
+	if p.accounts != nil {
+		balance, err := p.accounts.charge(r, macaroons)
+		if err == nil || errors.Is(err, ErrInsufficientBalance) {
+			w.Header().Set(BalanceHeader, strconv.FormatInt(balance, 10))
+		}
+
+		if errors.Is(err, ErrInsufficientBalance) {
+			// The account must be topped up to keep using it
+			reject(p.authenticator, err)
+			return
+		} else if err != nil {
+			reject(p.errorHandler, err)
+			return
+		}
+	}
+
+	if p.usageCounter != nil {
+		meteredWriter, err := p.meterResponse(w, r, macaroons)
+		if errors.Is(err, ErrAllowanceExhausted) {
+			// The token was used up, a new payment is required to keep downloading
+			reject(p.authenticator, err)
+			return
+		} else if err != nil {
+			reject(p.errorHandler, err)
+			return
+		}
+		w = meteredWriter
+	}
+
+	if p.connectionGuard != nil {
+		w = p.guardConnection(w, r, macaroons)
+	}
+
+	// Only payments spent by this request are credited, a reusable or held payment would be credited again on every failure
+	if p.refunds != nil && len(spent.payments) > 0 {
+		w = p.creditWriter(w, r, macaroons)
+	}
+
+	p.apiHandler.ServeHTTP(w, r)
+}
+
+func (p proxy) meterResponse(w http.ResponseWriter, r *http.Request, macaroons map[Identifier]*macaroon.Macaroon) (http.ResponseWriter, error) {
+	meters, err := byteMeters(macaroons)
+	if err != nil || len(meters) == 0 {
+		return w, err
+	}
+	return meterResponse(r.Context(), w, p.usageCounter, meters)
+}
+
+// withCancelCause passes the cause to the next handler through the request context
+// The context is detached from any previous cancellation, so an earlier cause doesn't mask the new one
+func withCancelCause(r *http.Request, cause error) *http.Request {
+	ctx, cancelCause := context.WithCancelCause(context.WithoutCancel(r.Context()))
+	cancelCause(cause)
+	return r.WithContext(ctx)
 }
 
 const (
@@ -103,9 +279,13 @@ const (
 var authorizationMatcher = regexp.MustCompile(fmt.Sprintf(`L402 (\S+):([a-f0-9]{%d})`, hexBlockSize))
 
 func getL402AuthorizationHeader(r *http.Request) (string, Hash, bool) {
+	return l402Authorization(r.Header)
+}
+
+func l402Authorization(header http.Header) (string, Hash, bool) {
 	var preimageHash Hash
 
-	for _, v := range r.Header.Values("Authorization") {
+	for _, v := range header.Values("Authorization") {
 		if matches := authorizationMatcher.FindStringSubmatch(v); len(matches) == expectedMatches {
 			macaroonBase64 := matches[macaroonBase64Index]
 			preimageHex := matches[preimageHexIndex]
@@ -120,25 +300,133 @@ func getL402AuthorizationHeader(r *http.Request) (string, Hash, bool) {
 	return "", Hash{}, false
 }
 
-func validatePreimage(macaroons map[Identifier]*macaroon.Macaroon, preimageHash Hash) bool {
-	for identifier := range macaroons {
+var (
+	errMalformedAuthorization = errors.New("malformed L402 authorization")
+	errPreimageMismatch       = errors.New("preimage doesn't match the payment hash")
+)
+
+// missingAuthorization tells apart clients that didn't send a token from the ones that sent a malformed one
+func missingAuthorization(header http.Header) error {
+	for _, v := range header.Values("Authorization") {
+		if strings.HasPrefix(v, "L402 ") {
+			return &MacaroonError{Index: -1, Stage: StageHeader, Err: errMalformedAuthorization}
+		}
+	}
+	return ErrPaymentRequired
+}
+
+func validatePreimage(identifiers []Identifier, preimageHash Hash) error {
+	for i, identifier := range identifiers {
 		if identifier.PaymentHash != preimageHash {
-			return false
+			return &MacaroonError{Index: i, Stage: StagePreimage, Err: errPreimageMismatch}
 		}
 	}
-	return true
+	return nil
 }
 
-type option func(*proxy)
+// Option configures the proxy middleware
+type Option func(*proxy)
 
-func WithAuthenticator(authenticator http.Handler) option {
+func WithAuthenticator(authenticator http.Handler) Option {
 	return func(p *proxy) {
 		p.authenticator = authenticator
 	}
 }
 
-func WithErrorHandler(errorrHandler http.Handler) option {
+func WithErrorHandler(errorrHandler http.Handler) Option {
 	return func(p *proxy) {
 		p.errorHandler = errorrHandler
 	}
 }
+
+// WithByteMetering charges the bytes written by the API handler against the max_bytes caveats of the token
+// Responses are cut off once the allowance runs out, and exhausted tokens are challenged for a new payment
+func WithByteMetering(counter UsageCounter) Option {
+	return func(p *proxy) {
+		p.usageCounter = counter
+	}
+}
+
+// WithRateLimiter throttles approved requests according to the rate caveats of the token
+// Throttled requests are handled by the error handler with an ErrRateLimited cause
+func WithRateLimiter(limiter RateLimiter) Option {
+	return func(p *proxy) {
+		p.rateLimiter = limiter
+	}
+}
+
+// WithConnectionGuard keeps enforcing access on connections hijacked by the API handler, like WebSockets
+// The token is revalidated periodically, usage is charged against the guard's ledger, and the connection is closed once access ends
+func WithConnectionGuard(guard ConnectionGuard) Option {
+	return func(p *proxy) {
+		p.connectionGuard = &guard
+	}
+}
+
+// WithAccounts turns tokens into prepaid accounts, see AccountMinter
+// The deposits of a token are credited to the account of its Identifier.ID, and each request debits the price set by the pricer
+// Accounts that can't cover a request are challenged for a top-up, and responses carry the remaining balance in the BalanceHeader
+// Only deposits set by AccountMinter, as the first caveat of a macaroon, are credited, with the amount the invoices store recorded
+// for their payment hash, so the minter's InvoiceProvider must be wrapped with RecordInvoices on that same store
+func WithAccounts(ledger AccountLedger, invoices InvoiceStore, pricer Pricer) Option {
+	return func(p *proxy) {
+		p.accounts = &accounts{ledger: ledger, invoices: invoices, pricer: pricer}
+	}
+}
+
+// WithMintingGuard checks every request with the guards, in order, before a challenge is minted for it
+// A rejected request is handled by the error handler with the guard's error as the cause, and the minter isn't called
+// See MintingLimiter, ProofOfWork and CookieCheck
+func WithMintingGuard(guards ...MintingGuard) Option {
+	return func(p *proxy) {
+		p.mintingGuards = append(p.mintingGuards, guards...)
+	}
+}
+
+// WithTokenCache skips decoding and signature verification for tokens that were approved before
+// Tokens are keyed by a hash of their Authorization value, their caveats are still checked on every request
+func WithTokenCache(cache TokenCache) Option {
+	return func(p *proxy) {
+		p.tokenCache = cache
+	}
+}
+
+// WithSingleUse makes every token good for a single request, for endpoints that charge a payment per call
+// The payment hashes of a token are consumed once a request is approved and let through by the rate limiter
+// A request then turned down, for lack of balance or allowance, puts them back
+// Replays are challenged for a new payment with an ErrTokenSpent cause
+func WithSingleUse(store ConsumeStore) Option {
+	return func(p *proxy) {
+		p.consumeStore = store
+	}
+}
+
+// WithRefunds issues a credit, in the CreditHeader, when the API handler fails a request paid by a single-use token, see WithSingleUse
+// Reusable tokens and escrowed payments are never credited, the former can be retried and the latter are cancelled instead
+// The credit is presented with the preimage of the failed token, in place of paying again, and it's redeemed once
+// With a Refunder, a credit presented along with an invoice in the RefundInvoiceHeader is refunded instead
+// Refunds.RootKeys is required, and Refunds.Credits defaults to a MemoryConsumeStore
+func WithRefunds(refunds Refunds) Option {
+	if refunds.RootKeys == nil {
+		panic("l402: WithRefunds needs the RootKeys to sign credits with")
+	}
+	if refunds.Credits == nil {
+		refunds.Credits = MemoryConsumeStore(refundCreditTTL)
+	}
+	return func(p *proxy) {
+		p.refunds = &refunds
+	}
+}
+
+// WithEscrow serves tokens minted by EscrowMinter, presented as "L402 <macaroon>" while their payment is held
+// The payment is settled once the API responds with a status the escrow considers a success, and cancelled otherwise
+// Once settled, the client learns the preimage and can keep using the token as any other
+// Each held payment is served once, other requests presenting it are challenged with an ErrTokenSpent cause
+func WithEscrow(escrow Escrow) Option {
+	return func(p *proxy) {
+		if escrow.Claims == nil {
+			escrow.Claims = MemoryConsumeStore(escrowClaimTTL)
+		}
+		p.escrow = &escrow
+	}
+}
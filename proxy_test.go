@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	macaroon "gopkg.in/macaroon.v2"
 )
@@ -28,6 +29,15 @@ func TestProxy_ServeHTTP(t *testing.T) {
 			},
 			expectedResponseStatus: http.StatusPaymentRequired,
 		},
+		"malformed authorization": {
+			authorizationHeader: "L402 macaroon-without-preimage",
+			expectedAuthenticator: spyHandler{
+				called:          true,
+				cancelCause:     ErrPaymentRequired,
+				replyStatusCode: http.StatusPaymentRequired,
+			},
+			expectedResponseStatus: http.StatusPaymentRequired,
+		},
 		"defective macaroon": {
 			authorizationHeader: "L402 AGIAJEemVQUTEyNCR0exk7ek90Cg==:79852a0791225dee00be0a6cf31a1619782c21d35995e118bfc74ad812174035",
 			expectedError: spyHandler{
@@ -88,6 +98,10 @@ func TestProxy_ServeHTTP(t *testing.T) {
 				t.Errorf("expected: %v but got: %v", test.expectedAuthenticator.called, authenticator.called)
 			}
 
+			if !errors.Is(authenticator.cancelCause, test.expectedAuthenticator.cancelCause) {
+				t.Errorf("expected: %v but got: %v", test.expectedAuthenticator.cancelCause, authenticator.cancelCause)
+			}
+
 			if errorHandler.called != test.expectedError.called {
 				t.Errorf("expected: %v but got: %v", test.expectedError.called, errorHandler.called)
 			}
@@ -170,47 +184,162 @@ func TestGetL402AuthorizationHeader(t *testing.T) {
 	}
 }
 
-func TestValidatePreimage(t *testing.T) {
+func TestDecodeAuthorization(t *testing.T) {
+	invoices := &preimageInvoiceProvider{}
+	minter := Minter(invoices, MemoryRootKeyStore(), FixedPrice(1000))
+	handler := Proxy(minter, Authority(MemoryRootKeyStore()))(http.NotFoundHandler())
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	token := challengedToken(t, w, invoices)
+
 	tests := map[string]struct {
-		preimageHash   Hash
-		expectedResult bool
+		authorization     string
+		expectedMacaroons int
+		expectedError     error
 	}{
-		"valid preimage": {
-			preimageHash: Hash{
-				166, 18, 134, 107, 7, 192, 14, 53, 235, 54, 169, 100, 101, 177, 74, 170,
-				6, 147, 124, 244, 193, 53, 90, 53, 242, 92, 235, 25, 179, 10, 56, 21,
-			},
-			expectedResult: true,
-		},
-		"invalid preimage": {
-			preimageHash: Hash{
-				1, 8, 134, 107, 7, 192, 14, 53, 235, 54, 169, 100, 101, 177, 74, 10,
-				6, 147, 124, 244, 193, 53, 90, 53, 242, 92, 235, 25, 179, 10, 6, 20,
-			},
-			expectedResult: false,
-		},
+		"no token":        {expectedError: ErrPaymentRequired},
+		"malformed token": {authorization: "L402 abc", expectedError: ErrPaymentRequired},
+		"wrong preimage":  {authorization: token[:len(token)-1] + "f", expectedError: ErrInvalidPreimage},
+		"valid token":     {authorization: token, expectedMacaroons: 1},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			header := make(http.Header)
+			if test.authorization != "" {
+				header.Set("Authorization", test.authorization)
+			}
+
+			verified, err := DecodeAuthorization(header)
+
+			if !errors.Is(err, test.expectedError) {
+				t.Errorf("expected: %v but got: %v", test.expectedError, err)
+			}
+
+			if len(verified.Macaroons) != test.expectedMacaroons {
+				t.Errorf("expected: %d but got: %d", test.expectedMacaroons, len(verified.Macaroons))
+			}
+		})
+	}
+}
+
+func TestProxy_NoMacaroons(t *testing.T) {
+	rootKeys := MemoryRootKeyStore()
+	minter := Minter(&preimageInvoiceProvider{}, rootKeys, FixedPrice(1000))
+	refunds := Refunds{RootKeys: rootKeys, Credits: MemoryConsumeStore(time.Hour)}
+	handler := Proxy(minter, nil, WithConnectionGuard(ConnectionGuard{}), WithAccounts(MemoryLedger(), MemoryInvoiceStore(), FixedPrice(1000)), WithRefunds(refunds), WithSingleUse(MemoryConsumeStore(time.Hour)))(http.NotFoundHandler())
+	p := handler.(*proxy) //nolint:forcetypeassert
+
+	w := httptest.NewRecorder()
+	p.serveAPI(w, httptest.NewRequest("GET", "/", nil), map[Identifier]*macaroon.Macaroon{}, true)
+
+	if w.Code != http.StatusPaymentRequired {
+		t.Errorf("expected: %d but got: %d", http.StatusPaymentRequired, w.Code)
 	}
+}
 
+func TestValidatePreimage(t *testing.T) {
 	paymentHash := Hash{
 		166, 18, 134, 107, 7, 192, 14, 53, 235, 54, 169, 100, 101, 177, 74, 170,
 		6, 147, 124, 244, 193, 53, 90, 53, 242, 92, 235, 25, 179, 10, 56, 21,
 	}
+	otherPaymentHash := Hash{
+		1, 8, 134, 107, 7, 192, 14, 53, 235, 54, 169, 100, 101, 177, 74, 10,
+		6, 147, 124, 244, 193, 53, 90, 53, 242, 92, 235, 25, 179, 10, 6, 20,
+	}
 
-	macaroons := make(map[Identifier]*macaroon.Macaroon)
-	macaroons[Identifier{ID: ID{1}, PaymentHash: paymentHash}] = &macaroon.Macaroon{}
-	macaroons[Identifier{ID: ID{2}, PaymentHash: paymentHash}] = &macaroon.Macaroon{}
+	tests := map[string]struct {
+		identifiers   []Identifier
+		expectedError error
+		expectedIndex int
+	}{
+		"valid preimage": {
+			identifiers: []Identifier{{ID: ID{1}, PaymentHash: paymentHash}, {ID: ID{2}, PaymentHash: paymentHash}},
+		},
+		"invalid preimage": {
+			identifiers:   []Identifier{{ID: ID{1}, PaymentHash: otherPaymentHash}, {ID: ID{2}, PaymentHash: otherPaymentHash}},
+			expectedError: ErrInvalidPreimage,
+		},
+		// The index counts in the order of the token, not in the order of the IDs
+		"invalid preimage of the second macaroon": {
+			identifiers:   []Identifier{{ID: ID{2}, PaymentHash: paymentHash}, {ID: ID{1}, PaymentHash: otherPaymentHash}},
+			expectedError: ErrInvalidPreimage,
+			expectedIndex: 1,
+		},
+	}
 
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
-			valid := validatePreimage(macaroons, test.preimageHash)
+			err := validatePreimage(test.identifiers, paymentHash)
+
+			if !errors.Is(err, test.expectedError) {
+				t.Errorf("expected: %v but got: %v", test.expectedError, err)
+			}
 
-			if valid != test.expectedResult {
-				t.Errorf("expected: %v but got: %v", test.expectedResult, valid)
+			var macaroonError *MacaroonError
+			if test.expectedError != nil && (!errors.As(err, &macaroonError) || macaroonError.Index != test.expectedIndex || macaroonError.Stage != StagePreimage) {
+				t.Errorf("expected the preimage of macaroon %d to fail but got: %v", test.expectedIndex, err)
 			}
 		})
 	}
 }
 
+func TestProxy_WithByteMetering(t *testing.T) {
+	preimage := Hash{}
+	identifier := Identifier{PaymentHash: sha256.Sum256(preimage[:]), ID: ID{1}}
+	macaroonID, _ := MarchalIdentifier(identifier)
+	mac, _ := macaroon.New([]byte{1}, macaroonID, "", macaroon.V2)
+	AddFirstPartyCaveats(mac, NewCaveat(MaxBytesCondition, "15")) //nolint:errcheck
+	macaroonBase64, _ := MarshalMacaroons(mac)
+
+	authenticator := spyHandler{replyStatusCode: http.StatusPaymentRequired}
+	accessAuthority := mockAccessAuthority{func(*http.Request, map[Identifier]*macaroon.Macaroon) Rejection {
+		return nil // access approved
+	}}
+	apiHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for range 2 {
+			if _, err := w.Write([]byte("0123456789")); err != nil {
+				return
+			}
+		}
+	})
+
+	handler := Proxy(nil, accessAuthority, WithAuthenticator(&authenticator), WithByteMetering(MemoryUsageCounter()))(apiHandler)
+
+	tests := []struct {
+		expectedBody           string
+		expectedResponseStatus int
+		expectedAuthenticator  bool
+	}{
+		{expectedBody: "012345678901234", expectedResponseStatus: http.StatusOK},
+		{expectedResponseStatus: http.StatusPaymentRequired, expectedAuthenticator: true},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/some_proctected_resource", nil)
+		r.Header.Set("Authorization", "L402 "+macaroonBase64+":"+hex.EncodeToString(preimage[:]))
+
+		handler.ServeHTTP(w, r)
+
+		if body := w.Body.String(); body != test.expectedBody {
+			t.Errorf("expected: %s but got: %s", test.expectedBody, body)
+		}
+
+		if w.Code != test.expectedResponseStatus {
+			t.Errorf("expected: %d but got: %d", test.expectedResponseStatus, w.Code)
+		}
+
+		if authenticator.called != test.expectedAuthenticator {
+			t.Errorf("expected: %v but got: %v", test.expectedAuthenticator, authenticator.called)
+		}
+
+		if test.expectedAuthenticator && !errors.Is(authenticator.cancelCause, ErrAllowanceExhausted) {
+			t.Errorf("expected: %v but got: %v", ErrAllowanceExhausted, authenticator.cancelCause)
+		}
+	}
+}
+
 type mockAccessAuthority struct {
 	approveAccess func(*http.Request, map[Identifier]*macaroon.Macaroon) Rejection
 }
@@ -0,0 +1,149 @@
+package l402
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+// RateCondition limits how many requests a token can make per period of time, as in "rate=100/1m"
+const RateCondition = "rate"
+
+type Rate struct {
+	Requests int
+	Per      time.Duration
+}
+
+func ParseRate(s string) (Rate, error) {
+	requests, per, found := strings.Cut(s, "/")
+	if !found {
+		return Rate{}, fmt.Errorf("%w: %s=%s", ErrInvalidCaveat, RateCondition, s)
+	}
+
+	// Accept a bare unit like "10/s" as a shorthand for "10/1s"
+	if per != "" && unicode.IsLetter(rune(per[0])) {
+		per = "1" + per
+	}
+
+	rate := Rate{}
+	var err error
+	if rate.Requests, err = strconv.Atoi(requests); err != nil || rate.Requests <= 0 {
+		return Rate{}, fmt.Errorf("%w: %s=%s", ErrInvalidCaveat, RateCondition, s)
+	} else if rate.Per, err = time.ParseDuration(per); err != nil || rate.Per <= 0 {
+		return Rate{}, fmt.Errorf("%w: %s=%s", ErrInvalidCaveat, RateCondition, s)
+	}
+
+	return rate, nil
+}
+
+func (r Rate) String() string {
+	return fmt.Sprintf("%d/%s", r.Requests, r.Per)
+}
+
+// perSecond is the rate at which the token bucket is refilled
+func (r Rate) perSecond() float64 {
+	return float64(r.Requests) / r.Per.Seconds()
+}
+
+// rateLimits returns the rate of every macaroon restricted by a rate caveat
+// When a macaroon carries many rate caveats, the most restrictive one is used
+func rateLimits(macaroons map[Identifier]*macaroon.Macaroon) (map[ID]Rate, error) {
+	rates := make(map[ID]Rate)
+	for identifier, mac := range macaroons {
+		for _, value := range caveatValues(mac, RateCondition) {
+			rate, err := ParseRate(value)
+			if err != nil {
+				return nil, err
+			}
+			if current, found := rates[identifier.ID]; !found || rate.perSecond() < current.perSecond() ||
+				(rate.perSecond() == current.perSecond() && rate.Requests < current.Requests) {
+				rates[identifier.ID] = rate
+			}
+		}
+	}
+	return rates, nil
+}
+
+type RateLimiter interface {
+	// Allow takes one request from the allowance of every token and reports how long to wait if any is throttled
+	Allow(rates map[ID]Rate) (time.Duration, bool)
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// refill adds the tokens earned since the last update and returns how long until a whole token is available
+func (b *tokenBucket) refill(rate Rate, now time.Time) time.Duration {
+	elapsed := now.Sub(b.updated).Seconds()
+	b.tokens = math.Min(float64(rate.Requests), b.tokens+elapsed*rate.perSecond())
+	b.updated = now
+
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rate.perSecond() * float64(time.Second))
+}
+
+type tokenBucketLimiter struct {
+	mu      sync.Mutex
+	buckets *lru[ID, *tokenBucket]
+	now     func() time.Time
+}
+
+// TokenBucketLimiter keeps a token bucket per macaroon ID
+// At most capacity buckets are kept, the least recently used ones are evicted and start full again if seen later
+func TokenBucketLimiter(capacity int) *tokenBucketLimiter {
+	return &tokenBucketLimiter{
+		buckets: newLRU[ID, *tokenBucket](capacity),
+		now:     time.Now,
+	}
+}
+
+func (l *tokenBucketLimiter) Allow(rates map[ID]Rate) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	buckets := make([]*tokenBucket, 0, len(rates))
+	var retryAfter time.Duration
+
+	// Check every bucket before taking from any of them, so a throttled request doesn't consume allowance
+	for id, rate := range rates {
+		bucket, found := l.buckets.Get(id)
+		if !found {
+			bucket = &tokenBucket{tokens: float64(rate.Requests), updated: now}
+			l.buckets.Add(id, bucket)
+		}
+
+		retryAfter = max(retryAfter, bucket.refill(rate, now))
+		buckets = append(buckets, bucket)
+	}
+
+	if retryAfter > 0 {
+		return retryAfter, false
+	}
+
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	return 0, true
+}
+
+type ErrRateLimited time.Duration //nolint:errname
+
+func (e ErrRateLimited) Error() string {
+	return fmt.Sprintf("rate limited, retry after %s", time.Duration(e))
+}
+
+// RetryAfter returns the value of the Retry-After header in seconds
+func (e ErrRateLimited) RetryAfter() string {
+	return strconv.FormatInt(int64(math.Ceil(time.Duration(e).Seconds())), 10)
+}
@@ -0,0 +1,159 @@
+package l402
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := map[string]struct {
+		rate          string
+		expectedRate  Rate
+		expectedError error
+	}{
+		"empty": {
+			expectedError: ErrInvalidCaveat,
+		},
+		"no period": {
+			rate:          "10",
+			expectedError: ErrInvalidCaveat,
+		},
+		"zero requests": {
+			rate:          "0/1s",
+			expectedError: ErrInvalidCaveat,
+		},
+		"negative period": {
+			rate:          "10/-1s",
+			expectedError: ErrInvalidCaveat,
+		},
+		"bare unit": {
+			rate:         "10/s",
+			expectedRate: Rate{Requests: 10, Per: time.Second},
+		},
+		"duration": {
+			rate:         "100/5m",
+			expectedRate: Rate{Requests: 100, Per: 5 * time.Minute},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			rate, err := ParseRate(test.rate)
+
+			if !errors.Is(err, test.expectedError) {
+				t.Fatalf("expected: %v but got: %v", test.expectedError, err)
+			}
+
+			if rate != test.expectedRate {
+				t.Errorf("expected: %v but got: %v", test.expectedRate, rate)
+			}
+		})
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	mac, _ := macaroon.New([]byte{1}, []byte{2}, "", macaroon.V2)
+	AddFirstPartyCaveats(mac, NewCaveat(RateCondition, "10/s"), NewCaveat(RateCondition, "60/1m"), NewCaveat(RateCondition, "5/s")) //nolint:errcheck
+
+	rates, err := rateLimits(map[Identifier]*macaroon.Macaroon{{ID: ID{1}}: mac})
+	if err != nil {
+		t.Fatalf("expected: %v but got: %v", nil, err)
+	}
+
+	if expectedRate := (Rate{Requests: 60, Per: time.Minute}); rates[ID{1}] != expectedRate {
+		t.Errorf("expected: %v but got: %v", expectedRate, rates[ID{1}])
+	}
+}
+
+func TestTokenBucketLimiter_Allow(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := TokenBucketLimiter(2)
+	limiter.now = func() time.Time { return now }
+
+	basic := map[ID]Rate{{1}: {Requests: 2, Per: time.Second}}
+	premium := map[ID]Rate{{2}: {Requests: 10, Per: time.Second}}
+
+	steps := []struct {
+		rates              map[ID]Rate
+		advance            time.Duration
+		expectedAllowed    bool
+		expectedRetryAfter time.Duration
+	}{
+		{rates: basic, expectedAllowed: true},
+		{rates: basic, expectedAllowed: true},
+		{rates: basic, expectedAllowed: false, expectedRetryAfter: 500 * time.Millisecond},
+		{rates: premium, expectedAllowed: true},
+		{rates: premium, expectedAllowed: true},
+		{rates: premium, expectedAllowed: true},
+		{rates: basic, advance: 250 * time.Millisecond, expectedAllowed: false, expectedRetryAfter: 250 * time.Millisecond},
+		{rates: basic, advance: 250 * time.Millisecond, expectedAllowed: true},
+		{rates: map[ID]Rate{}, expectedAllowed: true},
+	}
+
+	for i, step := range steps {
+		now = now.Add(step.advance)
+
+		retryAfter, allowed := limiter.Allow(step.rates)
+
+		if allowed != step.expectedAllowed {
+			t.Errorf("step %d expected: %v but got: %v", i, step.expectedAllowed, allowed)
+		}
+
+		if retryAfter != step.expectedRetryAfter {
+			t.Errorf("step %d expected: %v but got: %v", i, step.expectedRetryAfter, retryAfter)
+		}
+	}
+}
+
+func TestTokenBucketLimiter_Eviction(t *testing.T) {
+	limiter := TokenBucketLimiter(2)
+	limiter.now = func() time.Time { return time.Unix(0, 0) }
+	rate := Rate{Requests: 1, Per: time.Hour}
+
+	for id := range byte(3) {
+		if _, allowed := limiter.Allow(map[ID]Rate{{id}: rate}); !allowed {
+			t.Errorf("expected token %d to be allowed", id)
+		}
+	}
+
+	if limiter.buckets.Len() != 2 {
+		t.Errorf("expected: %d but got: %d", 2, limiter.buckets.Len())
+	}
+
+	// The first bucket was evicted, so the token starts with a full allowance again
+	if _, allowed := limiter.Allow(map[ID]Rate{{0}: rate}); !allowed {
+		t.Error("expected evicted token to be allowed")
+	}
+
+	if _, allowed := limiter.Allow(map[ID]Rate{{2}: rate}); allowed {
+		t.Error("expected recent token to be throttled")
+	}
+}
+
+func TestProxy_WithRateLimiter(t *testing.T) {
+	mac, _ := macaroon.New([]byte{1}, []byte{2}, "", macaroon.V2)
+	AddFirstPartyCaveats(mac, NewCaveat(RateCondition, "1/1m")) //nolint:errcheck
+	macaroons := map[Identifier]*macaroon.Macaroon{{ID: ID{1}}: mac}
+
+	handler := Proxy(nil, nil, WithRateLimiter(TokenBucketLimiter(10)))(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	p := handler.(*proxy) //nolint:forcetypeassert
+
+	var w *httptest.ResponseRecorder
+	for _, expectedStatus := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		w = httptest.NewRecorder()
+		p.serveAPI(w, httptest.NewRequest("GET", "/some_proctected_resource", nil), macaroons, true)
+
+		if w.Code != expectedStatus {
+			t.Errorf("expected: %d but got: %d", expectedStatus, w.Code)
+		}
+	}
+
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "60" {
+		t.Errorf("expected: %s but got: %s", "60", retryAfter)
+	}
+}
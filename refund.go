@@ -0,0 +1,216 @@
+package l402
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+// CreditCondition binds a credit macaroon to the Identifier.ID of the token whose request failed, see WithRefunds
+const CreditCondition = "credit"
+
+const (
+	// CreditHeader carries the credit macaroon issued for a failed request
+	CreditHeader = "L402-Credit"
+	// RefundInvoiceHeader carries the invoice that a client submits, along with a credit, to be refunded
+	RefundInvoiceHeader = "L402-Refund-Invoice"
+)
+
+// Refunder pays back the clients of failed requests
+type Refunder interface {
+	// Refund pays the invoice submitted by a client, amountMsat is what the client paid for the failed request
+	Refund(ctx context.Context, invoice Invoice, amountMsat uint64) error
+}
+
+// Refunds credits the clients of paid requests that the API fails to serve
+type Refunds struct {
+	// RootKeys signs the credit macaroons, it must be the root key store of the authority
+	RootKeys RootKeyStore
+	// Credits remembers the redeemed credits by the ID of the payment they stand for, so each payment is credited or refunded once
+	Credits ConsumeStore
+	// Credited tells which response statuses issue a credit, it defaults to the 5xx statuses
+	Credited func(status int) bool
+	// Refunder and Invoices are optional, together they allow clients to trade a credit for a refund of what they paid
+	// Invoices must be recorded by the minter with RecordInvoices, it tells how much each payment hash paid
+	Refunder Refunder
+	Invoices InvoiceStore
+}
+
+// refundCreditTTL is how long the default credits of WithRefunds are remembered
+const refundCreditTTL = 24 * time.Hour
+
+var (
+	ErrRefundRejected      = errors.New("refund rejected")
+	errCreditAlreadySet    = errors.New("credit already set")
+	errNotCredit           = errors.New("not a credit")
+	errUnknownRefundAmount = errors.New("unknown refund amount")
+	errNothingToCredit     = errors.New("no paid macaroon to credit")
+)
+
+func (rf Refunds) credited(status int) bool {
+	if rf.Credited != nil {
+		return rf.Credited(status)
+	}
+	return status >= http.StatusInternalServerError
+}
+
+// mintCredit mints a credit for the first paid macaroon of a token, it keeps the payment hash and the caveats of that macaroon
+// The client redeems it with the preimage it already has, and the credit caveat binds it to the original Identifier.ID
+// Credits presented along with it were redeemed by the request, so they're never credited again
+func (rf Refunds) mintCredit(ctx context.Context, macaroons map[Identifier]*macaroon.Macaroon) (string, error) {
+	var original Identifier
+	var mac *macaroon.Macaroon
+	for _, identifier := range SortedIdentifiers(macaroons) {
+		if _, isCredit := credit(macaroons[identifier]); !isCredit {
+			original, mac = identifier, macaroons[identifier]
+			break
+		}
+	}
+	if mac == nil {
+		return "", errNothingToCredit
+	}
+
+	caveats := []Caveat{NewCaveat(CreditCondition, hex.EncodeToString(original.ID[:]))}
+	for _, c := range mac.Caveats() {
+		if c.VerificationId != nil {
+			continue
+		}
+		caveat, err := DecodeCaveat(string(c.Id))
+		if err != nil {
+			return "", err
+		} else if caveat.Condition != CreditCondition {
+			caveats = append(caveats, caveat)
+		}
+	}
+
+	id, rootKey, err := rf.RootKeys.NewRootKey(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return mintMacaroon(rootKey, Identifier{PaymentHash: original.PaymentHash, ID: id}, caveats)
+}
+
+// credit returns the ID bound by the credit caveat set by Refunds
+// Only the first caveat of a macaroon counts, so a credit added by the holder of the token is never redeemed as such
+func credit(mac *macaroon.Macaroon) (ID, bool) {
+	caveats := mac.Caveats()
+	if len(caveats) == 0 || caveats[0].VerificationId != nil {
+		return ID{}, false
+	}
+
+	caveat, err := DecodeCaveat(string(caveats[0].Id))
+	if err != nil || caveat.Condition != CreditCondition {
+		return ID{}, false
+	}
+
+	var id ID
+	if n, err := hex.Decode(id[:], []byte(caveat.Value)); err != nil || n != len(id) {
+		return ID{}, false
+	}
+	return id, true
+}
+
+// CreditSatisfier only allows a single credit caveat, set by the proxy, credits are redeemed by WithRefunds
+func CreditSatisfier() Satisfier {
+	return Satisfier{
+		Condition: CreditCondition,
+		SatisfyPrevious: func(Caveat, Caveat) error {
+			return errCreditAlreadySet
+		},
+	}
+}
+
+// serveRefund trades a credit for a refund of the payment of the failed request
+// The credit is redeemed before paying, so a refund that fails isn't retried with the same credit
+func (p proxy) serveRefund(w http.ResponseWriter, r *http.Request, macaroons map[Identifier]*macaroon.Macaroon, invoice Invoice) {
+	identifiers := SortedIdentifiers(macaroons)
+	if len(identifiers) != 1 {
+		p.errorHandler.ServeHTTP(w, withCancelCause(r, fmt.Errorf("%w: %w", ErrRefundRejected, errNotCredit)))
+		return
+	} else if _, isCredit := credit(macaroons[identifiers[0]]); !isCredit {
+		p.errorHandler.ServeHTTP(w, withCancelCause(r, fmt.Errorf("%w: %w", ErrRefundRejected, errNotCredit)))
+		return
+	}
+
+	record, err := p.refunds.Invoices.Invoice(r.Context(), identifiers[0].PaymentHash)
+	if errors.Is(err, ErrUnknownInvoice) {
+		p.errorHandler.ServeHTTP(w, withCancelCause(r, fmt.Errorf("%w: %w", ErrRefundRejected, errUnknownRefundAmount)))
+		return
+	} else if err != nil {
+		p.errorHandler.ServeHTTP(w, withCancelCause(r, err))
+		return
+	}
+
+	if amount, ok := invoice.AmountMsat(); ok && amount != record.AmountMsat {
+		p.errorHandler.ServeHTTP(w, withCancelCause(r, fmt.Errorf("%w: the invoice must be for %d msat", ErrRefundRejected, record.AmountMsat)))
+		return
+	}
+
+	if _, err := p.spend(r.Context(), macaroons); errors.Is(err, ErrTokenSpent) {
+		p.authenticator.ServeHTTP(w, withCancelCause(r, err))
+		return
+	} else if err != nil {
+		p.errorHandler.ServeHTTP(w, withCancelCause(r, err))
+		return
+	}
+
+	if err := p.refunds.Refunder.Refund(context.WithoutCancel(r.Context()), invoice, record.AmountMsat); err != nil {
+		p.errorHandler.ServeHTTP(w, withCancelCause(r, err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// creditWriter issues a credit before the API handler writes a status that calls for one
+type creditWriter struct {
+	http.ResponseWriter
+	issue   func(status int)
+	written bool
+}
+
+func (c *creditWriter) WriteHeader(status int) {
+	if !c.written && status >= http.StatusOK {
+		c.written = true
+		c.issue(status)
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *creditWriter) Write(b []byte) (int, error) {
+	c.written = true
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *creditWriter) Flush() {
+	c.written = true
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (c *creditWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// creditWriter wraps the writer of the API handler, so failed responses carry a credit in the CreditHeader
+// Credits that can't be minted are left out, the response is still served
+func (p proxy) creditWriter(w http.ResponseWriter, r *http.Request, macaroons map[Identifier]*macaroon.Macaroon) http.ResponseWriter {
+	return &creditWriter{
+		ResponseWriter: w,
+		issue: func(status int) {
+			if !p.refunds.credited(status) {
+				return
+			}
+			if creditBase64, err := p.refunds.mintCredit(context.WithoutCancel(r.Context()), macaroons); err == nil {
+				w.Header().Set(CreditHeader, creditBase64)
+			}
+		},
+	}
+}
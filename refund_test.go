@@ -0,0 +1,327 @@
+package l402
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+func TestWithRefunds_Credit(t *testing.T) {
+	rootKeys := MemoryRootKeyStore()
+	invoices := &preimageInvoiceProvider{}
+	refunds := Refunds{RootKeys: rootKeys, Credits: MemoryConsumeStore(time.Hour)}
+
+	status := http.StatusServiceUnavailable
+	minter := Minter(invoices, rootKeys, FixedPrice(1000, NewCaveat(PathCondition, "/inference")))
+	handler := Proxy(minter, Authority(rootKeys), WithSingleUse(MemoryConsumeStore(time.Hour)), WithRefunds(refunds))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+
+	serve := func(authorization string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/inference", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	token := challengedToken(t, serve(""), invoices)
+	_, preimageHex, _ := strings.Cut(token, ":")
+
+	w := serve(token)
+	creditBase64 := w.Header().Get(CreditHeader)
+	if w.Code != http.StatusServiceUnavailable || creditBase64 == "" {
+		t.Fatalf("expected a credit for the failed request but got: %d %q", w.Code, creditBase64)
+	}
+
+	status = http.StatusOK
+	credit := "L402 " + creditBase64 + ":" + preimageHex
+
+	tests := []struct {
+		authorization          string
+		expectedResponseStatus int
+	}{
+		{authorization: token, expectedResponseStatus: http.StatusPaymentRequired},
+		{authorization: credit, expectedResponseStatus: http.StatusOK},
+		{authorization: credit, expectedResponseStatus: http.StatusPaymentRequired},
+	}
+
+	for _, test := range tests {
+		if w := serve(test.authorization); w.Code != test.expectedResponseStatus {
+			t.Errorf("expected: %d but got: %d", test.expectedResponseStatus, w.Code)
+		} else if w.Header().Get(CreditHeader) != "" {
+			t.Errorf("unexpected credit: %s", w.Header().Get(CreditHeader))
+		}
+	}
+
+	// The credit is bound to the failed token and keeps its caveats
+	macaroons, _ := UnmarshalMacaroons(creditBase64)
+	original, _ := UnmarshalMacaroons(strings.TrimPrefix(strings.Split(token, ":")[0], "L402 "))
+	originalIdentifier := SortedIdentifiers(original)[0]
+	creditIdentifier := SortedIdentifiers(macaroons)[0]
+
+	if creditIdentifier.PaymentHash != originalIdentifier.PaymentHash {
+		t.Errorf("expected: %x but got: %x", originalIdentifier.PaymentHash, creditIdentifier.PaymentHash)
+	}
+
+	expectedCaveats := []string{"credit=" + hex.EncodeToString(originalIdentifier.ID[:]), "path=/inference"}
+	var caveats []string
+	for _, c := range macaroons[creditIdentifier].Caveats() {
+		caveats = append(caveats, string(c.Id))
+	}
+	if strings.Join(caveats, " ") != strings.Join(expectedCaveats, " ") {
+		t.Errorf("expected: %v but got: %v", expectedCaveats, caveats)
+	}
+}
+
+func TestWithRefunds_Credited(t *testing.T) {
+	tests := map[string]struct {
+		credited       func(status int) bool
+		status         int
+		expectedCredit bool
+	}{
+		"success":                {status: http.StatusOK},
+		"client error":           {status: http.StatusNotFound},
+		"server error":           {status: http.StatusInternalServerError, expectedCredit: true},
+		"custom policy":          {credited: func(status int) bool { return status == http.StatusGatewayTimeout }, status: http.StatusGatewayTimeout, expectedCredit: true},
+		"excluded by the policy": {credited: func(status int) bool { return status == http.StatusGatewayTimeout }, status: http.StatusInternalServerError},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			rootKeys := MemoryRootKeyStore()
+			invoices := &preimageInvoiceProvider{}
+			refunds := Refunds{RootKeys: rootKeys, Credits: MemoryConsumeStore(time.Hour), Credited: test.credited}
+
+			handler := Proxy(Minter(invoices, rootKeys, FixedPrice(1000)), Authority(rootKeys), WithSingleUse(MemoryConsumeStore(time.Hour)), WithRefunds(refunds))(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					http.Error(w, "", test.status)
+				}))
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Authorization", challengedToken(t, w, invoices))
+			w = httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if credited := w.Header().Get(CreditHeader) != ""; credited != test.expectedCredit {
+				t.Errorf("expected: %v but got: %v", test.expectedCredit, credited)
+			}
+		})
+	}
+}
+
+func TestWithRefunds_Refund(t *testing.T) {
+	rootKeys := MemoryRootKeyStore()
+	invoices := &preimageInvoiceProvider{}
+	refunder := &fakeRefunder{}
+	refunds := Refunds{RootKeys: rootKeys, Credits: MemoryConsumeStore(time.Hour), Refunder: refunder, Invoices: MemoryInvoiceStore()}
+
+	minter := Minter(RecordInvoices(invoices, refunds.Invoices), rootKeys, FixedPrice(1000))
+	handler := Proxy(minter, Authority(rootKeys), WithSingleUse(MemoryConsumeStore(time.Hour)), WithRefunds(refunds))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+
+	serve := func(authorization, refundInvoice string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		if refundInvoice != "" {
+			r.Header.Set(RefundInvoiceHeader, refundInvoice)
+		}
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	token := challengedToken(t, serve("", ""), invoices)
+	_, preimageHex, _ := strings.Cut(token, ":")
+	credit := "L402 " + serve(token, "").Header().Get(CreditHeader) + ":" + preimageHex
+
+	tests := []struct {
+		authorization          string
+		refundInvoice          string
+		expectedResponseStatus int
+		expectedRefunds        int
+	}{
+		{authorization: token, refundInvoice: "lnbc10n1client", expectedResponseStatus: http.StatusBadRequest},
+		{authorization: credit, refundInvoice: "lnbc20n1client", expectedResponseStatus: http.StatusBadRequest},
+		{authorization: credit, refundInvoice: "lnbc10n1client", expectedResponseStatus: http.StatusNoContent, expectedRefunds: 1},
+		{authorization: credit, refundInvoice: "lnbc10n1client", expectedResponseStatus: http.StatusPaymentRequired, expectedRefunds: 1},
+	}
+
+	for _, test := range tests {
+		if w := serve(test.authorization, test.refundInvoice); w.Code != test.expectedResponseStatus {
+			t.Errorf("expected: %d but got: %d", test.expectedResponseStatus, w.Code)
+		}
+
+		if len(refunder.refunds) != test.expectedRefunds {
+			t.Errorf("expected: %d but got: %d", test.expectedRefunds, len(refunder.refunds))
+		}
+	}
+
+	if refunder.refunds["lnbc10n1client"] != 1000 {
+		t.Errorf("expected: %d but got: %d", 1000, refunder.refunds["lnbc10n1client"])
+	}
+}
+
+func TestWithRefunds_NotCredited(t *testing.T) {
+	failing := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	t.Run("reusable token", func(t *testing.T) {
+		rootKeys := MemoryRootKeyStore()
+		invoices := &preimageInvoiceProvider{}
+		refunds := Refunds{RootKeys: rootKeys, Credits: MemoryConsumeStore(time.Hour)}
+		handler := Proxy(Minter(invoices, rootKeys, FixedPrice(1000)), Authority(rootKeys), WithRefunds(refunds))(failing)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		token := challengedToken(t, w, invoices)
+
+		// The token can be retried, so its failures aren't credited
+		for range 2 {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Authorization", token)
+			handler.ServeHTTP(w, r)
+
+			if w.Code != http.StatusInternalServerError {
+				t.Errorf("expected: %d but got: %d", http.StatusInternalServerError, w.Code)
+			} else if w.Header().Get(CreditHeader) != "" {
+				t.Errorf("unexpected credit: %s", w.Header().Get(CreditHeader))
+			}
+		}
+	})
+
+	t.Run("escrowed token", func(t *testing.T) {
+		rootKeys := MemoryRootKeyStore()
+		invoices := &fakeHoldInvoiceProvider{}
+		escrow := Escrow{Invoices: invoices, Secret: []byte("secret")}
+		refunds := Refunds{RootKeys: rootKeys, Credits: MemoryConsumeStore(time.Hour)}
+		handler := Proxy(EscrowMinter(escrow, rootKeys, FixedPrice(1000)), Authority(rootKeys),
+			WithEscrow(escrow), WithSingleUse(MemoryConsumeStore(time.Hour)), WithRefunds(refunds))(failing)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		challenge := challengeMatcher.FindStringSubmatch(w.Header().Get("WWW-Authenticate"))
+		paymentHash := invoices.paymentHashes[Invoice(challenge[2])]
+		invoices.pay(paymentHash)
+
+		w = httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", "L402 "+challenge[1])
+		handler.ServeHTTP(w, r)
+
+		// The held payment is cancelled, crediting it too would refund it twice
+		if w.Header().Get(CreditHeader) != "" {
+			t.Errorf("unexpected credit: %s", w.Header().Get(CreditHeader))
+		}
+		if state := invoices.states[paymentHash]; state != "canceled" {
+			t.Errorf("expected: %s but got: %s", "canceled", state)
+		}
+	})
+}
+
+func TestWithRefunds_Defaults(t *testing.T) {
+	t.Run("no root keys", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected WithRefunds to reject refunds without root keys")
+			}
+		}()
+		WithRefunds(Refunds{Credits: MemoryConsumeStore(time.Hour)})
+	})
+
+	t.Run("no credits", func(t *testing.T) {
+		rootKeys := MemoryRootKeyStore()
+		invoices := &preimageInvoiceProvider{}
+		status := http.StatusInternalServerError
+		handler := Proxy(Minter(invoices, rootKeys, FixedPrice(1000)), Authority(rootKeys),
+			WithSingleUse(MemoryConsumeStore(time.Hour)), WithRefunds(Refunds{RootKeys: rootKeys}))(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(status)
+			}))
+
+		serve := func(authorization string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Authorization", authorization)
+			handler.ServeHTTP(w, r)
+			return w
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		token := challengedToken(t, w, invoices)
+		_, preimageHex, _ := strings.Cut(token, ":")
+
+		creditBase64 := serve(token).Header().Get(CreditHeader)
+		if creditBase64 == "" {
+			t.Fatal("expected a credit for the failed request")
+		}
+
+		// The credits are redeemed once with the default store
+		status = http.StatusOK
+		credit := "L402 " + creditBase64 + ":" + preimageHex
+		for _, expectedStatus := range []int{http.StatusOK, http.StatusPaymentRequired} {
+			if w := serve(credit); w.Code != expectedStatus {
+				t.Errorf("expected: %d but got: %d", expectedStatus, w.Code)
+			}
+		}
+	})
+}
+
+func TestCreditSatisfier(t *testing.T) {
+	ctx := context.Background()
+	rootKeys := MemoryRootKeyStore()
+	id, rootKey, _ := rootKeys.NewRootKey(ctx)
+
+	macaroonID, _ := MarchalIdentifier(Identifier{ID: id})
+	mac, _ := macaroon.New(rootKey, macaroonID, "", macaroon.V2)
+	AddFirstPartyCaveats(mac, NewCaveat(CreditCondition, hex.EncodeToString(id[:])), NewCaveat(CreditCondition, hex.EncodeToString(make([]byte, 32)))) //nolint:errcheck
+
+	rejection := Authority(rootKeys).ApproveAccess(httptest.NewRequest("GET", "/", nil), map[Identifier]*macaroon.Macaroon{{ID: id}: mac})
+
+	if !errors.Is(rejection, errCreditAlreadySet) {
+		t.Errorf("expected: %v but got: %v", errCreditAlreadySet, rejection)
+	}
+}
+
+func TestCredit_AddedByHolder(t *testing.T) {
+	macaroonID, _ := MarchalIdentifier(Identifier{ID: ID{1}})
+	mac, _ := macaroon.New([]byte("root key"), macaroonID, "", macaroon.V2)
+	AddFirstPartyCaveats(mac, NewCaveat(PathCondition, "/"), NewCaveat(CreditCondition, hex.EncodeToString(make([]byte, 32)))) //nolint:errcheck
+
+	if _, isCredit := credit(mac); isCredit {
+		t.Error("expected a credit caveat added by the holder to be ignored")
+	}
+}
+
+// fakeRefunder records the amount refunded to each invoice
+type fakeRefunder struct {
+	refunds map[Invoice]uint64
+}
+
+func (f *fakeRefunder) Refund(_ context.Context, invoice Invoice, amountMsat uint64) error {
+	if f.refunds == nil {
+		f.refunds = make(map[Invoice]uint64)
+	}
+	f.refunds[invoice] += amountMsat
+	return nil
+}
@@ -0,0 +1,86 @@
+package l402
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+type RevocationStore interface {
+	// Revoke rejects every macaroon with the ID from now on
+	Revoke(context.Context, ID) error
+	Revoked(context.Context, ID) (bool, error)
+}
+
+type memoryRevocationStore struct {
+	mu      sync.RWMutex
+	revoked map[ID]struct{}
+}
+
+func MemoryRevocationStore() *memoryRevocationStore {
+	return &memoryRevocationStore{revoked: make(map[ID]struct{})}
+}
+
+func (s *memoryRevocationStore) Revoke(_ context.Context, id ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revoked[id] = struct{}{}
+	return nil
+}
+
+func (s *memoryRevocationStore) Revoked(_ context.Context, id ID) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, revoked := s.revoked[id]
+	return revoked, nil
+}
+
+type revocableRootKeys struct {
+	RootKeyStore
+	revocations RevocationStore
+}
+
+// RevocableRootKeys hides the root keys of revoked IDs, so the authority rejects their macaroons
+// Tokens kept by a token cache must be revoked there too, see RevocationsWithCaches
+func RevocableRootKeys(rootKeys RootKeyStore, revocations RevocationStore) RootKeyStore {
+	return revocableRootKeys{RootKeyStore: rootKeys, revocations: revocations}
+}
+
+func (r revocableRootKeys) RootKey(ctx context.Context, id ID) ([]byte, error) {
+	if revoked, err := r.revocations.Revoked(ctx, id); err != nil {
+		return nil, err
+	} else if revoked {
+		return nil, fmt.Errorf("%w: %w", ErrUnknownRootKey, ErrRevoked)
+	}
+	return r.RootKeyStore.RootKey(ctx, id)
+}
+
+// DeleteRootKey forgets a root key, if the wrapped store is a RootKeyDeleter, and gives errors.ErrUnsupported otherwise
+func (r revocableRootKeys) DeleteRootKey(ctx context.Context, id ID) error {
+	if deleter, ok := r.RootKeyStore.(RootKeyDeleter); ok {
+		return deleter.DeleteRootKey(ctx, id)
+	}
+	return errors.ErrUnsupported
+}
+
+type revocationsWithCaches struct {
+	RevocationStore
+	caches []TokenCache
+}
+
+// RevocationsWithCaches revokes IDs in the store and in the token caches, so cached tokens are rejected at once
+// Caches of other instances keep the tokens until their ttl runs out
+func RevocationsWithCaches(revocations RevocationStore, caches ...TokenCache) RevocationStore {
+	return revocationsWithCaches{RevocationStore: revocations, caches: caches}
+}
+
+func (r revocationsWithCaches) Revoke(ctx context.Context, id ID) error {
+	if err := r.RevocationStore.Revoke(ctx, id); err != nil {
+		return err
+	}
+	for _, cache := range r.caches {
+		cache.Revoke(id)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package l402
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+func TestRevocableRootKeys(t *testing.T) {
+	ctx := context.Background()
+	revocations := MemoryRevocationStore()
+	rootKeys := RevocableRootKeys(MemoryRootKeyStore(), revocations)
+
+	id, _, _ := rootKeys.NewRootKey(ctx)
+	if _, err := rootKeys.RootKey(ctx, id); err != nil {
+		t.Errorf("expected: %v but got: %v", nil, err)
+	}
+
+	revocations.Revoke(ctx, id) //nolint:errcheck
+
+	_, err := rootKeys.RootKey(ctx, id)
+	if !errors.Is(err, ErrUnknownRootKey) || !errors.Is(err, ErrRevoked) {
+		t.Errorf("expected: %v but got: %v", ErrRevoked, err)
+	}
+}
+
+func TestRevocationsWithCaches(t *testing.T) {
+	cache := MemoryTokenCache(10, time.Minute)
+	cache.Add(Hash{1}, VerifiedToken{Macaroons: map[Identifier]*macaroon.Macaroon{{ID: ID{1}}: nil}}, cache.Generation())
+	cache.Add(Hash{2}, VerifiedToken{Macaroons: map[Identifier]*macaroon.Macaroon{{ID: ID{2}}: nil}}, cache.Generation())
+
+	revocations := RevocationsWithCaches(MemoryRevocationStore(), cache)
+	if err := revocations.Revoke(context.Background(), ID{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if revoked, _ := revocations.Revoked(context.Background(), ID{1}); !revoked {
+		t.Error("expected the ID to be revoked")
+	}
+
+	if _, found := cache.Get(Hash{1}); found {
+		t.Error("expected the token to be revoked")
+	}
+
+	if _, found := cache.Get(Hash{2}); !found {
+		t.Error("expected the token to be cached")
+	}
+}
@@ -0,0 +1,184 @@
+package l402
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type RootKeyStore interface {
+	// NewRootKey assigns a new ID and the root key used to sign the macaroon with that ID
+	NewRootKey(context.Context) (ID, []byte, error)
+	// RootKey returns the root key of a macaroon ID, or ErrUnknownRootKey
+	RootKey(context.Context, ID) ([]byte, error)
+}
+
+// RootKeyDeleter is implemented by the root key stores that can forget a root key
+// Minters delete the root key of a challenge they failed to mint, so failed invoices don't pile up keys that no token uses
+// Wrappers of other stores give errors.ErrUnsupported when the store they wrap can't delete, the key is then left in place
+type RootKeyDeleter interface {
+	DeleteRootKey(context.Context, ID) error
+}
+
+// deleteRootKey forgets the root key of a challenge that failed to be minted, if the store can
+func deleteRootKey(ctx context.Context, rootKeys RootKeyStore, id ID) {
+	if deleter, ok := rootKeys.(RootKeyDeleter); ok {
+		deleter.DeleteRootKey(context.WithoutCancel(ctx), id) //nolint:errcheck
+	}
+}
+
+type memoryRootKeyStore struct {
+	mu       sync.RWMutex
+	rootKeys map[ID][]byte
+}
+
+func MemoryRootKeyStore() *memoryRootKeyStore {
+	return &memoryRootKeyStore{rootKeys: make(map[ID][]byte)}
+}
+
+func (s *memoryRootKeyStore) NewRootKey(context.Context) (ID, []byte, error) {
+	id, rootKey, err := newRandomRootKey()
+	if err != nil {
+		return ID{}, nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rootKeys[id] = rootKey
+
+	return id, bytes.Clone(rootKey), nil
+}
+
+func (s *memoryRootKeyStore) RootKey(_ context.Context, id ID) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rootKey, found := s.rootKeys[id]
+	if !found {
+		return nil, ErrUnknownRootKey
+	}
+	return bytes.Clone(rootKey), nil
+}
+
+func (s *memoryRootKeyStore) DeleteRootKey(_ context.Context, id ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.rootKeys, id)
+	return nil
+}
+
+func newRandomRootKey() (ID, []byte, error) {
+	var id ID
+	rootKey := make([]byte, BlockSize)
+
+	if _, err := rand.Read(id[:]); err != nil {
+		return ID{}, nil, err
+	} else if _, err := rand.Read(rootKey); err != nil {
+		return ID{}, nil, err
+	}
+
+	return id, rootKey, nil
+}
+
+type fileRootKeyStore struct {
+	memoryRootKeyStore
+	filename string
+}
+
+// FileRootKeyStore keeps the root keys in a JSON lines file, every new key is appended to it and synced
+// Deleted keys are appended with an empty root key
+func FileRootKeyStore(filename string) (*fileRootKeyStore, error) {
+	s := &fileRootKeyStore{
+		memoryRootKeyStore: memoryRootKeyStore{rootKeys: make(map[ID][]byte)},
+		filename:           filename,
+	}
+
+	// Each line maps IDs to root keys, files written before the JSON lines format are a single line
+	_, err := readJSONLines(filename, func(line []byte) error {
+		var encodedRootKeys map[string]string
+		if err := json.Unmarshal(line, &encodedRootKeys); err != nil {
+			return err
+		}
+
+		for encodedID, encodedRootKey := range encodedRootKeys {
+			id, err := decodeID(encodedID)
+			if err != nil {
+				return err
+			}
+			rootKey, err := hex.DecodeString(encodedRootKey)
+			if err != nil {
+				return fmt.Errorf("invalid root key of ID %q", encodedID)
+			} else if len(rootKey) == 0 {
+				delete(s.rootKeys, id)
+				continue
+			}
+			s.rootKeys[id] = rootKey
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *fileRootKeyStore) NewRootKey(context.Context) (ID, []byte, error) {
+	id, rootKey, err := newRandomRootKey()
+	if err != nil {
+		return ID{}, nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := appendJSONLine(s.filename, map[string]string{hex.EncodeToString(id[:]): hex.EncodeToString(rootKey)}); err != nil {
+		return ID{}, nil, err
+	}
+	s.rootKeys[id] = rootKey
+
+	return id, bytes.Clone(rootKey), nil
+}
+
+func (s *fileRootKeyStore) DeleteRootKey(_ context.Context, id ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.rootKeys[id]; !found {
+		return nil
+	}
+	if err := appendJSONLine(s.filename, map[string]string{hex.EncodeToString(id[:]): ""}); err != nil {
+		return err
+	}
+	delete(s.rootKeys, id)
+
+	return nil
+}
+
+// writeFileAtomic writes to a temporary file and renames it over the destination,
+// so readers never see a partially written file even if the process crashes
+func writeFileAtomic(filename string, data []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name()) //nolint:errcheck
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	} else if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	} else if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), filename)
+}
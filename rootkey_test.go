@@ -0,0 +1,112 @@
+package l402
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemoryRootKeyStore(t *testing.T) {
+	ctx := context.Background()
+	rootKeys := MemoryRootKeyStore()
+
+	id, rootKey, err := rootKeys.NewRootKey(ctx)
+	if err != nil {
+		t.Fatalf("expected: %v but got: %v", nil, err)
+	}
+
+	if storedRootKey, err := rootKeys.RootKey(ctx, id); err != nil || !bytes.Equal(storedRootKey, rootKey) {
+		t.Errorf("expected: %x but got: %x %v", rootKey, storedRootKey, err)
+	}
+
+	if _, err := rootKeys.RootKey(ctx, ID{}); !errors.Is(err, ErrUnknownRootKey) {
+		t.Errorf("expected: %v but got: %v", ErrUnknownRootKey, err)
+	}
+}
+
+func TestFileRootKeyStore(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "root_keys.json")
+
+	rootKeys, err := FileRootKeyStore(filename)
+	if err != nil {
+		t.Fatalf("expected: %v but got: %v", nil, err)
+	}
+
+	id, rootKey, err := rootKeys.NewRootKey(ctx)
+	if err != nil {
+		t.Fatalf("expected: %v but got: %v", nil, err)
+	}
+
+	// Reopening the file must give back the same keys
+	reopenedRootKeys, err := FileRootKeyStore(filename)
+	if err != nil {
+		t.Fatalf("expected: %v but got: %v", nil, err)
+	}
+
+	if storedRootKey, err := reopenedRootKeys.RootKey(ctx, id); err != nil || !bytes.Equal(storedRootKey, rootKey) {
+		t.Errorf("expected: %x but got: %x %v", rootKey, storedRootKey, err)
+	}
+
+	// Deleted keys stay deleted after reopening the file
+	if err := reopenedRootKeys.DeleteRootKey(ctx, id); err != nil {
+		t.Fatalf("expected: %v but got: %v", nil, err)
+	}
+	if reopenedRootKeys, err = FileRootKeyStore(filename); err != nil {
+		t.Fatalf("expected: %v but got: %v", nil, err)
+	}
+	if _, err := reopenedRootKeys.RootKey(ctx, id); !errors.Is(err, ErrUnknownRootKey) {
+		t.Errorf("expected: %v but got: %v", ErrUnknownRootKey, err)
+	}
+
+	if info, _ := os.Stat(filename); info.Mode().Perm() != 0o600 {
+		t.Errorf("expected: %v but got: %v", os.FileMode(0o600), info.Mode().Perm())
+	}
+
+	os.WriteFile(filename, []byte(`{"00": "00"}`), 0o600) //nolint:errcheck
+	if _, err := FileRootKeyStore(filename); err == nil {
+		t.Error("expected an error for an invalid ID")
+	}
+}
+
+func TestFileRootKeyStore_Journal(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "root_keys.json")
+
+	// Files written before the JSON lines format hold a single object without a newline
+	os.WriteFile(filename, []byte(`{"0100000000000000000000000000000000000000000000000000000000000000": "aa"}`), 0o600) //nolint:errcheck
+
+	rootKeys, err := FileRootKeyStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, _, _ := rootKeys.NewRootKey(ctx)
+	rootKeys.NewRootKey(ctx) //nolint:errcheck
+
+	// Every key appends a line instead of rewriting the file
+	data, _ := os.ReadFile(filename)
+	if lines := bytes.Count(data, []byte("\n")); lines != 3 {
+		t.Errorf("expected: %d but got: %d", 3, lines)
+	}
+
+	// A key cut short by a crash is dropped
+	os.WriteFile(filename, append(data, `{"02`...), 0o600) //nolint:errcheck
+	reopened, err := FileRootKeyStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []ID{{1}, id} {
+		if _, err := reopened.RootKey(ctx, id); err != nil {
+			t.Errorf("expected: %v but got: %v", nil, err)
+		}
+	}
+
+	if data, _ := os.ReadFile(filename); bytes.Count(data, []byte("\n")) != 3 || !bytes.HasSuffix(data, []byte("\n")) {
+		t.Errorf("expected the torn line to be truncated but got: %q", data)
+	}
+}
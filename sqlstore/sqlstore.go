@@ -0,0 +1,251 @@
+// Package sqlstore keeps the state of the L402 flow in a SQL database, so it can be shared by every instance of a service
+package sqlstore
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofeuer/l402"
+)
+
+// Dialect adapts the queries to a database
+type Dialect struct {
+	Name        string
+	BlobType    string
+	Placeholder func(n int) string
+	// MigrationLock is run first in the migration transaction, it holds off the other instances migrating the same database
+	MigrationLock string
+}
+
+var (
+	SQLite = Dialect{
+		Name:        "sqlite",
+		BlobType:    "BLOB",
+		Placeholder: func(int) string { return "?" },
+		// Any write takes the lock of the whole database, like BEGIN IMMEDIATE would
+		MigrationLock: `DELETE FROM l402_schema_migrations WHERE version < 0`,
+	}
+	Postgres = Dialect{
+		Name:        "postgres",
+		BlobType:    "BYTEA",
+		Placeholder: func(n int) string { return fmt.Sprintf("$%d", n) },
+		// An advisory lock released with the transaction, its key is "l402" in ASCII
+		MigrationLock: `SELECT pg_advisory_xact_lock(1815359538)`,
+	}
+)
+
+// migrations are applied in order, each one exactly once, the schema version is the number of migrations applied
+// They're idempotent as well, so a database migrated without the lock of its dialect converges to the same schema
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS l402_root_keys (
+		id {{blob}} PRIMARY KEY,
+		root_key {{blob}} NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS l402_invoices (
+		payment_hash {{blob}} PRIMARY KEY,
+		invoice TEXT NOT NULL,
+		amount_msat BIGINT NOT NULL,
+		memo TEXT NOT NULL,
+		created_at BIGINT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS l402_revocations (
+		id {{blob}} PRIMARY KEY,
+		revoked_at BIGINT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS l402_usage (
+		id {{blob}} PRIMARY KEY,
+		total BIGINT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS l402_sealed_root_keys (
+		id {{blob}} PRIMARY KEY,
+		sealed {{blob}} NOT NULL
+	)`,
+}
+
+// Store implements l402.RootKeyStore, l402.RootKeyDeleter, l402.SealedRootKeyStore, l402.InvoiceStore, l402.RevocationStore and l402.UsageCounter
+type Store struct {
+	db      *sql.DB
+	dialect Dialect
+	now     func() time.Time
+}
+
+// New migrates the database schema to the latest version and returns a store on top of it
+func New(ctx context.Context, db *sql.DB, dialect Dialect) (*Store, error) {
+	s := &Store{db: db, dialect: dialect, now: time.Now}
+	if err := s.migrate(ctx); err != nil {
+		return nil, fmt.Errorf("migrating the %s schema: %w", dialect.Name, err)
+	}
+	return s, nil
+}
+
+// migrate applies the missing migrations in a single transaction, holding the migration lock of the dialect
+// Instances starting together wait for each other, and the ones that come second find the schema up to date
+func (s *Store) migrate(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS l402_schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if s.dialect.MigrationLock != "" {
+		if _, err := tx.ExecContext(ctx, s.dialect.MigrationLock); err != nil {
+			return fmt.Errorf("taking the migration lock: %w", err)
+		}
+	}
+
+	var version int
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM l402_schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+
+	for i, migration := range migrations[min(version, len(migrations)):] {
+		if _, err := tx.ExecContext(ctx, strings.ReplaceAll(migration, "{{blob}}", s.dialect.BlobType)); err != nil {
+			return fmt.Errorf("version %d: %w", version+i+1, err)
+		}
+		if _, err := tx.ExecContext(ctx, s.query(`INSERT INTO l402_schema_migrations (version) VALUES (?) ON CONFLICT (version) DO NOTHING`), version+i+1); err != nil {
+			return fmt.Errorf("version %d: %w", version+i+1, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// query replaces the ? placeholders with the ones of the dialect
+func (s *Store) query(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString(s.dialect.Placeholder(n))
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func (s *Store) NewRootKey(ctx context.Context) (l402.ID, []byte, error) {
+	var id l402.ID
+	rootKey := make([]byte, l402.BlockSize)
+	if _, err := rand.Read(id[:]); err != nil {
+		return l402.ID{}, nil, err
+	} else if _, err := rand.Read(rootKey); err != nil {
+		return l402.ID{}, nil, err
+	}
+
+	if _, err := s.db.ExecContext(ctx, s.query(`INSERT INTO l402_root_keys (id, root_key) VALUES (?, ?)`), id[:], rootKey); err != nil {
+		return l402.ID{}, nil, err
+	}
+	return id, rootKey, nil
+}
+
+func (s *Store) RootKey(ctx context.Context, id l402.ID) ([]byte, error) {
+	var rootKey []byte
+	err := s.db.QueryRowContext(ctx, s.query(`SELECT root_key FROM l402_root_keys WHERE id = ?`), id[:]).Scan(&rootKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, l402.ErrUnknownRootKey
+	}
+	return rootKey, err
+}
+
+// DeleteRootKey implements l402.RootKeyDeleter
+func (s *Store) DeleteRootKey(ctx context.Context, id l402.ID) error {
+	_, err := s.db.ExecContext(ctx, s.query(`DELETE FROM l402_root_keys WHERE id = ?`), id[:])
+	return err
+}
+
+func (s *Store) SaveSealedRootKey(ctx context.Context, id l402.ID, sealed []byte) error {
+	_, err := s.db.ExecContext(ctx, s.query(`INSERT INTO l402_sealed_root_keys (id, sealed) VALUES (?, ?)
+		ON CONFLICT (id) DO UPDATE SET sealed = excluded.sealed`), id[:], sealed)
+	return err
+}
+
+func (s *Store) SealedRootKey(ctx context.Context, id l402.ID) ([]byte, error) {
+	var sealed []byte
+	err := s.db.QueryRowContext(ctx, s.query(`SELECT sealed FROM l402_sealed_root_keys WHERE id = ?`), id[:]).Scan(&sealed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, l402.ErrUnknownRootKey
+	}
+	return sealed, err
+}
+
+func (s *Store) DeleteSealedRootKey(ctx context.Context, id l402.ID) error {
+	_, err := s.db.ExecContext(ctx, s.query(`DELETE FROM l402_sealed_root_keys WHERE id = ?`), id[:])
+	return err
+}
+
+func (s *Store) SealedRootKeyIDs(ctx context.Context) ([]l402.ID, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id FROM l402_sealed_root_keys`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []l402.ID
+	for rows.Next() {
+		var id []byte
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		} else if len(id) != len(l402.ID{}) {
+			return nil, fmt.Errorf("invalid ID %x", id)
+		}
+		ids = append(ids, l402.ID(id))
+	}
+	return ids, rows.Err()
+}
+
+func (s *Store) SaveInvoice(ctx context.Context, record l402.InvoiceRecord) error {
+	_, err := s.db.ExecContext(ctx, s.query(`INSERT INTO l402_invoices (payment_hash, invoice, amount_msat, memo, created_at) VALUES (?, ?, ?, ?, ?)`),
+		record.PaymentHash[:], string(record.Invoice), int64(record.AmountMsat), record.Memo, record.CreatedAt.UnixNano()) //nolint:gosec
+	return err
+}
+
+func (s *Store) Invoice(ctx context.Context, paymentHash l402.Hash) (l402.InvoiceRecord, error) {
+	record := l402.InvoiceRecord{PaymentHash: paymentHash}
+	var invoice string
+	var amountMsat, createdAt int64
+
+	err := s.db.QueryRowContext(ctx, s.query(`SELECT invoice, amount_msat, memo, created_at FROM l402_invoices WHERE payment_hash = ?`), paymentHash[:]).
+		Scan(&invoice, &amountMsat, &record.Memo, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return l402.InvoiceRecord{}, l402.ErrUnknownInvoice
+	} else if err != nil {
+		return l402.InvoiceRecord{}, err
+	}
+
+	record.Invoice = l402.Invoice(invoice)
+	record.AmountMsat = uint64(amountMsat) //nolint:gosec
+	record.CreatedAt = time.Unix(0, createdAt).UTC()
+	return record, nil
+}
+
+func (s *Store) Revoke(ctx context.Context, id l402.ID) error {
+	_, err := s.db.ExecContext(ctx, s.query(`INSERT INTO l402_revocations (id, revoked_at) VALUES (?, ?) ON CONFLICT (id) DO NOTHING`),
+		id[:], s.now().UnixNano())
+	return err
+}
+
+func (s *Store) Revoked(ctx context.Context, id l402.ID) (bool, error) {
+	var revoked bool
+	err := s.db.QueryRowContext(ctx, s.query(`SELECT EXISTS (SELECT 1 FROM l402_revocations WHERE id = ?)`), id[:]).Scan(&revoked)
+	return revoked, err
+}
+
+// Add increments the usage of a token atomically, so every instance counts against the same total
+func (s *Store) Add(ctx context.Context, id l402.ID, n int64) (int64, error) {
+	var total int64
+	err := s.db.QueryRowContext(ctx, s.query(`INSERT INTO l402_usage (id, total) VALUES (?, ?)
+		ON CONFLICT (id) DO UPDATE SET total = l402_usage.total + excluded.total
+		RETURNING total`), id[:], n).Scan(&total)
+	return total, err
+}
@@ -0,0 +1,206 @@
+package sqlstore
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofeuer/l402"
+	_ "modernc.org/sqlite"
+)
+
+var (
+	_ l402.RootKeyStore       = (*Store)(nil)
+	_ l402.SealedRootKeyStore = (*Store)(nil)
+	_ l402.InvoiceStore       = (*Store)(nil)
+	_ l402.RevocationStore    = (*Store)(nil)
+	_ l402.UsageCounter       = (*Store)(nil)
+)
+
+func openStore(t *testing.T, filename string) (*Store, *sql.DB) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	store, err := New(context.Background(), db, SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, db
+}
+
+func TestMigrations(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "l402.db")
+	_, db := openStore(t, filename)
+
+	// Migrating again is a no-op
+	_, db = openStore(t, filename)
+
+	var version int
+	db.QueryRow(`SELECT MAX(version) FROM l402_schema_migrations`).Scan(&version) //nolint:errcheck
+	if version != len(migrations) {
+		t.Errorf("expected: %d but got: %d", len(migrations), version)
+	}
+}
+
+func TestMigrations_Concurrent(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "l402.db")
+
+	// Instances starting together, each with its own connections to the database
+	errs := make(chan error, 8)
+	var wg sync.WaitGroup
+	for range cap(errs) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			db, err := sql.Open("sqlite", filename+"?_pragma=busy_timeout(10000)")
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer db.Close()
+
+			_, err = New(context.Background(), db, SQLite)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("expected: %v but got: %v", nil, err)
+		}
+	}
+
+	_, db := openStore(t, filename)
+	var version, count int
+	db.QueryRow(`SELECT MAX(version), COUNT(*) FROM l402_schema_migrations`).Scan(&version, &count) //nolint:errcheck
+	if version != len(migrations) || count != len(migrations) {
+		t.Errorf("expected: %d but got: %d versions up to %d", len(migrations), count, version)
+	}
+}
+
+func TestStore_RootKeys(t *testing.T) {
+	ctx := context.Background()
+	store, _ := openStore(t, filepath.Join(t.TempDir(), "l402.db"))
+
+	id, rootKey, err := store.NewRootKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if storedRootKey, err := store.RootKey(ctx, id); err != nil || !bytes.Equal(storedRootKey, rootKey) {
+		t.Errorf("expected: %x but got: %x %v", rootKey, storedRootKey, err)
+	}
+
+	if _, err := store.RootKey(ctx, l402.ID{}); !errors.Is(err, l402.ErrUnknownRootKey) {
+		t.Errorf("expected: %v but got: %v", l402.ErrUnknownRootKey, err)
+	}
+
+	if err := store.DeleteRootKey(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.RootKey(ctx, id); !errors.Is(err, l402.ErrUnknownRootKey) {
+		t.Errorf("expected: %v but got: %v", l402.ErrUnknownRootKey, err)
+	}
+}
+
+func TestStore_SealedRootKeys(t *testing.T) {
+	ctx := context.Background()
+	store, db := openStore(t, filepath.Join(t.TempDir(), "l402.db"))
+	oldKEK := l402.KeyEncryptionKey{ID: "2024", Key: bytes.Repeat([]byte{1}, l402.BlockSize)}
+	newKEK := l402.KeyEncryptionKey{ID: "2025", Key: bytes.Repeat([]byte{2}, l402.BlockSize)}
+
+	rootKeys, _ := l402.EncryptedRootKeys(store, oldKEK)
+	id, rootKey, err := rootKeys.NewRootKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sealed []byte
+	db.QueryRow(`SELECT sealed FROM l402_sealed_root_keys`).Scan(&sealed) //nolint:errcheck
+	if len(sealed) == 0 || bytes.Contains(sealed, rootKey) {
+		t.Error("expected the root key to be encrypted")
+	}
+
+	rotated, _ := l402.EncryptedRootKeys(store, newKEK, oldKEK)
+	if err := rotated.Rewrap(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	rewrapped, _ := l402.EncryptedRootKeys(store, newKEK)
+	if storedRootKey, err := rewrapped.RootKey(ctx, id); err != nil || !bytes.Equal(storedRootKey, rootKey) {
+		t.Errorf("expected: %x but got: %x %v", rootKey, storedRootKey, err)
+	}
+
+	if _, err := rewrapped.RootKey(ctx, l402.ID{}); !errors.Is(err, l402.ErrUnknownRootKey) {
+		t.Errorf("expected: %v but got: %v", l402.ErrUnknownRootKey, err)
+	}
+}
+
+func TestStore_Invoices(t *testing.T) {
+	ctx := context.Background()
+	store, _ := openStore(t, filepath.Join(t.TempDir(), "l402.db"))
+
+	record := l402.InvoiceRecord{
+		PaymentHash: l402.Hash{1},
+		Invoice:     "lnbc1",
+		AmountMsat:  1000,
+		Memo:        "L402",
+		CreatedAt:   time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	if err := store.SaveInvoice(ctx, record); err != nil {
+		t.Fatal(err)
+	}
+
+	if stored, err := store.Invoice(ctx, record.PaymentHash); err != nil || stored != record {
+		t.Errorf("expected: %+v but got: %+v %v", record, stored, err)
+	}
+
+	if _, err := store.Invoice(ctx, l402.Hash{2}); !errors.Is(err, l402.ErrUnknownInvoice) {
+		t.Errorf("expected: %v but got: %v", l402.ErrUnknownInvoice, err)
+	}
+}
+
+func TestStore_Revocations(t *testing.T) {
+	ctx := context.Background()
+	store, _ := openStore(t, filepath.Join(t.TempDir(), "l402.db"))
+
+	for range 2 {
+		if err := store.Revoke(ctx, l402.ID{1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := map[l402.ID]bool{{1}: true, {2}: false}
+	for id, expectedRevoked := range tests {
+		if revoked, err := store.Revoked(ctx, id); err != nil || revoked != expectedRevoked {
+			t.Errorf("expected: %v but got: %v %v", expectedRevoked, revoked, err)
+		}
+	}
+}
+
+func TestStore_Usage(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "l402.db")
+	store, _ := openStore(t, filename)
+	otherInstance, _ := openStore(t, filename)
+
+	store.Add(ctx, l402.ID{1}, 100)        //nolint:errcheck
+	otherInstance.Add(ctx, l402.ID{1}, 50) //nolint:errcheck
+
+	if total, err := store.Add(ctx, l402.ID{1}, 0); err != nil || total != 150 {
+		t.Errorf("expected: %d but got: %d %v", 150, total, err)
+	}
+}
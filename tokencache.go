@@ -0,0 +1,111 @@
+package l402
+
+import (
+	"crypto/sha256"
+	"slices"
+	"sync"
+	"time"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+// VerifiedToken is a token that was decoded, matched its preimage and had its signatures verified
+type VerifiedToken struct {
+	Macaroons  map[Identifier]*macaroon.Macaroon
+	Discharges []*macaroon.Macaroon
+	// Identifiers lists the macaroons in the order of the token, MacaroonError.Index counts in that order
+	Identifiers []Identifier
+}
+
+type TokenCache interface {
+	// Get returns the token verified for an Authorization value, keyed by a hash of that value
+	Get(key Hash) (VerifiedToken, bool)
+	// Generation changes with every revocation, it's read before a token is approved and handed to Add
+	Generation() uint64
+	// Add remembers a token once the authority approved a request with it
+	// The token is left out if a revocation happened since the generation was read, it might have been revoked after its approval
+	Add(key Hash, token VerifiedToken, generation uint64)
+	// Revoke forgets every token with a macaroon of the given IDs, so they're verified again on their next use
+	Revoke(ids ...ID)
+	// RevokeFunc forgets every token with a macaroon whose ID is matched by revoked
+	RevokeFunc(revoked func(ID) bool)
+}
+
+type cachedToken struct {
+	token   VerifiedToken
+	expires time.Time
+}
+
+type memoryTokenCache struct {
+	mu         sync.Mutex
+	tokens     *lru[Hash, cachedToken]
+	generation uint64 // bumped by every revocation
+	ttl        time.Duration
+	now        func() time.Time
+}
+
+// MemoryTokenCache keeps at most capacity verified tokens for ttl, the least recently used ones are evicted
+// A cached token isn't checked against the root key store again, so revoking a root key must be followed by Revoke
+// See RevocationsWithCaches and KeyManager's InvalidateOnCutoff
+func MemoryTokenCache(capacity int, ttl time.Duration) *memoryTokenCache {
+	return &memoryTokenCache{
+		tokens: newLRU[Hash, cachedToken](capacity),
+		ttl:    ttl,
+		now:    time.Now,
+	}
+}
+
+func (c *memoryTokenCache) Get(key Hash) (VerifiedToken, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, found := c.tokens.Get(key)
+	if !found {
+		return VerifiedToken{}, false
+	} else if !c.now().Before(cached.expires) {
+		c.tokens.Remove(key)
+		return VerifiedToken{}, false
+	}
+	return cached.token, true
+}
+
+func (c *memoryTokenCache) Generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+func (c *memoryTokenCache) Add(key Hash, token VerifiedToken, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	c.tokens.Add(key, cachedToken{token: token, expires: c.now().Add(c.ttl)})
+}
+
+func (c *memoryTokenCache) Revoke(ids ...ID) {
+	c.RevokeFunc(func(id ID) bool { return slices.Contains(ids, id) })
+}
+
+func (c *memoryTokenCache) RevokeFunc(revoked func(ID) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+
+	c.tokens.RemoveFunc(func(_ Hash, cached cachedToken) bool {
+		for identifier := range cached.token.Macaroons {
+			if revoked(identifier.ID) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// tokenCacheKey hashes the parts of an Authorization value
+func tokenCacheKey(macaroonBase64 string, preimageHash Hash) Hash {
+	return sha256.Sum256(append([]byte(macaroonBase64+":"), preimageHash[:]...))
+}
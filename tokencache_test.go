@@ -0,0 +1,180 @@
+package l402
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+func TestMemoryTokenCache(t *testing.T) {
+	now := time.Now()
+	cache := MemoryTokenCache(10, time.Minute)
+	cache.now = func() time.Time { return now }
+
+	token := VerifiedToken{Macaroons: map[Identifier]*macaroon.Macaroon{{ID: ID{1}}: nil}}
+	cache.Add(Hash{1}, token, cache.Generation())
+	cache.Add(Hash{2}, VerifiedToken{Macaroons: map[Identifier]*macaroon.Macaroon{{ID: ID{2}}: nil}}, cache.Generation())
+
+	if _, found := cache.Get(Hash{1}); !found {
+		t.Error("expected the token to be cached")
+	}
+
+	cache.Revoke(ID{1})
+	if _, found := cache.Get(Hash{1}); found {
+		t.Error("expected the token to be revoked")
+	}
+
+	cache.Add(Hash{3}, VerifiedToken{Macaroons: map[Identifier]*macaroon.Macaroon{{ID: ID{3}}: nil}}, cache.Generation())
+	cache.RevokeFunc(func(id ID) bool { return id == ID{3} })
+	if _, found := cache.Get(Hash{3}); found {
+		t.Error("expected the token to be revoked")
+	}
+
+	// A token approved before a revocation isn't cached, it might have been revoked since
+	generation := cache.Generation()
+	cache.Revoke(ID{4})
+	cache.Add(Hash{4}, VerifiedToken{Macaroons: map[Identifier]*macaroon.Macaroon{{ID: ID{4}}: nil}}, generation)
+	if _, found := cache.Get(Hash{4}); found {
+		t.Error("expected the token to be left out")
+	}
+
+	now = now.Add(time.Minute)
+	if _, found := cache.Get(Hash{2}); found {
+		t.Error("expected the token to be expired")
+	}
+}
+
+func TestWithTokenCache(t *testing.T) {
+	rootKeys := &countingRootKeyStore{RootKeyStore: MemoryRootKeyStore()}
+	invoices := &preimageInvoiceProvider{}
+	cache := MemoryTokenCache(10, time.Minute)
+
+	minter := Minter(invoices, rootKeys, FixedPrice(1000, NewCaveat(PathCondition, "/videos")))
+	handler := Proxy(minter, Authority(rootKeys), WithTokenCache(cache))(http.NotFoundHandler())
+
+	serve := func(path, authorization string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	token := challengedToken(t, serve("/videos", ""), invoices)
+
+	tests := []struct {
+		path                   string
+		revoke                 bool
+		expectedResponseStatus int
+		expectedRootKeyLookups int
+	}{
+		{path: "/videos", expectedResponseStatus: http.StatusNotFound, expectedRootKeyLookups: 1},
+		{path: "/videos", expectedResponseStatus: http.StatusNotFound, expectedRootKeyLookups: 1},
+		// Caveats are still checked for cached tokens
+		{path: "/photos", expectedResponseStatus: http.StatusPaymentRequired, expectedRootKeyLookups: 1},
+		{path: "/videos", revoke: true, expectedResponseStatus: http.StatusNotFound, expectedRootKeyLookups: 2},
+	}
+
+	for _, test := range tests {
+		if test.revoke {
+			macaroonBase64, _, _ := strings.Cut(strings.TrimPrefix(token, "L402 "), ":")
+			macaroons, _ := UnmarshalMacaroons(macaroonBase64)
+			cache.Revoke(SortedIdentifiers(macaroons)[0].ID)
+		}
+
+		if w := serve(test.path, token); w.Code != test.expectedResponseStatus {
+			t.Errorf("expected: %d but got: %d", test.expectedResponseStatus, w.Code)
+		}
+
+		if rootKeys.lookups != test.expectedRootKeyLookups {
+			t.Errorf("expected: %d but got: %d", test.expectedRootKeyLookups, rootKeys.lookups)
+		}
+	}
+}
+
+func TestWithTokenCache_RevokedWhileApproved(t *testing.T) {
+	cache := MemoryTokenCache(10, time.Minute)
+	revocations := RevocationsWithCaches(MemoryRevocationStore(), cache)
+	rootKeys := RevocableRootKeys(MemoryRootKeyStore(), revocations)
+	invoices := &preimageInvoiceProvider{}
+
+	// The token is revoked right after the authority approved it, before the proxy caches it
+	authority := revokingAuthority{AccessAuthority: Authority(rootKeys), revocations: revocations}
+	handler := Proxy(Minter(invoices, rootKeys, FixedPrice(1000)), authority, WithTokenCache(cache))(http.NotFoundHandler())
+
+	serve := func(authorization string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	token := challengedToken(t, serve(""), invoices)
+
+	for _, expectedStatus := range []int{http.StatusNotFound, http.StatusPaymentRequired} {
+		if w := serve(token); w.Code != expectedStatus {
+			t.Errorf("expected: %d but got: %d", expectedStatus, w.Code)
+		}
+	}
+}
+
+// revokingAuthority revokes every token it approves, like a revocation landing between the approval and the caching
+type revokingAuthority struct {
+	AccessAuthority
+	revocations RevocationStore
+}
+
+func (a revokingAuthority) ApproveAccess(r *http.Request, macaroons map[Identifier]*macaroon.Macaroon) Rejection {
+	rejection := a.AccessAuthority.ApproveAccess(r, macaroons)
+	for identifier := range macaroons {
+		a.revocations.Revoke(r.Context(), identifier.ID) //nolint:errcheck
+	}
+	return rejection
+}
+
+type countingRootKeyStore struct {
+	RootKeyStore
+	lookups int
+}
+
+func (s *countingRootKeyStore) RootKey(ctx context.Context, id ID) ([]byte, error) {
+	s.lookups++
+	return s.RootKeyStore.RootKey(ctx, id)
+}
+
+func BenchmarkProxy_ServeHTTP(b *testing.B) {
+	benchmarks := map[string][]Option{
+		"uncached": nil,
+		"cached":   {WithTokenCache(MemoryTokenCache(1000, time.Minute))},
+	}
+
+	for name, options := range benchmarks {
+		b.Run(name, func(b *testing.B) {
+			rootKeys := MemoryRootKeyStore()
+			invoices := &preimageInvoiceProvider{}
+			minter := Minter(invoices, rootKeys, FixedPrice(1000, NewCaveat(PathCondition, "/videos")))
+			handler := Proxy(minter, Authority(rootKeys), options...)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/videos", nil))
+			r := httptest.NewRequest("GET", "/videos", nil)
+			r.Header.Set("Authorization", challengedToken(b, w, invoices))
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				handler.ServeHTTP(httptest.NewRecorder(), r)
+			}
+		})
+	}
+}